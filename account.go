@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	Role string
+
+	Account struct {
+		Username     string `json:"username"`
+		PasswordHash string `json:"passwordHash,omitempty"`
+		Role         Role   `json:"role,omitempty"`
+		// SessionGeneration is part of every session token, changing the password increments it, which invalidates
+		// all tokens issued before
+		SessionGeneration int `json:"sessionGeneration,omitempty"`
+		// Password is only read to migrate legacy plaintext accounts, it's never written back
+		Password string `json:"password,omitempty"`
+	}
+
+	AccountView struct {
+		Username string
+		Role     Role
+	}
+)
+
+const (
+	RoleViewer      Role = "viewer"
+	RoleContributor Role = "contributor"
+	RoleMaintainer  Role = "maintainer"
+	RoleAdmin       Role = "admin"
+	// Accounts created before roles existed had unrestricted access, so they keep it
+	legacyAccountRole = RoleAdmin
+	defaultRole       = RoleViewer
+
+	accountsReloadInterval = 5 * time.Second
+	generatedPasswordBytes = 18
+	minPasswordLength      = 8
+	// bcrypt only hashes the first 72 bytes of a password and refuses longer ones
+	maxPasswordBytes = 72
+)
+
+var (
+	// Roles ordered by their privileges, every role includes the permissions of all roles before it
+	roles         = []Role{RoleViewer, RoleContributor, RoleMaintainer, RoleAdmin}
+	accounts      = map[string]Account{}
+	accountsMutex = sync.RWMutex{}
+	// accountsFileMutex serializes the writes of the accounts file
+	accountsFileMutex = sync.Mutex{}
+	accountsModTime   time.Time
+
+	errAccountExists   = errors.New("account already exists")
+	errAccountNotFound = errors.New("account not found")
+	errPasswordLength  = fmt.Errorf("password has to be at least %d characters long", minPasswordLength)
+	errPasswordTooLong = fmt.Errorf("password must not be longer than %d bytes", maxPasswordBytes)
+	errUnknownRole     = errors.New("unknown role")
+)
+
+func parseRole(rawRole string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(rawRole)))
+	if !slices.Contains(roles, role) {
+		return "", fmt.Errorf("%w \"%s\"", errUnknownRole, rawRole)
+	}
+	return role, nil
+}
+
+// Includes reports whether the role grants at least the permissions of the required role
+func (r Role) Includes(required Role) bool {
+	return slices.Index(roles, r) >= slices.Index(roles, required)
+}
+
+func (a *Account) toView() AccountView {
+	return AccountView{
+		Username: a.Username,
+		Role:     a.Role,
+	}
+}
+
+func findAccount(username string) (Account, bool) {
+	accountsMutex.RLock()
+	defer accountsMutex.RUnlock()
+	account, found := accounts[username]
+	return account, found
+}
+
+func allAccounts() []Account {
+	accountsMutex.RLock()
+	defer accountsMutex.RUnlock()
+	return accountList()
+}
+
+// accountList copies the accounts sorted by username, accountsMutex has to be held by the caller
+func accountList() []Account {
+	list := make([]Account, 0, len(accounts))
+	for _, account := range accounts {
+		list = append(list, account)
+	}
+	slices.SortFunc(list, func(a, b Account) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return list
+}
+
+// readAccounts loads the accounts file. Accounts that still carry a plaintext password are migrated to a bcrypt
+// hash and the file is rewritten afterward.
+func readAccounts() error {
+	info, err := os.Stat(appConfig.AccountsFile)
+	if err != nil {
+		return err
+	}
+
+	accountData, err := os.ReadFile(appConfig.AccountsFile)
+	if err != nil {
+		return err
+	}
+
+	var readAccounts []Account
+	err = json.Unmarshal(accountData, &readAccounts)
+	if err != nil {
+		return fmt.Errorf("error unmarshaling accounts file: %w", err)
+	}
+
+	newAccounts := make(map[string]Account, len(readAccounts))
+	migrated := 0
+	for _, account := range readAccounts {
+		if len(account.PasswordHash) == 0 && len(account.Password) > 0 {
+			account.PasswordHash, err = hashPassword([]byte(account.Password))
+			if err != nil {
+				return fmt.Errorf("error migrating the password of account \"%s\": %w", account.Username, err)
+			}
+			migrated++
+		}
+		account.Password = ""
+		if len(account.Role) == 0 {
+			account.Role = legacyAccountRole
+		} else if role, err := parseRole(string(account.Role)); err == nil {
+			account.Role = role
+		} else {
+			logger.Warnf("Account \"%s\" has unknown role \"%s\", falling back to %s", account.Username, account.Role, RoleViewer)
+			account.Role = RoleViewer
+		}
+		newAccounts[account.Username] = account
+	}
+
+	accountsMutex.Lock()
+	accounts = newAccounts
+	accountsModTime = info.ModTime()
+	accountsMutex.Unlock()
+
+	if migrated > 0 {
+		logger.Infof("Migrated %d accounts with plaintext passwords to password hashes", migrated)
+		return writeAccounts()
+	}
+
+	return nil
+}
+
+// writeAccounts persists the current accounts
+func writeAccounts() error {
+	return updateAccounts(func() error {
+		return nil
+	})
+}
+
+// updateAccounts applies the change to the accounts and persists them. The accounts are copied while the change still
+// holds the lock, and accountsFileMutex is held until the file is written, so concurrent changes are written in the
+// order they were made.
+func updateAccounts(change func() error) error {
+	accountsFileMutex.Lock()
+	defer accountsFileMutex.Unlock()
+
+	accountsMutex.Lock()
+	err := change()
+	list := accountList()
+	accountsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeAccountList(list)
+}
+
+// writeAccountList replaces the accounts file atomically, so the reload watcher never sees a partially written file
+func writeAccountList(list []Account) error {
+	accountData, err := json.MarshalIndent(&list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(path.Dir(appConfig.AccountsFile), ".accounts-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(accountData)
+	closeErr := tmpFile.Close()
+	if err = errors.Join(err, closeErr); err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpFile.Name(), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), appConfig.AccountsFile)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(appConfig.AccountsFile); err == nil {
+		accountsMutex.Lock()
+		accountsModTime = info.ModTime()
+		accountsMutex.Unlock()
+	}
+
+	return nil
+}
+
+func setupAccounts() {
+	err := readAccounts()
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Warnf("Accounts file \"%s\" does not exist, use the \"users add\" command to create an account", appConfig.AccountsFile)
+	} else if err != nil {
+		logger.Panicf("Error reading accounts file: %v", err)
+	}
+
+	go watchAccounts()
+}
+
+// watchAccounts reloads the accounts file whenever it has been modified, so accounts can be changed without a restart
+func watchAccounts() {
+	ticker := time.NewTicker(accountsReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(appConfig.AccountsFile)
+		if err != nil {
+			continue
+		}
+
+		accountsMutex.RLock()
+		modified := !info.ModTime().Equal(accountsModTime)
+		accountsMutex.RUnlock()
+
+		if !modified {
+			continue
+		}
+
+		err = readAccounts()
+		if err != nil {
+			logger.Errorf("Error reloading accounts file: %v", err)
+			continue
+		}
+		logger.Infof("Reloaded accounts file \"%s\"", appConfig.AccountsFile)
+	}
+}
+
+func generatePassword() (string, error) {
+	pw := make([]byte, generatedPasswordBytes)
+	_, err := rand.Read(pw)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(pw), nil
+}
+
+// hashNewPassword checks the length of a password set by a user and hashes it
+func hashNewPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errPasswordLength
+	}
+	if len(password) > maxPasswordBytes {
+		return "", errPasswordTooLong
+	}
+	return hashPassword([]byte(password))
+}
+
+func addAccount(username, password string, role Role) error {
+	username = strings.TrimSpace(username)
+	if len(username) == 0 {
+		return errors.New("username must not be empty")
+	}
+	passwordHash, err := hashNewPassword(password)
+	if err != nil {
+		return err
+	}
+	return updateAccounts(func() error {
+		if _, found := accounts[username]; found {
+			return errAccountExists
+		}
+		accounts[username] = Account{
+			Username:     username,
+			PasswordHash: passwordHash,
+			Role:         role,
+		}
+		return nil
+	})
+}
+
+func removeAccount(username string) error {
+	return updateAccounts(func() error {
+		if _, found := accounts[username]; !found {
+			return errAccountNotFound
+		}
+		delete(accounts, username)
+		return nil
+	})
+}
+
+func changePassword(username, password string) error {
+	passwordHash, err := hashNewPassword(password)
+	if err != nil {
+		return err
+	}
+	return updateAccounts(func() error {
+		account, found := accounts[username]
+		if !found {
+			return errAccountNotFound
+		}
+		account.PasswordHash = passwordHash
+		account.SessionGeneration++
+		accounts[username] = account
+		return nil
+	})
+}
+
+func changeRole(username string, role Role) error {
+	return updateAccounts(func() error {
+		account, found := accounts[username]
+		if !found {
+			return errAccountNotFound
+		}
+		account.Role = role
+		accounts[username] = account
+		return nil
+	})
+}
+
+// ------------- COMMAND LINE -------------
+
+func readPasswordArg(args []string, index int) (string, error) {
+	if len(args) > index {
+		return args[index], nil
+	}
+
+	fmt.Print("Password (leave empty to generate one): ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func usersCommand(args []string) error {
+	const usage = "usage: users list | add <username> [password] | remove <username> | passwd <username> [password] | role <username> <role>"
+
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	err := readAccounts()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if args[0] == "list" {
+		for _, account := range allAccounts() {
+			fmt.Printf("%s\t%s\n", account.Username, account.Role)
+		}
+		return nil
+	}
+
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+	username := args[1]
+
+	switch args[0] {
+	case "add", "passwd":
+		password, err := readPasswordArg(args, 2)
+		if err != nil {
+			return err
+		}
+		generated := len(password) == 0
+		if generated {
+			password, err = generatePassword()
+			if err != nil {
+				return err
+			}
+		}
+
+		if args[0] == "add" {
+			err = addAccount(username, password, defaultRole)
+		} else {
+			err = changePassword(username, password)
+		}
+		if err != nil {
+			return err
+		}
+
+		if generated {
+			fmt.Printf("Generated password for \"%s\": %s\n", username, password)
+		}
+	case "remove":
+		err = removeAccount(username)
+		if err != nil {
+			return err
+		}
+	case "role":
+		if len(args) < 3 {
+			return errors.New(usage)
+		}
+		role, err := parseRole(args[2])
+		if err != nil {
+			return err
+		}
+		err = changeRole(username, role)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New(usage)
+	}
+
+	fmt.Printf("Updated account \"%s\"\n", username)
+	return nil
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getUsersHtml(c *gin.Context) {
+	renderUsersHtml(c, 200, gin.H{})
+}
+
+func renderUsersHtml(c *gin.Context, status int, data gin.H) {
+	data["users"] = Map(allAccounts(), func(a Account) AccountView {
+		return a.toView()
+	})
+	data["currentUser"] = c.GetString(gin.AuthUserKey)
+	data["roles"] = roles
+	data["defaultRole"] = defaultRole
+	c.HTML(status, "users.gohtml", data)
+}
+
+func updateUsersForm(c *gin.Context) {
+	username := c.PostForm("username")
+	password := c.PostForm("password")
+
+	action := c.PostForm("action")
+	isCurrentUser := username == c.GetString(gin.AuthUserKey)
+
+	var err error
+	generated := false
+	if (action == "add" || action == "rotate") && len(password) == 0 {
+		password, err = generatePassword()
+		if err != nil {
+			c.Error(err)
+			c.String(500, "Error generating password: %v", err)
+			return
+		}
+		generated = true
+	}
+
+	switch action {
+	case "add":
+		var role Role
+		role, err = parseRole(c.PostForm("role"))
+		if err == nil {
+			err = addAccount(username, password, role)
+		}
+	case "rotate":
+		err = changePassword(username, password)
+	case "role":
+		var role Role
+		role, err = parseRole(c.PostForm("role"))
+		if err == nil && isCurrentUser {
+			err = errors.New("you can't change your own role")
+		} else if err == nil {
+			err = changeRole(username, role)
+		}
+	case "remove":
+		if isCurrentUser {
+			err = errors.New("you can't remove your own account")
+		} else {
+			err = removeAccount(username)
+		}
+	default:
+		err = errors.New("unknown action")
+	}
+
+	if errors.Is(err, errPasswordHash) {
+		c.Error(err)
+		renderUsersHtml(c, 500, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		renderUsersHtml(c, 400, gin.H{"error": err.Error()})
+		return
+	}
+
+	data := gin.H{"message": fmt.Sprintf("Updated account \"%s\"", username)}
+	if generated {
+		data["generatedPassword"] = password
+		data["generatedFor"] = username
+	}
+	renderUsersHtml(c, 200, data)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupTestAccounts uses an empty accounts file in a temporary directory
+func setupTestAccounts(t *testing.T) {
+	setupTestSessions(t)
+	appConfig.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	accounts = map[string]Account{}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		stored string
+		plain  string
+		valid  bool
+	}{
+		{"matching hash", hash, "correct horse", true},
+		{"wrong password", hash, "battery staple", false},
+		{"empty hash and password", "", "", false},
+		{"plaintext", "correct horse", "correct horse", false},
+		{"truncated hash", hash[:len(hash)-1], "correct horse", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := checkPassword(test.stored, []byte(test.plain)); valid != test.valid {
+				t.Errorf("got %v, expected %v", valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestAddAccountPasswordLength(t *testing.T) {
+	setupTestAccounts(t)
+
+	tests := []struct {
+		name     string
+		password string
+		err      error
+	}{
+		{"too short", "short", errPasswordLength},
+		{"too long", strings.Repeat("a", maxPasswordBytes+1), errPasswordTooLong},
+		{"multibyte characters over the limit", strings.Repeat("ü", maxPasswordBytes/2+1), errPasswordTooLong},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := addAccount("bob", test.password, RoleViewer); !errors.Is(err, test.err) {
+				t.Errorf("addAccount returned %v", err)
+			}
+			if err := changePassword("alice", test.password); !errors.Is(err, test.err) {
+				t.Errorf("changePassword returned %v", err)
+			}
+		})
+	}
+	if len(allAccounts()) != 0 {
+		t.Errorf("rejected passwords created accounts %v", allAccounts())
+	}
+
+	longest := strings.Repeat("a", maxPasswordBytes)
+	if err := addAccount("bob", longest, RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if !validateCredentials("bob", longest) || validateCredentials("bob", "") {
+		t.Error("password of the maximum length isn't checked correctly")
+	}
+}
+
+func TestReadAccountsMigration(t *testing.T) {
+	setupTestAccounts(t)
+	legacy := `[{"username": "old", "password": "plaintext password"}, {"username": "empty", "role": "viewer"}]`
+	if err := os.WriteFile(appConfig.AccountsFile, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readAccounts(); err != nil {
+		t.Fatal(err)
+	}
+	if !validateCredentials("old", "plaintext password") {
+		t.Error("migrated account can't log in")
+	}
+	if validateCredentials("empty", "") {
+		t.Error("account without a password accepted an empty password")
+	}
+	data, _ := os.ReadFile(appConfig.AccountsFile)
+	if strings.Contains(string(data), "plaintext password") {
+		t.Error("plaintext password was written back")
+	}
+
+	overlong := `[{"username": "old", "password": "` + strings.Repeat("a", maxPasswordBytes+1) + `"}]`
+	if err := os.WriteFile(appConfig.AccountsFile, []byte(overlong), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := readAccounts(); !errors.Is(err, errPasswordHash) {
+		t.Errorf("migrating an overlong password returned %v", err)
+	}
+	if !validateCredentials("old", "plaintext password") {
+		t.Error("failed migration replaced the loaded accounts")
+	}
+}
+
+func TestUpdateUsersFormPasswordTooLong(t *testing.T) {
+	setupTestAccounts(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLFiles("resources/ui/users.gohtml", "resources/ui/header.gohtml", "resources/ui/footer.gohtml")
+	r.POST("/users", updateUsersForm)
+
+	form := url.Values{"action": {"add"}, "username": {"bob"}, "role": {"viewer"}, "password": {strings.Repeat("a", 100)}}
+	request := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("got status %d", recorder.Code)
+	}
+	if _, found := findAccount("bob"); found {
+		t.Error("account with an overlong password was created")
+	}
+}
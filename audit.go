@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type (
+	// AuditEntry records a change of an image, author, category or variant and the user who made it
+	AuditEntry struct {
+		ID         uint      `gorm:"primaryKey"`
+		CreatedAt  time.Time `gorm:"index"`
+		Username   string    `gorm:"size:100;index"`
+		Action     string    `gorm:"size:20"`
+		EntityType string    `gorm:"size:20;index:idx_audit_entity"`
+		EntityID   uint      `gorm:"index:idx_audit_entity"`
+		// ImageID is the image the entity belongs to, so the history of an image includes the changes of its variants
+		ImageID uint `gorm:"index"`
+		// Changes is a JSON object of the changed columns with their old and new values
+		Changes string
+		// Superseded is set on the entries of entities deleted by an import, whose IDs may belong to other entities now
+		Superseded bool
+	}
+
+	AuditEntryDto struct {
+		ID         uint                   `json:"id" yaml:"id"`
+		CreatedAt  time.Time              `json:"createdAt" yaml:"createdAt"`
+		Username   string                 `json:"username" yaml:"username"`
+		Action     string                 `json:"action" yaml:"action"`
+		EntityType string                 `json:"entityType" yaml:"entityType"`
+		EntityID   uint                   `json:"entityId" yaml:"entityId"`
+		ImageID    uint                   `json:"imageId,omitempty" yaml:"imageId,omitempty"`
+		Changes    map[string]AuditChange `json:"changes,omitempty" yaml:"changes,omitempty"`
+		Superseded bool                   `json:"superseded,omitempty" yaml:"superseded,omitempty"`
+	}
+
+	// AuditChange is the value of a column before and after the change, Old is nil for created entities and New is
+	// nil for deleted ones
+	AuditChange struct {
+		Old any `json:"old" yaml:"old"`
+		New any `json:"new" yaml:"new"`
+	}
+
+	AuditFilter struct {
+		Username   string
+		Action     string
+		EntityType string
+		EntityID   uint
+		ImageID    uint
+		// After and Before are kept as given, either as date or RFC 3339 timestamp
+		After  string
+		Before string
+		Page   Page
+	}
+
+	// auditSnapshot contains the audited columns of an entity, and the category and related image IDs of images
+	auditSnapshot map[string]any
+
+	// pendingAudit records a change that spans several statements, or doesn't run the hooks of the models
+	pendingAudit struct {
+		entityType string
+		ids        []uint
+		before     map[uint]auditSnapshot
+	}
+
+	auditUserKey   struct{}
+	auditManualKey struct{}
+)
+
+const (
+	auditActionCreate  = "create"
+	auditActionUpdate  = "update"
+	auditActionDelete  = "delete"
+	auditActionRestore = "restore"
+	auditActionPurge   = "purge"
+	// auditActionImport is recorded without an entity when an import replaces all images, authors and categories
+	auditActionImport = "import"
+
+	auditEntityImage    = "image"
+	auditEntityAuthor   = "author"
+	auditEntityCategory = "category"
+	auditEntityVariant  = "variant"
+
+	// auditSystemUser is recorded for changes that weren't made by a user, e.g. by the trash sweeper
+	auditSystemUser = "system"
+
+	auditListLimit    = 100
+	imageHistoryLimit = 200
+)
+
+var (
+	// auditIgnoredColumns change with every update, or are covered by the action
+	auditIgnoredColumns = []string{"created_at", "updated_at", "deleted_at"}
+
+	errUnknownAuditEntity = errors.New("unknown entity type")
+)
+
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
+
+func (e *AuditEntry) toDto() AuditEntryDto {
+	dto := AuditEntryDto{
+		ID:         e.ID,
+		CreatedAt:  e.CreatedAt,
+		Username:   e.Username,
+		Action:     e.Action,
+		EntityType: e.EntityType,
+		EntityID:   e.EntityID,
+		ImageID:    e.ImageID,
+		Superseded: e.Superseded,
+	}
+	if len(e.Changes) > 0 {
+		// Numbers are kept as written, instead of turning IDs and file sizes into floats
+		decoder := json.NewDecoder(bytes.NewReader([]byte(e.Changes)))
+		decoder.UseNumber()
+		err := decoder.Decode(&dto.Changes)
+		if err != nil {
+			logger.Warnf("Could not decode changes of audit entry %d: %v", e.ID, err)
+		}
+	}
+	return dto
+}
+
+func auditModel(entityType string) (any, error) {
+	switch entityType {
+	case auditEntityImage:
+		return &Image{}, nil
+	case auditEntityAuthor:
+		return &Author{}, nil
+	case auditEntityCategory:
+		return &Category{}, nil
+	case auditEntityVariant:
+		return &ImageVariant{}, nil
+	}
+	return nil, fmt.Errorf("%w \"%s\"", errUnknownAuditEntity, entityType)
+}
+
+// withAuditUser attributes the changes made with the context to the user, e.g. to the user who enqueued a job.
+// Requests don't need it, their gin.Context already contains the authenticated user.
+func withAuditUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, auditUserKey{}, username)
+}
+
+func auditUser(tx *gorm.DB) string {
+	for _, key := range []any{auditUserKey{}, gin.AuthUserKey} {
+		if username, ok := tx.Statement.Context.Value(key).(string); ok && len(username) > 0 {
+			return username
+		}
+	}
+	return auditSystemUser
+}
+
+// auditedManually returns whether the changes of the entity are recorded by a pendingAudit instead of the hooks
+func auditedManually(tx *gorm.DB, entityType string, id uint) bool {
+	pending, _ := tx.Statement.Context.Value(auditManualKey{}).(*pendingAudit)
+	return pending != nil && pending.entityType == entityType && slices.Contains(pending.ids, id)
+}
+
+// loadAuditSnapshots loads the audited columns of the entities, deleted ones included
+func loadAuditSnapshots(tx *gorm.DB, entityType string, ids []uint) (map[uint]auditSnapshot, error) {
+	snapshots := make(map[uint]auditSnapshot, len(ids))
+	if len(ids) == 0 {
+		return snapshots, nil
+	}
+	model, err := auditModel(entityType)
+	if err != nil {
+		return nil, err
+	}
+
+	models := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+	res := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Where("id IN ?", ids).Find(models.Interface())
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	ctx := tx.Statement.Context
+	fields := res.Statement.Schema.Fields
+	for i := 0; i < models.Elem().Len(); i++ {
+		value := models.Elem().Index(i)
+		snapshot := auditSnapshot{}
+		for _, field := range fields {
+			if len(field.DBName) == 0 || slices.Contains(auditIgnoredColumns, field.DBName) {
+				continue
+			}
+			snapshot[field.DBName], _ = field.ValueOf(ctx, value)
+		}
+		id, _ := snapshot["id"].(uint)
+		snapshots[id] = snapshot
+	}
+
+	if entityType == auditEntityImage {
+		var rows []ImageCategory
+		res = tx.Session(&gorm.Session{NewDB: true}).Where("image_id IN ?", ids).Order("category_id").Find(&rows)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		for _, snapshot := range snapshots {
+			snapshot["categories"] = []uint{}
+		}
+		for _, row := range rows {
+			if snapshot, found := snapshots[row.ImageID]; found {
+				snapshot["categories"] = append(snapshot["categories"].([]uint), row.CategoryID)
+			}
+		}
+
+		var relations []struct {
+			ImageID   uint
+			RelatedID uint
+		}
+		res = tx.Session(&gorm.Session{NewDB: true}).Table("images_relations").Where("image_id IN ?", ids).
+			Order("related_id").Find(&relations)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		for _, snapshot := range snapshots {
+			snapshot["related"] = []uint{}
+		}
+		for _, relation := range relations {
+			if snapshot, found := snapshots[relation.ImageID]; found {
+				snapshot["related"] = append(snapshot["related"].([]uint), relation.RelatedID)
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+// diff returns the columns that differ between the snapshots. Either snapshot may be nil for created and deleted
+// entities, their empty columns are left out.
+func (before auditSnapshot) diff(after auditSnapshot) map[string]AuditChange {
+	changes := map[string]AuditChange{}
+	for column, value := range before {
+		newValue, found := after[column]
+		if !found && !isEmptyAuditValue(value) || found && !reflect.DeepEqual(value, newValue) {
+			changes[column] = AuditChange{Old: value, New: newValue}
+		}
+	}
+	for column, value := range after {
+		if _, found := before[column]; !found && !isEmptyAuditValue(value) {
+			changes[column] = AuditChange{New: value}
+		}
+	}
+	return changes
+}
+
+func isEmptyAuditValue(value any) bool {
+	if value == nil {
+		return true
+	}
+	reflected := reflect.ValueOf(value)
+	return reflected.IsZero() || reflected.Kind() == reflect.Slice && reflected.Len() == 0
+}
+
+func recordAudit(tx *gorm.DB, entityType string, id uint, action string, before, after auditSnapshot) error {
+	changes := before.diff(after)
+	if action == auditActionUpdate && len(changes) == 0 {
+		return nil
+	}
+
+	entry := AuditEntry{
+		Username:   auditUser(tx),
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   id,
+	}
+	switch entityType {
+	case auditEntityImage:
+		entry.ImageID = id
+	case auditEntityVariant:
+		for _, snapshot := range []auditSnapshot{after, before} {
+			if imageId, found := snapshot["image_id"].(uint); found {
+				entry.ImageID = imageId
+			}
+		}
+	}
+	if len(changes) > 0 {
+		raw, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		entry.Changes = string(raw)
+	}
+	err := tx.Session(&gorm.Session{NewDB: true}).Create(&entry).Error
+	if err != nil {
+		return err
+	}
+
+	if (action == auditActionCreate || action == auditActionUpdate) && after != nil && hasRevisions(entityType) {
+		return recordRevision(tx, entityType, id, before, after)
+	}
+	return nil
+}
+
+// auditBeforeChange loads the current state of the entity in the BeforeUpdate and BeforeDelete hooks
+func auditBeforeChange(tx *gorm.DB, entityType string, id uint) (auditSnapshot, error) {
+	if id == 0 || auditedManually(tx, entityType, id) {
+		return nil, nil
+	}
+	snapshots, err := loadAuditSnapshots(tx, entityType, []uint{id})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots[id], nil
+}
+
+// auditAfterChange records the change in the AfterCreate, AfterUpdate and AfterDelete hooks. before is the state
+// loaded by auditBeforeChange.
+func auditAfterChange(tx *gorm.DB, entityType string, id uint, action string, before auditSnapshot) error {
+	if id == 0 || auditedManually(tx, entityType, id) {
+		return nil
+	}
+	if action == auditActionCreate && tx.Statement.DB.RowsAffected == 0 {
+		// Associations are saved with an upsert that doesn't insert existing entities
+		return nil
+	}
+	if action == auditActionUpdate && before == nil {
+		return nil
+	}
+
+	if action == auditActionDelete {
+		if tx.Statement.Unscoped {
+			action = auditActionPurge
+		}
+		return recordAudit(tx, entityType, id, action, before, nil)
+	}
+	snapshots, err := loadAuditSnapshots(tx, entityType, []uint{id})
+	if err != nil {
+		return err
+	}
+	return recordAudit(tx, entityType, id, action, before, snapshots[id])
+}
+
+// beginAudit loads the entities before a change that spans several statements or doesn't run the hooks of the
+// models. The hooks don't record changes of these entities on the returned transaction, commit records a single
+// entry per changed entity instead.
+func beginAudit(tx *gorm.DB, entityType string, ids ...uint) (*gorm.DB, *pendingAudit, error) {
+	ids = uniqueIds(ids)
+	before, err := loadAuditSnapshots(tx, entityType, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	pending := &pendingAudit{entityType: entityType, ids: ids, before: before}
+	return tx.WithContext(context.WithValue(tx.Statement.Context, auditManualKey{}, pending)), pending, nil
+}
+
+func (p *pendingAudit) commit(tx *gorm.DB) error {
+	after, err := loadAuditSnapshots(tx, p.entityType, p.ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range p.ids {
+		err = recordAudit(tx, p.entityType, id, auditActionUpdate, p.before[id], after[id])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryAuditLog returns the matching entries, newest first
+func queryAuditLog(filter *AuditFilter) ([]AuditEntry, error) {
+	tx := db.Model(&AuditEntry{})
+	if len(filter.Username) > 0 {
+		tx = tx.Where("username = ?", filter.Username)
+	}
+	if len(filter.Action) > 0 {
+		tx = tx.Where("action = ?", filter.Action)
+	}
+	if len(filter.EntityType) > 0 {
+		tx = tx.Where("entity_type = ?", filter.EntityType)
+	}
+	if filter.EntityID > 0 {
+		tx = tx.Where("entity_id = ?", filter.EntityID)
+	}
+	if filter.ImageID > 0 {
+		tx = tx.Where("image_id = ?", filter.ImageID)
+	}
+	if filter.EntityID > 0 || filter.ImageID > 0 {
+		// The IDs of superseded entries belong to entities deleted by an import
+		tx = tx.Where("superseded = ?", false)
+	}
+	for _, dateFilter := range []struct {
+		raw        string
+		operator   string
+		upperBound bool
+	}{
+		{filter.After, ">=", false},
+		{filter.Before, "<", true},
+	} {
+		if len(dateFilter.raw) == 0 {
+			continue
+		}
+		date, err := parseFilterDate(dateFilter.raw, dateFilter.upperBound)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date '%s'", dateFilter.raw)
+		}
+		tx = tx.Where("created_at "+dateFilter.operator+" ?", date)
+	}
+
+	res := tx.Session(&gorm.Session{}).Count(&filter.Page.Total)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	var entries []AuditEntry
+	tx = tx.Order("created_at desc").Order("id desc").Offset(filter.Page.Offset)
+	if filter.Page.Limit > 0 {
+		tx = tx.Limit(filter.Page.Limit)
+	}
+	res = tx.Find(&entries)
+	filter.Page.Count = len(entries)
+	return entries, res.Error
+}
+
+// imageHistory returns the changes of the image and its variants, newest first
+func imageHistory(imageId uint) []AuditEntryDto {
+	if imageId == 0 {
+		return nil
+	}
+	filter := AuditFilter{ImageID: imageId, Page: Page{Limit: imageHistoryLimit}}
+	entries, err := queryAuditLog(&filter)
+	if err != nil {
+		logger.Errorf("Could not load history of image %d: %v", imageId, err)
+	}
+	return Map(entries, func(entry AuditEntry) AuditEntryDto {
+		return entry.toDto()
+	})
+}
+
+func auditFilterFromQuery(c *gin.Context) (AuditFilter, error) {
+	filter := AuditFilter{
+		Username:   c.Query("user"),
+		Action:     c.Query("action"),
+		EntityType: c.Query("entityType"),
+		After:      c.Query("after"),
+		Before:     c.Query("before"),
+	}
+
+	for name, target := range map[string]*uint{"entityId": &filter.EntityID, "imageId": &filter.ImageID} {
+		raw := c.Query(name)
+		if len(raw) == 0 {
+			continue
+		}
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s '%s'", name, raw)
+		}
+		*target = uint(id)
+	}
+
+	for _, raw := range []string{filter.After, filter.Before} {
+		if _, err := parseFilterDate(raw, false); len(raw) > 0 && err != nil {
+			return filter, fmt.Errorf("invalid date '%s'", raw)
+		}
+	}
+
+	var err error
+	filter.Page, err = parsePage(c, auditListLimit)
+	if err != nil {
+		return filter, err
+	}
+	if len(filter.Page.Cursor) > 0 {
+		return filter, errors.New("the audit log is paged by offset")
+	}
+	return filter, nil
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getAuditLog(c *gin.Context) {
+	filter, err := auditFilterFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := queryAuditLog(&filter)
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Header(headerTotalCount, strconv.FormatInt(filter.Page.Total, 10))
+
+	entriesDto := Map(entries, func(entry AuditEntry) AuditEntryDto {
+		return entry.toDto()
+	})
+	c.JSON(http.StatusOK, &entriesDto)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestTruncateTablesKeepsAuditLog(t *testing.T) {
+	setupTestDatabase(t)
+	createTestImages(t, 2)
+	if len(imageHistory(1)) != 1 {
+		t.Fatalf("creating an image recorded %v", imageHistory(1))
+	}
+
+	if err := truncateTables(withAuditUser(context.Background(), "admin")); err != nil {
+		t.Fatal(err)
+	}
+
+	all := AuditFilter{}
+	entries, err := queryAuditLog(&all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d audit entries, expected the 2 creations and the import", len(entries))
+	}
+	if entries[0].Action != auditActionImport || entries[0].Username != "admin" || entries[0].Superseded {
+		t.Errorf("unexpected import entry %+v", entries[0])
+	}
+	for _, entry := range entries[1:] {
+		if !entry.Superseded {
+			t.Errorf("entry %d of a deleted image isn't superseded", entry.ID)
+		}
+	}
+
+	// The import reuses the IDs, the imported images start without history
+	createTestImages(t, 1)
+	if history := imageHistory(1); len(history) != 1 || history[0].Superseded {
+		t.Errorf("history of the imported image is %+v", history)
+	}
+}
+
+func TestRecordAudit(t *testing.T) {
+	setupTestDatabase(t)
+	alice := withAuditUser(context.Background(), "alice")
+	image := Image{Name: "sunset", Title: "Sunset"}
+	if res := db.WithContext(alice).Create(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	image.Title = "Evening"
+	if res := db.WithContext(alice).Save(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	// Saving without changes isn't recorded
+	if res := db.WithContext(alice).Save(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	variant := ImageVariant{ImageID: image.ID, Format: "webp", FileName: "sunset-small.webp"}
+	if res := db.WithContext(withAuditUser(context.Background(), "bob")).Create(&variant); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res := db.Delete(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	history := imageHistory(image.ID)
+	expected := []struct {
+		username   string
+		action     string
+		entityType string
+	}{
+		{auditSystemUser, auditActionDelete, auditEntityImage},
+		{"bob", auditActionCreate, auditEntityVariant},
+		{"alice", auditActionUpdate, auditEntityImage},
+		{"alice", auditActionCreate, auditEntityImage},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("got history %+v", history)
+	}
+	for i, entry := range expected {
+		if history[i].Username != entry.username || history[i].Action != entry.action ||
+			history[i].EntityType != entry.entityType || history[i].ImageID != image.ID {
+			t.Errorf("entry %d is %+v, expected %+v", i, history[i], entry)
+		}
+	}
+
+	// The update contains the changed column only, the creation and deletion the values of the entity
+	changes, _ := json.Marshal(history[2].Changes)
+	if string(changes) != `{"title":{"old":"Sunset","new":"Evening"}}` {
+		t.Errorf("update recorded the changes %s", changes)
+	}
+	if change := history[3].Changes["name"]; change.Old != nil || change.New != "sunset" {
+		t.Errorf("creation recorded the name change %+v", change)
+	}
+	if change := history[0].Changes["title"]; change.Old != "Evening" || change.New != nil {
+		t.Errorf("deletion recorded the title change %+v", change)
+	}
+	if _, found := history[0].Changes["description"]; found {
+		t.Error("deletion recorded the empty description")
+	}
+}
+
+func TestQueryAuditLog(t *testing.T) {
+	setupTestDatabase(t)
+	for i, username := range []string{"alice", "bob", "alice"} {
+		ctx := withAuditUser(context.Background(), username)
+		if res := db.WithContext(ctx).Create(&Author{Name: fmt.Sprintf("author-%d", i)}); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	createTestImages(t, 1)
+
+	tests := []struct {
+		name    string
+		filter  AuditFilter
+		ids     []uint
+		total   int64
+		invalid bool
+	}{
+		{"all", AuditFilter{}, []uint{4, 3, 2, 1}, 4, false},
+		{"username", AuditFilter{Username: "alice"}, []uint{3, 1}, 2, false},
+		{"entity type", AuditFilter{EntityType: auditEntityImage}, []uint{4}, 1, false},
+		{"entity", AuditFilter{EntityType: auditEntityAuthor, EntityID: 2}, []uint{2}, 1, false},
+		{"action", AuditFilter{Action: auditActionDelete}, []uint{}, 0, false},
+		{"page", AuditFilter{Page: Page{Offset: 1, Limit: 2}}, []uint{3, 2}, 4, false},
+		{"after", AuditFilter{After: "2000-01-01"}, []uint{4, 3, 2, 1}, 4, false},
+		{"before", AuditFilter{Before: "2000-01-01T00:00:00Z"}, []uint{}, 0, false},
+		{"invalid date", AuditFilter{After: "yesterday"}, nil, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := queryAuditLog(&test.filter)
+			if (err != nil) != test.invalid {
+				t.Fatalf("got error %v", err)
+			}
+			if test.invalid {
+				return
+			}
+			ids := Map(entries, func(entry AuditEntry) uint { return entry.ID })
+			if !slices.Equal(ids, test.ids) || test.filter.Page.Total != test.total {
+				t.Errorf("got entries %v of %d, expected %v of %d", ids, test.filter.Page.Total, test.ids, test.total)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	LoginDto struct {
+		Username string `json:"username" form:"username" binding:"required"`
+		Password string `json:"password" form:"password" binding:"required"`
+	}
+
+	SessionTokenDto struct {
+		Token     string    `json:"token" yaml:"token"`
+		Username  string    `json:"username" yaml:"username"`
+		ExpiresAt time.Time `json:"expiresAt" yaml:"expiresAt"`
+	}
+
+	SessionClaims struct {
+		ID        string `json:"jti"`
+		Subject   string `json:"sub"`
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		// Generation is the session generation of the account when the token was issued
+		Generation int `json:"gen,omitempty"`
+	}
+
+	// RevokedSession is a token that was logged out or refreshed before it expired. Revocations are stored, so they
+	// outlive a restart.
+	RevokedSession struct {
+		ID        string    `gorm:"primaryKey"`
+		ExpiresAt time.Time `gorm:"index"`
+	}
+)
+
+const (
+	sessionClaimsKey   = "sessionClaims"
+	accountRoleKey     = "accountRole"
+	authSchemeBasic    = "basic"
+	authSchemeBearer   = "bearer"
+	basicAuthRealm     = `Basic realm="Authorization Required"`
+	sessionTokenPrefix = "v1"
+)
+
+var (
+	sessionSecret   []byte
+	revokedSessions = map[string]time.Time{}
+	revokedMutex    = sync.RWMutex{}
+	dummyHash       string
+	dummyHashOnce   sync.Once
+
+	errPasswordHash = errors.New("error hashing password")
+	errInvalidToken = errors.New("invalid session token")
+	errExpiredToken = errors.New("session token expired")
+	errRevokedToken = errors.New("session token revoked")
+)
+
+func setupSessions() {
+	loadRevokedSessions()
+
+	if len(appConfig.SessionSecret) > 0 {
+		sessionSecret = []byte(appConfig.SessionSecret)
+		return
+	}
+
+	sessionSecret = make([]byte, 32)
+	_, err := rand.Read(sessionSecret)
+	if err != nil {
+		logger.Panicf("Could not generate session secret: %v", err)
+	}
+	logger.Warnf("No session secret configured, issued session tokens will be invalid after a restart")
+}
+
+func hashPassword(pw []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(pw, bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errPasswordHash, err)
+	}
+	return string(hash), nil
+}
+
+// checkPassword compares the plain password with the stored bcrypt hash. Anything else, including an empty hash,
+// never matches, legacy plaintext passwords are migrated when the accounts are read.
+func checkPassword(storedPw string, plainPw []byte) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(storedPw), plainPw)
+	return err == nil
+}
+
+func validateCredentials(username, password string) bool {
+	account, found := findAccount(username)
+	if !found {
+		// Compare anyway, so the response time doesn't reveal whether the user exists
+		dummyHashOnce.Do(func() {
+			var err error
+			dummyHash, err = hashPassword([]byte{})
+			if err != nil {
+				logger.Errorf("Error hashing dummy password: %v", err)
+			}
+		})
+		checkPassword(dummyHash, []byte(password))
+		return false
+	}
+	return checkPassword(account.PasswordHash, []byte(password))
+}
+
+func randomTokenId() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func signSessionPayload(payload string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func issueSessionToken(username string) (*SessionTokenDto, error) {
+	account, found := findAccount(username)
+	if !found {
+		return nil, errAccountNotFound
+	}
+
+	id, err := randomTokenId()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(appConfig.SessionLifetime())
+	claims := SessionClaims{
+		ID:         id,
+		Subject:    username,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  expiresAt.Unix(),
+		Generation: account.SessionGeneration,
+	}
+
+	claimBytes, err := json.Marshal(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := sessionTokenPrefix + "." + base64.RawURLEncoding.EncodeToString(claimBytes)
+	return &SessionTokenDto{
+		Token:     payload + "." + signSessionPayload(payload),
+		Username:  username,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+func parseSessionToken(token string) (*SessionClaims, error) {
+	lastDot := strings.LastIndex(token, ".")
+	if lastDot < 0 {
+		return nil, errInvalidToken
+	}
+
+	payload, signature := token[:lastDot], token[lastDot+1:]
+	if !hmac.Equal([]byte(signature), []byte(signSessionPayload(payload))) {
+		return nil, errInvalidToken
+	}
+
+	prefix, rawClaims, found := strings.Cut(payload, ".")
+	if !found || prefix != sessionTokenPrefix {
+		return nil, errInvalidToken
+	}
+
+	claimBytes, err := base64.RawURLEncoding.DecodeString(rawClaims)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var claims SessionClaims
+	err = json.Unmarshal(claimBytes, &claims)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errExpiredToken
+	}
+
+	if isSessionRevoked(claims.ID) {
+		return nil, errRevokedToken
+	}
+
+	account, found := findAccount(claims.Subject)
+	if !found {
+		return nil, errInvalidToken
+	}
+	if account.SessionGeneration != claims.Generation {
+		return nil, errRevokedToken
+	}
+
+	return &claims, nil
+}
+
+// loadRevokedSessions reads the stored revocations of tokens that haven't expired yet
+func loadRevokedSessions() {
+	res := db.Where("expires_at < ?", time.Now()).Delete(&RevokedSession{})
+	if res.Error != nil {
+		logger.Errorf("Could not delete expired session revocations: %v", res.Error)
+	}
+
+	var revoked []RevokedSession
+	res = db.Find(&revoked)
+	if res.Error != nil {
+		logger.Panicf("Could not load session revocations: %v", res.Error)
+	}
+
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+	for _, session := range revoked {
+		revokedSessions[session.ID] = session.ExpiresAt
+	}
+}
+
+func revokeSession(claims *SessionClaims) error {
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	now := time.Now()
+	// Expired tokens are rejected anyway, so there is no need to remember them any longer
+	for id, expiresAt := range revokedSessions {
+		if now.After(expiresAt) {
+			delete(revokedSessions, id)
+		}
+	}
+	res := db.Where("expires_at < ?", now).Delete(&RevokedSession{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	revoked := RevokedSession{ID: claims.ID, ExpiresAt: time.Unix(claims.ExpiresAt, 0)}
+	res = db.Save(&revoked)
+	if res.Error != nil {
+		return res.Error
+	}
+	revokedSessions[revoked.ID] = revoked.ExpiresAt
+	return nil
+}
+
+func isSessionRevoked(id string) bool {
+	revokedMutex.RLock()
+	defer revokedMutex.RUnlock()
+	_, revoked := revokedSessions[id]
+	return revoked
+}
+
+// authRequired accepts either a session token issued by the login endpoint ("Authorization: Bearer <token>") or
+// HTTP Basic auth credentials. The authenticated username is stored under gin.AuthUserKey.
+func authRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, credentials, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+
+		switch strings.ToLower(scheme) {
+		case authSchemeBearer:
+			claims, err := parseSessionToken(strings.TrimSpace(credentials))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			setAuthenticatedUser(c, claims.Subject)
+			c.Set(sessionClaimsKey, claims)
+			return
+		case authSchemeBasic:
+			username, password, ok := c.Request.BasicAuth()
+			if ok && validateCredentials(username, password) {
+				setAuthenticatedUser(c, username)
+				return
+			}
+		}
+
+		c.Header("WWW-Authenticate", basicAuthRealm)
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+func setAuthenticatedUser(c *gin.Context, username string) {
+	// The role is looked up on every request, so role changes apply to existing sessions immediately
+	role := RoleViewer
+	if account, found := findAccount(username); found {
+		role = account.Role
+	}
+	c.Set(gin.AuthUserKey, username)
+	c.Set(accountRoleKey, role)
+}
+
+func currentRole(c *gin.Context) Role {
+	role, found := c.Get(accountRoleKey)
+	if !found {
+		return ""
+	}
+	return role.(Role)
+}
+
+// hasRole checks whether the authenticated user has at least the required role and responds with 403 otherwise.
+// It's meant for handlers that serve multiple actions with different permissions.
+func hasRole(c *gin.Context, required Role) bool {
+	if currentRole(c).Includes(required) {
+		return true
+	}
+	c.String(http.StatusForbidden, "This action requires the role \"%s\"", required)
+	return false
+}
+
+func requireRole(required Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasRole(c, required) {
+			c.Abort()
+		}
+	}
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func login(c *gin.Context) {
+	loginDto := LoginDto{}
+	if err := c.ShouldBind(&loginDto); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	if !validateCredentials(loginDto.Username, loginDto.Password) {
+		c.String(http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	token, err := issueSessionToken(loginDto.Username)
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error issuing session token: %v", err)
+		return
+	}
+
+	logger.Infof("User \"%s\" logged in", loginDto.Username)
+	c.JSON(http.StatusOK, token)
+}
+
+func logout(c *gin.Context) {
+	claims, found := c.Get(sessionClaimsKey)
+	if found {
+		err := revokeSession(claims.(*SessionClaims))
+		if err != nil {
+			c.Error(err)
+			c.String(http.StatusInternalServerError, "Error revoking session token: %v", err)
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// refreshSession issues a new token before the old one is revoked, so a failure leaves the user logged in
+func refreshSession(c *gin.Context) {
+	token, err := issueSessionToken(c.GetString(gin.AuthUserKey))
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error issuing session token: %v", err)
+		return
+	}
+
+	claims, found := c.Get(sessionClaimsKey)
+	if found {
+		err := revokeSession(claims.(*SessionClaims))
+		if err != nil {
+			c.Error(err)
+			c.String(http.StatusInternalServerError, "Error revoking session token: %v", err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, token)
+}
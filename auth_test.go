@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupTestSessions(t *testing.T) {
+	previousConfig, previousSecret, previousAccounts := appConfig, sessionSecret, accounts
+	t.Cleanup(func() {
+		appConfig, sessionSecret, accounts = previousConfig, previousSecret, previousAccounts
+		revokedSessions = map[string]time.Time{}
+	})
+
+	logger = zap.NewNop().Sugar()
+	appConfig = &AppConfig{sessionLifetime: time.Hour}
+	sessionSecret = []byte("test-secret")
+	accounts = map[string]Account{
+		"alice": {Username: "alice", Role: RoleAdmin, SessionGeneration: 2},
+	}
+	revokedSessions = map[string]time.Time{}
+}
+
+// signedToken builds a token with a valid signature around arbitrary claims
+func signedToken(prefix string, rawClaims string) string {
+	payload := prefix + "." + base64.RawURLEncoding.EncodeToString([]byte(rawClaims))
+	return payload + "." + signSessionPayload(payload)
+}
+
+func claimsJson(t *testing.T, claims SessionClaims) string {
+	claimBytes, err := json.Marshal(&claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(claimBytes)
+}
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	setupTestSessions(t)
+
+	token, err := issueSessionToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Username != "alice" || time.Until(token.ExpiresAt) > time.Hour {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	claims, err := parseSessionToken(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice" || claims.Generation != 2 || len(claims.ID) == 0 {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if _, err := issueSessionToken("bob"); !errors.Is(err, errAccountNotFound) {
+		t.Errorf("issuing a token for a missing account returned %v", err)
+	}
+}
+
+func TestParseSessionToken(t *testing.T) {
+	setupTestSessions(t)
+
+	now := time.Now()
+	valid := SessionClaims{ID: "valid", Subject: "alice", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix(), Generation: 2}
+	with := func(change func(claims *SessionClaims)) string {
+		claims := valid
+		change(&claims)
+		return signedToken(sessionTokenPrefix, claimsJson(t, claims))
+	}
+	validToken := signedToken(sessionTokenPrefix, claimsJson(t, valid))
+	revokedSessions["revoked"] = now.Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", validToken, nil},
+		{"empty", "", errInvalidToken},
+		{"without signature", strings.Join(strings.Split(validToken, ".")[:2], "."), errInvalidToken},
+		{"wrong signature", validToken[:strings.LastIndex(validToken, ".")+1] + "AAAA", errInvalidToken},
+		{"changed claims", strings.Replace(validToken, ".", ".e", 1), errInvalidToken},
+		{"other secret", "v1.e30.hmA4vWzrDpr3PpUyCrhhbPP3zT0gJZeRdmRWDFGHzCQ", errInvalidToken},
+		{"wrong prefix", signedToken("v2", claimsJson(t, valid)), errInvalidToken},
+		{"claims aren't json", signedToken(sessionTokenPrefix, "alice"), errInvalidToken},
+		{"expired", with(func(c *SessionClaims) { c.ExpiresAt = now.Add(-time.Second).Unix() }), errExpiredToken},
+		{"revoked", with(func(c *SessionClaims) { c.ID = "revoked" }), errRevokedToken},
+		{"unknown account", with(func(c *SessionClaims) { c.Subject = "bob" }), errInvalidToken},
+		{"previous generation", with(func(c *SessionClaims) { c.Generation = 1 }), errRevokedToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := parseSessionToken(test.token)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if test.err == nil && claims.ID != valid.ID {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestRevokedSessionsSurviveRestart(t *testing.T) {
+	setupTestSessions(t)
+	setupTestDatabase(t)
+
+	now := time.Now()
+	token, err := issueSessionToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseSessionToken(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeSession(claims); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&RevokedSession{ID: "expired", ExpiresAt: now.Add(-time.Minute)})
+
+	// A restart starts with an empty list and loads the stored revocations
+	revokedSessions = map[string]time.Time{}
+	loadRevokedSessions()
+
+	if _, err := parseSessionToken(token.Token); !errors.Is(err, errRevokedToken) {
+		t.Errorf("revoked token was accepted after a restart: %v", err)
+	}
+	var stored int64
+	db.Model(&RevokedSession{}).Where("id = ?", "expired").Count(&stored)
+	if stored != 0 {
+		t.Error("expired revocation wasn't deleted")
+	}
+}
+
+func TestChangePasswordInvalidatesSessions(t *testing.T) {
+	setupTestSessions(t)
+	appConfig.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	accounts = map[string]Account{}
+
+	if err := addAccount("bob", "first password", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	before, err := issueSessionToken("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := changePassword("bob", "second password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSessionToken(before.Token); !errors.Is(err, errRevokedToken) {
+		t.Errorf("token issued before the password change returned %v", err)
+	}
+
+	after, err := issueSessionToken("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSessionToken(after.Token); err != nil {
+		t.Errorf("token issued after the password change was rejected: %v", err)
+	}
+
+	// The generation is part of the accounts file, so other instances and restarts reject the old tokens as well
+	if err := readAccounts(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSessionToken(before.Token); !errors.Is(err, errRevokedToken) {
+		t.Errorf("token issued before the password change returned %v after reloading the accounts", err)
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	setupTestSessions(t)
+	setupTestDatabase(t)
+
+	refresh := func(username string, claims *SessionClaims) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/auth/refresh", nil)
+		c.Set(gin.AuthUserKey, username)
+		c.Set(sessionClaimsKey, claims)
+		refreshSession(c)
+		return recorder
+	}
+
+	token, _ := issueSessionToken("alice")
+	claims, _ := parseSessionToken(token.Token)
+	recorder := refresh("alice", claims)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("refresh returned %d", recorder.Code)
+	}
+	refreshed := SessionTokenDto{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSessionToken(refreshed.Token); err != nil {
+		t.Errorf("refreshed token was rejected: %v", err)
+	}
+	if _, err := parseSessionToken(token.Token); !errors.Is(err, errRevokedToken) {
+		t.Errorf("old token returned %v after the refresh", err)
+	}
+
+	// If no new token can be issued, the old one stays valid
+	other, _ := issueSessionToken("alice")
+	otherClaims, _ := parseSessionToken(other.Token)
+	if recorder := refresh("removed", otherClaims); recorder.Code != http.StatusInternalServerError {
+		t.Errorf("failed refresh returned %d", recorder.Code)
+	}
+	if _, err := parseSessionToken(other.Token); err != nil {
+		t.Errorf("failed refresh revoked the old token: %v", err)
+	}
+}
+
+func TestConcurrentAccountChanges(t *testing.T) {
+	setupTestSessions(t)
+	appConfig.AccountsFile = filepath.Join(t.TempDir(), "accounts.json")
+	accounts = map[string]Account{}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if err := changeRole("alice", RoleViewer); err != nil && !errors.Is(err, errAccountNotFound) {
+				t.Error(err)
+			}
+			accountsMutex.Lock()
+			accounts[fmt.Sprintf("user-%d", i)] = Account{Username: fmt.Sprintf("user-%d", i), Role: RoleViewer}
+			accountsMutex.Unlock()
+			if err := writeAccounts(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+
+	// The last write has to contain every account, an earlier snapshot must not overwrite it
+	if err := readAccounts(); err != nil {
+		t.Fatal(err)
+	}
+	if len(allAccounts()) != 8 {
+		t.Errorf("accounts file has %d accounts, expected 8", len(allAccounts()))
+	}
+}
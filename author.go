@@ -16,6 +16,8 @@ type Author struct {
 	Name   string `gorm:"uniqueIndex;size:50"`
 	Url    string
 	Images []Image
+	// auditBefore is the state before an update or delete, used by the hooks to record the change
+	auditBefore auditSnapshot
 }
 
 type AuthorDto struct {
@@ -25,6 +27,44 @@ type AuthorDto struct {
 	ImageCount uint   `json:"-" yaml:"-"`
 }
 
+func (a *Author) AfterCreate(tx *gorm.DB) (err error) {
+	return auditAfterChange(tx, auditEntityAuthor, a.ID, auditActionCreate, nil)
+}
+
+func (a *Author) BeforeUpdate(tx *gorm.DB) (err error) {
+	a.auditBefore, err = auditBeforeChange(tx, auditEntityAuthor, a.ID)
+	return err
+}
+
+// AfterUpdate reindexes the images of the author, whose name is part of the search index. AfterSave would also
+// run whenever an image is saved together with its author.
+func (a *Author) AfterUpdate(tx *gorm.DB) (err error) {
+	if a.ID == 0 {
+		return nil
+	}
+	err = auditAfterChange(tx, auditEntityAuthor, a.ID, auditActionUpdate, a.auditBefore)
+	if err != nil {
+		return err
+	}
+	return indexImagesWhere(tx, "author_id = ?", a.ID)
+}
+
+func (a *Author) BeforeDelete(tx *gorm.DB) (err error) {
+	a.auditBefore, err = auditBeforeChange(tx, auditEntityAuthor, a.ID)
+	return err
+}
+
+func (a *Author) AfterDelete(tx *gorm.DB) (err error) {
+	if a.ID == 0 {
+		return nil
+	}
+	err = auditAfterChange(tx, auditEntityAuthor, a.ID, auditActionDelete, a.auditBefore)
+	if err != nil {
+		return err
+	}
+	return indexImagesWhere(tx, "author_id = ?", a.ID)
+}
+
 func (a *Author) toDto() AuthorDto {
 	return AuthorDto{
 		ID:   a.ID,
@@ -142,7 +182,8 @@ func getAuthorHtml(c *gin.Context) {
 
 	if err == nil {
 		c.HTML(200, "author.gohtml", gin.H{
-			"author": author.toDtoWithImageCount(),
+			"author":  author.toDtoWithImageCount(),
+			"authors": getAllAuthors(),
 		})
 	}
 }
@@ -164,7 +205,7 @@ func updateAuthorForm(c *gin.Context) {
 
 		author.updateWithDto(dto)
 
-		db.Save(&author)
+		db.WithContext(c).Save(&author)
 
 		if isNewAuthor {
 			c.Redirect(302, fmt.Sprintf("/authors/%d", author.ID))
@@ -172,7 +213,18 @@ func updateAuthorForm(c *gin.Context) {
 			getAuthorHtml(c)
 		}
 	case "delete":
-		db.Unscoped().Delete(&author)
+		if !hasRole(c, RoleAdmin) {
+			return
+		}
+		options, err := deleteOptionsFromRequest(c)
+		if err == nil {
+			err = trashAuthor(c, author, options)
+		}
+		if err != nil {
+			c.Error(err)
+			c.String(deleteErrorStatus(err), "Error deleting author: %v", err)
+			return
+		}
 		c.Redirect(302, "/authors")
 	}
 }
@@ -230,7 +282,7 @@ func addAuthor(c *gin.Context) {
 
 	author := authorDto.toModel()
 
-	result := db.Create(&author)
+	result := db.WithContext(c).Create(&author)
 
 	if result.Error != nil {
 		c.String(http.StatusInternalServerError, "Error inserting author: %v", result.Error)
@@ -262,7 +314,7 @@ func updateAuthor(c *gin.Context) {
 	}
 
 	author.updateWithDto(authorDto)
-	res = db.Save(&author)
+	res = db.WithContext(c).Save(&author)
 	if res.Error != nil {
 		c.String(http.StatusInternalServerError, "Error updating author with ID '%s': %v", id, res.Error)
 		return
@@ -277,12 +329,23 @@ func deleteAuthor(c *gin.Context) {
 		c.String(http.StatusBadRequest, err.Error())
 	}
 
+	options, err := deleteOptionsFromRequest(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
 	author := Author{}
-	author.ID = id
+	res := db.Limit(1).Find(&author, id)
+	if res.RowsAffected == 0 {
+		c.String(http.StatusNotFound, "Author with ID '%d' not found", id)
+		return
+	}
 
-	res := db.Delete(&author)
-	if res.Error != nil {
-		c.String(http.StatusInternalServerError, "Error deleting author with ID '%s': %v", id, res.Error)
+	err = trashAuthor(c, &author, options)
+	if err != nil {
+		c.Error(err)
+		c.String(deleteErrorStatus(err), "Error deleting author with ID '%d': %v", id, err)
 		return
 	}
 
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type (
+	// BulkEditDto describes changes applied to all listed images. Fields that are not set are left unchanged.
+	BulkEditDto struct {
+		ImageIDs         []uint `json:"imageIds" yaml:"imageIds" binding:"required"`
+		AddCategories    []uint `json:"addCategories,omitempty" yaml:"addCategories,omitempty"`
+		RemoveCategories []uint `json:"removeCategories,omitempty" yaml:"removeCategories,omitempty"`
+		AuthorID         *uint  `json:"authorId,omitempty" yaml:"authorId,omitempty"`
+		Nsfw             *bool  `json:"nsfw,omitempty" yaml:"nsfw,omitempty"`
+		// SortIndexShift is added to the sort index of every image, it may be negative
+		SortIndexShift int `json:"sortIndexShift,omitempty" yaml:"sortIndexShift,omitempty"`
+	}
+
+	// BulkEditResultDto contains the number of rows affected by each part of a bulk edit
+	BulkEditResultDto struct {
+		Images            int   `json:"images" yaml:"images"`
+		CategoriesAdded   int64 `json:"categoriesAdded" yaml:"categoriesAdded"`
+		CategoriesRemoved int64 `json:"categoriesRemoved" yaml:"categoriesRemoved"`
+		AuthorChanged     int64 `json:"authorChanged" yaml:"authorChanged"`
+		NsfwChanged       int64 `json:"nsfwChanged" yaml:"nsfwChanged"`
+		SortIndexShifted  int64 `json:"sortIndexShifted" yaml:"sortIndexShifted"`
+	}
+)
+
+const bulkSummaryParam = "bulkSummary"
+
+var (
+	errBulkNoImages = errors.New("no images selected")
+	errBulkNotFound = errors.New("not found")
+)
+
+func (r *BulkEditResultDto) String() string {
+	return fmt.Sprintf("Edited %d images: %d category assignments added, %d removed, %d authors changed, "+
+		"%d NSFW flags changed, %d sort indices shifted",
+		r.Images, r.CategoriesAdded, r.CategoriesRemoved, r.AuthorChanged, r.NsfwChanged, r.SortIndexShifted)
+}
+
+// bulkEditImages applies the edit to all images in a single transaction. It fails without changing anything if one
+// of the referenced images, categories or the author doesn't exist.
+func bulkEditImages(ctx context.Context, edit *BulkEditDto) (*BulkEditResultDto, error) {
+	ids := uniqueIds(edit.ImageIDs)
+	if len(ids) == 0 {
+		return nil, errBulkNoImages
+	}
+	result := BulkEditResultDto{Images: len(ids)}
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := requireExisting(tx, &Image{}, "images", ids)
+		if err != nil {
+			return err
+		}
+		tx, audit, err := beginAudit(tx, auditEntityImage, ids...)
+		if err != nil {
+			return err
+		}
+		categories := uniqueIds(append(append([]uint{}, edit.AddCategories...), edit.RemoveCategories...))
+		err = requireExisting(tx, &Category{}, "categories", categories)
+		if err != nil {
+			return err
+		}
+
+		if len(edit.AddCategories) > 0 {
+			res := tx.Exec("INSERT INTO images_categories (image_id, category_id) "+
+				"SELECT images.id, categories.id FROM images, categories WHERE images.id IN ? AND categories.id IN ? "+
+				"ON CONFLICT DO NOTHING", ids, uniqueIds(edit.AddCategories))
+			if res.Error != nil {
+				return res.Error
+			}
+			result.CategoriesAdded = res.RowsAffected
+		}
+
+		if len(edit.RemoveCategories) > 0 {
+			res := tx.Exec("DELETE FROM images_categories WHERE image_id IN ? AND category_id IN ?",
+				ids, uniqueIds(edit.RemoveCategories))
+			if res.Error != nil {
+				return res.Error
+			}
+			result.CategoriesRemoved = res.RowsAffected
+		}
+
+		if edit.AuthorID != nil {
+			err = requireExisting(tx, &Author{}, "authors", []uint{*edit.AuthorID})
+			if err != nil {
+				return err
+			}
+			res := tx.Model(&Image{}).Where("id IN ? AND author_id IS NOT ?", ids, *edit.AuthorID).
+				Update("author_id", *edit.AuthorID)
+			if res.Error != nil {
+				return res.Error
+			}
+			result.AuthorChanged = res.RowsAffected
+		}
+
+		if edit.Nsfw != nil {
+			res := tx.Model(&Image{}).Where("id IN ? AND nsfw IS NOT ?", ids, *edit.Nsfw).Update("nsfw", *edit.Nsfw)
+			if res.Error != nil {
+				return res.Error
+			}
+			result.NsfwChanged = res.RowsAffected
+		}
+
+		if edit.SortIndexShift != 0 {
+			res := tx.Model(&Image{}).Where("id IN ?", ids).
+				Update("sort_index", gorm.Expr("sort_index + ?", edit.SortIndexShift))
+			if res.Error != nil {
+				return res.Error
+			}
+			result.SortIndexShifted = res.RowsAffected
+		}
+
+		// Updates by condition don't run the hooks of the images, so the search index is updated here
+		if result.CategoriesAdded > 0 || result.CategoriesRemoved > 0 || result.AuthorChanged > 0 {
+			err = indexImages(tx, ids...)
+			if err != nil {
+				return err
+			}
+		}
+		return audit.commit(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// requireExisting returns an error listing the IDs that don't exist in the table of the model
+func requireExisting(tx *gorm.DB, model any, name string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var existing []uint
+	res := tx.Model(model).Where("id IN ?", ids).Pluck("id", &existing)
+	if res.Error != nil {
+		return res.Error
+	}
+	missing := make([]string, 0)
+	for _, id := range ids {
+		if !slices.Contains(existing, id) {
+			missing = append(missing, strconv.FormatUint(uint64(id), 10))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s %w: %s", name, errBulkNotFound, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func uniqueIds(ids []uint) []uint {
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if id > 0 && !slices.Contains(unique, id) {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// bulkEditFromForm reads the bulk edit form of the image list. Empty author and NSFW fields keep the current values.
+func bulkEditFromForm(c *gin.Context) (*BulkEditDto, error) {
+	edit := BulkEditDto{}
+	var err error
+
+	formIds := func(name string) []uint {
+		if err != nil {
+			return nil
+		}
+		var ids []uint
+		ids, err = parseIds(strings.Join(c.PostFormArray(name), ","))
+		return ids
+	}
+	edit.ImageIDs = formIds("imageIds")
+	edit.AddCategories = formIds("addCategories")
+	edit.RemoveCategories = formIds("removeCategories")
+	if err != nil {
+		return nil, err
+	}
+
+	rawAuthor := c.PostForm("author")
+	if len(rawAuthor) > 0 {
+		authorId, err := strconv.ParseUint(rawAuthor, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		author := uint(authorId)
+		edit.AuthorID = &author
+	}
+
+	rawNsfw := c.PostForm("nsfw")
+	if len(rawNsfw) > 0 {
+		nsfw, err := strconv.ParseBool(rawNsfw)
+		if err != nil {
+			return nil, err
+		}
+		edit.Nsfw = &nsfw
+	}
+
+	rawShift := c.PostForm("sortIndexShift")
+	if len(rawShift) > 0 {
+		edit.SortIndexShift, err = strconv.Atoi(rawShift)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &edit, nil
+}
+
+func bulkErrorStatus(err error) int {
+	if errors.Is(err, errBulkNoImages) || errors.Is(err, errBulkNotFound) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func bulkEditImagesForm(c *gin.Context) {
+	edit, err := bulkEditFromForm(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid bulk edit: %v", err)
+		return
+	}
+
+	result, err := bulkEditImages(c, edit)
+	if err != nil {
+		c.Error(err)
+		c.String(bulkErrorStatus(err), "Error editing images: %v", err)
+		return
+	}
+
+	// Return to the list with the same filters, only local image list URLs are accepted
+	returnUrl, err := url.Parse(c.PostForm("returnUrl"))
+	if err != nil || returnUrl.IsAbs() || len(returnUrl.Host) > 0 || returnUrl.Path != "/images" {
+		returnUrl = &url.URL{Path: "/images"}
+	}
+	query := returnUrl.Query()
+	query.Set(bulkSummaryParam, result.String())
+	returnUrl.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, returnUrl.RequestURI())
+}
+
+func bulkEditImagesApi(c *gin.Context) {
+	edit := BulkEditDto{}
+	if err := c.ShouldBind(&edit); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	result, err := bulkEditImages(c, &edit)
+	if err != nil {
+		c.Error(err)
+		c.String(bulkErrorStatus(err), "Error editing images: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
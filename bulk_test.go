@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// bulkTestState describes the fields a bulk edit changes, so edits that fail can be checked to change nothing
+type bulkTestState struct {
+	categories map[uint][]uint
+	authors    map[uint]uint
+	nsfw       map[uint]bool
+	sortIndex  map[uint]int
+}
+
+func loadBulkTestState(t *testing.T) bulkTestState {
+	t.Helper()
+	var images []Image
+	if res := db.Preload("Categories").Order("id").Find(&images); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	state := bulkTestState{categories: map[uint][]uint{}, authors: map[uint]uint{}, nsfw: map[uint]bool{}, sortIndex: map[uint]int{}}
+	for _, image := range images {
+		categories := image.categoryIds()
+		slices.Sort(categories)
+		state.categories[image.ID] = categories
+		state.authors[image.ID] = image.AuthorID
+		state.nsfw[image.ID] = image.Nsfw
+		state.sortIndex[image.ID] = image.SortIndex
+	}
+	return state
+}
+
+func (s bulkTestState) equal(other bulkTestState) bool {
+	for id, categories := range s.categories {
+		if !slices.Equal(categories, other.categories[id]) {
+			return false
+		}
+	}
+	return len(s.categories) == len(other.categories) && maps.Equal(s.authors, other.authors) &&
+		maps.Equal(s.nsfw, other.nsfw) && maps.Equal(s.sortIndex, other.sortIndex)
+}
+
+// setupTestBulk creates three images, two categories and an author. Image 1 is already in the first category.
+func setupTestBulk(t *testing.T) (Category, Category, Author) {
+	setupTestDatabase(t)
+	createTestImages(t, 3)
+	landscapes, portraits := Category{Name: "landscapes"}, Category{Name: "portraits"}
+	db.Create(&landscapes)
+	db.Create(&portraits)
+	author := Author{Name: "Jane"}
+	db.Create(&author)
+	image := Image{}
+	db.First(&image, 1)
+	if err := db.Model(&image).Association("Categories").Append(&landscapes); err != nil {
+		t.Fatal(err)
+	}
+	return landscapes, portraits, author
+}
+
+func countAuditEntries(t *testing.T) int64 {
+	var count int64
+	if res := db.Model(&AuditEntry{}).Count(&count); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	return count
+}
+
+func TestBulkEditImages(t *testing.T) {
+	landscapes, portraits, author := setupTestBulk(t)
+	nsfw := true
+
+	result, err := bulkEditImages(context.Background(), &BulkEditDto{
+		ImageIDs:         []uint{1, 2, 2},
+		AddCategories:    []uint{landscapes.ID},
+		RemoveCategories: []uint{portraits.ID},
+		AuthorID:         &author.ID,
+		Nsfw:             &nsfw,
+		SortIndexShift:   -5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BulkEditResultDto{Images: 2, CategoriesAdded: 1, AuthorChanged: 2, NsfwChanged: 2, SortIndexShifted: 2}
+	if *result != expected {
+		t.Errorf("got result %+v, expected %+v", *result, expected)
+	}
+
+	state := loadBulkTestState(t)
+	for _, id := range []uint{1, 2} {
+		if !slices.Equal(state.categories[id], []uint{landscapes.ID}) || state.authors[id] != author.ID || !state.nsfw[id] ||
+			state.sortIndex[id] != int(id)*sortIndexStep-5 {
+			t.Errorf("image %d wasn't edited: %+v", id, state)
+		}
+	}
+	if len(state.categories[3]) > 0 || state.authors[3] != 0 || state.nsfw[3] || state.sortIndex[3] != 3*sortIndexStep {
+		t.Errorf("image 3 was edited: %+v", state)
+	}
+}
+
+func TestBulkEditImagesInvalid(t *testing.T) {
+	landscapes, _, author := setupTestBulk(t)
+	unknown := uint(99)
+	nsfw := true
+
+	tests := []struct {
+		name string
+		edit BulkEditDto
+		err  error
+	}{
+		{"no images", BulkEditDto{ImageIDs: []uint{0}, Nsfw: &nsfw}, errBulkNoImages},
+		{"unknown image", BulkEditDto{ImageIDs: []uint{1, 99}, AddCategories: []uint{landscapes.ID}, Nsfw: &nsfw}, errBulkNotFound},
+		{"unknown category", BulkEditDto{ImageIDs: []uint{2}, AddCategories: []uint{landscapes.ID, 99}, Nsfw: &nsfw}, errBulkNotFound},
+		// The categories are added before the author is checked
+		{"unknown author", BulkEditDto{ImageIDs: []uint{2, 3}, AddCategories: []uint{landscapes.ID}, AuthorID: &unknown,
+			Nsfw: &nsfw}, errBulkNotFound},
+		{"unknown category to remove", BulkEditDto{ImageIDs: []uint{2}, AuthorID: &author.ID, SortIndexShift: 1,
+			RemoveCategories: []uint{99}}, errBulkNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := loadBulkTestState(t)
+			audited := countAuditEntries(t)
+
+			if _, err := bulkEditImages(context.Background(), &test.edit); !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if after := loadBulkTestState(t); !before.equal(after) {
+				t.Errorf("failed edit changed %+v to %+v", before, after)
+			}
+			if countAuditEntries(t) != audited {
+				t.Error("failed edit was audited")
+			}
+		})
+	}
+}
+
+func TestBulkEditImagesRollback(t *testing.T) {
+	landscapes, portraits, author := setupTestBulk(t)
+	before := loadBulkTestState(t)
+	audited := countAuditEntries(t)
+
+	// The sort indices are shifted last, after the categories, the author and the NSFW flags were changed
+	failure := errors.New("update failed")
+	err := db.Callback().Update().Before("gorm:update").Register("test:fail_sort_index", func(tx *gorm.DB) {
+		if updates, ok := tx.Statement.Dest.(map[string]any); ok {
+			if _, found := updates["sort_index"]; found {
+				tx.AddError(failure)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nsfw := true
+	_, err = bulkEditImages(context.Background(), &BulkEditDto{
+		ImageIDs:         []uint{1, 2, 3},
+		AddCategories:    []uint{portraits.ID},
+		RemoveCategories: []uint{landscapes.ID},
+		AuthorID:         &author.ID,
+		Nsfw:             &nsfw,
+		SortIndexShift:   10,
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("got error %v", err)
+	}
+	if after := loadBulkTestState(t); !before.equal(after) {
+		t.Errorf("failed edit changed %+v to %+v", before, after)
+	}
+	if countAuditEntries(t) != audited {
+		t.Error("failed edit was audited")
+	}
+	if bulkErrorStatus(err) != 500 {
+		t.Errorf("failure has status %d", bulkErrorStatus(err))
+	}
+}
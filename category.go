@@ -18,7 +18,12 @@ type Category struct {
 	Description string
 	Show        bool
 	Nsfw        bool
-	Images      []*Image `gorm:"many2many:images_categories"`
+	// ProcessingProfileID is used for images of this category that don't have a profile of their own
+	ProcessingProfileID *uint
+	ProcessingProfile   *ProcessingProfile
+	Images              []*Image `gorm:"many2many:images_categories"`
+	// auditBefore is the state before an update or delete, used by the hooks to record the change
+	auditBefore auditSnapshot
 }
 
 type CategoryDto struct {
@@ -29,10 +34,49 @@ type CategoryDto struct {
 	Show        *bool  `json:"show" yaml:"show"`
 	Nsfw        *bool  `json:"nsfw" yaml:"nsfw"`
 	ImageCount  uint   `json:"-" yaml:"-"`
+	// ProcessingProfileID sets the processing profile of the category, 0 removes it
+	ProcessingProfileID *uint `json:"processingProfileId,omitempty" yaml:"processingProfileId,omitempty"`
+}
+
+func (c *Category) AfterCreate(tx *gorm.DB) (err error) {
+	return auditAfterChange(tx, auditEntityCategory, c.ID, auditActionCreate, nil)
+}
+
+func (c *Category) BeforeUpdate(tx *gorm.DB) (err error) {
+	c.auditBefore, err = auditBeforeChange(tx, auditEntityCategory, c.ID)
+	return err
+}
+
+// AfterUpdate reindexes the images of the category, whose display name is part of the search index
+func (c *Category) AfterUpdate(tx *gorm.DB) (err error) {
+	if c.ID == 0 {
+		return nil
+	}
+	err = auditAfterChange(tx, auditEntityCategory, c.ID, auditActionUpdate, c.auditBefore)
+	if err != nil {
+		return err
+	}
+	return indexImagesWhere(tx, "id IN (SELECT image_id FROM images_categories WHERE category_id = ?)", c.ID)
+}
+
+func (c *Category) BeforeDelete(tx *gorm.DB) (err error) {
+	c.auditBefore, err = auditBeforeChange(tx, auditEntityCategory, c.ID)
+	return err
+}
+
+func (c *Category) AfterDelete(tx *gorm.DB) (err error) {
+	if c.ID == 0 {
+		return nil
+	}
+	err = auditAfterChange(tx, auditEntityCategory, c.ID, auditActionDelete, c.auditBefore)
+	if err != nil {
+		return err
+	}
+	return indexImagesWhere(tx, "id IN (SELECT image_id FROM images_categories WHERE category_id = ?)", c.ID)
 }
 
 func (c *Category) toDto() CategoryDto {
-	return CategoryDto{
+	dto := CategoryDto{
 		ID:          c.ID,
 		Name:        c.Name,
 		DisplayName: c.DisplayName,
@@ -40,6 +84,11 @@ func (c *Category) toDto() CategoryDto {
 		Show:        &c.Show,
 		Nsfw:        &c.Nsfw,
 	}
+	if c.ProcessingProfileID != nil {
+		profileId := *c.ProcessingProfileID
+		dto.ProcessingProfileID = &profileId
+	}
+	return dto
 }
 
 func (c *Category) toDtoWithImageCount() CategoryDto {
@@ -68,6 +117,15 @@ func (c *Category) updateWithDto(dto CategoryDto) {
 	if dto.Nsfw != nil {
 		c.Nsfw = *dto.Nsfw
 	}
+	if dto.ProcessingProfileID != nil {
+		c.ProcessingProfile = nil
+		if *dto.ProcessingProfileID > 0 {
+			profileId := *dto.ProcessingProfileID
+			c.ProcessingProfileID = &profileId
+		} else {
+			c.ProcessingProfileID = nil
+		}
+	}
 }
 
 func (c *CategoryDto) toModel() Category {
@@ -200,7 +258,10 @@ func getCategoryHtml(c *gin.Context) {
 
 	if err == nil {
 		c.HTML(200, "category.gohtml", gin.H{
-			"category": category.toDtoWithImageCount(),
+			"category":   category.toDtoWithImageCount(),
+			"categories": getAllCategories(),
+			"profiles":   getAllProcessingProfiles(),
+			"reserved":   isReservedCategory(category),
 		})
 	}
 }
@@ -219,16 +280,17 @@ func updateCategoryForm(c *gin.Context) {
 		_, nsfw := c.GetPostFormArray("nsfw")
 
 		dto := CategoryDto{
-			Name:        c.PostForm("name"),
-			DisplayName: c.PostForm("displayName"),
-			Description: c.PostForm("description"),
-			Nsfw:        &nsfw,
-			Show:        &show,
+			Name:                c.PostForm("name"),
+			DisplayName:         c.PostForm("displayName"),
+			Description:         c.PostForm("description"),
+			Nsfw:                &nsfw,
+			Show:                &show,
+			ProcessingProfileID: parseProfileId(c.PostForm("processingProfile")),
 		}
 
 		category.updateWithDto(dto)
 
-		db.Save(&category)
+		db.WithContext(c).Save(&category)
 
 		if isNewCategory {
 			c.Redirect(302, fmt.Sprintf("/categories/%d", category.ID))
@@ -236,7 +298,18 @@ func updateCategoryForm(c *gin.Context) {
 			getCategoryHtml(c)
 		}
 	case "delete":
-		db.Unscoped().Delete(&category)
+		if !hasRole(c, RoleAdmin) {
+			return
+		}
+		options, err := deleteOptionsFromRequest(c)
+		if err == nil {
+			err = trashCategory(c, category, options)
+		}
+		if err != nil {
+			c.Error(err)
+			c.String(deleteErrorStatus(err), "Error deleting category: %v", err)
+			return
+		}
 		c.Redirect(302, "/categories")
 	}
 
@@ -301,7 +374,7 @@ func addCategory(c *gin.Context) {
 
 	category := categoryDto.toModel()
 
-	result := db.Create(&category)
+	result := db.WithContext(c).Create(&category)
 
 	if result.Error != nil {
 		c.String(http.StatusInternalServerError, "Error inserting category: %v", result.Error)
@@ -333,7 +406,7 @@ func updateCategory(c *gin.Context) {
 	}
 
 	category.updateWithDto(categoryDto)
-	res = db.Save(&category)
+	res = db.WithContext(c).Save(&category)
 	if res.Error != nil {
 		c.String(http.StatusInternalServerError, "Error updating category with ID '%s': %v", id, res.Error)
 		return
@@ -348,12 +421,23 @@ func deleteCategory(c *gin.Context) {
 		c.String(http.StatusBadRequest, err.Error())
 	}
 
+	options, err := deleteOptionsFromRequest(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
 	category := Category{}
-	category.ID = id
+	res := db.Limit(1).Find(&category, id)
+	if res.RowsAffected == 0 {
+		c.String(http.StatusNotFound, "Category with ID '%d' not found", id)
+		return
+	}
 
-	res := db.Delete(&category)
-	if res.Error != nil {
-		c.String(http.StatusInternalServerError, "Error updating category with ID '%s': %v", id, res.Error)
+	err = trashCategory(c, &category, options)
+	if err != nil {
+		c.Error(err)
+		c.String(deleteErrorStatus(err), "Error deleting category with ID '%d': %v", id, err)
 		return
 	}
 
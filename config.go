@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pelletier/go-toml/v2"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	AppConfig struct {
+		Env string `yaml:"env" toml:"env"`
+		// LogLevel is the minimum level of logged messages, e.g. "debug" or "info"
+		LogLevel string `yaml:"logLevel" toml:"logLevel"`
+		// GinMode is the mode of the web framework, "debug" logs every route and request
+		GinMode string `yaml:"ginMode" toml:"ginMode"`
+		// RequireSessionSecret refuses to start without SessionSecret instead of generating a random one, which
+		// would log out everyone on every restart
+		RequireSessionSecret bool   `yaml:"requireSessionSecret" toml:"requireSessionSecret"`
+		ExportDir            string `yaml:"exportDir" toml:"exportDir"`
+		DataDir              string `yaml:"dataDir" toml:"dataDir"`
+		ProcessedDir         string `yaml:"processedDir" toml:"processedDir"`
+		IconDir              string `yaml:"iconDir" toml:"iconDir"`
+		OriginalDir          string `yaml:"originalDir" toml:"originalDir"`
+		ImportDir            string `yaml:"importDir" toml:"importDir"`
+		DbLocation           string `yaml:"dbLocation" toml:"dbLocation"`
+		AccountsFile         string `yaml:"accountsFile" toml:"accountsFile"`
+		SessionSecret        string `yaml:"sessionSecret" toml:"sessionSecret"`
+		SessionDuration      string `yaml:"sessionDuration" toml:"sessionDuration"`
+		JobWorkers           int    `yaml:"jobWorkers" toml:"jobWorkers"`
+		// ProcessingWorkers limits the libvips pipelines running at the same time across all jobs and requests
+		ProcessingWorkers  int    `yaml:"processingWorkers" toml:"processingWorkers"`
+		ProcessingMemoryMB int    `yaml:"processingMemoryMB" toml:"processingMemoryMB"`
+		Port               uint16 `yaml:"port" toml:"port"`
+		// TrashDir keeps the originals of deleted images until they are restored or purged
+		TrashDir string `yaml:"trashDir" toml:"trashDir"`
+		// TrashRetention is how long deleted items are kept before they are purged, 0 keeps them forever
+		TrashRetention string `yaml:"trashRetention" toml:"trashRetention"`
+		// VersionDir keeps the previous originals of images, that have been replaced by an upload
+		VersionDir string `yaml:"versionDir" toml:"versionDir"`
+		// ObjectDir keeps the content of the files in all other directories, which only reference it by its hash
+		ObjectDir string `yaml:"objectDir" toml:"objectDir"`
+		// OriginalVersions is the number of previous originals kept per image, 0 keeps all of them
+		OriginalVersions int `yaml:"originalVersions" toml:"originalVersions"`
+		// OriginalVersionRetention is how long previous originals are kept, 0 keeps them forever
+		OriginalVersionRetention string `yaml:"originalVersionRetention" toml:"originalVersionRetention"`
+		// Storage is "local" to keep originals, variants and icons in the configured directories, or "s3" to keep them
+		// in an S3 compatible object storage
+		Storage string   `yaml:"storage" toml:"storage"`
+		S3      S3Config `yaml:"s3" toml:"s3"`
+		// ExportTarget is "directory" to only write the export to ExportDir, "archive" to download it from /export as
+		// well, or "git" to commit it to the Git working tree ExportDir is part of
+		ExportTarget        string `yaml:"exportTarget" toml:"exportTarget"`
+		ExportArchiveFormat string `yaml:"exportArchiveFormat" toml:"exportArchiveFormat"`
+		ExportGitName       string `yaml:"exportGitName" toml:"exportGitName"`
+		ExportGitEmail      string `yaml:"exportGitEmail" toml:"exportGitEmail"`
+
+		logLevel                 zapcore.Level
+		sessionLifetime          time.Duration
+		trashRetention           time.Duration
+		originalVersionRetention time.Duration
+	}
+
+	// configOption maps a single option of AppConfig to its environment variable and command line flag
+	configOption struct {
+		Env         string
+		Flag        string
+		Description string
+		Set         func(value string) error
+	}
+)
+
+const (
+	envPrefix         = "APP_"
+	envDevelopment    = "development"
+	envProduction     = "production"
+	defaultConfigFile = "data/config.yml"
+)
+
+var (
+	// Default values for each environment profile. Directories that are left empty are derived from DataDir.
+	profileDefaults = map[string]AppConfig{
+		envDevelopment: {
+			LogLevel:                 "debug",
+			GinMode:                  gin.DebugMode,
+			RequireSessionSecret:     false,
+			DataDir:                  "data/",
+			SessionDuration:          "168h",
+			JobWorkers:               2,
+			ProcessingWorkers:        2,
+			ProcessingMemoryMB:       512,
+			Port:                     3000,
+			TrashRetention:           "720h",
+			OriginalVersions:         10,
+			OriginalVersionRetention: "0",
+			Storage:                  storageLocal,
+			ExportTarget:             exportTargetDirectory,
+			ExportArchiveFormat:      exportArchiveTarGz,
+			ExportGitName:            "Gallery Image Manager",
+			ExportGitEmail:           "image-manager@localhost",
+		},
+		envProduction: {
+			LogLevel:                 "info",
+			GinMode:                  gin.ReleaseMode,
+			RequireSessionSecret:     true,
+			DataDir:                  "data/",
+			SessionDuration:          "24h",
+			JobWorkers:               2,
+			ProcessingWorkers:        2,
+			ProcessingMemoryMB:       512,
+			Port:                     3000,
+			TrashRetention:           "720h",
+			OriginalVersions:         10,
+			OriginalVersionRetention: "0",
+			Storage:                  storageLocal,
+			ExportTarget:             exportTargetDirectory,
+			ExportArchiveFormat:      exportArchiveTarGz,
+			ExportGitName:            "Gallery Image Manager",
+			ExportGitEmail:           "image-manager@localhost",
+		},
+	}
+	// Aliases for the environment profile names, "prod" is used by the Makefile as well
+	envAliases = map[string]string{
+		"dev":  envDevelopment,
+		"prod": envProduction,
+	}
+)
+
+func stringOption(target *string) func(string) error {
+	return func(value string) error {
+		*target = value
+		return nil
+	}
+}
+
+func intOption(target *int) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+		return nil
+	}
+}
+
+func boolOption(target *bool) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*target = parsed
+		return nil
+	}
+}
+
+func portOption(target *uint16) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		*target = uint16(parsed)
+		return nil
+	}
+}
+
+func (config *AppConfig) options() []configOption {
+	return []configOption{
+		{Env: "LOG_LEVEL", Flag: "log-level", Description: "minimum level of logged messages, e.g. debug, info or warn", Set: stringOption(&config.LogLevel)},
+		{Env: "GIN_MODE", Flag: "gin-mode", Description: "mode of the web framework, either \"debug\" or \"release\"", Set: stringOption(&config.GinMode)},
+		{Env: "REQUIRE_SESSION_SECRET", Flag: "require-session-secret", Description: "refuse to start without a session secret", Set: boolOption(&config.RequireSessionSecret)},
+		{Env: "PORT", Flag: "port", Description: "port the web server listens on", Set: portOption(&config.Port)},
+		{Env: "DATA_DIR", Flag: "data-dir", Description: "base directory for application data", Set: stringOption(&config.DataDir)},
+		{Env: "EXPORT_DIR", Flag: "export-dir", Description: "directory the gallery export is written to", Set: stringOption(&config.ExportDir)},
+		{Env: "PROCESSED_DIR", Flag: "processed-dir", Description: "directory for processed image variants", Set: stringOption(&config.ProcessedDir)},
+		{Env: "ICON_DIR", Flag: "icon-dir", Description: "directory for processed icons", Set: stringOption(&config.IconDir)},
+		{Env: "ORIGINAL_DIR", Flag: "original-dir", Description: "directory for original image files", Set: stringOption(&config.OriginalDir)},
+		{Env: "IMPORT_DIR", Flag: "import-dir", Description: "gallery library to import from", Set: stringOption(&config.ImportDir)},
+		{Env: "DB_LOCATION", Flag: "db", Description: "location of the SQLite database", Set: stringOption(&config.DbLocation)},
+		{Env: "ACCOUNTS_FILE", Flag: "accounts-file", Description: "location of the accounts file", Set: stringOption(&config.AccountsFile)},
+		{Env: "SESSION_SECRET", Flag: "session-secret", Description: "secret used to sign session tokens", Set: stringOption(&config.SessionSecret)},
+		{Env: "SESSION_DURATION", Flag: "session-duration", Description: "lifetime of issued session tokens, e.g. 12h", Set: stringOption(&config.SessionDuration)},
+		{Env: "JOB_WORKERS", Flag: "job-workers", Description: "number of background jobs running in parallel", Set: intOption(&config.JobWorkers)},
+		{Env: "PROCESSING_WORKERS", Flag: "processing-workers", Description: "number of image processing pipelines running in parallel", Set: intOption(&config.ProcessingWorkers)},
+		{Env: "PROCESSING_MEMORY_MB", Flag: "processing-memory-mb", Description: "estimated memory image processing may use in MB, 0 disables the limit", Set: intOption(&config.ProcessingMemoryMB)},
+		{Env: "TRASH_DIR", Flag: "trash-dir", Description: "directory for originals of deleted images", Set: stringOption(&config.TrashDir)},
+		{Env: "TRASH_RETENTION", Flag: "trash-retention", Description: "how long deleted items are kept in the trash, e.g. 720h, 0 keeps them forever", Set: stringOption(&config.TrashRetention)},
+		{Env: "VERSION_DIR", Flag: "version-dir", Description: "directory for previous originals of images", Set: stringOption(&config.VersionDir)},
+		{Env: "OBJECT_DIR", Flag: "object-dir", Description: "directory for the content of all stored files, addressed by its hash", Set: stringOption(&config.ObjectDir)},
+		{Env: "ORIGINAL_VERSIONS", Flag: "original-versions", Description: "number of previous originals kept per image, 0 keeps all of them", Set: intOption(&config.OriginalVersions)},
+		{Env: "ORIGINAL_VERSION_RETENTION", Flag: "original-version-retention", Description: "how long previous originals are kept, e.g. 2160h, 0 keeps them forever", Set: stringOption(&config.OriginalVersionRetention)},
+		{Env: "STORAGE", Flag: "storage", Description: "where originals, variants and icons are stored, either \"local\" or \"s3\"", Set: stringOption(&config.Storage)},
+		{Env: "S3_ENDPOINT", Flag: "s3-endpoint", Description: "endpoint of the S3 compatible storage, e.g. http://localhost:9000", Set: stringOption(&config.S3.Endpoint)},
+		{Env: "S3_REGION", Flag: "s3-region", Description: "region of the S3 bucket", Set: stringOption(&config.S3.Region)},
+		{Env: "S3_BUCKET", Flag: "s3-bucket", Description: "bucket the files are stored in", Set: stringOption(&config.S3.Bucket)},
+		{Env: "S3_ACCESS_KEY", Flag: "s3-access-key", Description: "access key of the S3 storage", Set: stringOption(&config.S3.AccessKey)},
+		{Env: "S3_SECRET_KEY", Flag: "s3-secret-key", Description: "secret key of the S3 storage", Set: stringOption(&config.S3.SecretKey)},
+		{Env: "EXPORT_TARGET", Flag: "export-target", Description: "where the export goes, either \"directory\", \"archive\" or \"git\"", Set: stringOption(&config.ExportTarget)},
+		{Env: "EXPORT_ARCHIVE_FORMAT", Flag: "export-archive-format", Description: "format of the export archive, either \"tar.gz\" or \"zip\"", Set: stringOption(&config.ExportArchiveFormat)},
+		{Env: "EXPORT_GIT_NAME", Flag: "export-git-name", Description: "author name of the export commits", Set: stringOption(&config.ExportGitName)},
+		{Env: "EXPORT_GIT_EMAIL", Flag: "export-git-email", Description: "author email of the export commits", Set: stringOption(&config.ExportGitEmail)},
+		{Env: "S3_PUBLIC_URL", Flag: "s3-public-url", Description: "public URL of the bucket, files are redirected to it instead of being proxied", Set: stringOption(&config.S3.PublicUrl)},
+	}
+}
+
+func (config *AppConfig) IsProduction() bool {
+	return config.Env == envProduction
+}
+
+func (config *AppConfig) MinLogLevel() zapcore.Level {
+	return config.logLevel
+}
+
+func (config *AppConfig) SessionLifetime() time.Duration {
+	return config.sessionLifetime
+}
+
+func (config *AppConfig) TrashRetentionPeriod() time.Duration {
+	return config.trashRetention
+}
+
+func (config *AppConfig) OriginalVersionRetentionPeriod() time.Duration {
+	return config.originalVersionRetention
+}
+
+func normalizeEnv(env string) (string, error) {
+	env = strings.ToLower(strings.TrimSpace(env))
+	if len(env) == 0 {
+		return envDevelopment, nil
+	}
+	if alias, found := envAliases[env]; found {
+		env = alias
+	}
+	if _, found := profileDefaults[env]; !found {
+		return "", fmt.Errorf("unknown environment profile \"%s\"", env)
+	}
+	return env, nil
+}
+
+// loadConfig builds the AppConfig from (in ascending order of precedence) the environment profile defaults,
+// the config file, APP_* environment variables and the command line flags. Arguments left after the flags are
+// returned as well, they select a command to run instead of the web server.
+func loadConfig(args []string) (*AppConfig, []string, error) {
+	flags := flag.NewFlagSet(path.Base(os.Args[0]), flag.ContinueOnError)
+	configFile := flags.String("config", "", "location of the YAML or TOML config file (env: APP_CONFIG_FILE)")
+	flagEnv := flags.String("env", "", "environment profile, development or production (env: APP_ENV)")
+	flagValues := map[string]*string{}
+	for _, option := range (&AppConfig{}).options() {
+		flagValues[option.Flag] = flags.String(option.Flag, "", fmt.Sprintf("%s (env: %s%s)", option.Description, envPrefix, option.Env))
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	setFlags := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	configFileExplicit := true
+	if !setFlags["config"] {
+		*configFile = os.Getenv(envPrefix + "CONFIG_FILE")
+	}
+	if len(*configFile) == 0 {
+		*configFile = defaultConfigFile
+		configFileExplicit = false
+	}
+
+	configData, err := os.ReadFile(*configFile)
+	if err != nil {
+		if configFileExplicit || !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, fmt.Errorf("could not read config file \"%s\": %w", *configFile, err)
+		}
+		configData = nil
+	}
+
+	// The profile is resolved before the defaults are chosen. The flag wins over the env var, which wins over the
+	// config file.
+	fileEnv := struct {
+		Env string `yaml:"env" toml:"env"`
+	}{}
+	if configData != nil {
+		err = decodeConfig(*configFile, configData, &fileEnv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read config file \"%s\": %w", *configFile, err)
+		}
+	}
+	env := *flagEnv
+	if !setFlags["env"] {
+		env = os.Getenv(envPrefix + "ENV")
+	}
+	if len(strings.TrimSpace(env)) == 0 {
+		env = fileEnv.Env
+	}
+	env, err = normalizeEnv(env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := profileDefaults[env]
+	if configData != nil {
+		err = decodeConfig(*configFile, configData, &config)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read config file \"%s\": %w", *configFile, err)
+		}
+	}
+	config.Env = env
+
+	configOptions := config.options()
+	for _, option := range configOptions {
+		if value, found := os.LookupEnv(envPrefix + option.Env); found {
+			if err := option.Set(value); err != nil {
+				return nil, nil, fmt.Errorf("invalid value \"%s\" for %s%s: %w", value, envPrefix, option.Env, err)
+			}
+		}
+	}
+
+	for _, option := range configOptions {
+		if !setFlags[option.Flag] {
+			continue
+		}
+		value := *flagValues[option.Flag]
+		if err := option.Set(value); err != nil {
+			return nil, nil, fmt.Errorf("invalid value \"%s\" for -%s: %w", value, option.Flag, err)
+		}
+	}
+
+	config.applyDerivedDefaults()
+	return &config, flags.Args(), config.validate()
+}
+
+// decodeConfig reads TOML if the file has a .toml extension and YAML otherwise
+func decodeConfig(fileName string, data []byte, target any) error {
+	if strings.EqualFold(path.Ext(fileName), ".toml") {
+		return toml.Unmarshal(data, target)
+	}
+	return yaml.Unmarshal(data, target)
+}
+
+// applyDerivedDefaults fills all locations that haven't been configured explicitly with a location inside DataDir
+func (config *AppConfig) applyDerivedDefaults() {
+	derived := []struct {
+		value *string
+		name  string
+	}{
+		{&config.ExportDir, "export"},
+		{&config.ProcessedDir, "images/processed"},
+		{&config.OriginalDir, "images/originals"},
+		{&config.IconDir, "icons"},
+		{&config.TrashDir, "trash"},
+		{&config.VersionDir, "images/versions"},
+		{&config.ObjectDir, "objects"},
+		{&config.DbLocation, "image-manager.db"},
+		{&config.AccountsFile, "accounts.json"},
+	}
+
+	for _, d := range derived {
+		if len(*d.value) == 0 {
+			*d.value = path.Join(config.DataDir, d.name)
+		}
+	}
+}
+
+func (config *AppConfig) validate() error {
+	if len(config.DataDir) == 0 {
+		return errors.New("no data directory configured")
+	}
+	if config.Port == 0 {
+		return errors.New("no port configured")
+	}
+
+	logLevel, err := zapcore.ParseLevel(config.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log level \"%s\"", config.LogLevel)
+	}
+	config.logLevel = logLevel
+	if !slices.Contains([]string{gin.DebugMode, gin.ReleaseMode, gin.TestMode}, config.GinMode) {
+		return fmt.Errorf("unknown gin mode \"%s\", expected \"%s\" or \"%s\"", config.GinMode, gin.DebugMode, gin.ReleaseMode)
+	}
+	if config.RequireSessionSecret && len(config.SessionSecret) == 0 {
+		return fmt.Errorf("the %s profile requires a session secret, set %sSESSION_SECRET or disable requireSessionSecret",
+			config.Env, envPrefix)
+	}
+
+	if config.JobWorkers < 1 {
+		return fmt.Errorf("at least one job worker is required, got %d", config.JobWorkers)
+	}
+	if config.ProcessingWorkers < 1 {
+		return fmt.Errorf("at least one processing worker is required, got %d", config.ProcessingWorkers)
+	}
+	if config.ProcessingMemoryMB < 0 {
+		return fmt.Errorf("processing memory limit must not be negative, got %d", config.ProcessingMemoryMB)
+	}
+
+	sessionLifetime, err := time.ParseDuration(config.SessionDuration)
+	if err != nil || sessionLifetime <= 0 {
+		return fmt.Errorf("invalid session duration \"%s\"", config.SessionDuration)
+	}
+	config.sessionLifetime = sessionLifetime
+
+	trashRetention, err := time.ParseDuration(config.TrashRetention)
+	if err != nil || trashRetention < 0 {
+		return fmt.Errorf("invalid trash retention \"%s\"", config.TrashRetention)
+	}
+	config.trashRetention = trashRetention
+
+	if config.OriginalVersions < 0 {
+		return fmt.Errorf("number of kept original versions must not be negative, got %d", config.OriginalVersions)
+	}
+	originalVersionRetention, err := time.ParseDuration(config.OriginalVersionRetention)
+	if err != nil || originalVersionRetention < 0 {
+		return fmt.Errorf("invalid original version retention \"%s\"", config.OriginalVersionRetention)
+	}
+	config.originalVersionRetention = originalVersionRetention
+
+	switch config.Storage {
+	case storageLocal:
+	case storageS3:
+		if err := config.S3.validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown storage \"%s\", expected \"%s\" or \"%s\"", config.Storage, storageLocal, storageS3)
+	}
+
+	if !slices.Contains(exportArchiveFormats, config.ExportArchiveFormat) {
+		return fmt.Errorf("unknown export archive format \"%s\", expected one of %s", config.ExportArchiveFormat,
+			strings.Join(exportArchiveFormats, ", "))
+	}
+	switch config.ExportTarget {
+	case exportTargetDirectory, exportTargetArchive:
+	case exportTargetGit:
+		if _, err := exec.LookPath("git"); err != nil {
+			return fmt.Errorf("the git export target needs git: %w", err)
+		}
+		if len(config.ExportGitName) == 0 || len(config.ExportGitEmail) == 0 {
+			return errors.New("the git export target needs an author name and email")
+		}
+	default:
+		return fmt.Errorf("unknown export target \"%s\", expected \"%s\", \"%s\" or \"%s\"", config.ExportTarget,
+			exportTargetDirectory, exportTargetArchive, exportTargetGit)
+	}
+
+	writableDirs := []string{
+		config.DataDir,
+		config.ExportDir,
+		path.Dir(config.DbLocation),
+	}
+	// The files are kept in the bucket when the object storage is used
+	if config.Storage == storageLocal {
+		writableDirs = append(writableDirs,
+			config.ProcessedDir,
+			config.OriginalDir,
+			config.IconDir,
+			config.TrashDir,
+			config.VersionDir,
+			config.ObjectDir,
+		)
+	}
+
+	errs := make([]error, 0)
+	for _, dir := range writableDirs {
+		if err := ensureWritableDir(dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(config.ImportDir) > 0 {
+		if info, err := os.Stat(config.ImportDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("import directory \"%s\" is not a readable directory", config.ImportDir))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ensureWritableDir creates the directory if necessary and checks whether files can be created inside it
+func ensureWritableDir(dir string) error {
+	err := createDirIfNotExists(dir)
+	if err != nil {
+		return fmt.Errorf("could not create directory \"%s\": %w", dir, err)
+	}
+
+	probe, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return fmt.Errorf("directory \"%s\" is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearAppEnv removes all APP_* variables of the environment the tests run in for the duration of the test
+func clearAppEnv(t *testing.T) {
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		os.Unsetenv(name)
+		t.Cleanup(func() {
+			os.Setenv(name, value)
+		})
+	}
+}
+
+func setTestEnv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		t.Setenv(envPrefix+name, value)
+	}
+}
+
+func writeTestConfig(t *testing.T, name string, content string) string {
+	location := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(location, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dataDir := t.TempDir()
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		port uint16
+		// profile is the selected environment profile, its session duration tells whose defaults were used
+		profile         string
+		sessionDuration string
+	}{
+		{
+			name:            "profile defaults",
+			port:            3000,
+			profile:         envDevelopment,
+			sessionDuration: "168h",
+		},
+		{
+			name:            "config file over defaults",
+			file:            "port: 4000\nenv: production\nsessionSecret: secret\n",
+			port:            4000,
+			profile:         envProduction,
+			sessionDuration: "24h",
+		},
+		{
+			name:            "env var over config file",
+			file:            "port: 4000\nenv: production\nsessionDuration: 1h\n",
+			env:             map[string]string{"PORT": "5000", "ENV": "dev"},
+			port:            5000,
+			profile:         envDevelopment,
+			sessionDuration: "1h",
+		},
+		{
+			name:            "flag over env var",
+			file:            "port: 4000\nsessionSecret: secret\n",
+			env:             map[string]string{"PORT": "5000", "ENV": "development"},
+			args:            []string{"-port", "6000", "-env", "prod"},
+			port:            6000,
+			profile:         envProduction,
+			sessionDuration: "24h",
+		},
+		{
+			name:            "empty env var falls back to the config file",
+			file:            "env: production\nsessionSecret: secret\n",
+			env:             map[string]string{"ENV": " "},
+			port:            3000,
+			profile:         envProduction,
+			sessionDuration: "24h",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearAppEnv(t)
+			setTestEnv(t, test.env)
+			t.Setenv(envPrefix+"DATA_DIR", dataDir)
+			args := append([]string{"-config", writeTestConfig(t, "config.yml", test.file)}, test.args...)
+
+			config, _, err := loadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Port != test.port || config.Env != test.profile || config.SessionDuration != test.sessionDuration {
+				t.Errorf("got port %d, profile %s and session duration %s", config.Port, config.Env, config.SessionDuration)
+			}
+		})
+	}
+}
+
+func TestLoadConfigProfiles(t *testing.T) {
+	clearAppEnv(t)
+	t.Setenv(envPrefix+"CONFIG_FILE", writeTestConfig(t, "config.yml", ""))
+	t.Setenv(envPrefix+"DATA_DIR", t.TempDir())
+
+	development, _, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if development.MinLogLevel() != zapcore.DebugLevel || development.GinMode != gin.DebugMode || development.RequireSessionSecret {
+		t.Errorf("unexpected development profile %+v", development)
+	}
+
+	t.Setenv(envPrefix+"ENV", envProduction)
+	if _, _, err := loadConfig(nil); err == nil || !strings.Contains(err.Error(), "requires a session secret") {
+		t.Errorf("production profile without session secret returned %v", err)
+	}
+
+	t.Setenv(envPrefix+"SESSION_SECRET", "secret")
+	production, _, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if production.MinLogLevel() != zapcore.InfoLevel || production.GinMode != gin.ReleaseMode || !production.RequireSessionSecret {
+		t.Errorf("unexpected production profile %+v", production)
+	}
+}
+
+func TestLoadConfigToml(t *testing.T) {
+	clearAppEnv(t)
+	dataDir := t.TempDir()
+	file := writeTestConfig(t, "config.toml", `
+env = "production"
+dataDir = "`+filepath.ToSlash(dataDir)+`"
+port = 4000
+sessionSecret = "secret"
+trashRetention = "48h"
+logLevel = "warn"
+
+[s3]
+endpoint = "http://localhost:9000"
+bucket = "gallery"
+publicUrl = "http://localhost:9000/gallery"
+`)
+
+	config, args, err := loadConfig([]string{"-config", file, "users", "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Env != envProduction || config.Port != 4000 || config.TrashRetentionPeriod() != 48*time.Hour ||
+		config.MinLogLevel() != zapcore.WarnLevel {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.S3.Bucket != "gallery" || config.S3.PublicUrl != "http://localhost:9000/gallery" {
+		t.Errorf("unexpected s3 config %+v", config.S3)
+	}
+	if config.OriginalDir != filepath.ToSlash(filepath.Join(dataDir, "images/originals")) {
+		t.Errorf("original dir %s isn't derived from the data dir", config.OriginalDir)
+	}
+	if strings.Join(args, " ") != "users list" {
+		t.Errorf("got command arguments %v", args)
+	}
+
+	invalid := writeTestConfig(t, "invalid.toml", "port = \"many\"\n")
+	if _, _, err := loadConfig([]string{"-config", invalid}); err == nil {
+		t.Error("invalid TOML config was accepted")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{"missing explicit config file", nil, []string{"-config", "/nonexistent/config.yml"}},
+		{"unknown profile", map[string]string{"ENV": "staging"}, nil},
+		{"invalid env var", map[string]string{"PORT": "http"}, nil},
+		{"invalid flag", nil, []string{"-job-workers", "many"}},
+		{"unknown flag", nil, []string{"-colour"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearAppEnv(t)
+			setTestEnv(t, test.env)
+			t.Setenv(envPrefix+"DATA_DIR", t.TempDir())
+			t.Setenv(envPrefix+"CONFIG_FILE", writeTestConfig(t, "config.yml", ""))
+			if _, _, err := loadConfig(test.args); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAppConfigValidate(t *testing.T) {
+	blockingFile := writeTestConfig(t, "file", "")
+	tests := []struct {
+		name   string
+		change func(config *AppConfig)
+		err    string
+	}{
+		{"no port", func(c *AppConfig) { c.Port = 0 }, "no port configured"},
+		{"log level", func(c *AppConfig) { c.LogLevel = "verbose" }, "invalid log level"},
+		{"gin mode", func(c *AppConfig) { c.GinMode = "fast" }, "unknown gin mode"},
+		{"required session secret", func(c *AppConfig) { c.RequireSessionSecret = true }, "requires a session secret"},
+		{"job workers", func(c *AppConfig) { c.JobWorkers = 0 }, "at least one job worker"},
+		{"processing memory", func(c *AppConfig) { c.ProcessingMemoryMB = -1 }, "must not be negative"},
+		{"session duration", func(c *AppConfig) { c.SessionDuration = "-1h" }, "invalid session duration"},
+		{"trash retention", func(c *AppConfig) { c.TrashRetention = "a month" }, "invalid trash retention"},
+		{"storage", func(c *AppConfig) { c.Storage = "ftp" }, "unknown storage"},
+		{"s3 without bucket", func(c *AppConfig) {
+			c.Storage = storageS3
+			c.S3 = S3Config{Endpoint: "http://localhost:9000", AccessKey: "a", SecretKey: "s"}
+		}, "needs bucket"},
+		{"export target", func(c *AppConfig) { c.ExportTarget = "ftp" }, "unknown export target"},
+		{"archive format", func(c *AppConfig) { c.ExportArchiveFormat = "rar" }, "unknown export archive format"},
+		{"unwritable directory", func(c *AppConfig) { c.OriginalDir = filepath.Join(blockingFile, "originals") }, "could not create directory"},
+		{"missing import directory", func(c *AppConfig) { c.ImportDir = filepath.Join(t.TempDir(), "missing") }, "is not a readable directory"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := profileDefaults[envDevelopment]
+			config.DataDir = t.TempDir()
+			config.applyDerivedDefaults()
+			if err := config.validate(); err != nil {
+				t.Fatalf("defaults are invalid: %v", err)
+			}
+
+			test.change(&config)
+			err := config.validate()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
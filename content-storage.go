@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+type (
+	// ContentStorage keeps the content of its files in a blob storage, addressed by the hash of the content, and only a
+	// small reference to the blob under the key of the file. Files with the same content share a blob, e.g. an
+	// original that is moved into the trash or kept as previous version. Deleting a file only deletes its reference,
+	// blobs that aren't referenced by any file anymore are deleted by collectBlobs.
+	ContentStorage struct {
+		refs  Storage
+		blobs Storage
+	}
+
+	// contentRef is stored under the key of a file and points to the blob with its content
+	contentRef struct {
+		Blob string `json:"blob"`
+		Size int64  `json:"size"`
+	}
+)
+
+const (
+	// contentRefMaxSize is larger than any encoded contentRef, larger files are always content stored before the
+	// storage was content addressed
+	contentRefMaxSize = 256
+	// contentMigratedKey marks a storage whose files have all been moved into blobs
+	contentMigratedKey = ".content-addressed"
+
+	// blobGracePeriod protects blobs that were written but aren't referenced yet from being collected
+	blobGracePeriod    = time.Hour
+	blobSweepInterval  = 6 * time.Hour
+	blobKeyPrefixChars = 2
+)
+
+var (
+	// contentStorages share the blob storage, a blob is only collected if none of them references it
+	contentStorages []*ContentStorage
+
+	blobKeyRegex = regexp.MustCompile(`^([0-9a-f]{2})/([0-9a-f]{64})(\.[0-9a-z]+)?$`)
+)
+
+func newContentStorage(refs Storage, blobs Storage) *ContentStorage {
+	return &ContentStorage{refs: refs, blobs: blobs}
+}
+
+// blobKey returns the key of the content, the extension of the file is kept so the content type of a blob is known
+func blobKey(data []byte, key string) string {
+	hash := sha256.Sum256(data)
+	encoded := hex.EncodeToString(hash[:])
+	return encoded[:blobKeyPrefixChars] + "/" + encoded + strings.ToLower(path.Ext(key))
+}
+
+func isBlobKey(key string) bool {
+	match := blobKeyRegex.FindStringSubmatch(key)
+	return match != nil && strings.HasPrefix(match[2], match[1])
+}
+
+// parseContentRef decodes the reference, ok is false for files that were stored before the storage was content
+// addressed
+func parseContentRef(data []byte) (contentRef, bool) {
+	ref := contentRef{}
+	if len(data) > contentRefMaxSize || json.Unmarshal(data, &ref) != nil || !isBlobKey(ref.Blob) {
+		return contentRef{}, false
+	}
+	return ref, true
+}
+
+// readRef loads the reference of the file. Files stored before the storage was content addressed are returned as
+// legacy content instead.
+func (s *ContentStorage) readRef(ctx context.Context, key string) (contentRef, []byte, error) {
+	data, err := s.refs.Get(ctx, key)
+	if err != nil {
+		return contentRef{}, nil, err
+	}
+	ref, ok := parseContentRef(data)
+	if !ok {
+		return contentRef{}, data, nil
+	}
+	return ref, nil, nil
+}
+
+// putBlob writes the content unless a blob with the same content exists. Existing blobs that might be unreferenced
+// are written again, so they aren't collected before the reference to them is written.
+func (s *ContentStorage) putBlob(ctx context.Context, key string, data []byte) (string, error) {
+	blob := blobKey(data, key)
+	object, err := s.blobs.Stat(ctx, blob)
+	if err == nil && object.Size == int64(len(data)) && time.Since(object.Modified) < blobGracePeriod/2 {
+		return blob, nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	return blob, s.blobs.Put(ctx, blob, data)
+}
+
+func (s *ContentStorage) Put(ctx context.Context, key string, data []byte) error {
+	blob, err := s.putBlob(ctx, key, data)
+	if err != nil {
+		return err
+	}
+	ref, err := json.Marshal(contentRef{Blob: blob, Size: int64(len(data))})
+	if err != nil {
+		return err
+	}
+	return s.refs.Put(ctx, key, ref)
+}
+
+func (s *ContentStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	ref, legacy, err := s.readRef(ctx, key)
+	if err != nil || legacy != nil {
+		return legacy, err
+	}
+	data, err := s.blobs.Get(ctx, ref.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("content of %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// Delete only deletes the reference, the blob is collected once no file references it anymore
+func (s *ContentStorage) Delete(ctx context.Context, key string) error {
+	return s.refs.Delete(ctx, key)
+}
+
+// List reads the references of the files to report the size of their content
+func (s *ContentStorage) List(ctx context.Context, prefix string) ([]StorageObject, error) {
+	refObjects, err := s.refs.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]StorageObject, 0, len(refObjects))
+	for _, object := range refObjects {
+		if object.Key == contentMigratedKey {
+			continue
+		}
+		if object.Size <= contentRefMaxSize {
+			ref, _, err := s.readRef(ctx, object.Key)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if len(ref.Blob) > 0 {
+				object.Size = ref.Size
+			}
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (s *ContentStorage) Stat(ctx context.Context, key string) (StorageObject, error) {
+	object, err := s.refs.Stat(ctx, key)
+	if err != nil || object.Size > contentRefMaxSize {
+		return object, err
+	}
+	ref, _, err := s.readRef(ctx, key)
+	if err != nil || len(ref.Blob) == 0 {
+		return object, err
+	}
+	_, err = s.blobs.Stat(ctx, ref.Blob)
+	if err != nil {
+		return StorageObject{}, fmt.Errorf("content of %s: %w", key, err)
+	}
+	object.Size = ref.Size
+	return object, nil
+}
+
+// PublicURL returns the public URL of the blob, if the blob storage has one
+func (s *ContentStorage) PublicURL(key string) (string, bool) {
+	redirector, ok := s.blobs.(storageRedirector)
+	if !ok {
+		return "", false
+	}
+	ref, legacy, err := s.readRef(context.Background(), key)
+	if err != nil || legacy != nil {
+		return "", false
+	}
+	return redirector.PublicURL(ref.Blob)
+}
+
+// localPath returns the location of the content on the local file system, if the blobs are stored there
+func (s *ContentStorage) localPath(ctx context.Context, key string) (string, bool) {
+	local, ok := s.blobs.(*LocalStorage)
+	if !ok {
+		return "", false
+	}
+	ref, legacy, err := s.readRef(ctx, key)
+	if err != nil || legacy != nil {
+		return "", false
+	}
+	location, err := local.path(ref.Blob)
+	return location, err == nil
+}
+
+// moveRef moves the file to another storage with the same blobs, only the reference has to be moved. ok is false if
+// the file has to be copied instead.
+func (s *ContentStorage) moveRef(ctx context.Context, sourceKey string, destination *ContentStorage, destinationKey string) (bool, error) {
+	if s.blobs != destination.blobs {
+		return false, nil
+	}
+	data, err := s.refs.Get(ctx, sourceKey)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := parseContentRef(data); !ok {
+		return false, nil
+	}
+	err = destination.refs.Put(ctx, destinationKey, data)
+	if err != nil {
+		return false, err
+	}
+	return true, s.refs.Delete(ctx, sourceKey)
+}
+
+// migrate moves the files stored before the storage was content addressed into blobs
+func (s *ContentStorage) migrate(ctx context.Context) (int, error) {
+	if _, err := s.refs.Stat(ctx, contentMigratedKey); err == nil {
+		return 0, nil
+	}
+	objects, err := s.refs.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, object := range objects {
+		if object.Key == contentMigratedKey {
+			continue
+		}
+		_, legacy, err := s.readRef(ctx, object.Key)
+		if err != nil {
+			return migrated, err
+		}
+		if legacy == nil {
+			continue
+		}
+		err = s.Put(ctx, object.Key, legacy)
+		if err != nil {
+			return migrated, fmt.Errorf("could not migrate %s: %w", object.Key, err)
+		}
+		migrated++
+	}
+	return migrated, s.refs.Put(ctx, contentMigratedKey, []byte(time.Now().Format(time.RFC3339)))
+}
+
+// referencedBlobs reads the references of all storages that keep their content in the blobs
+func referencedBlobs(ctx context.Context, blobs Storage, storages []*ContentStorage) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for _, storage := range storages {
+		if storage.blobs != blobs {
+			continue
+		}
+		objects, err := storage.refs.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			if object.Size > contentRefMaxSize {
+				continue
+			}
+			ref, _, err := storage.readRef(ctx, object.Key)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			referenced[ref.Blob] = true
+		}
+	}
+	return referenced, nil
+}
+
+// collectBlobs deletes the blobs that aren't referenced by any of the storages and are older than the grace period.
+// The references are read twice, a file that is moved to another storage while the references are read is only
+// missed by one of the reads.
+func collectBlobs(ctx context.Context, blobs Storage, storages []*ContentStorage) (int, error) {
+	// Blobs are listed first, so blobs referenced after the references have been read are younger than the grace period
+	objects, err := blobs.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	unreferenced := make([]string, 0)
+	for pass := 0; pass < 2; pass++ {
+		referenced, err := referencedBlobs(ctx, blobs, storages)
+		if err != nil {
+			return 0, err
+		}
+		if pass == 0 {
+			for _, object := range objects {
+				if isBlobKey(object.Key) && !referenced[object.Key] && time.Since(object.Modified) >= blobGracePeriod {
+					unreferenced = append(unreferenced, object.Key)
+				}
+			}
+		} else {
+			unreferenced = slices.DeleteFunc(unreferenced, func(blob string) bool {
+				return referenced[blob]
+			})
+		}
+		if len(unreferenced) == 0 {
+			return 0, nil
+		}
+	}
+
+	for i, blob := range unreferenced {
+		err = blobs.Delete(ctx, blob)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(unreferenced), nil
+}
+
+// migrateContentStorages moves the files of all storages that were stored before they were content addressed
+func migrateContentStorages(ctx context.Context) error {
+	for _, storage := range contentStorages {
+		migrated, err := storage.migrate(ctx)
+		if err != nil {
+			return err
+		}
+		if migrated > 0 {
+			logger.Infof("Moved %d files into the content addressed storage", migrated)
+		}
+	}
+	return nil
+}
+
+func setupBlobSweep() {
+	go sweepBlobs()
+}
+
+// sweepBlobs regularly deletes the blobs of deleted files
+func sweepBlobs() {
+	ticker := time.NewTicker(blobSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if len(contentStorages) > 0 {
+			collected, err := collectBlobs(context.Background(), contentStorages[0].blobs, contentStorages)
+			if err != nil {
+				logger.Errorf("Error deleting unreferenced blobs: %v", err)
+			}
+			if collected > 0 {
+				logger.Infof("Deleted %d unreferenced blobs", collected)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestContentStorages(t *testing.T, count int) ([]*ContentStorage, *LocalStorage) {
+	blobs := newLocalStorage(t.TempDir())
+	storages := make([]*ContentStorage, count)
+	for i := range storages {
+		storages[i] = newContentStorage(newLocalStorage(t.TempDir()), blobs)
+	}
+	return storages, blobs
+}
+
+func blobKeys(t *testing.T, blobs Storage) []string {
+	objects, err := blobs.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Map(objects, func(o StorageObject) string { return o.Key })
+}
+
+// ageBlobs makes all blobs older than the grace period
+func ageBlobs(t *testing.T, blobs *LocalStorage) {
+	old := time.Now().Add(-2 * blobGracePeriod)
+	for _, key := range blobKeys(t, blobs) {
+		location, _ := blobs.path(key)
+		if err := os.Chtimes(location, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContentStorageRoundTrip(t *testing.T) {
+	storages, blobs := newTestContentStorages(t, 1)
+	storage := storages[0]
+	ctx := context.Background()
+
+	for _, key := range []string{"1.jpg", "2.jpg", "nested/3.jpg"} {
+		if err := storage.Put(ctx, key, []byte("same content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Put(ctx, "4.jpg", []byte("other content")); err != nil {
+		t.Fatal(err)
+	}
+	if keys := blobKeys(t, blobs); len(keys) != 2 || !isBlobKey(keys[0]) {
+		t.Errorf("files with the same content don't share a blob, got blobs %v", keys)
+	}
+
+	data, err := storage.Get(ctx, "nested/3.jpg")
+	if err != nil || string(data) != "same content" {
+		t.Errorf("Get returned %q, %v", data, err)
+	}
+	object, err := storage.Stat(ctx, "4.jpg")
+	if err != nil || object.Key != "4.jpg" || object.Size != int64(len("other content")) {
+		t.Errorf("Stat returned %+v, %v", object, err)
+	}
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 || objects[0].Size != int64(len("same content")) {
+		t.Errorf("List returned %+v", objects)
+	}
+
+	if err := storage.Delete(ctx, "1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Get(ctx, "1.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get of a deleted file returned %v", err)
+	}
+	if data, err := storage.Get(ctx, "2.jpg"); err != nil || string(data) != "same content" {
+		t.Errorf("deleting a file removed the content of another one: %q, %v", data, err)
+	}
+}
+
+func TestContentStorageMigrate(t *testing.T) {
+	storages, blobs := newTestContentStorages(t, 1)
+	storage := storages[0]
+	ctx := context.Background()
+	legacy := map[string]string{"1.jpg": "legacy original", "images.json": `[{"blob": "not a reference"}]`}
+	for key, content := range legacy {
+		if err := storage.refs.Put(ctx, key, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files stored before the storage was content addressed can be read before they are migrated
+	if data, err := storage.Get(ctx, "1.jpg"); err != nil || string(data) != "legacy original" {
+		t.Errorf("Get of a legacy file returned %q, %v", data, err)
+	}
+
+	migrated, err := storage.migrate(ctx)
+	if err != nil || migrated != 2 {
+		t.Fatalf("migrated %d files, %v", migrated, err)
+	}
+	if len(blobKeys(t, blobs)) != 2 {
+		t.Errorf("got blobs %v", blobKeys(t, blobs))
+	}
+	for key, content := range legacy {
+		if data, err := storage.Get(ctx, key); err != nil || string(data) != content {
+			t.Errorf("Get of migrated %s returned %q, %v", key, data, err)
+		}
+	}
+	objects, _ := storage.List(ctx, "")
+	if keys := Map(objects, func(o StorageObject) string { return o.Key }); !slices.Equal(keys, []string{"1.jpg", "images.json"}) {
+		t.Errorf("List returned %v", keys)
+	}
+
+	if migrated, err := storage.migrate(ctx); migrated != 0 || err != nil {
+		t.Errorf("second migration moved %d files, %v", migrated, err)
+	}
+}
+
+func TestContentStorageMoveObject(t *testing.T) {
+	storages, blobs := newTestContentStorages(t, 2)
+	originals, trash := storages[0], storages[1]
+	ctx := context.Background()
+	if err := originals.Put(ctx, "1.jpg", []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	blobsBefore := blobKeys(t, blobs)
+
+	if err := moveObject(ctx, originals, "1.jpg", trash, "1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if objectExists(ctx, originals, "1.jpg") {
+		t.Error("moved file still exists")
+	}
+	if data, err := trash.Get(ctx, "1.jpg"); err != nil || string(data) != "original" {
+		t.Errorf("moved file contains %q, %v", data, err)
+	}
+	if blobsAfter := blobKeys(t, blobs); !slices.Equal(blobsBefore, blobsAfter) {
+		t.Errorf("moving changed the blobs from %v to %v", blobsBefore, blobsAfter)
+	}
+
+	// Storages with other blobs get a copy of the content
+	other, _ := newTestContentStorages(t, 1)
+	if err := moveObject(ctx, trash, "1.jpg", other[0], "1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := other[0].Get(ctx, "1.jpg"); err != nil || string(data) != "original" {
+		t.Errorf("copied file contains %q, %v", data, err)
+	}
+}
+
+func TestCollectBlobs(t *testing.T) {
+	storages, blobs := newTestContentStorages(t, 2)
+	ctx := context.Background()
+	for _, storage := range storages {
+		if err := storage.Put(ctx, "kept.jpg", []byte("kept")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storages[0].Put(ctx, "deleted.jpg", []byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storages[1].Put(ctx, "shared.jpg", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storages[0].Put(ctx, "shared.jpg", []byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"deleted.jpg", "shared.jpg"} {
+		if err := storages[0].Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Blobs within the grace period may be referenced by a file that is being written
+	if collected, err := collectBlobs(ctx, blobs, storages); collected != 0 || err != nil {
+		t.Errorf("collected %d new blobs, %v", collected, err)
+	}
+
+	ageBlobs(t, blobs)
+	if collected, err := collectBlobs(ctx, blobs, storages); collected != 1 || err != nil {
+		t.Errorf("collected %d blobs, %v", collected, err)
+	}
+	if len(blobKeys(t, blobs)) != 2 {
+		t.Errorf("remaining blobs are %v", blobKeys(t, blobs))
+	}
+	for _, storage := range storages {
+		if data, err := storage.Get(ctx, "kept.jpg"); err != nil || string(data) != "kept" {
+			t.Errorf("Get of a referenced file returned %q, %v", data, err)
+		}
+	}
+	if data, err := storages[1].Get(ctx, "shared.jpg"); err != nil || string(data) != "shared" {
+		t.Errorf("blob still referenced by another storage was collected: %q, %v", data, err)
+	}
+
+	// A blob that is written again is kept, even though it was unreferenced for longer than the grace period
+	if err := storages[0].Put(ctx, "deleted.jpg", []byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storages[0].Delete(ctx, "kept.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	ageBlobs(t, blobs)
+	if err := storages[0].Put(ctx, "kept again.jpg", []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if collected, err := collectBlobs(ctx, blobs, storages[:1]); collected != 1 || err != nil {
+		t.Errorf("collected %d blobs, %v", collected, err)
+	}
+	if data, err := storages[0].Get(ctx, "kept again.jpg"); err != nil || string(data) != "kept" {
+		t.Errorf("blob written again was collected: %q, %v", data, err)
+	}
+}
+
+func TestServeContentStorage(t *testing.T) {
+	storages, _ := newTestContentStorages(t, 1)
+	if err := storages[0].Put(context.Background(), "sunset.webp", []byte("variant")); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	serveStorage(r, "/files/processed", storages[0])
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/files/processed/sunset.webp", http.StatusOK, "variant"},
+		{"/files/processed/missing.webp", http.StatusNotFound, ""},
+		{"/files/processed/../sunset.webp", http.StatusBadRequest, "invalid URL path\n"},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if recorder.Code != test.status || recorder.Body.String() != test.body {
+			t.Errorf("%s returned %d %q", test.path, recorder.Code, recorder.Body.String())
+		}
+		if test.status == http.StatusOK && recorder.Header().Get("Content-Type") != "image/webp" {
+			t.Errorf("%s has content type %s", test.path, recorder.Header().Get("Content-Type"))
+		}
+	}
+}
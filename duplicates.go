@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/bimg"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"image/color"
+	"image/png"
+	"math/bits"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type (
+	DuplicateGroupDto struct {
+		// Distance is the largest hamming distance between the hashes of two images in the group
+		Distance int        `json:"distance" yaml:"distance"`
+		Images   []ImageDto `json:"images" yaml:"images"`
+	}
+
+	DuplicateGroupView struct {
+		Distance int
+		Images   []ImageView
+	}
+
+	MergeImagesDto struct {
+		DuplicateID uint `json:"duplicateId" form:"duplicateId" binding:"required"`
+	}
+)
+
+const (
+	// dHash compares each pixel of a 9x8 grayscale thumbnail with its right neighbour, which yields 64 bits
+	dHashWidth  = 9
+	dHashHeight = 8
+	// Images whose hashes differ in at most this many bits are considered duplicates
+	defaultDuplicateDistance = 6
+	maxDuplicateDistance     = 20
+)
+
+var (
+	errInvalidHash = errors.New("invalid perceptual hash")
+	errMergeSelf   = errors.New("an image can't be merged into itself")
+)
+
+// perceptualHash computes the difference hash (dHash) of an image. Scaled, recompressed or slightly edited copies of
+// an image have hashes with a small hamming distance.
+func perceptualHash(ctx context.Context, data []byte) (string, error) {
+	size, err := imageSizeFromBytes(&data)
+	if err != nil {
+		return "", err
+	}
+
+	release, err := processingLimiter.Acquire(ctx, estimateProcessingMemory(size, len(data)))
+	if err != nil {
+		return "", err
+	}
+	thumbnail, err := bimg.NewImage(data).Process(bimg.Options{
+		Width:          dHashWidth,
+		Height:         dHashHeight,
+		Force:          true,
+		Type:           bimg.PNG,
+		Interpretation: bimg.InterpretationBW,
+	})
+	release()
+	if err != nil {
+		return "", err
+	}
+
+	img, err := png.Decode(bytes.NewReader(thumbnail))
+	if err != nil {
+		return "", err
+	}
+
+	bounds := img.Bounds()
+	luminance := func(x, y int) uint8 {
+		return color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+	}
+
+	var hash uint64
+	for y := 0; y < dHashHeight; y++ {
+		for x := 0; x < dHashWidth-1; x++ {
+			hash <<= 1
+			if luminance(x, y) > luminance(x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+func hashDistance(a, b string) (int, error) {
+	hashA, errA := strconv.ParseUint(a, 16, 64)
+	hashB, errB := strconv.ParseUint(b, 16, 64)
+	if errA != nil || errB != nil {
+		return 0, errInvalidHash
+	}
+	return bits.OnesCount64(hashA ^ hashB), nil
+}
+
+// findSimilarImages returns the IDs of all images whose hash is within maxDistance of the given hash
+func findSimilarImages(hash string, excludeId uint, maxDistance int) []uint {
+	var images []Image
+	db.Select("id", "perceptual_hash").Where("perceptual_hash <> '' AND id <> ?", excludeId).Find(&images)
+
+	similar := make([]uint, 0)
+	for _, image := range images {
+		distance, err := hashDistance(hash, image.PerceptualHash)
+		if err == nil && distance <= maxDistance {
+			similar = append(similar, image.ID)
+		}
+	}
+	return similar
+}
+
+// findDuplicateGroups groups all images whose hashes are within maxDistance of each other. Groups are transitive, so
+// an image similar to any image of a group is part of it.
+func findDuplicateGroups(maxDistance int) ([][]Image, []int) {
+	var images []Image
+	db.Preload(clause.Associations).Where("perceptual_hash <> ''").Order("id ASC").Find(&images)
+
+	parents := make([]int, len(images))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+
+	groupDistances := map[int]int{}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			distance, err := hashDistance(images[i].PerceptualHash, images[j].PerceptualHash)
+			if err != nil || distance > maxDistance {
+				continue
+			}
+			rootI, rootJ := find(i), find(j)
+			parents[rootJ] = rootI
+			groupDistances[rootI] = max(groupDistances[rootI], groupDistances[rootJ], distance)
+		}
+	}
+
+	members := map[int][]Image{}
+	roots := make([]int, 0)
+	for i := range images {
+		root := find(i)
+		if _, found := members[root]; !found {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], images[i])
+	}
+
+	groups := make([][]Image, 0)
+	distances := make([]int, 0)
+	for _, root := range roots {
+		if len(members[root]) < 2 {
+			continue
+		}
+		groups = append(groups, members[root])
+		distances = append(distances, groupDistances[root])
+	}
+
+	return groups, distances
+}
+
+// mergeImages merges the duplicate into the kept image. The kept image gains the categories and related images of
+// the duplicate, the duplicate is deleted together with its files.
+func mergeImages(ctx context.Context, keep, duplicate *Image) error {
+	if keep.ID == duplicate.ID {
+		return errMergeSelf
+	}
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The duplicate is recorded as deleted by the hooks
+		tx, audit, err := beginAudit(tx, auditEntityImage, keep.ID)
+		if err != nil {
+			return err
+		}
+
+		categories := slices.Clone(keep.Categories)
+		for _, category := range duplicate.Categories {
+			if !slices.Contains(keep.categoryIds(), category.ID) {
+				categories = append(categories, category)
+			}
+		}
+		err = tx.Model(keep).Association("Categories").Replace(categories)
+		if err != nil {
+			return err
+		}
+		err = indexImages(tx, keep.ID)
+		if err != nil {
+			return err
+		}
+
+		relatedIds := keep.relatedImageIds()
+		for _, related := range duplicate.Related {
+			if related.ID == keep.ID || slices.Contains(relatedIds, related.ID) {
+				continue
+			}
+			res := tx.Exec("INSERT INTO images_relations (image_id, related_id) VALUES (?, ?), (?, ?)", keep.ID, related.ID, related.ID, keep.ID)
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+
+		res := tx.Exec("DELETE FROM images_relations WHERE image_id = ? OR related_id = ?", duplicate.ID, duplicate.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		err = tx.Model(duplicate).Association("Categories").Clear()
+		if err != nil {
+			return err
+		}
+
+		res = tx.Unscoped().Where("image_id = ?", duplicate.ID).Delete(&ImageMetadata{})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		err = removeVariants(duplicate.ID, tx, nil)
+		if err != nil {
+			return err
+		}
+
+		res = tx.Delete(duplicate)
+		if res.Error != nil {
+			return res.Error
+		}
+		return audit.commit(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The merged image stays in the trash with its original until it is purged
+	if duplicate.ImageExists {
+		err = moveObject(ctx, originalStorage, duplicate.OriginalFileName(), trashStorage, duplicate.OriginalFileName())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warnf("Could not move original of merged image %d to trash: %v", duplicate.ID, err)
+		}
+	}
+
+	logger.Infof("Merged image %d into image %d", duplicate.ID, keep.ID)
+	return nil
+}
+
+func duplicateDistanceParam(c *gin.Context) int {
+	distance, err := strconv.Atoi(c.Query("distance"))
+	if err != nil || distance < 0 {
+		return defaultDuplicateDistance
+	}
+	return min(distance, maxDuplicateDistance)
+}
+
+func loadImageById(id uint) (*Image, error) {
+	var image Image
+	res := db.Preload(clause.Associations).First(&image, id)
+	if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("image with id '%d' not found", id)
+	}
+	return &image, nil
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getDuplicatesHtml(c *gin.Context) {
+	distance := duplicateDistanceParam(c)
+	groups, distances := findDuplicateGroups(distance)
+
+	views := make([]DuplicateGroupView, len(groups))
+	for i, group := range groups {
+		views[i] = DuplicateGroupView{
+			Distance: distances[i],
+			Images: Map(group, func(image Image) ImageView {
+				return image.toView()
+			}),
+		}
+	}
+
+	var unhashed int64
+	db.Model(&Image{}).Where("image_exists = ? AND perceptual_hash = ''", true).Count(&unhashed)
+
+	c.HTML(http.StatusOK, "duplicates.gohtml", gin.H{
+		"groups":      views,
+		"distance":    distance,
+		"maxDistance": maxDuplicateDistance,
+		"unhashed":    unhashed,
+		"role":        currentRole(c),
+	})
+}
+
+func mergeDuplicatesForm(c *gin.Context) {
+	keepId, errKeep := strconv.ParseUint(c.PostForm("keep"), 10, 64)
+	duplicateId, errDuplicate := strconv.ParseUint(c.PostForm("duplicate"), 10, 64)
+	if errKeep != nil || errDuplicate != nil {
+		c.String(http.StatusBadRequest, "Invalid image IDs")
+		return
+	}
+
+	keep, err := loadImageById(uint(keepId))
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	duplicate, err := loadImageById(uint(duplicateId))
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+
+	err = mergeImages(c, keep, duplicate)
+	if errors.Is(err, errMergeSelf) {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error merging images: %v", err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/images/duplicates?distance="+c.PostForm("distance"))
+}
+
+func getDuplicates(c *gin.Context) {
+	groups, distances := findDuplicateGroups(duplicateDistanceParam(c))
+
+	groupsDto := make([]DuplicateGroupDto, len(groups))
+	for i, group := range groups {
+		groupsDto[i] = DuplicateGroupDto{
+			Distance: distances[i],
+			Images: Map(group, func(image Image) ImageDto {
+				return image.toDto()
+			}),
+		}
+	}
+
+	c.JSON(http.StatusOK, &groupsDto)
+}
+
+func mergeImageApi(c *gin.Context) {
+	id, err := pathIdToInt(imageIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	mergeDto := MergeImagesDto{}
+	if err := c.ShouldBind(&mergeDto); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	keep, err := loadImageById(id)
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	duplicate, err := loadImageById(mergeDto.DuplicateID)
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+
+	err = mergeImages(c, keep, duplicate)
+	if errors.Is(err, errMergeSelf) {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error merging images: %v", err)
+		return
+	}
+
+	keep, err = loadImageById(id)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, keep.toDto())
+}
+
+func parseImageIds(rawIds string) []uint {
+	ids := make([]uint, 0)
+	for _, rawId := range strings.Split(rawIds, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(rawId), 10, 64)
+		if err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestHashDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"0000000000000000", "0000000000000000", 0},
+		{"ffffffffffffffff", "0000000000000000", 64},
+		{"0000000000000001", "0000000000000000", 1},
+		{"8000000000000000", "0000000000000001", 2},
+		{"f0f0f0f0f0f0f0f0", "0f0f0f0f0f0f0f0f", 64},
+		{"00ff00ff00ff00ff", "00ff00ff00ff00fe", 1},
+		{"123456789abcdef0", "123456789abcdef0", 0},
+	}
+	for _, test := range tests {
+		distance, err := hashDistance(test.a, test.b)
+		if err != nil || distance != test.distance {
+			t.Errorf("hashDistance(%s, %s) = %d, %v, expected %d", test.a, test.b, distance, err, test.distance)
+		}
+		reversed, err := hashDistance(test.b, test.a)
+		if err != nil || reversed != distance {
+			t.Errorf("hashDistance(%s, %s) = %d, %v, isn't symmetric", test.b, test.a, reversed, err)
+		}
+	}
+}
+
+func TestHashDistanceInvalid(t *testing.T) {
+	for _, hash := range []string{"", "xyz", "1ffffffffffffffff"} {
+		if _, err := hashDistance(hash, "0000000000000000"); !errors.Is(err, errInvalidHash) {
+			t.Errorf("hashDistance(%q) returned %v", hash, err)
+		}
+	}
+}
+
+// createTestHashedImages creates an image with each of the perceptual hashes, an empty hash isn't hashed yet
+func createTestHashedImages(t *testing.T, hashes ...string) []*Image {
+	images := make([]*Image, 0, len(hashes))
+	for i, hash := range hashes {
+		image := Image{Name: fmt.Sprintf("image-%d", i+1), Format: "jpg", PerceptualHash: hash}
+		if res := db.Create(&image); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		images = append(images, &image)
+	}
+	return images
+}
+
+func TestFindSimilarImages(t *testing.T) {
+	setupTestDatabase(t)
+	createTestHashedImages(t, "0000000000000000", "0000000000000003", "00000000000000ff", "")
+
+	similar := findSimilarImages("0000000000000001", 0, 2)
+	if !slices.Equal(similar, []uint{1, 2}) {
+		t.Errorf("similar images are %v", similar)
+	}
+	// An image isn't a duplicate of itself when its hash is updated
+	similar = findSimilarImages("0000000000000000", 1, 2)
+	if !slices.Equal(similar, []uint{2}) {
+		t.Errorf("similar images excluding the image itself are %v", similar)
+	}
+}
+
+func TestFindDuplicateGroups(t *testing.T) {
+	setupTestDatabase(t)
+	// Image 3 is only close to image 2, but joins the group of images 1 and 2
+	createTestHashedImages(t, "0000000000000000", "000000000000000f", "00000000000000ff", "ffffffffffffffff",
+		"fffffffffffffffe", "f0f0f0f0f0f0f0f0", "")
+
+	groups, distances := findDuplicateGroups(4)
+	ids := Map(groups, func(group []Image) []uint {
+		return Map(group, func(image Image) uint { return image.ID })
+	})
+	if len(ids) != 2 || !slices.Equal(ids[0], []uint{1, 2, 3}) || !slices.Equal(ids[1], []uint{4, 5}) {
+		t.Fatalf("got groups %v", ids)
+	}
+	if !slices.Equal(distances, []int{4, 1}) {
+		t.Errorf("got group distances %v", distances)
+	}
+}
+
+func TestMergeImages(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	images := createTestHashedImages(t, "0000000000000000", "0000000000000001", "ffffffffffffffff")
+	keep, duplicate, related := images[0], images[1], images[2]
+	ctx := context.Background()
+
+	landscapes, portraits := Category{Name: "landscapes"}, Category{Name: "portraits"}
+	db.Create(&landscapes)
+	db.Create(&portraits)
+	db.Model(keep).Association("Categories").Append(&landscapes)
+	db.Model(duplicate).Association("Categories").Append(&landscapes, &portraits)
+	db.Exec("INSERT INTO images_relations (image_id, related_id) VALUES (?, ?), (?, ?)", duplicate.ID, related.ID, related.ID, duplicate.ID)
+	db.Model(duplicate).UpdateColumn("image_exists", true)
+	if err := originalStorage.Put(ctx, duplicate.OriginalFileName(), []byte("duplicate")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mergeImages(ctx, keep, keep); !errors.Is(err, errMergeSelf) {
+		t.Errorf("merging an image into itself returned %v", err)
+	}
+
+	keep, _ = loadImageById(keep.ID)
+	duplicate, _ = loadImageById(duplicate.ID)
+	if err := mergeImages(ctx, keep, duplicate); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := loadImageById(keep.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if categories := merged.categoryIds(); !slices.Equal(categories, []uint{landscapes.ID, portraits.ID}) {
+		t.Errorf("merged image has categories %v", categories)
+	}
+	if relatedIds := merged.relatedImageIds(); !slices.Equal(relatedIds, []uint{related.ID}) {
+		t.Errorf("merged image is related to %v", relatedIds)
+	}
+	if _, err := loadImageById(duplicate.ID); err == nil {
+		t.Error("duplicate wasn't deleted")
+	}
+	expectStoredFile(t, originalStorage, duplicate.OriginalFileName(), "")
+	expectStoredFile(t, trashStorage, duplicate.OriginalFileName(), "duplicate")
+}
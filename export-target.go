@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	exportTargetDirectory = "directory"
+	exportTargetArchive   = "archive"
+	exportTargetGit       = "git"
+
+	exportArchiveTarGz = "tar.gz"
+	exportArchiveZip   = "zip"
+
+	// exportCommitListLength limits the files listed per change type in the message of an export commit
+	exportCommitListLength = 20
+)
+
+var (
+	exportArchiveFormats = []string{exportArchiveTarGz, exportArchiveZip}
+
+	errExportNotInWorkTree = errors.New("export directory is not inside a git working tree")
+)
+
+// exportArchiveFiles returns the manifest of the current export and the files an archive of it contains
+func exportArchiveFiles() (*ExportManifest, []string, error) {
+	manifestData, err := os.ReadFile(path.Join(appConfig.ExportDir, exportManifestName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read export manifest: %w", err)
+	}
+	manifest := ExportManifest{}
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read export manifest: %w", err)
+	}
+
+	names := make([]string, 0, len(manifest.Files)+2)
+	for name := range manifest.Files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	names = append(names, exportManifestName)
+	if _, err := os.Stat(path.Join(appConfig.ExportDir, exportChangelogName)); err == nil {
+		names = append(names, exportChangelogName)
+	}
+	return &manifest, names, nil
+}
+
+func writeTarGzArchive(w io.Writer, dir string, names []string, modified time.Time) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	for _, name := range names {
+		data, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = archive.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  modified,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = archive.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+func writeZipArchive(w io.Writer, dir string, names []string, modified time.Time) error {
+	archive := zip.NewWriter(w)
+	for _, name := range names {
+		data, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		file, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: modified,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// commitExport commits the changes of the export directory to the git working tree it is part of. Only the export
+// directory is committed, other changes of the working tree are left alone.
+func commitExport(changes *ExportChanges, username string) (string, error) {
+	git := func(args ...string) (string, error) {
+		command := exec.Command("git", append([]string{"-C", appConfig.ExportDir}, args...)...)
+		output, err := command.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(string(output)))
+		}
+		return strings.TrimSpace(string(output)), nil
+	}
+
+	if _, err := git("rev-parse", "--is-inside-work-tree"); err != nil {
+		return "", fmt.Errorf("%w: %w", errExportNotInWorkTree, err)
+	}
+	_, err := git("add", "--all", "--", ".")
+	if err != nil {
+		return "", err
+	}
+
+	// Changes of a previous export whose commit failed are committed as well
+	err = exec.Command("git", "-C", appConfig.ExportDir, "diff", "--cached", "--quiet", "--", ".").Run()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return "", nil
+	} else if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return "", fmt.Errorf("git diff failed: %w", err)
+	}
+
+	_, err = git(
+		"-c", "user.name="+appConfig.ExportGitName,
+		"-c", "user.email="+appConfig.ExportGitEmail,
+		"commit", "--quiet", "--message", exportCommitMessage(changes, username), "--", ".",
+	)
+	if err != nil {
+		return "", err
+	}
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("Committed export as %s", commit)
+	return commit, nil
+}
+
+func exportCommitMessage(changes *ExportChanges, username string) string {
+	message := strings.Builder{}
+	fmt.Fprintf(&message, "Update gallery export (%s)\n\n", changes.summary())
+	if len(username) > 0 {
+		fmt.Fprintf(&message, "Exported by %s at %s.\n", username, changes.ExportedAt.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(&message, "Exported at %s.\n", changes.ExportedAt.Format(time.RFC3339))
+	}
+
+	for _, section := range []struct {
+		title string
+		names []string
+	}{
+		{"Added", changes.Added},
+		{"Updated", changes.Updated},
+		{"Removed", changes.Removed},
+	} {
+		if len(section.names) == 0 {
+			continue
+		}
+		fmt.Fprintf(&message, "\n%s:\n", section.title)
+		for i, name := range section.names {
+			if i == exportCommitListLength {
+				fmt.Fprintf(&message, "- and %d more\n", len(section.names)-i)
+				break
+			}
+			fmt.Fprintf(&message, "- %s\n", name)
+		}
+	}
+	return message.String()
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+// sendExportArchive sends the current export as archive, which is named after the time of the last change so it can
+// be told apart from archives of other exports
+func sendExportArchive(c *gin.Context, format string) {
+	exportLock.Lock()
+	defer exportLock.Unlock()
+
+	manifest, names, err := exportArchiveFiles()
+	if err != nil {
+		c.String(http.StatusInternalServerError, c.Error(err).Error())
+		return
+	}
+
+	fileName := fmt.Sprintf("gallery-export-%s.%s", manifest.ExportedAt.UTC().Format("20060102-150405"), format)
+	contentType := "application/gzip"
+	write := writeTarGzArchive
+	if format == exportArchiveZip {
+		contentType = "application/zip"
+		write = writeZipArchive
+	}
+
+	// The files are checked before the response is started, afterward errors can't be reported anymore
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(appConfig.ExportDir, name)); errors.Is(err, fs.ErrNotExist) {
+			c.String(http.StatusConflict, "Export file %s is missing, run the export again", name)
+			return
+		}
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	err = write(c.Writer, appConfig.ExportDir, names, manifest.ExportedAt)
+	if err != nil {
+		c.Error(err)
+		logger.Errorf("Error writing export archive: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setupTestExport exports the test image to a new directory with the given target
+func setupTestExport(t *testing.T, target string) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	config := *appConfig
+	config.ExportDir = filepath.Join(t.TempDir(), "export")
+	config.ExportTarget = target
+	config.ExportArchiveFormat = exportArchiveTarGz
+	config.ExportGitName = "Exporter"
+	config.ExportGitEmail = "exporter@localhost"
+	appConfig = &config
+	createTestImageFiles(t)
+}
+
+func runTestExportRequest(query string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/export?"+query, nil)
+	c.Set(gin.AuthUserKey, "alice")
+	exportData(c)
+	return recorder
+}
+
+func tarGzNames(t *testing.T, data []byte) []string {
+	compressed, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(compressed)
+	names := make([]string, 0)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func zipNames(t *testing.T, data []byte) []string {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Map(archive.File, func(file *zip.File) string { return file.Name })
+}
+
+func TestExportTargetDirectory(t *testing.T) {
+	setupTestExport(t, exportTargetDirectory)
+
+	recorder := runTestExportRequest("")
+	expected := "Exported to " + appConfig.ExportDir + ": 6 added, 0 updated, 0 removed"
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+		t.Errorf("got %d %q", recorder.Code, recorder.Body.String())
+	}
+	// The archive format only applies to the archive target
+	if recorder := runTestExportRequest("format=rar"); recorder.Code != http.StatusOK {
+		t.Errorf("export with an archive format returned %d", recorder.Code)
+	}
+}
+
+func TestExportTargetArchive(t *testing.T) {
+	setupTestExport(t, exportTargetArchive)
+	files := []string{"icons/icons.json", "meta/authors.json", "meta/categories.json", "meta/images.json",
+		"meta/preload.txt", "sunset-small.webp", exportManifestName, exportChangelogName}
+
+	tests := []struct {
+		query       string
+		contentType string
+		extension   string
+		names       func(t *testing.T, data []byte) []string
+	}{
+		{"", "application/gzip", ".tar.gz", tarGzNames},
+		{"format=zip", "application/zip", ".zip", zipNames},
+	}
+	for _, test := range tests {
+		recorder := runTestExportRequest(test.query)
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != test.contentType {
+			t.Fatalf("%s: got %d with content type %s", test.query, recorder.Code, recorder.Header().Get("Content-Type"))
+		}
+		if disposition := recorder.Header().Get("Content-Disposition"); !strings.HasSuffix(disposition, test.extension) {
+			t.Errorf("%s: got content disposition %s", test.query, disposition)
+		}
+		if names := test.names(t, recorder.Body.Bytes()); !slices.Equal(names, files) {
+			t.Errorf("%s: archive contains %v, expected %v", test.query, names, files)
+		}
+	}
+
+	if recorder := runTestExportRequest("format=rar"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("unknown archive format returned %d", recorder.Code)
+	}
+}
+
+func TestExportTargetGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	setupTestExport(t, exportTargetGit)
+	ctx := context.Background()
+
+	// The export directory isn't part of a working tree yet
+	if _, err := exportGallery(ctx, "alice"); !errors.Is(err, errExportNotInWorkTree) {
+		t.Fatalf("export outside a working tree returned %v", err)
+	}
+
+	repository := filepath.Dir(appConfig.ExportDir)
+	if output, err := exec.Command("git", "init", "--quiet", repository).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v: %s", err, output)
+	}
+	result, err := exportGallery(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Commit) == 0 {
+		t.Fatal("export wasn't committed")
+	}
+	output, err := exec.Command("git", "-C", repository, "log", "--format=%an%n%B").CombinedOutput()
+	if err != nil || !strings.HasPrefix(string(output), "Exporter\nUpdate gallery export (") ||
+		!strings.Contains(string(output), "Exported by alice") {
+		t.Errorf("got commit %s, %v", output, err)
+	}
+	// The files written by the first attempt outside the working tree are committed as well
+	output, err = exec.Command("git", "-C", repository, "ls-files").CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "export/sunset-small.webp\n") {
+		t.Errorf("committed files are %s, %v", output, err)
+	}
+
+	if result, err := exportGallery(ctx, "alice"); err != nil || len(result.Commit) > 0 {
+		t.Errorf("export without changes was committed as %s, %v", result.Commit, err)
+	}
+}
+
+func TestExportCommitMessage(t *testing.T) {
+	changes := ExportChanges{Removed: []string{"old.webp"}}
+	for i := 1; i <= exportCommitListLength+5; i++ {
+		changes.Added = append(changes.Added, fmt.Sprintf("%02d.webp", i))
+	}
+
+	message := exportCommitMessage(&changes, "")
+	if !strings.HasPrefix(message, "Update gallery export (25 added, 0 updated, 1 removed)\n\nExported at ") {
+		t.Errorf("got message %s", message)
+	}
+	for _, expected := range []string{"\nAdded:\n- 01.webp\n", "- 20.webp\n- and 5 more\n", "\nRemoved:\n- old.webp\n"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("message doesn't contain %q:\n%s", expected, message)
+		}
+	}
+	if strings.Contains(message, "21.webp") || strings.Contains(message, "Updated:") {
+		t.Errorf("message lists too much:\n%s", message)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gallery-image-manager/util"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	ExportFile struct {
+		Hash string `json:"hash"`
+		Size int64  `json:"size"`
+	}
+
+	// ExportManifest lists every file of the export by its path relative to ExportDir. It's only written again if an
+	// export changed any file, so ExportedAt is the time of the last change.
+	ExportManifest struct {
+		ExportedAt time.Time             `json:"exportedAt"`
+		Files      map[string]ExportFile `json:"files"`
+	}
+
+	// ExportChanges are the files one export added, updated or removed, so a deployment only has to sync those
+	ExportChanges struct {
+		ExportedAt time.Time `json:"exportedAt"`
+		Added      []string  `json:"added"`
+		Updated    []string  `json:"updated"`
+		Removed    []string  `json:"removed"`
+	}
+
+	ExportResult struct {
+		Changes ExportChanges `json:"changes"`
+		// Commit is the commit the git export target created, empty if nothing changed or another target is used
+		Commit string `json:"commit,omitempty"`
+	}
+
+	// exportWriter writes the files of an export, files whose content didn't change are left untouched
+	exportWriter struct {
+		dir      string
+		manifest ExportManifest
+		changes  ExportChanges
+	}
+)
+
+const (
+	exportManifestName  = "manifest.json"
+	exportChangelogName = "changelog.json"
+	// exportChangelogLength is the number of exports with changes that are kept in the changelog
+	exportChangelogLength = 100
+)
+
+var exportLock sync.Mutex
+
+func newExportWriter(dir string) *exportWriter {
+	now := time.Now().UTC()
+	return &exportWriter{
+		dir: dir,
+		manifest: ExportManifest{
+			ExportedAt: now,
+			Files:      map[string]ExportFile{},
+		},
+		changes: ExportChanges{
+			ExportedAt: now,
+			Added:      []string{},
+			Updated:    []string{},
+			Removed:    []string{},
+		},
+	}
+}
+
+func contentHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func (w *exportWriter) location(name string) string {
+	return filepath.Join(w.dir, filepath.FromSlash(name))
+}
+
+// write adds the file to the manifest and writes it unless the existing file has the same content
+func (w *exportWriter) write(name string, data []byte) error {
+	file := ExportFile{Hash: contentHash(data), Size: int64(len(data))}
+	w.manifest.Files[name] = file
+
+	location := w.location(name)
+	info, err := os.Stat(location)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		w.changes.Added = append(w.changes.Added, name)
+	case err != nil:
+		return err
+	case info.IsDir():
+		return errors.New(name + " is a directory")
+	default:
+		if info.Size() == file.Size {
+			existing, err := os.ReadFile(location)
+			if err != nil {
+				return err
+			}
+			if contentHash(existing) == file.Hash {
+				return nil
+			}
+		}
+		w.changes.Updated = append(w.changes.Updated, name)
+	}
+
+	err = createDirIfNotExists(filepath.Dir(location))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(location, data, 0644)
+}
+
+func (w *exportWriter) writeJson(name string, value any) error {
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return w.write(name, jsonBytes)
+}
+
+// copyStorage writes all files of the storage below the prefix
+func (w *exportWriter) copyStorage(ctx context.Context, storage Storage, prefix string) error {
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		data, err := storage.Get(ctx, object.Key)
+		if err != nil {
+			return err
+		}
+		err = w.write(prefix+object.Key, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStale deletes all files of the export directory that haven't been written by this export. Hidden files like
+// .git or .nojekyll aren't part of the export and are kept.
+func (w *exportWriter) removeStale() error {
+	return filepath.WalkDir(w.dir, func(location string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if location != w.dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		relative, err := filepath.Rel(w.dir, location)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relative)
+		if _, written := w.manifest.Files[name]; written || name == exportManifestName || name == exportChangelogName {
+			return nil
+		}
+		err = os.Remove(location)
+		if err != nil {
+			return err
+		}
+		w.changes.Removed = append(w.changes.Removed, name)
+		return nil
+	})
+}
+
+// finish writes the manifest and adds the changes to the changelog, exports that didn't change anything aren't
+// recorded
+func (w *exportWriter) finish() error {
+	slices.Sort(w.changes.Added)
+	slices.Sort(w.changes.Updated)
+	slices.Sort(w.changes.Removed)
+
+	if w.changeCount() == 0 && util.Exists(w.location(exportManifestName)) {
+		return nil
+	}
+	jsonBytes, err := json.Marshal(&w.manifest)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(w.location(exportManifestName), jsonBytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	if w.changeCount() == 0 {
+		return nil
+	}
+	changelog := make([]ExportChanges, 0)
+	existing, err := os.ReadFile(w.location(exportChangelogName))
+	if err == nil {
+		err = json.Unmarshal(existing, &changelog)
+		if err != nil {
+			logger.Warnf("Could not read export changelog, starting a new one: %v", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	changelog = append([]ExportChanges{w.changes}, changelog...)
+	if len(changelog) > exportChangelogLength {
+		changelog = changelog[:exportChangelogLength]
+	}
+
+	jsonBytes, err = json.Marshal(&changelog)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(w.location(exportChangelogName), jsonBytes, 0644)
+}
+
+func (w *exportWriter) changeCount() int {
+	return len(w.changes.Added) + len(w.changes.Updated) + len(w.changes.Removed)
+}
+
+// exportGallery writes the processed variants, icons and the metadata of the gallery to ExportDir. Only files that
+// changed since the last export are written, files that don't belong to the gallery anymore are removed. The git
+// export target commits the changes afterward.
+func exportGallery(ctx context.Context, username string) (*ExportResult, error) {
+	exportLock.Lock()
+	defer exportLock.Unlock()
+
+	tx := db.Session(&gorm.Session{}).WithContext(ctx)
+	writer := newExportWriter(appConfig.ExportDir)
+
+	err := createDirIfNotExists(appConfig.ExportDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.copyStorage(ctx, processedStorage, "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.copyStorage(ctx, iconStorage, "icons/")
+	if err != nil {
+		return nil, err
+	}
+
+	iconCategory := Category{Name: iconCategoryName}
+	tx.First(&iconCategory)
+
+	var images []Image
+	tx.
+		Preload("Variants").
+		Preload("Categories").
+		Preload("Related").
+		Order("sort_index ASC").
+		Order("id ASC").
+		Find(&images)
+
+	imagesDto := make([]ImageDto, 0, len(images))
+	preloadUrlBuffer := bytes.Buffer{}
+
+	for _, image := range images {
+		dto := image.toDtoWithVariants()
+		if slices.Contains(dto.Categories, iconCategory.ID) {
+			logger.Infof("Skipping image in icon category")
+		} else {
+			imagesDto = append(imagesDto, dto)
+
+			for _, variant := range image.Variants {
+				preloadUrlBuffer.WriteString("/export/" + variant.FileName + "\n")
+			}
+		}
+	}
+
+	err = writer.writeJson("meta/images.json", &imagesDto)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.write("meta/preload.txt", preloadUrlBuffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var categories []Category
+	tx.Find(&categories)
+
+	categoriesDto := Map(categories, func(c Category) CategoryDto {
+		return c.toDto()
+	})
+
+	err = writer.writeJson("meta/categories.json", &categoriesDto)
+	if err != nil {
+		return nil, err
+	}
+
+	var authors []Author
+	tx.Find(&authors)
+
+	authorsDto := Map(authors, func(a Author) AuthorDto {
+		return a.toDto()
+	})
+
+	err = writer.writeJson("meta/authors.json", &authorsDto)
+	if err != nil {
+		return nil, err
+	}
+
+	var icons []Icon
+	tx.Find(&icons)
+
+	err = writer.writeJson("icons/icons.json", &icons)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.removeStale()
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Exported to %s: %s", appConfig.ExportDir, writer.changes.summary())
+	result := ExportResult{Changes: writer.changes}
+
+	if appConfig.ExportTarget == exportTargetGit {
+		result.Commit, err = commitExport(&writer.changes, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+func (c *ExportChanges) summary() string {
+	return fmt.Sprintf("%d added, %d updated, %d removed", len(c.Added), len(c.Updated), len(c.Removed))
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func exportData(c *gin.Context) {
+	format := c.DefaultQuery("format", appConfig.ExportArchiveFormat)
+	if appConfig.ExportTarget == exportTargetArchive && !slices.Contains(exportArchiveFormats, format) {
+		c.String(http.StatusBadRequest, "Unknown archive format \"%s\", expected one of %s", format,
+			strings.Join(exportArchiveFormats, ", "))
+		return
+	}
+
+	result, err := exportGallery(c, c.GetString(gin.AuthUserKey))
+	if err != nil {
+		c.String(500, c.Error(err).Error())
+		return
+	}
+
+	switch {
+	case appConfig.ExportTarget == exportTargetArchive:
+		sendExportArchive(c, format)
+	case len(result.Commit) > 0:
+		c.String(200, "Exported to %s: %s, committed %s", appConfig.ExportDir, result.Changes.summary(), result.Commit)
+	default:
+		c.String(200, "Exported to %s: %s", appConfig.ExportDir, result.Changes.summary())
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// runTestExport writes the files like an export and returns its changes
+func runTestExport(t *testing.T, dir string, files map[string]string) ExportChanges {
+	writer := newExportWriter(dir)
+	for name, content := range files {
+		if err := writer.write(name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.removeStale(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.finish(); err != nil {
+		t.Fatal(err)
+	}
+	return writer.changes
+}
+
+func readTestChangelog(t *testing.T, dir string) []ExportChanges {
+	changelog := make([]ExportChanges, 0)
+	data, err := os.ReadFile(filepath.Join(dir, exportChangelogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &changelog); err != nil {
+		t.Fatal(err)
+	}
+	return changelog
+}
+
+func TestExportChanges(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".nojekyll"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exports := []struct {
+		name    string
+		files   map[string]string
+		added   []string
+		updated []string
+		removed []string
+	}{
+		{
+			name:  "first export",
+			files: map[string]string{"a.webp": "a", "meta/images.json": "[]", "icons/icons.json": "[1]"},
+			added: []string{"a.webp", "icons/icons.json", "meta/images.json"},
+		},
+		{
+			name:  "unchanged",
+			files: map[string]string{"a.webp": "a", "meta/images.json": "[]", "icons/icons.json": "[1]"},
+		},
+		{
+			name:    "added, updated and removed",
+			files:   map[string]string{"a.webp": "b", "b.webp": "b", "meta/images.json": "[{}]"},
+			added:   []string{"b.webp"},
+			updated: []string{"a.webp", "meta/images.json"},
+			removed: []string{"icons/icons.json"},
+		},
+		{
+			name:    "same size, different content",
+			files:   map[string]string{"a.webp": "c", "b.webp": "b", "meta/images.json": "[{}]"},
+			updated: []string{"a.webp"},
+		},
+		{
+			name:    "everything removed",
+			files:   map[string]string{},
+			removed: []string{"a.webp", "b.webp", "meta/images.json"},
+		},
+	}
+
+	recorded := make([]ExportChanges, 0)
+	for _, export := range exports {
+		changes := runTestExport(t, dir, export.files)
+		expected := ExportChanges{ExportedAt: changes.ExportedAt, Added: export.added, Updated: export.updated, Removed: export.removed}
+		for _, names := range []*[]string{&expected.Added, &expected.Updated, &expected.Removed} {
+			if *names == nil {
+				*names = []string{}
+			}
+		}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("%s: got changes %+v, expected %+v", export.name, changes, expected)
+		}
+		if len(changes.Added)+len(changes.Updated)+len(changes.Removed) > 0 {
+			recorded = append([]ExportChanges{changes}, recorded...)
+		}
+		changelog := readTestChangelog(t, dir)
+		if len(changelog) != len(recorded) {
+			t.Fatalf("%s: changelog has %d entries, expected %d", export.name, len(changelog), len(recorded))
+		}
+		for i := range changelog {
+			if !reflect.DeepEqual(changelog[i].Added, recorded[i].Added) || !reflect.DeepEqual(changelog[i].Removed, recorded[i].Removed) ||
+				!reflect.DeepEqual(changelog[i].Updated, recorded[i].Updated) || !changelog[i].ExportedAt.Equal(recorded[i].ExportedAt) {
+				t.Errorf("%s: changelog entry %d is %+v, expected %+v", export.name, i, changelog[i], recorded[i])
+			}
+		}
+
+		manifest := ExportManifest{}
+		data, err := os.ReadFile(filepath.Join(dir, exportManifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Files) != len(export.files) || !manifest.ExportedAt.Equal(recorded[0].ExportedAt) {
+			t.Errorf("%s: got manifest %+v", export.name, manifest)
+		}
+		for name, content := range export.files {
+			if manifest.Files[name] != (ExportFile{Hash: contentHash([]byte(content)), Size: int64(len(content))}) {
+				t.Errorf("%s: manifest entry of %s is %+v", export.name, name, manifest.Files[name])
+			}
+		}
+	}
+
+	for _, hidden := range []string{".nojekyll", ".git/HEAD"} {
+		if _, err := os.Stat(filepath.Join(dir, hidden)); err != nil {
+			t.Errorf("hidden file %s was removed: %v", hidden, err)
+		}
+	}
+}
+
+func TestExportChangelogLength(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	dir := t.TempDir()
+	runTestExport(t, dir, map[string]string{"a.webp": "0"})
+	for i := 1; i <= exportChangelogLength; i++ {
+		runTestExport(t, dir, map[string]string{"a.webp": string(rune('a' + i%2))})
+	}
+
+	changelog := readTestChangelog(t, dir)
+	if len(changelog) != exportChangelogLength {
+		t.Errorf("changelog has %d entries, expected %d", len(changelog), exportChangelogLength)
+	}
+	if len(changelog[len(changelog)-1].Added) > 0 {
+		t.Error("the oldest export wasn't dropped from the changelog")
+	}
+}
+
+func TestExportChangelogUnreadable(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, exportChangelogName), []byte("{broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := runTestExport(t, dir, map[string]string{"a.webp": "a"})
+	changelog := readTestChangelog(t, dir)
+	if len(changelog) != 1 || !reflect.DeepEqual(changelog[0].Added, changes.Added) {
+		t.Errorf("got changelog %+v", changelog)
+	}
+}
+
+func TestExportGallery(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	config := *appConfig
+	config.ExportDir = t.TempDir()
+	appConfig = &config
+	image := createTestImageFiles(t)
+	ctx := context.Background()
+	meta := []string{"icons/icons.json", "meta/authors.json", "meta/categories.json", "meta/images.json", "meta/preload.txt"}
+
+	result, err := exportGallery(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(meta, "sunset-small.webp"); !slices.Equal(result.Changes.Added, expected) {
+		t.Errorf("first export added %v, expected %v", result.Changes.Added, expected)
+	}
+	if result.Changes.summary() != "6 added, 0 updated, 0 removed" {
+		t.Errorf("got summary %s", result.Changes.summary())
+	}
+	data, err := os.ReadFile(filepath.Join(appConfig.ExportDir, "sunset-small.webp"))
+	if err != nil || string(data) != "variant" {
+		t.Errorf("exported variant contains %q, %v", data, err)
+	}
+
+	// Unchanged files aren't written again, so syncing the export directory only transfers the changes
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	variantLocation := filepath.Join(appConfig.ExportDir, "sunset-small.webp")
+	if err := os.Chtimes(variantLocation, old, old); err != nil {
+		t.Fatal(err)
+	}
+	result, err = exportGallery(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Changes.summary() != "0 added, 0 updated, 0 removed" {
+		t.Errorf("export without changes has changes %+v", result.Changes)
+	}
+	if info, err := os.Stat(variantLocation); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("unchanged variant was written again: %v", err)
+	}
+
+	if err := trashImage(ctx, image); err != nil {
+		t.Fatal(err)
+	}
+	result, err = exportGallery(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := result.Changes
+	if len(changes.Added) > 0 || !slices.Equal(changes.Updated, []string{"meta/images.json", "meta/preload.txt"}) ||
+		!slices.Equal(changes.Removed, []string{"sunset-small.webp"}) {
+		t.Errorf("export after deleting the image has changes %+v", changes)
+	}
+	if len(readTestChangelog(t, appConfig.ExportDir)) != 2 {
+		t.Error("export without changes was recorded in the changelog")
+	}
+}
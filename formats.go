@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/bimg"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type (
+	// FormatDto describes an image format and whether the installed libvips can read and write it
+	FormatDto struct {
+		Name     string `json:"name" yaml:"name"`
+		MimeType string `json:"mimeType" yaml:"mimeType"`
+		Load     bool   `json:"load" yaml:"load"`
+		Save     bool   `json:"save" yaml:"save"`
+		Output   bool   `json:"output" yaml:"output"`
+		Note     string `json:"note,omitempty" yaml:"note,omitempty"`
+	}
+)
+
+const (
+	jpegXlFormatName = "jxl"
+	// AVIF encoding is slow at the lowest speeds, 6 is a good tradeoff between speed and size
+	avifEncodeSpeed = 6
+)
+
+var (
+	// outputFormats are the formats processing rules are allowed to produce, in the order browsers should prefer them
+	outputFormats = []bimg.ImageType{bimg.AVIF, bimg.WEBP, bimg.JPEG, bimg.PNG}
+	mimeTypes     = map[bimg.ImageType]string{
+		bimg.JPEG: "image/jpeg",
+		bimg.PNG:  "image/png",
+		bimg.WEBP: "image/webp",
+		bimg.AVIF: "image/avif",
+		bimg.GIF:  "image/gif",
+		bimg.TIFF: "image/tiff",
+		bimg.HEIF: "image/heif",
+	}
+	supportedFormats = map[bimg.ImageType]FormatDto{}
+
+	errJpegXlUnsupported = errors.New("JPEG XL output is not supported, the bimg binding in use can't encode it")
+)
+
+// detectFormats asks libvips which formats it can load and save. Output formats libvips can't save are rejected
+// when processing rules are stored and skipped during processing.
+func detectFormats() {
+	for imageType := range mimeTypes {
+		supportedFormats[imageType] = FormatDto{
+			Name:     bimg.ImageTypeName(imageType),
+			MimeType: mimeTypes[imageType],
+			Load:     bimg.IsTypeSupported(imageType),
+			Save:     bimg.IsTypeSupportedSave(imageType),
+			Output:   slices.Contains(outputFormats, imageType),
+		}
+	}
+
+	available := Map(availableOutputFormats(), bimg.ImageTypeName)
+	logger.Infof("Available output formats: %s", strings.Join(available, ", "))
+}
+
+func allFormats() []FormatDto {
+	formats := make([]FormatDto, 0, len(supportedFormats)+1)
+	for _, format := range supportedFormats {
+		formats = append(formats, format)
+	}
+	formats = append(formats, FormatDto{
+		Name:     jpegXlFormatName,
+		MimeType: "image/jxl",
+		Note:     errJpegXlUnsupported.Error(),
+	})
+	slices.SortFunc(formats, func(a, b FormatDto) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return formats
+}
+
+func isFormatAvailable(format bimg.ImageType) bool {
+	return slices.Contains(outputFormats, format) && supportedFormats[format].Save
+}
+
+func availableOutputFormats() []bimg.ImageType {
+	available := make([]bimg.ImageType, 0, len(outputFormats))
+	for _, format := range outputFormats {
+		if isFormatAvailable(format) {
+			available = append(available, format)
+		}
+	}
+	return available
+}
+
+func parseImageFormat(name string) (bimg.ImageType, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "jpg":
+		name = "jpeg"
+	case jpegXlFormatName, "jpegxl", "jpeg-xl":
+		return bimg.UNKNOWN, errJpegXlUnsupported
+	}
+	for _, format := range outputFormats {
+		if bimg.ImageTypeName(format) == name {
+			return format, nil
+		}
+	}
+	return bimg.UNKNOWN, fmt.Errorf("unsupported output format \"%s\"", name)
+}
+
+// formatPreference orders format names like outputFormats, unknown formats come last
+func formatPreference(name string) int {
+	for i, format := range outputFormats {
+		if bimg.ImageTypeName(format) == name {
+			return i
+		}
+	}
+	return len(outputFormats)
+}
+
+// formatForMimeType returns the name of the format with the MIME type, if it's one of the known image formats
+func formatForMimeType(mimeType string) (string, bool) {
+	for format, formatMimeType := range mimeTypes {
+		if formatMimeType == mimeType {
+			return bimg.ImageTypeName(format), true
+		}
+	}
+	return "", false
+}
+
+func mimeTypeForFormat(name string) string {
+	format, err := parseImageFormat(name)
+	if err != nil {
+		return ""
+	}
+	return mimeTypes[format]
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getFormats(c *gin.Context) {
+	c.JSON(http.StatusOK, allFormats())
+}
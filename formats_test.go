@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"github.com/h2non/bimg"
+	"slices"
+	"testing"
+)
+
+func TestFormatForMimeType(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		format   string
+		known    bool
+	}{
+		{"image/jpeg", "jpeg", true},
+		{"image/png", "png", true},
+		{"image/heif", "heif", true},
+		{"image/svg+xml", "", false},
+		{"image/x-portable-graymap", "", false},
+		{"application/octet-stream", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		format, known := formatForMimeType(test.mimeType)
+		if format != test.format || known != test.known {
+			t.Errorf("formatForMimeType(%q) = %q, %v", test.mimeType, format, known)
+		}
+		// Formats are stored in columns of 5 characters
+		if len(format) > 5 {
+			t.Errorf("format %q of %s doesn't fit the format column", format, test.mimeType)
+		}
+	}
+}
+
+func TestParseImageFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format bimg.ImageType
+		err    error
+	}{
+		{"webp", bimg.WEBP, nil},
+		{" AVIF ", bimg.AVIF, nil},
+		{"jpg", bimg.JPEG, nil},
+		{"jpeg", bimg.JPEG, nil},
+		{"jxl", bimg.UNKNOWN, errJpegXlUnsupported},
+		{"JPEG-XL", bimg.UNKNOWN, errJpegXlUnsupported},
+		// Formats that can be read aren't necessarily output formats
+		{"gif", bimg.UNKNOWN, nil},
+		{"", bimg.UNKNOWN, nil},
+	}
+	for _, test := range tests {
+		format, err := parseImageFormat(test.name)
+		if format != test.format || (test.err != nil && !errors.Is(err, test.err)) ||
+			(test.format == bimg.UNKNOWN) != (err != nil) {
+			t.Errorf("parseImageFormat(%q) = %v, %v", test.name, format, err)
+		}
+	}
+}
+
+func TestAvailableOutputFormats(t *testing.T) {
+	previous := supportedFormats
+	t.Cleanup(func() {
+		supportedFormats = previous
+	})
+	supportedFormats = map[bimg.ImageType]FormatDto{
+		bimg.AVIF: {Load: true, Save: false},
+		bimg.WEBP: {Load: true, Save: true},
+		bimg.JPEG: {Load: true, Save: true},
+		bimg.GIF:  {Load: true, Save: true},
+	}
+
+	// Formats libvips can't write and formats that aren't output formats are left out, in the order of preference
+	if available := availableOutputFormats(); !slices.Equal(available, []bimg.ImageType{bimg.WEBP, bimg.JPEG}) {
+		t.Errorf("got available output formats %v", available)
+	}
+	if formatPreference("avif") >= formatPreference("webp") || formatPreference("gif") != len(outputFormats) {
+		t.Error("AVIF isn't preferred over WebP, or GIF isn't last")
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/h2non/bimg"
 	"math"
-	"os"
-	"path"
-	"path/filepath"
+	"slices"
 	"sync"
 )
 
@@ -22,27 +24,40 @@ type (
 		Enlarge      bool
 		Background   *bimg.Color
 		Format       bimg.ImageType
+		// KeepMetadata keeps the metadata of the original, which may contain the location an image was taken at
+		KeepMetadata bool
 	}
 
 	ImageOptions struct {
+		Context       context.Context
 		Image         *Image
 		Data          *[]byte
+		SourceSize    bimg.ImageSize
 		ProcRule      ProcessingRule
 		HeightLimited bool
-		TargetPath    string
+		// Target is the storage the variant is written to, the processed variants if empty
+		Target Storage
 	}
 
 	ImageProcessResult struct {
-		ImageID     uint                    `json:"imageId" yaml:"imageId"`
-		Name        string                  `json:"name" yaml:"name"`
-		Title       string                  `json:"title" yaml:"title"`
-		Description string                  `json:"description" yaml:"description"`
-		Related     []uint                  `json:"related" yaml:"related"`
-		Categories  []uint                  `json:"categories" yaml:"categories"`
-		Author      uint                    `json:"author" yaml:"author"`
-		Nsfw        bool                    `json:"nsfw" yaml:"nsfw"`
-		Original    *ProcessedImageVariant  `json:"original" yaml:"original"`
-		Variants    []ProcessedImageVariant `json:"variants" yaml:"variants"`
+		ImageID     uint   `json:"imageId" yaml:"imageId"`
+		Skipped     bool   `json:"skipped" yaml:"skipped"`
+		Fingerprint string `json:"-" yaml:"-"`
+		// PerceptualHash is only set if the image didn't have one yet
+		PerceptualHash string `json:"-" yaml:"-"`
+		// Metadata is only set if the metadata of the image hadn't been extracted yet
+		Metadata *ImageMetadata `json:"-" yaml:"-"`
+		// OriginalFile is only set if the stored information about the original was missing or outdated
+		OriginalFile *OriginalFileInfo       `json:"-" yaml:"-"`
+		Name         string                  `json:"name" yaml:"name"`
+		Title        string                  `json:"title" yaml:"title"`
+		Description  string                  `json:"description" yaml:"description"`
+		Related      []uint                  `json:"related" yaml:"related"`
+		Categories   []uint                  `json:"categories" yaml:"categories"`
+		Author       uint                    `json:"author" yaml:"author"`
+		Nsfw         bool                    `json:"nsfw" yaml:"nsfw"`
+		Original     *ProcessedImageVariant  `json:"original" yaml:"original"`
+		Variants     []ProcessedImageVariant `json:"variants" yaml:"variants"`
 	}
 
 	IconProcessResult struct {
@@ -63,10 +78,15 @@ type (
 	}
 
 	ImageProcessConfig struct {
+		// Context cancels processing that is still waiting for the processing limiter
+		Context         context.Context
 		Image           *Image
-		TargetPath      string
+		Target          Storage
 		ProcessRules    []ProcessingRule
 		ProcessOriginal bool
+		// SkipUnchanged skips images whose original and processing rules haven't changed since they were last
+		// processed, as long as all of their variants still exist
+		SkipUnchanged bool
 	}
 )
 
@@ -210,19 +230,36 @@ func originalProcessingRule() ProcessingRule {
 	return *originalProcRule
 }
 
-func processImageAsync(config *ImageProcessConfig, targetChannel chan<- *ImageProcessResult, wg *sync.WaitGroup) {
-	defer wg.Done()
-	result, err := processImage(config)
-	if err == nil && result != nil {
-		targetChannel <- result
+// processingFingerprint identifies the input of a processing run. If it didn't change, processing the image again
+// would yield the same variants.
+func processingFingerprint(image *Image, dataHash []byte, procRules []ProcessingRule, originalRule *ProcessingRule) (string, error) {
+	hash := sha256.New()
+	hash.Write(dataHash)
+	hash.Write([]byte(image.ImageIdentifier()))
+
+	if originalRule != nil {
+		procRules = append(slices.Clone(procRules), *originalRule)
+	}
+
+	rulesJson, err := json.Marshal(procRules)
+	if err != nil {
+		return "", err
 	}
+	hash.Write(rulesJson)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func deleteFiles(glob string) {
-	oldFiles, _ := filepath.Glob(glob)
-	for _, file := range oldFiles {
-		_ = os.Remove(file)
+func variantFilesExist(ctx context.Context, variants []ImageVariant) bool {
+	if len(variants) == 0 {
+		return false
+	}
+	for _, variant := range variants {
+		if !objectExists(ctx, processedStorage, variant.FileName) {
+			return false
+		}
 	}
+	return true
 }
 
 func processImage(config *ImageProcessConfig) (*ImageProcessResult, error) {
@@ -231,42 +268,105 @@ func processImage(config *ImageProcessConfig) (*ImageProcessResult, error) {
 		logger.Warnf("No image file exists for image %d", image.ID)
 	}
 
-	// Delete old processed images
-	deleteFiles(fmt.Sprintf("%s/%s.*", appConfig.ProcessedDir, image.ImageIdentifier()))
-	deleteFiles(fmt.Sprintf("%s/%s%s*", appConfig.ProcessedDir, image.ImageIdentifier(), suffixSeparator))
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	imageFile, err := os.ReadFile(image.OriginalFilePath())
+	imageFile, err := originalStorage.Get(ctx, image.OriginalFileName())
 	if err != nil {
 		logger.Errorf("Could not read image file: %v", err)
 		return nil, err
 	}
 
-	size, err := imageSizeFromBytes(&imageFile)
+	procRules := config.ProcessRules
+	originalRule := originalProcessingRule()
+
+	if len(procRules) == 0 {
+		procRules, originalRule = processingRulesForImage(image)
+	}
+
+	var fingerprintOriginalRule *ProcessingRule
+	if config.ProcessOriginal {
+		fingerprintOriginalRule = &originalRule
+	}
+
+	dataHash := sha256.Sum256(imageFile)
+	fingerprint, err := processingFingerprint(image, dataHash[:], procRules, fingerprintOriginalRule)
 	if err != nil {
 		return nil, err
 	}
 
-	heightLimited := size.Height > size.Width
+	result := ImageProcessResult{
+		ImageID:     image.ID,
+		Name:        image.Name,
+		Title:       image.Title,
+		Description: image.Description,
+		Related:     image.relatedImageIds(),
+		Categories:  image.categoryIds(),
+		Author:      image.AuthorID,
+		Nsfw:        image.Nsfw,
+		Fingerprint: fingerprint,
+	}
 
-	wg := sync.WaitGroup{}
+	if len(image.PerceptualHash) == 0 {
+		result.PerceptualHash, err = perceptualHash(ctx, imageFile)
+		if err != nil {
+			logger.Warnf("Could not compute perceptual hash of image %d: %v", image.ID, err)
+		}
+	}
 
-	procRules := config.ProcessRules
+	var metadataCount int64
+	db.Model(&ImageMetadata{}).Where("image_id = ?", image.ID).Count(&metadataCount)
+	if metadataCount == 0 {
+		result.Metadata, err = extractMetadata(image.ID, imageFile)
+		if err != nil {
+			logger.Warnf("Could not extract metadata of image %d: %v", image.ID, err)
+		}
+	}
 
-	if len(procRules) == 0 {
-		procRules = defaultProcessingRules()
+	// The dimensions are only read from the file if it changed since they were stored
+	size, known := image.originalSize(hex.EncodeToString(dataHash[:]))
+	if !known {
+		info, err := originalFileInfo(imageFile)
+		if err != nil {
+			return nil, err
+		}
+		result.OriginalFile = &info
+		size = bimg.ImageSize{Width: info.Width, Height: info.Height}
+	}
+
+	if config.SkipUnchanged && fingerprint == image.ProcessingFingerprint && variantFilesExist(ctx, image.Variants) {
+		result.Skipped = true
+		for _, variant := range image.Variants {
+			processedVariant := variant.toProcessedVariant()
+			if variant.Original {
+				result.Original = &processedVariant
+			} else {
+				result.Variants = append(result.Variants, processedVariant)
+			}
+		}
+		logger.Debugf("Skipped unchanged image \"%s\"", image.Name)
+		return &result, nil
 	}
 
+	heightLimited := size.Height > size.Width
+
+	wg := sync.WaitGroup{}
+
 	channel := make(chan ProcessedImageVariant, len(procRules))
 
 	for i := range procRules {
 		wg.Add(1)
 		procRule := procRules[i]
 		go processImageRuleAsync(ImageOptions{
+			Context:       ctx,
 			Image:         image,
 			Data:          &imageFile,
+			SourceSize:    size,
 			ProcRule:      procRule,
 			HeightLimited: heightLimited,
-			TargetPath:    config.TargetPath,
+			Target:        config.Target,
 		}, channel, &wg)
 	}
 
@@ -277,27 +377,23 @@ func processImage(config *ImageProcessConfig) (*ImageProcessResult, error) {
 
 	variants := make([]ProcessedImageVariant, 0, len(procRules))
 
-	for result := range channel {
-		variants = append(variants, result)
+	for variant := range channel {
+		variants = append(variants, variant)
 	}
 
-	result := ImageProcessResult{
-		ImageID:     image.ID,
-		Name:        image.Name,
-		Title:       image.Title,
-		Description: image.Description,
-		Related:     image.relatedImageIds(),
-		Categories:  image.categoryIds(),
-		Author:      image.AuthorID,
-		Nsfw:        image.Nsfw,
-		Variants:    variants,
+	result.Variants = variants
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
 	if config.ProcessOriginal {
 		original, _ := processImageRule(ImageOptions{
+			Context:       ctx,
 			Image:         image,
 			Data:          &imageFile,
-			ProcRule:      originalProcessingRule(),
+			SourceSize:    size,
+			ProcRule:      originalRule,
 			HeightLimited: heightLimited,
 		})
 
@@ -323,9 +419,9 @@ func imageSize(image *bimg.Image) (bimg.ImageSize, error) {
 
 func processIcon(image *Image) ([]*IconProcessResult, error) {
 	result, err := processImage(&ImageProcessConfig{
-		TargetPath:   appConfig.IconDir,
+		Target:       iconStorage,
 		Image:        image,
-		ProcessRules: IconProcessingRules(),
+		ProcessRules: iconProcessingRules(),
 	})
 
 	if err != nil {
@@ -373,10 +469,22 @@ func processImageRuleAsync(options ImageOptions, targetChannel chan<- ProcessedI
 func processImageRule(imageOptions ImageOptions) (*ProcessedImageVariant, error) {
 	procRule := imageOptions.ProcRule
 
+	if !isFormatAvailable(procRule.Format) {
+		err := fmt.Errorf("output format %s is not available", bimg.ImageTypeName(procRule.Format))
+		logger.Warnf("Skipping processing rule: %v", err)
+		return nil, err
+	}
+
 	options := bimg.Options{
 		Type:    procRule.Format,
 		Quality: procRule.Quality,
 		Enlarge: procRule.Enlarge,
+		// Removes EXIF including the GPS position, IPTC and XMP from the variant
+		StripMetadata: !procRule.KeepMetadata,
+	}
+
+	if procRule.Format == bimg.AVIF {
+		options.Speed = avifEncodeSpeed
 	}
 
 	if procRule.Width > 0 && procRule.Height > 0 {
@@ -396,7 +504,17 @@ func processImageRule(imageOptions ImageOptions) (*ProcessedImageVariant, error)
 		options.Background = *procRule.Background
 	}
 
+	ctx := imageOptions.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	release, err := processingLimiter.Acquire(ctx, estimateProcessingMemory(imageOptions.SourceSize, len(*imageOptions.Data)))
+	if err != nil {
+		return nil, err
+	}
 	processed, err := bimg.NewImage(*imageOptions.Data).Process(options)
+	release()
 	if err != nil {
 		logger.Errorf("Error processing image: %v", err)
 		return nil, err
@@ -430,14 +548,12 @@ func processImageRule(imageOptions ImageOptions) (*ProcessedImageVariant, error)
 
 	result.Name = baseFileName
 
-	targetPath := imageOptions.TargetPath
-	if targetPath == "" {
-		targetPath = appConfig.ProcessedDir
+	target := imageOptions.Target
+	if target == nil {
+		target = processedStorage
 	}
 
-	targetPath = path.Join(targetPath, result.FileName)
-
-	err = os.WriteFile(targetPath, processed, 0666)
+	err = target.Put(ctx, result.FileName, processed)
 	if err != nil {
 		logger.Errorf("Error writing processed image: %v", err)
 		return nil, err
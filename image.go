@@ -1,21 +1,39 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"html/template"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type (
+	ProcessImagesPayload struct {
+		Force bool `json:"force"`
+	}
+
+	ProcessImagePayload struct {
+		ImageID uint `json:"imageId"`
+	}
+
+	ProcessImagesSummary struct {
+		Processed int    `json:"processed"`
+		Skipped   int    `json:"skipped"`
+		Failed    []uint `json:"failed,omitempty"`
+	}
+
 	Image struct {
 		gorm.Model
 		Name             string `gorm:"size:50"`
@@ -28,10 +46,26 @@ type (
 		ImageExists      bool
 		AuthorID         uint
 		SortIndex        int
-		Author           *Author
-		Categories       []*Category `gorm:"many2many:images_categories"`
-		Related          []*Image    `gorm:"many2many:images_relations;association_jointable_foreignkey:related_id"`
-		Variants         []ImageVariant
+		// ProcessingFingerprint identifies the original and processing rules used for the current variants
+		ProcessingFingerprint string `gorm:"size:64"`
+		// PerceptualHash is the hex encoded dHash of the original, used to find duplicates
+		PerceptualHash string `gorm:"size:16;index"`
+		// Width, Height, FileSize, MimeType and Checksum describe the original
+		Width               int
+		Height              int
+		FileSize            int64
+		MimeType            string `gorm:"size:50"`
+		Checksum            string `gorm:"size:64"`
+		ProcessingProfileID *uint
+		ProcessingProfile   *ProcessingProfile
+		Author              *Author
+		Categories          []*Category `gorm:"many2many:images_categories"`
+		Related             []*Image    `gorm:"many2many:images_relations;association_jointable_foreignkey:related_id"`
+		Variants            []ImageVariant
+		// OriginalVersionID is the upload that is the current original, 0 if it predates the kept versions
+		OriginalVersionID uint
+		// auditBefore is the state before an update or delete, used by the hooks to record the change
+		auditBefore auditSnapshot
 	}
 
 	ImageVariant struct {
@@ -46,6 +80,8 @@ type (
 		Name     string
 		ImageID  uint
 		Image    *Image
+		// auditBefore is the state before an update or delete, used by the hooks to record the change
+		auditBefore auditSnapshot
 	}
 
 	Icon struct {
@@ -71,7 +107,13 @@ type (
 		Author           *AuthorDto        `json:"author,omitempty" yaml:"author,omitempty"`
 		Related          []uint            `json:"related,omitempty" yaml:"related,omitempty"`
 		Variants         []ImageVariantDto `json:"variants,omitempty" yaml:"variants,omitempty"`
-		Categories       []uint            `json:"categories,omitempty" yaml:"categories,omitempty"`
+		// VariantGroups contains the variants grouped by size, with all formats of each size
+		VariantGroups []ImageVariantGroupDto `json:"variantGroups,omitempty" yaml:"variantGroups,omitempty"`
+		Categories    []uint                 `json:"categories,omitempty" yaml:"categories,omitempty"`
+		// ProcessingProfileID overrides the processing profile of the image's categories, 0 removes the override
+		ProcessingProfileID *uint `json:"processingProfileId,omitempty" yaml:"processingProfileId,omitempty"`
+		// Original is set by the server once the original has been uploaded
+		Original *ImageOriginalDto `binding:"-" json:"original,omitempty" yaml:"original,omitempty"`
 	}
 
 	ImageView struct {
@@ -89,6 +131,9 @@ type (
 		RelatedIds    []uint
 		SortIndex     int
 		Related       map[uint]string
+		// ProcessingProfileID is 0 if the image uses the profile of its categories
+		ProcessingProfileID uint
+		Original            *ImageOriginalDto
 	}
 
 	ImageVariantDto struct {
@@ -101,16 +146,92 @@ type (
 		Suffix   string `json:"suffix,omitempty" yaml:"suffix,omitempty"`
 		Original bool   `json:"original" yaml:"original"`
 		ImageID  uint   `json:"imageId" yaml:"imageId"`
+		MimeType string `json:"mimeType" yaml:"mimeType"`
+	}
+
+	// ImageVariantGroupDto is a single size of an image, its sources are ordered from the most to the least
+	// preferred format, so they can be used as <picture> sources with the last one as fallback
+	ImageVariantGroupDto struct {
+		Height   int                     `json:"height" yaml:"height"`
+		Width    int                     `json:"width" yaml:"width"`
+		Name     string                  `json:"name,omitempty" yaml:"name,omitempty"`
+		Suffix   string                  `json:"suffix,omitempty" yaml:"suffix,omitempty"`
+		Original bool                    `json:"original" yaml:"original"`
+		Sources  []ImageVariantSourceDto `json:"sources" yaml:"sources"`
+	}
+
+	ImageVariantSourceDto struct {
+		Format   string `json:"format" yaml:"format"`
+		MimeType string `json:"mimeType" yaml:"mimeType"`
+		FileName string `json:"fileName" yaml:"fileName"`
+		Quality  int    `json:"quality" yaml:"quality"`
 	}
 )
 
 func (i *Image) AfterCreate(tx *gorm.DB) (err error) {
 	if i.SortIndex == 0 {
-		i.SortIndex = int(i.ID * 10)
-		res := tx.Save(i)
-		return res.Error
+		i.SortIndex = int(i.ID) * sortIndexStep
+		// The sort index belongs to the creation, so it's updated without the update hooks
+		res := tx.Model(i).UpdateColumn("sort_index", i.SortIndex)
+		if res.Error != nil {
+			return res.Error
+		}
 	}
-	return nil
+	return auditAfterChange(tx, auditEntityImage, i.ID, auditActionCreate, nil)
+}
+
+func (i *Image) BeforeUpdate(tx *gorm.DB) (err error) {
+	i.auditBefore, err = auditBeforeChange(tx, auditEntityImage, i.ID)
+	return err
+}
+
+func (i *Image) AfterUpdate(tx *gorm.DB) (err error) {
+	return auditAfterChange(tx, auditEntityImage, i.ID, auditActionUpdate, i.auditBefore)
+}
+
+func (i *Image) AfterSave(tx *gorm.DB) (err error) {
+	if i.ID == 0 {
+		return nil
+	}
+	return indexImages(tx, i.ID)
+}
+
+func (i *Image) BeforeDelete(tx *gorm.DB) (err error) {
+	i.auditBefore, err = auditBeforeChange(tx, auditEntityImage, i.ID)
+	return err
+}
+
+func (i *Image) AfterDelete(tx *gorm.DB) (err error) {
+	if i.ID == 0 {
+		return nil
+	}
+	err = auditAfterChange(tx, auditEntityImage, i.ID, auditActionDelete, i.auditBefore)
+	if err != nil {
+		return err
+	}
+	return unindexImage(tx, i.ID)
+}
+
+func (v *ImageVariant) AfterCreate(tx *gorm.DB) (err error) {
+	return auditAfterChange(tx, auditEntityVariant, v.ID, auditActionCreate, nil)
+}
+
+func (v *ImageVariant) BeforeUpdate(tx *gorm.DB) (err error) {
+	v.auditBefore, err = auditBeforeChange(tx, auditEntityVariant, v.ID)
+	return err
+}
+
+func (v *ImageVariant) AfterUpdate(tx *gorm.DB) (err error) {
+	return auditAfterChange(tx, auditEntityVariant, v.ID, auditActionUpdate, v.auditBefore)
+}
+
+func (v *ImageVariant) BeforeDelete(tx *gorm.DB) (err error) {
+	v.auditBefore, err = auditBeforeChange(tx, auditEntityVariant, v.ID)
+	return err
+}
+
+func (v *ImageVariant) AfterDelete(tx *gorm.DB) (err error) {
+	return auditAfterChange(tx, auditEntityVariant, v.ID, auditActionDelete, v.auditBefore)
 }
 
 func (i *Image) toDto() ImageDto {
@@ -125,6 +246,12 @@ func (i *Image) toDto() ImageDto {
 		Nsfw:             &i.Nsfw,
 		AuthorID:         i.AuthorID,
 		SortIndex:        i.SortIndex,
+		Original:         i.originalDto(),
+	}
+
+	if i.ProcessingProfileID != nil {
+		profileId := *i.ProcessingProfileID
+		dto.ProcessingProfileID = &profileId
 	}
 
 	if i.Categories != nil {
@@ -153,10 +280,56 @@ func (i *Image) toDtoWithVariants() ImageDto {
 		dto.Variants = Map(i.Variants, func(iv ImageVariant) ImageVariantDto {
 			return iv.toDto()
 		})
+		dto.VariantGroups = groupVariants(dto.Variants)
 	}
 	return dto
 }
 
+// groupVariants groups variants of the same size that only differ in their format
+func groupVariants(variants []ImageVariantDto) []ImageVariantGroupDto {
+	groups := make([]ImageVariantGroupDto, 0, len(variants))
+	groupIndexes := map[string]int{}
+
+	for _, variant := range variants {
+		key := fmt.Sprintf("%t|%s|%s|%dx%d", variant.Original, variant.Name, variant.Suffix, variant.Width, variant.Height)
+		idx, found := groupIndexes[key]
+		if !found {
+			idx = len(groups)
+			groupIndexes[key] = idx
+			groups = append(groups, ImageVariantGroupDto{
+				Height:   variant.Height,
+				Width:    variant.Width,
+				Name:     variant.Name,
+				Suffix:   variant.Suffix,
+				Original: variant.Original,
+			})
+		}
+		groups[idx].Sources = append(groups[idx].Sources, ImageVariantSourceDto{
+			Format:   variant.Format,
+			MimeType: variant.MimeType,
+			FileName: variant.FileName,
+			Quality:  variant.Quality,
+		})
+	}
+
+	for _, group := range groups {
+		slices.SortFunc(group.Sources, func(a, b ImageVariantSourceDto) int {
+			return formatPreference(a.Format) - formatPreference(b.Format)
+		})
+	}
+	slices.SortFunc(groups, func(a, b ImageVariantGroupDto) int {
+		if a.Original != b.Original {
+			if a.Original {
+				return 1
+			}
+			return -1
+		}
+		return a.Width*a.Height - b.Width*b.Height
+	})
+
+	return groups
+}
+
 func (i *Image) toView() ImageView {
 	view := ImageView{
 		ID:            i.ID,
@@ -171,6 +344,11 @@ func (i *Image) toView() ImageView {
 		CategoryNames: make([]string, len(i.Categories)),
 		Related:       make(map[uint]string, len(i.Related)),
 		RelatedIds:    make([]uint, len(i.Related)),
+		Original:      i.originalDto(),
+	}
+
+	if i.ProcessingProfileID != nil {
+		view.ProcessingProfileID = *i.ProcessingProfileID
 	}
 
 	if i.Author != nil {
@@ -246,6 +424,16 @@ func (i *Image) updateWithDto(dto ImageDto) {
 	if dto.Nsfw != nil {
 		i.Nsfw = *dto.Nsfw
 	}
+	if dto.ProcessingProfileID != nil {
+		// Drop the loaded association, otherwise saving would restore the old profile ID from it
+		i.ProcessingProfile = nil
+		if *dto.ProcessingProfileID > 0 {
+			profileId := *dto.ProcessingProfileID
+			i.ProcessingProfileID = &profileId
+		} else {
+			i.ProcessingProfileID = nil
+		}
+	}
 }
 
 func (i *ImageDto) toModel() Image {
@@ -262,10 +450,6 @@ func (i *Image) OriginalFileName() string {
 	return fmt.Sprintf("%s.%s", strconv.Itoa(int(i.ID)), i.Format)
 }
 
-func (i *Image) OriginalFilePath() string {
-	return path.Join(appConfig.OriginalDir, i.OriginalFileName())
-}
-
 func (i *Image) ImageIdentifier() string {
 	if i.IgnoreAuthorName {
 		return strings.ToLower(i.Name)
@@ -298,6 +482,18 @@ func (i *Image) categoryIds() []uint {
 	return ids
 }
 
+func (iv *ImageVariant) toProcessedVariant() ProcessedImageVariant {
+	return ProcessedImageVariant{
+		Height:   iv.Height,
+		Width:    iv.Width,
+		Format:   iv.Format,
+		FileName: iv.FileName,
+		Quality:  iv.Quality,
+		Suffix:   iv.Suffix,
+		Name:     iv.Name,
+	}
+}
+
 func (iv *ImageVariant) toDto() ImageVariantDto {
 	return ImageVariantDto{
 		Height:   iv.Height,
@@ -309,72 +505,154 @@ func (iv *ImageVariant) toDto() ImageVariantDto {
 		ImageID:  iv.ImageID,
 		Suffix:   iv.Suffix,
 		Original: iv.Original,
+		MimeType: mimeTypeForFormat(iv.Format),
 	}
 }
 
 const (
 	imageIdName = "imageId"
+
+	jobTypeProcessImages = "process-images"
+	jobTypeProcessImage  = "process-image"
+
+	categoryModeAny = "any"
+	categoryModeAll = "all"
 )
 
 // ------------- WEBSERVER HANDLER -------------
 
-func fetchImages(c *gin.Context) ([]*Image, *ListFilter, error) {
+// fetchImages loads the page of images matching the filter in the query. defaultLimit is the page size used if the
+// query doesn't contain a limit, 0 returns all images.
+func fetchImages(c *gin.Context, defaultLimit int) ([]*Image, *ListFilter, error) {
 	var images []*Image
 	var filter ListFilter
 
-	tx := db.Preload("Author").Preload("Categories")
+	page, err := parsePage(c, defaultLimit)
+	if err != nil {
+		c.Error(err)
+		c.String(400, err.Error())
+		return nil, nil, err
+	}
+
+	tx := db.Model(&Image{})
 
-	_, withVariants := c.GetQuery("withVariants")
-	if withVariants {
-		tx = tx.Preload("Variants")
+	filter.Categories, err = queryIds(c, "category")
+	if err == nil && len(filter.Categories) == 0 && len(c.Param(categoryIdName)) > 0 {
+		filter.Categories, err = parseIds(c.Param(categoryIdName))
+	}
+	if err == nil {
+		filter.ExcludedCategories, err = queryIds(c, "excludeCategory")
+	}
+	if err == nil {
+		filter.Authors, err = queryIds(c, "author")
+	}
+	if err == nil && len(filter.Authors) == 0 && len(c.Param(authorIdName)) > 0 {
+		filter.Authors, err = parseIds(c.Param(authorIdName))
+	}
+	if err != nil {
+		c.Error(err)
+		c.String(400, err.Error())
+		return nil, nil, err
+	}
+
+	filter.CategoryMode = strings.ToLower(c.Query("categoryMode"))
+	if filter.CategoryMode != categoryModeAll {
+		filter.CategoryMode = categoryModeAny
 	}
 
-	rawCategory := c.Query("category")
-	if len(rawCategory) == 0 {
-		rawCategory = c.Param(categoryIdName)
+	if len(filter.Categories) > 0 {
+		if filter.CategoryMode == categoryModeAll {
+			tx = tx.Where("images.id IN (SELECT image_id FROM images_categories WHERE category_id IN ? "+
+				"GROUP BY image_id HAVING COUNT(DISTINCT category_id) = ?)", filter.Categories, len(filter.Categories))
+		} else {
+			tx = tx.Where("images.id IN (SELECT image_id FROM images_categories WHERE category_id IN ?)", filter.Categories)
+		}
+	}
+	if len(filter.ExcludedCategories) > 0 {
+		tx = tx.Where("images.id NOT IN (SELECT image_id FROM images_categories WHERE category_id IN ?)", filter.ExcludedCategories)
+	}
+	if len(filter.Authors) > 0 {
+		tx = tx.Where("images.author_id IN ?", filter.Authors)
 	}
 
-	if len(rawCategory) > 0 {
-		categoryId, err := strconv.ParseUint(rawCategory, 0, 64)
+	dateFilters := []struct {
+		param    string
+		value    *string
+		column   string
+		operator string
+	}{
+		{"createdAfter", &filter.CreatedAfter, "images.created_at", ">="},
+		{"createdBefore", &filter.CreatedBefore, "images.created_at", "<"},
+		{"updatedAfter", &filter.UpdatedAfter, "images.updated_at", ">="},
+		{"updatedBefore", &filter.UpdatedBefore, "images.updated_at", "<"},
+	}
+	for _, dateFilter := range dateFilters {
+		raw := strings.TrimSpace(c.Query(dateFilter.param))
+		if len(raw) == 0 {
+			continue
+		}
+		date, err := parseFilterDate(raw, dateFilter.operator == "<")
 		if err != nil {
+			err = fmt.Errorf("invalid %s: %w", dateFilter.param, err)
 			c.Error(err)
 			c.String(400, err.Error())
 			return nil, nil, err
 		}
-		filter.Category = uint(categoryId)
-		if categoryId > 0 {
-			tx = tx.Joins("INNER JOIN images_categories ic ON ic.image_id = images.id AND ic.category_id = ?", categoryId)
+		*dateFilter.value = raw
+		tx = tx.Where(dateFilter.column+" "+dateFilter.operator+" ?", date)
+	}
+
+	boolFilters := []struct {
+		param string
+		value **bool
+	}{
+		{"nsfw", &filter.Nsfw},
+		{"imageExists", &filter.ImageExists},
+		{"hasVariants", &filter.HasVariants},
+	}
+	for _, boolFilter := range boolFilters {
+		raw := c.Query(boolFilter.param)
+		if len(raw) == 0 {
+			continue
 		}
-	}
-
-	rawAuthor := c.Query("author")
-	if len(rawAuthor) == 0 {
-		rawAuthor = c.Param(authorIdName)
-	}
-
-	if len(rawAuthor) > 0 {
-		authorId, err := strconv.ParseUint(rawAuthor, 0, 64)
+		value, err := strconv.ParseBool(raw)
 		if err != nil {
 			c.Error(err)
 			c.String(400, err.Error())
 			return nil, nil, err
 		}
-		filter.Author = uint(authorId)
-		if authorId > 0 {
-			tx = tx.Where(&Image{AuthorID: filter.Author})
+		*boolFilter.value = &value
+	}
+
+	if filter.Nsfw != nil {
+		tx = tx.Where("images.nsfw = ?", *filter.Nsfw)
+	}
+	if filter.ImageExists != nil {
+		tx = tx.Where("images.image_exists = ?", *filter.ImageExists)
+	}
+	if filter.HasVariants != nil {
+		variants := "EXISTS (SELECT 1 FROM image_variants WHERE image_variants.image_id = images.id AND image_variants.deleted_at IS NULL)"
+		if !*filter.HasVariants {
+			variants = "NOT " + variants
 		}
+		tx = tx.Where(variants)
 	}
 
-	rawNsfw := c.Query("nsfw")
-	if len(rawNsfw) > 0 {
-		nsfw, err := strconv.ParseBool(rawNsfw)
-		if err != nil {
-			c.Error(err)
-			c.String(400, err.Error())
+	filter.Query = strings.TrimSpace(c.Query("q"))
+	if len(filter.Query) > 0 {
+		query, err := searchQuery(filter.Query)
+		if err == nil && !searchAvailable {
+			err = errSearchUnavailable
+		}
+		if errors.Is(err, errSearchUnavailable) {
+			c.String(503, err.Error())
 			return nil, nil, err
 		}
-		filter.Nsfw = &nsfw
-		tx = tx.Where("nsfw = ?", nsfw)
+		if err == nil {
+			tx = tx.Joins("INNER JOIN "+searchTable+" ON "+searchTable+".rowid = images.id AND "+searchTable+" MATCH ?", query)
+		} else {
+			filter.Query = ""
+		}
 	}
 
 	sortMode := strings.ToLower(c.Query("sortMode"))
@@ -387,33 +665,131 @@ func fetchImages(c *gin.Context) ([]*Image, *ListFilter, error) {
 	sortBy := c.Query("sortBy")
 	if len(sortBy) == 0 {
 		sortBy = "sortIndex"
+		if len(filter.Query) > 0 {
+			sortBy = "relevance"
+		}
 	}
 	filter.SortBy = sortBy
-	switch sortBy {
-	case "sortIndex":
-		tx = tx.Order("sort_index " + sortMode)
-	case "id":
-		tx = tx.Order("id " + sortMode)
-	case "name":
-		tx = tx.Order("name " + sortMode)
-	case "title":
-		tx = tx.Order("title " + sortMode)
+
+	// The filtered query is reused for counting and loading the page
+	tx = tx.Session(&gorm.Session{})
+	res := tx.Count(&page.Total)
+	if res.Error != nil {
+		c.Error(res.Error)
+		c.String(500, res.Error.Error())
+		return nil, nil, res.Error
+	}
+
+	tx = tx.Preload("Author").Preload("Categories")
+	_, withVariants := c.GetQuery("withVariants")
+	if withVariants {
+		tx = tx.Preload("Variants")
 	}
 
-	res := tx.Find(&images)
+	if sortBy == "relevance" && len(filter.Query) > 0 {
+		// bm25 scores are lower for better matches
+		tx = tx.Order(searchRank() + " " + sortMode)
+	} else if sortBy == "categoryIndex" && len(filter.Categories) == 1 {
+		tx = tx.Order(categoryOrder(filter.Categories[0], sortMode))
+	} else if column := imageSortColumn(sortBy); len(column) > 0 && column != "images.id" {
+		tx = tx.Order(column + " " + sortMode)
+	}
+	// The ID makes the order unique, so pages don't skip or repeat images
+	tx = tx.Order("images.id " + sortMode)
+
+	if page.paged() {
+		tx, err = applyImageCursor(tx, &page, &filter)
+		if err != nil {
+			c.Error(err)
+			c.String(400, err.Error())
+			return nil, nil, err
+		}
+	}
+	if page.Limit > 0 {
+		// One more image than requested tells whether there is a next page
+		tx = tx.Limit(page.Limit + 1)
+	}
 
+	res = tx.Find(&images)
 	if res.Error != nil {
 		c.Error(res.Error)
 		c.String(500, res.Error.Error())
 		return nil, nil, res.Error
 	}
 
+	if page.Limit > 0 && len(images) > page.Limit {
+		images = images[:page.Limit]
+		page.NextCursor = nextImageCursor(images[len(images)-1], &filter, cursorOffset(&page)+len(images))
+	}
+	page.Count = len(images)
+	filter.Page = page
+
 	return images, &filter, nil
 
 }
 
+// queryIds parses the IDs of a query parameter, which may be repeated or contain a comma separated list
+func queryIds(c *gin.Context, name string) ([]uint, error) {
+	ids := make([]uint, 0)
+	for _, raw := range c.QueryArray(name) {
+		parsed, err := parseIds(raw)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, parsed...)
+	}
+	return ids, nil
+}
+
+// parseIds parses a comma separated list of IDs, 0 and empty entries are ignored
+func parseIds(raw string) ([]uint, error) {
+	ids := make([]uint, 0)
+	for _, rawId := range strings.Split(raw, ",") {
+		rawId = strings.TrimSpace(rawId)
+		if len(rawId) == 0 {
+			continue
+		}
+		id, err := strconv.ParseUint(rawId, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		if id > 0 {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids, nil
+}
+
+// parseFilterDate parses a date (2006-01-02) or a timestamp (RFC 3339). An upper bound given as a date includes the
+// whole day, so the start of the next day is returned.
+func parseFilterDate(raw string, upperBound bool) (time.Time, error) {
+	date, err := time.ParseInLocation(time.DateOnly, raw, time.Local)
+	if err == nil {
+		if upperBound {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// imageSortColumn returns the column the images are sorted by, or an empty string if the order isn't a column
+func imageSortColumn(sortBy string) string {
+	switch sortBy {
+	case "sortIndex":
+		return "images.sort_index"
+	case "id":
+		return "images.id"
+	case "name":
+		return "images.name"
+	case "title":
+		return "images.title"
+	}
+	return ""
+}
+
 func getImagesHtml(c *gin.Context) {
-	images, filter, err := fetchImages(c)
+	images, filter, err := fetchImages(c, defaultHtmlPageSize)
 	if err != nil {
 		return
 	}
@@ -422,11 +798,29 @@ func getImagesHtml(c *gin.Context) {
 		return image.toView()
 	})
 
+	var highlights map[uint]template.HTML
+	if len(filter.Query) > 0 {
+		highlights = searchHighlights(filter.Query)
+	}
+
+	// The summary of a bulk edit is only shown once, not on other pages or after returning from the next bulk edit
+	listUrl := *c.Request.URL
+	query := listUrl.Query()
+	query.Del(bulkSummaryParam)
+	listUrl.RawQuery = query.Encode()
+
 	c.HTML(200, "images.gohtml", gin.H{
-		"images":     viewImages,
-		"filter":     filter,
-		"authors":    getAllAuthors(),
-		"categories": getAllCategories(),
+		"images":      viewImages,
+		"highlights":  highlights,
+		"filter":      filter,
+		"page":        &filter.Page,
+		"listUrl":     listUrl.RequestURI(),
+		"previousUrl": pageUrl(&listUrl, max(filter.Page.Offset-filter.Page.Limit, 0)),
+		"nextUrl":     pageUrl(&listUrl, filter.Page.End()),
+		"bulkSummary": c.Query(bulkSummaryParam),
+		"role":        currentRole(c),
+		"authors":     getAllAuthors(),
+		"categories":  getAllCategories(),
 	})
 }
 
@@ -465,10 +859,27 @@ func getImageHtml(c *gin.Context) {
 			"image":      image.toView(),
 			"authors":    getAllAuthors(),
 			"categories": getAllCategories(),
+			"profiles":   getAllProcessingProfiles(),
+			"duplicates": similarImageViews(parseImageIds(c.Query("duplicates"))),
+			"metadata":   imageMetadataView(image.ID),
+			"history":    imageHistory(image.ID),
+			"originals":  originalVersionViews(image),
 		})
 	}
 }
 
+// similarImageViews loads the images an upload was reported to be similar to
+func similarImageViews(ids []uint) []ImageView {
+	if len(ids) == 0 {
+		return nil
+	}
+	var images []Image
+	db.Where("id IN ?", ids).Find(&images)
+	return Map(images, func(image Image) ImageView {
+		return image.toView()
+	})
+}
+
 func updateImageForm(c *gin.Context) {
 	image, err := loadImage(c)
 	if err != nil {
@@ -479,10 +890,15 @@ func updateImageForm(c *gin.Context) {
 	case "save":
 		isNewImage := image.ID == 0
 
+		if _, process := c.GetPostForm("process"); process && !hasRole(c, RoleMaintainer) {
+			return
+		}
+
 		dto := ImageDto{
-			Name:        c.PostForm("name"),
-			Title:       c.PostForm("title"),
-			Description: c.PostForm("description"),
+			Name:                c.PostForm("name"),
+			Title:               c.PostForm("title"),
+			Description:         c.PostForm("description"),
+			ProcessingProfileID: parseProfileId(c.PostForm("processingProfile")),
 		}
 
 		if newSortIndex, err := strconv.Atoi(c.PostForm("sortIndex")); err == nil {
@@ -530,10 +946,19 @@ func updateImageForm(c *gin.Context) {
 		}
 
 		authorChanged := image.AuthorID != dto.AuthorID
+		_, processAfterUpload := c.GetPostForm("process")
 
 		image.updateWithDto(dto)
 
-		db.Transaction(func(tx *gorm.DB) error {
+		txErr := db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+			// The image is saved in several steps, its categories are replaced after the update hooks ran
+			tx, audit, err := beginAudit(tx, auditEntityImage, image.ID)
+			if err != nil {
+				c.Error(err)
+				c.String(500, "Error loading image for the audit log: %v", err)
+				return err
+			}
+
 			res := tx.Save(&image)
 			if res.Error != nil {
 				c.Error(res.Error)
@@ -549,6 +974,13 @@ func updateImageForm(c *gin.Context) {
 					tx.Rollback()
 					return err
 				}
+				// Replacing associations doesn't run the hooks of the image
+				err = indexImages(tx, image.ID)
+				if err != nil {
+					c.Error(err)
+					c.String(500, "Error updating search index: %v", err)
+					return err
+				}
 			}
 			if newRelatedImages != nil {
 				// Delete old relations to this image
@@ -589,8 +1021,6 @@ func updateImageForm(c *gin.Context) {
 				}
 			}
 
-			_, processAfterUpload := c.GetPostForm("process")
-
 			if authorChanged {
 				err := removeVariants(image.ID, tx, c)
 				if err != nil {
@@ -601,36 +1031,44 @@ func updateImageForm(c *gin.Context) {
 				processAfterUpload = true
 			}
 
-			if processAfterUpload {
-				processImageForm(c, tx)
+			err = audit.commit(tx)
+			if err != nil {
+				c.Error(err)
+				c.String(500, "Error updating audit log: %v", err)
+				return err
 			}
-
 			return nil
 		})
 
+		if txErr == nil && processAfterUpload {
+			processImageForm(c, image)
+		}
+
 		if isNewImage {
 			c.Redirect(302, fmt.Sprintf("/images/%d", image.ID))
 		} else {
 			getImageHtml(c)
 		}
 	case "delete":
-		db.Transaction(func(tx *gorm.DB) error {
-			filePath := image.OriginalFilePath()
-			res := tx.Delete(&image)
-			if res.Error != nil {
-				c.Error(res.Error)
-				c.String(500, "Error deleting image in DB: %v", res.Error)
-				return res.Error
-			}
-			err = os.Remove(filePath)
-			if err != nil {
-				c.Error(err)
-				c.String(500, "Error deleting image original from disk: %v", err)
-				return err
-			}
-			return nil
-		})
+		if !hasRole(c, RoleMaintainer) {
+			return
+		}
+		err = trashImage(c, image)
+		if err != nil {
+			c.Error(err)
+			c.String(500, "Error deleting image: %v", err)
+			return
+		}
 		c.Redirect(302, "/images")
+	case "apply-metadata":
+		_, overwrite := c.GetPostForm("overwrite")
+		err = applyImageMetadata(c, image, overwrite)
+		if err != nil {
+			c.Error(err)
+			c.String(500, "Error applying metadata: %v", err)
+			return
+		}
+		c.Redirect(302, fmt.Sprintf("/images/%d", image.ID))
 	}
 }
 
@@ -639,8 +1077,8 @@ func removeVariants(imageId uint, tx *gorm.DB, c *gin.Context) error {
 	db.Where(&ImageVariant{ImageID: imageId}).Find(&variants)
 
 	for _, variant := range variants {
-		err := os.Remove(path.Join(appConfig.ProcessedDir, variant.FileName))
-		if err != nil && !os.IsNotExist(err) {
+		err := processedStorage.Delete(tx.Statement.Context, variant.FileName)
+		if err != nil {
 			return err
 		}
 		tx.Unscoped().Delete(&variant)
@@ -661,62 +1099,107 @@ func uploadImageForm(c *gin.Context) {
 		return
 	}
 
-	oldFileName := strconv.Itoa(int(image.ID)) + "." + image.Format
+	data, err := readUploadedFile(file)
+	if err != nil {
+		c.Error(err)
+		c.String(500, "Error reading file: %v", err)
+		return
+	}
 
-	// Check whether old file exists and delete it if it exits
-	if _, err := os.Stat(oldFileName); err == nil {
-		err = os.Remove(path.Join(appConfig.OriginalDir, oldFileName))
-		if err != nil {
-			c.Error(err)
-			c.String(500, "Could not remove old file: %v", err)
+	info, err := originalFileInfo(data)
+	if err != nil {
+		c.Error(err)
+		c.String(400, "Uploaded file is not a readable image: %v", err)
+		return
+	}
+
+	// Files without an extension get the one of their detected MIME type
+	format := strings.TrimPrefix(filepath.Ext(file.Filename), ".")
+	if len(format) == 0 {
+		var known bool
+		format, known = formatForMimeType(info.MimeType)
+		if !known {
+			c.String(400, "Uploaded file has no extension and its type %s is not a supported image format", info.MimeType)
 			return
 		}
 	}
 
-	extension := filepath.Ext(file.Filename)
-	newFileName := strconv.Itoa(int(image.ID)) + extension
+	version := OriginalVersion{
+		Username: c.GetString(gin.AuthUserKey),
+		FileName: file.Filename,
+		Format:   format,
+	}
+	version.setOriginalFileInfo(info)
+
+	var duplicates []uint
+	version.PerceptualHash, err = perceptualHash(c, data)
+	if err != nil {
+		logger.Warnf("Could not compute perceptual hash of image %d: %v", image.ID, err)
+	} else {
+		duplicates = findSimilarImages(version.PerceptualHash, image.ID, defaultDuplicateDistance)
+	}
 
-	err = c.SaveUploadedFile(file, path.Join(appConfig.OriginalDir, newFileName))
+	metadata, err := extractMetadata(image.ID, data)
+	if err != nil {
+		logger.Warnf("Could not extract metadata of image %d: %v", image.ID, err)
+		metadata = nil
+	} else if _, fill := c.GetPostForm("fillFromMetadata"); fill {
+		applyMetadata(image, metadata, false)
+	}
+
+	// The previous original is kept as a version, so it can be made the original again
+	files := originalFiles{}
+	err = db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+		err := replaceOriginal(tx, &files, image, &version, data)
+		if err != nil {
+			return err
+		}
+		if metadata != nil {
+			err = saveImageMetadata(tx, metadata)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Save(&image).Error
+	})
+	files.finish(c, err)
 	if err != nil {
 		c.Error(err)
 		c.String(500, "Error saving file: %v", err)
 		return
 	}
 
-	image.Format = extension[1:]
-	image.ImageExists = true
-
-	tx := db.Session(&gorm.Session{})
-	tx.Save(&image)
+	if _, err := pruneOriginalVersions(db, image.ID); err != nil {
+		logger.Warnf("Could not prune original versions of image %d: %v", image.ID, err)
+	}
 
 	_, processAfterUpload := c.GetPostForm("process")
 	if processAfterUpload {
-		processImageForm(c, tx)
+		processImageForm(c, image)
 	}
 
-	tx.Commit()
+	if len(duplicates) > 0 {
+		duplicateIds := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(duplicates)), ","), "[]")
+		c.Redirect(302, fmt.Sprintf("/images/%d?duplicates=%s", image.ID, duplicateIds))
+		return
+	}
 
 	c.Redirect(302, fmt.Sprintf("/images/%d", image.ID))
 
 }
 
-func processImageForm(c *gin.Context, tx *gorm.DB) {
-	image, err := loadImageSession(c, tx)
-	if err != nil || !image.ImageExists {
+// processImageForm enqueues processing of the image. It has to be called after the image has been committed, so
+// the job sees the current state.
+func processImageForm(c *gin.Context, image *Image) {
+	if !image.ImageExists {
 		return
 	}
 
-	result, err := processImage(&ImageProcessConfig{
-		Image:           image,
-		ProcessOriginal: true,
-	})
+	_, err := enqueueJob(jobTypeProcessImage, ProcessImagePayload{ImageID: image.ID}, c.GetString(gin.AuthUserKey))
 	if err != nil {
 		c.Error(err)
-		c.String(500, "Error processing file after upload: %v", err)
-		return
+		logger.Errorf("Error enqueuing processing of image %d: %v", image.ID, err)
 	}
-
-	_ = saveProcessResult(result, tx)
 }
 
 func getIcons(c *gin.Context) {
@@ -742,10 +1225,12 @@ func getIcons(c *gin.Context) {
 }
 
 func getImages(c *gin.Context) {
-	images, _, err := fetchImages(c)
+	// The API returns all images unless a page is requested
+	images, filter, err := fetchImages(c, 0)
 	if err != nil {
 		return
 	}
+	setPageHeaders(c, &filter.Page)
 
 	var imagesDto []ImageDto
 
@@ -789,7 +1274,7 @@ func addImage(c *gin.Context) {
 
 	image := imageDto.toModel()
 
-	result := db.Create(&image)
+	result := db.WithContext(c).Create(&image)
 
 	if result.Error != nil {
 		c.String(http.StatusInternalServerError, "Error inserting category: %v", result.Error)
@@ -821,7 +1306,7 @@ func updateImage(c *gin.Context) {
 	}
 
 	image.updateWithDto(imageDto)
-	res = db.Save(&image)
+	res = db.WithContext(c).Save(&image)
 	if res.Error != nil {
 		c.String(http.StatusInternalServerError, "Error updating image with ID '%s': %v", id, res.Error)
 		return
@@ -836,12 +1321,15 @@ func deleteImage(c *gin.Context) {
 		c.String(http.StatusBadRequest, err.Error())
 	}
 
-	image := Image{}
-	image.ID = id
+	image, err := loadImageById(id)
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
 
-	res := db.Delete(&image)
-	if res.Error != nil {
-		c.String(http.StatusInternalServerError, "Error deleting image with ID '%s': %v", id, res.Error)
+	err = trashImage(c, image)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error deleting image with ID '%d': %v", id, err)
 		return
 	}
 
@@ -890,7 +1378,7 @@ func processFaviconApi(c *gin.Context) {
 	if err != nil {
 		c.String(500, c.Error(err).Error())
 	}
-	err = os.WriteFile(path.Join(appConfig.ProcessedDir, "icons.json"), jsonBytes, 0666)
+	err = processedStorage.Put(c, "icons.json", jsonBytes)
 	if err != nil {
 		c.String(500, c.Error(err).Error())
 	}
@@ -898,67 +1386,207 @@ func processFaviconApi(c *gin.Context) {
 	c.JSON(200, &iconResult)
 }
 
-func processImages(c *gin.Context) {
-	var images []Image
-
-	db.Preload(clause.Associations).Find(&images)
-
-	err := os.RemoveAll(appConfig.ProcessedDir)
+// processImagesJob processes all images. Unless forced, images that haven't changed since they were last processed
+// are skipped. Variants and files that don't belong to any image anymore are removed afterward.
+func processImagesJob(ctx context.Context, run *JobRun) (any, error) {
+	payload := ProcessImagesPayload{}
+	err := run.DecodePayload(&payload)
 	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
+		return nil, err
 	}
 
-	err = createDirIfNotExists(appConfig.ProcessedDir)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
+	var images []Image
+	res := db.Preload(clause.Associations).Find(&images)
+	if res.Error != nil {
+		return nil, res.Error
 	}
 
-	wg := sync.WaitGroup{}
-	resultChannel := make(chan *ImageProcessResult, len(images))
+	summary := ProcessImagesSummary{}
 	results := make([]*ImageProcessResult, 0, len(images))
+	// Finished images are saved even after the job is cancelled, the context attributes the changes to the user who
+	// enqueued the job
+	tx := db.WithContext(context.WithoutCancel(ctx))
+
+	type imageOutcome struct {
+		imageId uint
+		result  *ImageProcessResult
+		err     error
+	}
 
-	for i := range images {
+	// Only as many images as there are processing slots are loaded at a time, the rules of each image share those
+	// slots through the processing limiter
+	indexes := make(chan int)
+	outcomes := make(chan imageOutcome)
+	wg := sync.WaitGroup{}
+	for w := 0; w < min(processingLimiter.Slots(), len(images)); w++ {
 		wg.Add(1)
-		// Go will override variables in the for loop before the goroutine starts
-		// Grab the value directly from the array instead
-		image := images[i]
-		processImageAsync(&ImageProcessConfig{
-			Image:           &image,
-			ProcessOriginal: true,
-		}, resultChannel, &wg)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result, err := processImage(&ImageProcessConfig{
+					Context:         ctx,
+					Image:           &images[i],
+					ProcessOriginal: true,
+					SkipUnchanged:   !payload.Force,
+				})
+				outcomes <- imageOutcome{imageId: images[i].ID, result: result, err: err}
+			}
+		}()
 	}
 
+	go func() {
+		defer close(indexes)
+		for i := range images {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	go func() {
 		wg.Wait()
-		close(resultChannel)
+		close(outcomes)
 	}()
 
-	tx := db.Session(&gorm.Session{AllowGlobalUpdate: true})
-	tx.Unscoped().Delete(&ImageVariant{})
-	tx.Exec("UPDATE sqlite_sequence SET seq = 0 WHERE name = 'image_variants'")
+	run.SetProgress(0, len(images))
+	done := 0
+	for outcome := range outcomes {
+		done++
+		if outcome.err == nil {
+			_, outcome.err = saveProcessResult(outcome.result, tx)
+		}
+		if outcome.err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("Error processing image %d: %v", outcome.imageId, outcome.err)
+				summary.Failed = append(summary.Failed, outcome.imageId)
+			}
+		} else {
+			results = append(results, outcome.result)
+			if outcome.result.Skipped {
+				summary.Skipped++
+			} else {
+				summary.Processed++
+			}
+		}
+		run.SetProgress(done, len(images))
+	}
 
-	for result := range resultChannel {
-		_ = saveProcessResult(result, tx)
-		results = append(results, result)
+	if ctx.Err() != nil {
+		return summary, ctx.Err()
 	}
 
-	tx.Commit()
+	err = removeOrphanedVariants(tx)
+	if err != nil {
+		logger.Errorf("Error removing orphaned variants: %v", err)
+	}
+
+	logger.Infof("Processed %d images, skipped %d unchanged images", summary.Processed, summary.Skipped)
 
 	jsonBytes, err := json.Marshal(&results)
 	if err != nil {
-		c.String(500, c.Error(err).Error())
+		return summary, err
 	}
-	err = os.WriteFile(path.Join(appConfig.ProcessedDir, "images.json"), jsonBytes, 0666)
+	err = processedStorage.Put(tx.Statement.Context, "images.json", jsonBytes)
 	if err != nil {
-		c.String(500, c.Error(err).Error())
+		return summary, err
+	}
+
+	return summary, nil
+}
+
+func processImageJob(ctx context.Context, run *JobRun) (any, error) {
+	payload := ProcessImagePayload{}
+	err := run.DecodePayload(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var image Image
+	res := db.Preload(clause.Associations).First(&image, payload.ImageID)
+	if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("image with id '%d' not found", payload.ImageID)
+	}
+
+	run.SetProgress(0, 1)
+	result, err := processImage(&ImageProcessConfig{
+		Context:         ctx,
+		Image:           &image,
+		ProcessOriginal: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := saveProcessResult(result, db.WithContext(context.WithoutCancel(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	run.SetProgress(1, 1)
+
+	return Map(variants, func(variant ImageVariant) ImageVariantDto {
+		return variant.toDto()
+	}), nil
+}
+
+func enqueueProcessImages(c *gin.Context) (*Job, error) {
+	force, _ := strconv.ParseBool(c.Query("force"))
+	if _, forceForm := c.GetPostForm("force"); forceForm {
+		force = true
+	}
+
+	return enqueueJob(jobTypeProcessImages, ProcessImagesPayload{Force: force}, c.GetString(gin.AuthUserKey))
+}
+
+func processImagesForm(c *gin.Context) {
+	job, err := enqueueProcessImages(c)
+	if err != nil {
+		c.Error(err)
+		c.String(500, "Error enqueuing image processing: %v", err)
+		return
+	}
+
+	c.Redirect(302, fmt.Sprintf("/jobs/%d", job.ID))
+}
+
+func processImages(c *gin.Context) {
+	job, err := enqueueProcessImages(c)
+	if err != nil {
+		c.Error(err)
+		c.String(500, "Error enqueuing image processing: %v", err)
+		return
 	}
 
-	c.JSON(200, &results)
+	c.JSON(http.StatusAccepted, job.toDto())
 }
 
-func saveProcessResult(result *ImageProcessResult, tx *gorm.DB) []ImageVariant {
+// saveProcessResult replaces the stored variants of the processed image with the new ones. Files of old variants
+// that weren't generated again are deleted once the new variants are saved, files that can't be deleted are left to
+// removeOrphanedVariants. The fingerprint is only saved together with the variants, so a failed save processes the
+// image again next time.
+func saveProcessResult(result *ImageProcessResult, tx *gorm.DB) ([]ImageVariant, error) {
+	if len(result.PerceptualHash) > 0 {
+		res := tx.Model(&Image{}).Where("id = ?", result.ImageID).UpdateColumn("perceptual_hash", result.PerceptualHash)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+	}
+	if result.OriginalFile != nil {
+		if err := saveOriginalFileInfo(result.ImageID, *result.OriginalFile); err != nil {
+			logger.Warnf("Could not save original file info of image %d: %v", result.ImageID, err)
+		}
+	}
+	if result.Metadata != nil {
+		if err := saveImageMetadata(tx, result.Metadata); err != nil {
+			logger.Warnf("Could not save metadata of image %d: %v", result.ImageID, err)
+		}
+	}
+
+	if result.Skipped {
+		return nil, nil
+	}
+
 	toImageVariant := func(pv ProcessedImageVariant, imageId uint, original bool) ImageVariant {
 		return ImageVariant{
 			Height:   pv.Height,
@@ -976,16 +1604,102 @@ func saveProcessResult(result *ImageProcessResult, tx *gorm.DB) []ImageVariant {
 	imageId := result.ImageID
 
 	variants := make([]ImageVariant, 0, len(result.Variants)+1)
+	newFiles := make(map[string]bool, len(result.Variants)+1)
 	for _, v := range result.Variants {
 		variants = append(variants, toImageVariant(v, imageId, false))
+		newFiles[v.FileName] = true
 	}
 
 	if result.Original != nil {
 		variants = append(variants, toImageVariant(*result.Original, imageId, true))
+		newFiles[result.Original.FileName] = true
+	}
+
+	var oldVariants []ImageVariant
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("image_id = ?", imageId).Find(&oldVariants)
+		if res.Error != nil {
+			return res.Error
+		}
+		res = tx.Unscoped().Delete(&ImageVariant{}, "image_id = ?", imageId)
+		if res.Error != nil {
+			return res.Error
+		}
+		if len(variants) > 0 {
+			res = tx.Create(variants)
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		return tx.Model(&Image{}).Where("id = ?", imageId).UpdateColumn("processing_fingerprint", result.Fingerprint).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not save variants of image %d: %w", imageId, err)
+	}
+
+	for _, oldVariant := range oldVariants {
+		if newFiles[oldVariant.FileName] {
+			continue
+		}
+		err = processedStorage.Delete(tx.Statement.Context, oldVariant.FileName)
+		if err != nil {
+			logger.Warnf("Could not remove outdated variant \"%s\": %v", oldVariant.FileName, err)
+		}
+	}
+
+	return variants, nil
+}
+
+// removeOrphanedVariants deletes variants of images that don't exist anymore, as well as all processed files that
+// aren't referenced by any variant
+func removeOrphanedVariants(tx *gorm.DB) error {
+	var orphanedVariants []ImageVariant
+	res := tx.Where("image_id NOT IN (?)", tx.Model(&Image{}).Select("id")).Find(&orphanedVariants)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if len(orphanedVariants) > 0 {
+		res = tx.Unscoped().Delete(&orphanedVariants)
+		if res.Error != nil {
+			return res.Error
+		}
+		logger.Infof("Removed %d orphaned variants", len(orphanedVariants))
+	}
+
+	var referencedFiles []string
+	res = tx.Model(&ImageVariant{}).Pluck("file_name", &referencedFiles)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	referenced := make(map[string]bool, len(referencedFiles))
+	for _, fileName := range referencedFiles {
+		referenced[fileName] = true
+	}
+
+	ctx := tx.Statement.Context
+	objects, err := processedStorage.List(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, object := range objects {
+		// Metadata files like images.json and icons.json are stored next to the variants
+		if strings.Contains(object.Key, "/") || referenced[object.Key] || path.Ext(object.Key) == ".json" {
+			continue
+		}
+		err = processedStorage.Delete(ctx, object.Key)
+		if err != nil {
+			return err
+		}
+		removed++
 	}
 
-	tx.Unscoped().Delete(&ImageVariant{}, "image_id = ?", imageId)
-	tx.Create(variants)
+	if removed > 0 {
+		logger.Infof("Removed %d orphaned processed files", removed)
+	}
 
-	return variants
+	return nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func processedTestResult(imageId uint) *ImageProcessResult {
+	return &ImageProcessResult{
+		ImageID:     imageId,
+		Fingerprint: "new-fingerprint",
+		Original:    &ProcessedImageVariant{Format: "jpg", FileName: "sunset.jpg"},
+		Variants:    []ProcessedImageVariant{{Format: "webp", FileName: "sunset-large.webp", Width: 1200}},
+	}
+}
+
+func variantFileNames(t *testing.T, imageId uint) []string {
+	var fileNames []string
+	if res := db.Model(&ImageVariant{}).Where("image_id = ?", imageId).Order("file_name").Pluck("file_name", &fileNames); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	return fileNames
+}
+
+func TestSaveProcessResult(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	ctx := context.Background()
+	image := createTestImageFiles(t)
+
+	variants, err := saveProcessResult(processedTestResult(image.ID), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 2 {
+		t.Errorf("got variants %+v", variants)
+	}
+	if fileNames := variantFileNames(t, image.ID); !slices.Equal(fileNames, []string{"sunset-large.webp", "sunset.jpg"}) {
+		t.Errorf("stored variants are %v", fileNames)
+	}
+	if objectExists(ctx, processedStorage, "sunset-small.webp") {
+		t.Error("file of the outdated variant wasn't deleted")
+	}
+	saved := Image{}
+	db.First(&saved, image.ID)
+	if saved.ProcessingFingerprint != "new-fingerprint" {
+		t.Errorf("fingerprint is %q", saved.ProcessingFingerprint)
+	}
+}
+
+func TestSaveProcessResultFailure(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	ctx := context.Background()
+	image := createTestImageFiles(t)
+
+	failure := errors.New("insert failed")
+	err := db.Callback().Create().Before("gorm:create").Register("test:fail_variants", func(tx *gorm.DB) {
+		if tx.Statement.Table == "image_variants" {
+			tx.AddError(failure)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := saveProcessResult(processedTestResult(image.ID), db); !errors.Is(err, failure) {
+		t.Fatalf("got error %v", err)
+	}
+	if fileNames := variantFileNames(t, image.ID); !slices.Equal(fileNames, []string{"sunset-small.webp"}) {
+		t.Errorf("failed save left the variants %v", fileNames)
+	}
+	if !objectExists(ctx, processedStorage, "sunset-small.webp") {
+		t.Error("file of the kept variant was deleted")
+	}
+	saved := Image{}
+	db.First(&saved, image.ID)
+	if saved.ProcessingFingerprint == "new-fingerprint" {
+		t.Error("fingerprint was saved without the variants, the image wouldn't be processed again")
+	}
+}
+
+func TestFetchImagesFilters(t *testing.T) {
+	setupTestDatabase(t)
+	createTestImages(t, 5)
+	jane, john := Author{Name: "Jane"}, Author{Name: "John"}
+	db.Create(&jane)
+	db.Create(&john)
+	categories := []Category{{Name: "landscapes"}, {Name: "coast"}, {Name: "portraits"}}
+	db.Create(&categories)
+	statements := []string{
+		"INSERT INTO images_categories (image_id, category_id) VALUES (1, 1), (2, 1), (2, 2), (3, 2), (4, 3)",
+		"UPDATE images SET author_id = 1 WHERE id IN (1, 2)",
+		"UPDATE images SET author_id = 2, nsfw = true WHERE id = 3",
+		"UPDATE images SET image_exists = true WHERE id IN (1, 2)",
+	}
+	for _, statement := range statements {
+		if res := db.Exec(statement); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	db.Create(&ImageVariant{ImageID: 2, Format: "webp", FileName: "image-2-small.webp"})
+	db.Model(&Image{}).Where("id = 1").UpdateColumn("created_at", time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local))
+	db.Model(&Image{}).Where("id = 2").UpdateColumn("created_at", time.Date(2024, 1, 20, 12, 0, 0, 0, time.Local))
+	db.Model(&Image{}).Where("id = 4").UpdateColumn("updated_at", time.Date(2024, 2, 1, 12, 0, 0, 0, time.Local))
+
+	tests := []struct {
+		query  string
+		images []string
+	}{
+		{"category=1", []string{"image-1", "image-2"}},
+		{"category=1,2", []string{"image-1", "image-2", "image-3"}},
+		{"category=1&category=2&categoryMode=ALL", []string{"image-2"}},
+		{"category=1&category=3&categoryMode=all", []string{}},
+		{"excludeCategory=2", []string{"image-1", "image-4", "image-5"}},
+		{"category=1&excludeCategory=2", []string{"image-1"}},
+		{"author=1", []string{"image-1", "image-2"}},
+		{"author=1&author=2&category=2", []string{"image-2", "image-3"}},
+		{"nsfw=true", []string{"image-3"}},
+		{"nsfw=false&imageExists=true", []string{"image-1", "image-2"}},
+		{"imageExists=false", []string{"image-3", "image-4", "image-5"}},
+		{"hasVariants=true", []string{"image-2"}},
+		{"hasVariants=false&excludeCategory=3", []string{"image-1", "image-3", "image-5"}},
+		// A date as upper bound includes the whole day
+		{"createdBefore=2024-01-20", []string{"image-1", "image-2"}},
+		{"createdAfter=2024-01-15&createdBefore=2024-01-20", []string{"image-2"}},
+		{"createdBefore=2024-01-15T00:00:00Z", []string{"image-1"}},
+		{"updatedBefore=2024-12-31", []string{"image-4"}},
+		{"updatedAfter=2024-12-31&createdAfter=2024-12-31", []string{"image-3", "image-5"}},
+	}
+	for _, test := range tests {
+		if images, page := fetchTestPage(t, test.query); !slices.Equal(images, test.images) || page.Total != int64(len(test.images)) {
+			t.Errorf("%s found %v of %d, expected %v", test.query, images, page.Total, test.images)
+		}
+	}
+
+	for _, query := range []string{"category=landscapes", "excludeCategory=1,x", "author=-1", "createdAfter=yesterday",
+		"updatedBefore=2024-13-01", "nsfw=maybe", "hasVariants=2"} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest("GET", "/v1/images?"+query, nil)
+		if _, _, err := fetchImages(c, 0); err == nil || recorder.Code != 400 {
+			t.Errorf("%s returned %v with status %d", query, err, recorder.Code)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/gin-gonic/gin"
 	"gopkg.in/yaml.v3"
 	"gorm.io/gorm"
-	"io"
+	"net/http"
 	"os"
 	"path"
 	"regexp"
@@ -120,10 +122,10 @@ func importMeta(libraryPath string) MetaImageCollection {
 	return imageDefinitions
 }
 
-func importGalleryLibrary(libraryPath string) error {
+func importGalleryLibrary(ctx context.Context, libraryPath string) error {
 	metaImages := importMeta(libraryPath)
 
-	err := truncateTables()
+	err := truncateTables(ctx)
 	if err != nil {
 		return err
 	}
@@ -181,7 +183,7 @@ func importGalleryLibrary(libraryPath string) error {
 			IgnoreAuthorName: meta.IgnoreAuthorName,
 			Author:           &author,
 			Categories:       categories,
-			SortIndex:        (idx + 1) * 10,
+			SortIndex:        (idx + 1) * sortIndexStep,
 		}
 
 		image.ID = uint(meta.ID + importIdOffset)
@@ -223,26 +225,51 @@ func importGalleryLibrary(libraryPath string) error {
 
 	tx.Commit()
 
-	// Clear original folder
-	err = os.RemoveAll(path.Join(appConfig.OriginalDir))
+	// Clear originals
+	err = clearStorage(ctx, originalStorage)
 	if err != nil {
 		return err
 	}
 
-	err = createDirIfNotExists(appConfig.OriginalDir)
+	// The trashed images have been truncated together with all others
+	err = clearStorage(ctx, trashStorage)
+	if err != nil {
+		return err
+	}
+
+	// Previous originals belong to images whose ids are reused by the import
+	err = clearStorage(ctx, versionStorage)
 	if err != nil {
 		return err
 	}
 
 	for _, image := range images {
-		copyImageFile(image.ID, libraryPath)
+		copyImageFile(ctx, image.ID, libraryPath)
 	}
 
 	return nil
 
 }
 
-func copyImageFile(imageId uint, libraryPath string) {
+// ------------- WEBSERVER HANDLER -------------
+
+func importLibrary(c *gin.Context) {
+	if len(appConfig.ImportDir) == 0 {
+		c.String(http.StatusBadRequest, "No import directory configured")
+		return
+	}
+
+	err := importGalleryLibrary(c, appConfig.ImportDir)
+	if err != nil {
+		c.String(http.StatusInternalServerError, c.Error(err).Error())
+		return
+	}
+
+	logger.Infof("User \"%s\" imported gallery library from %s", c.GetString(gin.AuthUserKey), appConfig.ImportDir)
+	c.String(http.StatusOK, "Imported gallery library from %s", appConfig.ImportDir)
+}
+
+func copyImageFile(ctx context.Context, imageId uint, libraryPath string) {
 	image := Image{}
 	image.ID = imageId
 	res := db.Preload("Author").First(&image)
@@ -255,27 +282,23 @@ func copyImageFile(imageId uint, libraryPath string) {
 
 	sourceFileName := fmt.Sprintf("%s.%s", image.ImageIdentifier(), format)
 	sourcePath := path.Join(libraryPath, sourceFileName)
-	source, err := os.Open(sourcePath)
+	data, err := os.ReadFile(sourcePath)
 	if err != nil {
 		logger.Errorf("Could not open source file: %v", err)
 		return
 	}
-	defer source.Close()
 
 	destinationFileName := fmt.Sprintf("%d.%s", image.ID, format)
-	destination, err := os.Create(path.Join(appConfig.OriginalDir, destinationFileName))
-	if err != nil {
-		logger.Errorf("Could not create destination file: %v", err)
-		return
-	}
-	defer destination.Close()
-
-	_, err = io.Copy(destination, source)
+	err = originalStorage.Put(ctx, destinationFileName, data)
 	if err != nil {
 		logger.Errorf("Could not copy file: %v", err)
 	}
 
 	image.ImageExists = true
+	err = updateOriginalFileInfo(ctx, &image)
+	if err != nil {
+		logger.Warnf("Could not read original of image %d: %v", image.ID, err)
+	}
 	db.Save(&image)
 }
 
@@ -283,8 +306,9 @@ func formatDescription(description string) string {
 	return descriptionRegexReplace.ReplaceAllString(description, "\n")
 }
 
-func truncateTables() error {
-	tables := []string{"images_categories", "images", "authors", "icons", "images_relations", "image_variants"}
+func truncateTables(ctx context.Context) error {
+	tables := []string{"images_categories", "images", "authors", "icons", "images_relations", "image_variants",
+		"original_versions", "image_metadata"}
 
 	for _, table := range tables {
 		res := db.Exec("DELETE FROM " + table)
@@ -298,7 +322,32 @@ func truncateTables() error {
 		}
 	}
 
-	res := db.Unscoped().Delete(&Category{}, "name NOT IN ?", reservedCategories)
+	if searchAvailable {
+		res := db.Exec("DELETE FROM " + searchTable)
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	// The import reuses the ids, so the history of the deleted entities would otherwise show up on the imported ones.
+	// Their revisions can't be restored anymore, their audit entries are kept but marked as superseded. Only the
+	// reserved categories are kept.
+	reservedIds := db.Model(&Category{}).Select("id").Where("name IN ?", reservedCategories)
+	res := db.Where("entity_type <> ? OR entity_id NOT IN (?)", auditEntityCategory, reservedIds).Delete(&Revision{})
+	if res.Error != nil {
+		return res.Error
+	}
+	res = db.Model(&AuditEntry{}).Where("entity_type <> ? OR entity_id NOT IN (?)", auditEntityCategory, reservedIds).
+		Update("superseded", true)
+	if res.Error != nil {
+		return res.Error
+	}
+	res = db.WithContext(ctx).Create(&AuditEntry{Username: auditUser(db.WithContext(ctx)), Action: auditActionImport})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	res = db.Unscoped().Delete(&Category{}, "name NOT IN ?", reservedCategories)
 	if res.Error != nil {
 		return res.Error
 	}
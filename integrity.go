@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+type (
+	// DeleteOptions decide what happens to the images that still reference a deleted author or category
+	DeleteOptions struct {
+		// Strategy is "refuse" (the default), "reassign" or "cascade"
+		Strategy string
+		// ReassignTo is the author or category that takes over the images if the strategy is "reassign"
+		ReassignTo uint
+	}
+
+	// integrityCheck finds rows that reference entities which don't exist anymore
+	integrityCheck struct {
+		Description string
+		Model       any
+		Table       string
+		Condition   string
+		// Repair fixes the orphaned rows, they are deleted if it isn't set
+		Repair func(tx *gorm.DB) (int64, error)
+	}
+)
+
+const (
+	// deleteStrategyRefuse fails the deletion as long as images reference the entity
+	deleteStrategyRefuse = "refuse"
+	// deleteStrategyReassign moves the images to another author, or adds them to another category
+	deleteStrategyReassign = "reassign"
+	// deleteStrategyCascade moves the images of an author to the trash, or removes the category from its images
+	deleteStrategyCascade = "cascade"
+
+	checkUsage = "usage: check [--repair]"
+)
+
+var (
+	deleteStrategies = []string{deleteStrategyRefuse, deleteStrategyReassign, deleteStrategyCascade}
+
+	errStillReferenced       = errors.New("still referenced")
+	errReservedCategory      = errors.New("reserved category")
+	errInvalidDeleteStrategy = errors.New("invalid delete strategy")
+
+	integrityChecks = []integrityCheck{
+		{
+			Description: "category assignments of missing images",
+			Table:       "images_categories",
+			Condition:   "image_id NOT IN (SELECT id FROM images)",
+		},
+		{
+			Description: "category assignments of missing categories",
+			Table:       "images_categories",
+			Condition:   "category_id NOT IN (SELECT id FROM categories)",
+		},
+		{
+			Description: "relations of missing images",
+			Table:       "images_relations",
+			Condition:   "image_id NOT IN (SELECT id FROM images) OR related_id NOT IN (SELECT id FROM images)",
+		},
+		{
+			Description: "variants of missing or deleted images",
+			Model:       &ImageVariant{},
+			Condition:   "image_id NOT IN (SELECT id FROM images WHERE deleted_at IS NULL)",
+			Repair:      repairOrphanedVariants,
+		},
+		{
+			Description: "original versions of missing images",
+			Model:       &OriginalVersion{},
+			Condition:   "image_id NOT IN (SELECT id FROM images)",
+			Repair:      repairOrphanedVersions,
+		},
+		{
+			Description: "metadata of missing images",
+			Model:       &ImageMetadata{},
+			Condition:   "image_id NOT IN (SELECT id FROM images)",
+		},
+		{
+			Description: "images of missing authors",
+			Model:       &Image{},
+			Condition:   "author_id > 0 AND author_id NOT IN (SELECT id FROM authors)",
+			Repair: func(tx *gorm.DB) (int64, error) {
+				res := tx.Unscoped().Model(&Image{}).
+					Where("author_id > 0 AND author_id NOT IN (SELECT id FROM authors)").UpdateColumn("author_id", 0)
+				return res.RowsAffected, res.Error
+			},
+		},
+	}
+)
+
+func (o *DeleteOptions) validate(id uint) error {
+	if len(o.Strategy) == 0 {
+		o.Strategy = deleteStrategyRefuse
+	}
+	if !slices.Contains(deleteStrategies, o.Strategy) {
+		return fmt.Errorf("%w \"%s\"", errInvalidDeleteStrategy, o.Strategy)
+	}
+	if o.Strategy == deleteStrategyReassign && (o.ReassignTo == 0 || o.ReassignTo == id) {
+		return fmt.Errorf("%w: reassign needs another author or category", errInvalidDeleteStrategy)
+	}
+	return nil
+}
+
+func isReservedCategory(category *Category) bool {
+	return slices.Contains(reservedCategories, category.Name)
+}
+
+// releaseAuthor applies the delete strategy to the images of the author, so it can be deleted without leaving images
+// that reference it
+func releaseAuthor(tx *gorm.DB, files *originalFiles, authorId uint, options DeleteOptions) error {
+	var ids []uint
+	res := tx.Model(&Image{}).Where("author_id = ?", authorId).Pluck("id", &ids)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	switch options.Strategy {
+	case deleteStrategyReassign:
+		err := requireExisting(tx, &Author{}, "authors", []uint{options.ReassignTo})
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidDeleteStrategy, err)
+		}
+		// Deleted images are moved as well, so they don't reference the author once they are restored
+		res = tx.Unscoped().Model(&Image{}).Where("author_id = ?", authorId).UpdateColumn("author_id", options.ReassignTo)
+		if res.Error != nil {
+			return res.Error
+		}
+		return indexImages(tx, ids...)
+	case deleteStrategyCascade:
+		for _, id := range ids {
+			image := Image{}
+			res = tx.First(&image, id)
+			if res.Error != nil {
+				return res.Error
+			}
+			err := trashImageTx(tx, files, &image)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(ids) > 0 {
+		return fmt.Errorf("author %d is %w by %d images", authorId, errStillReferenced, len(ids))
+	}
+	return nil
+}
+
+// releaseCategory applies the delete strategy to the images of the category, so it can be deleted without leaving
+// category assignments behind
+func releaseCategory(tx *gorm.DB, categoryId uint, options DeleteOptions) error {
+	var ids []uint
+	res := tx.Model(&Image{}).Where("id IN (SELECT image_id FROM images_categories WHERE category_id = ?)", categoryId).
+		Pluck("id", &ids)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	switch options.Strategy {
+	case deleteStrategyReassign:
+		err := requireExisting(tx, &Category{}, "categories", []uint{options.ReassignTo})
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidDeleteStrategy, err)
+		}
+		res = tx.Exec("INSERT INTO images_categories (image_id, category_id) "+
+			"SELECT image_id, ? FROM images_categories WHERE category_id = ? ON CONFLICT DO NOTHING",
+			options.ReassignTo, categoryId)
+		if res.Error != nil {
+			return res.Error
+		}
+	case deleteStrategyCascade:
+	default:
+		if len(ids) > 0 {
+			return fmt.Errorf("category %d is %w by %d images", categoryId, errStillReferenced, len(ids))
+		}
+		return nil
+	}
+
+	res = tx.Exec("DELETE FROM images_categories WHERE category_id = ?", categoryId)
+	if res.Error != nil {
+		return res.Error
+	}
+	return indexImages(tx, ids...)
+}
+
+func repairOrphanedVariants(tx *gorm.DB) (int64, error) {
+	var variants []ImageVariant
+	res := tx.Unscoped().Where("image_id NOT IN (SELECT id FROM images WHERE deleted_at IS NULL)").Find(&variants)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	for _, variant := range variants {
+		err := processedStorage.Delete(tx.Statement.Context, variant.FileName)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(variants) == 0 {
+		return 0, nil
+	}
+	res = tx.Unscoped().Delete(&variants)
+	return res.RowsAffected, res.Error
+}
+
+func (check *integrityCheck) query(tx *gorm.DB) *gorm.DB {
+	if check.Model != nil {
+		return tx.Unscoped().Model(check.Model).Where(check.Condition)
+	}
+	return tx.Table(check.Table).Where(check.Condition)
+}
+
+func (check *integrityCheck) repair(tx *gorm.DB) (int64, error) {
+	if check.Repair != nil {
+		return check.Repair(tx)
+	}
+	var res *gorm.DB
+	if check.Model != nil {
+		res = tx.Unscoped().Where(check.Condition).Delete(check.Model)
+	} else {
+		res = tx.Exec("DELETE FROM " + check.Table + " WHERE " + check.Condition)
+	}
+	return res.RowsAffected, res.Error
+}
+
+// checkCommand reports rows that reference missing images, authors or categories and removes them with --repair
+func checkCommand(args []string) error {
+	repair := false
+	for _, arg := range args {
+		if arg != "--repair" {
+			return errors.New(checkUsage)
+		}
+		repair = true
+	}
+
+	var found, repaired int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, check := range integrityChecks {
+			var count int64
+			res := check.query(tx).Count(&count)
+			if res.Error != nil {
+				return res.Error
+			}
+			if count == 0 {
+				continue
+			}
+			found += count
+			fmt.Printf("orphaned\t%d\t%s\n", count, check.Description)
+
+			if !repair {
+				continue
+			}
+			fixed, err := check.repair(tx)
+			if err != nil {
+				return fmt.Errorf("could not repair %s: %w", check.Description, err)
+			}
+			repaired += fixed
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d orphaned rows found, %d repaired\n", found, repaired)
+
+	if found > repaired {
+		return fmt.Errorf("%d rows reference missing entities", found-repaired)
+	}
+	return nil
+}
+
+func deleteErrorStatus(err error) int {
+	if errors.Is(err, errStillReferenced) || errors.Is(err, errReservedCategory) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, errInvalidDeleteStrategy) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// deleteOptionsFromRequest reads the delete strategy from the query of API requests or the form of the UI
+func deleteOptionsFromRequest(c *gin.Context) (DeleteOptions, error) {
+	options := DeleteOptions{
+		Strategy: c.Query("strategy"),
+	}
+	rawReassign := c.Query("reassignTo")
+	if c.Request.Method == http.MethodPost {
+		options.Strategy = c.PostForm("strategy")
+		rawReassign = c.PostForm("reassignTo")
+	}
+	if len(rawReassign) > 0 {
+		id, err := strconv.ParseUint(rawReassign, 10, 64)
+		if err != nil {
+			return options, fmt.Errorf("%w: %w", errInvalidDeleteStrategy, err)
+		}
+		options.ReassignTo = uint(id)
+	}
+	return options, nil
+}
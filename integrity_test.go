@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what the function prints, the check command reports to stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+	defer func() {
+		os.Stdout = previous
+	}()
+	run()
+	writer.Close()
+	return <-output
+}
+
+// createTestOrphans creates an image with valid references and rows of every kind that reference missing entities
+func createTestOrphans(t *testing.T) {
+	ctx := context.Background()
+	author := Author{Name: "Jane"}
+	db.Create(&author)
+	category := Category{Name: "landscapes"}
+	db.Create(&category)
+	images := []Image{{Name: "kept", AuthorID: author.ID}, {Name: "orphaned", AuthorID: 99}}
+	for i := range images {
+		if res := db.Create(&images[i]); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	kept := images[0]
+
+	statements := []string{
+		"INSERT INTO images_categories (image_id, category_id) VALUES (1, 1), (1, 99), (99, 1)",
+		"INSERT INTO images_relations (image_id, related_id) VALUES (1, 2), (2, 1), (1, 99)",
+	}
+	for _, statement := range statements {
+		if res := db.Exec(statement); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	rows := []any{
+		&ImageVariant{ImageID: kept.ID, Format: "webp", FileName: "kept.webp"},
+		&ImageVariant{ImageID: 99, Format: "webp", FileName: "orphaned.webp"},
+		&OriginalVersion{ImageID: kept.ID, Format: "jpg"},
+		&OriginalVersion{ImageID: 99, Format: "jpg"},
+		&ImageMetadata{ImageID: kept.ID},
+		&ImageMetadata{ImageID: 99},
+	}
+	for _, row := range rows {
+		if res := db.Create(row); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	for _, file := range []string{"kept.webp", "orphaned.webp"} {
+		if err := processedStorage.Put(ctx, file, []byte(file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"1-1.jpg", "99-2.jpg"} {
+		if err := versionStorage.Put(ctx, file, []byte(file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	createTestOrphans(t)
+	ctx := context.Background()
+
+	var err error
+	report := captureStdout(t, func() {
+		err = checkCommand(nil)
+	})
+	if err == nil || err.Error() != "7 rows reference missing entities" {
+		t.Errorf("check returned %v", err)
+	}
+	for _, line := range []string{
+		"orphaned\t1\tcategory assignments of missing images\n",
+		"orphaned\t1\tcategory assignments of missing categories\n",
+		"orphaned\t1\trelations of missing images\n",
+		"orphaned\t1\tvariants of missing or deleted images\n",
+		"orphaned\t1\toriginal versions of missing images\n",
+		"orphaned\t1\tmetadata of missing images\n",
+		"orphaned\t1\timages of missing authors\n",
+		"7 orphaned rows found, 0 repaired\n",
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("report doesn't contain %q:\n%s", line, report)
+		}
+	}
+	if !objectExists(ctx, processedStorage, "orphaned.webp") {
+		t.Error("check without --repair deleted files")
+	}
+
+	report = captureStdout(t, func() {
+		err = checkCommand([]string{"--repair"})
+	})
+	if err != nil || !strings.HasSuffix(report, "7 orphaned rows found, 7 repaired\n") {
+		t.Errorf("repair returned %v:\n%s", err, report)
+	}
+	report = captureStdout(t, func() {
+		err = checkCommand(nil)
+	})
+	if err != nil || report != "0 orphaned rows found, 0 repaired\n" {
+		t.Errorf("check after the repair returned %v:\n%s", err, report)
+	}
+
+	// The rows with valid references are kept
+	var categoryIds, relatedIds []uint
+	db.Table("images_categories").Where("image_id = 1").Pluck("category_id", &categoryIds)
+	db.Table("images_relations").Where("image_id = 1").Pluck("related_id", &relatedIds)
+	if !slices.Equal(categoryIds, []uint{1}) || !slices.Equal(relatedIds, []uint{2}) {
+		t.Errorf("image 1 has categories %v and relations %v", categoryIds, relatedIds)
+	}
+	orphaned := Image{}
+	db.First(&orphaned, 2)
+	if orphaned.AuthorID != 0 {
+		t.Errorf("image of a missing author still references author %d", orphaned.AuthorID)
+	}
+	for _, file := range []struct {
+		storage Storage
+		key     string
+		exists  bool
+	}{
+		{processedStorage, "kept.webp", true},
+		{processedStorage, "orphaned.webp", false},
+		{versionStorage, "1-1.jpg", true},
+		{versionStorage, "99-2.jpg", false},
+	} {
+		if objectExists(ctx, file.storage, file.key) != file.exists {
+			t.Errorf("%s exists is %v after the repair", file.key, !file.exists)
+		}
+	}
+
+	if err := checkCommand([]string{"--fix"}); err == nil || err.Error() != checkUsage {
+		t.Errorf("unknown argument returned %v", err)
+	}
+}
+
+func TestTrashAuthorStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  DeleteOptions
+		err      error
+		authorId uint
+		images   int64
+	}{
+		{"refuse by default", DeleteOptions{}, errStillReferenced, 1, 2},
+		{"reassign", DeleteOptions{Strategy: deleteStrategyReassign, ReassignTo: 2}, nil, 2, 2},
+		{"reassign to itself", DeleteOptions{Strategy: deleteStrategyReassign, ReassignTo: 1}, errInvalidDeleteStrategy, 1, 2},
+		{"reassign to missing author", DeleteOptions{Strategy: deleteStrategyReassign, ReassignTo: 99}, errInvalidDeleteStrategy, 1, 2},
+		{"cascade", DeleteOptions{Strategy: deleteStrategyCascade}, nil, 1, 0},
+		{"unknown strategy", DeleteOptions{Strategy: "ignore"}, errInvalidDeleteStrategy, 1, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDatabase(t)
+			setupTestStorage(t)
+			authors := []Author{{Name: "Jane"}, {Name: "John"}}
+			db.Create(&authors)
+			for _, name := range []string{"sunset", "harbour"} {
+				db.Create(&Image{Name: name, AuthorID: authors[0].ID})
+			}
+
+			err := trashAuthor(context.Background(), &authors[0], test.options)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			var authorIds []uint
+			db.Unscoped().Model(&Image{}).Pluck("author_id", &authorIds)
+			if len(authorIds) != 2 || authorIds[0] != test.authorId || authorIds[1] != test.authorId {
+				t.Errorf("images reference the authors %v", authorIds)
+			}
+			if count := countImages(t, db); count != test.images {
+				t.Errorf("%d images are left, expected %d", count, test.images)
+			}
+			deleted := db.First(&Author{}, authors[0].ID).RowsAffected == 0
+			if deleted != (test.err == nil) {
+				t.Errorf("author deleted is %v", deleted)
+			}
+		})
+	}
+}
+
+func TestTrashCategoryStrategies(t *testing.T) {
+	tests := []struct {
+		name    string
+		options DeleteOptions
+		err     error
+		// categories are the categories of image 1 and 2
+		categories []uint
+	}{
+		{"refuse by default", DeleteOptions{}, errStillReferenced, []uint{1, 1, 2}},
+		{"reassign", DeleteOptions{Strategy: deleteStrategyReassign, ReassignTo: 2}, nil, []uint{2, 2}},
+		{"reassign to missing category", DeleteOptions{Strategy: deleteStrategyReassign, ReassignTo: 99}, errInvalidDeleteStrategy, []uint{1, 1, 2}},
+		{"cascade", DeleteOptions{Strategy: deleteStrategyCascade}, nil, []uint{2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDatabase(t)
+			categories := []Category{{Name: "landscapes"}, {Name: "coast"}}
+			db.Create(&categories)
+			createTestImages(t, 2)
+			// Image 2 is already in the category the images are reassigned to
+			db.Exec("INSERT INTO images_categories (image_id, category_id) VALUES (1, 1), (2, 1), (2, 2)")
+
+			err := trashCategory(context.Background(), &categories[0], test.options)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			var assigned []uint
+			db.Table("images_categories").Order("image_id, category_id").Pluck("category_id", &assigned)
+			if !slices.Equal(assigned, test.categories) {
+				t.Errorf("images are assigned to %v, expected %v", assigned, test.categories)
+			}
+		})
+	}
+
+	setupTestDatabase(t)
+	createReservedCategories()
+	icons := Category{}
+	db.Where("name = ?", iconCategoryName).First(&icons)
+	err := trashCategory(context.Background(), &icons, DeleteOptions{Strategy: deleteStrategyCascade})
+	if !errors.Is(err, errReservedCategory) || deleteErrorStatus(err) != 409 {
+		t.Errorf("deleting a reserved category returned %v", err)
+	}
+}
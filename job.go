@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+type (
+	JobStatus string
+
+	// Job is a unit of background work. Jobs are persisted, so queued jobs survive a restart of the application.
+	Job struct {
+		gorm.Model
+		Type       string    `gorm:"size:50;index"`
+		Status     JobStatus `gorm:"size:20;index"`
+		Payload    string
+		Result     string
+		Error      string
+		Progress   int
+		Total      int
+		CreatedBy  string `gorm:"size:100"`
+		StartedAt  *time.Time
+		FinishedAt *time.Time
+	}
+
+	JobDto struct {
+		ID         uint            `json:"id" yaml:"id"`
+		Type       string          `json:"type" yaml:"type"`
+		Status     JobStatus       `json:"status" yaml:"status"`
+		Progress   int             `json:"progress" yaml:"progress"`
+		Total      int             `json:"total" yaml:"total"`
+		Percent    int             `json:"percent" yaml:"percent"`
+		Error      string          `json:"error,omitempty" yaml:"error,omitempty"`
+		Result     json.RawMessage `json:"result,omitempty" yaml:"-"`
+		CreatedBy  string          `json:"createdBy" yaml:"createdBy"`
+		CreatedAt  time.Time       `json:"createdAt" yaml:"createdAt"`
+		StartedAt  *time.Time      `json:"startedAt,omitempty" yaml:"startedAt,omitempty"`
+		FinishedAt *time.Time      `json:"finishedAt,omitempty" yaml:"finishedAt,omitempty"`
+	}
+
+	// JobRun gives a job handler access to the running job
+	JobRun struct {
+		job *Job
+	}
+
+	jobHandler func(ctx context.Context, run *JobRun) (any, error)
+)
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+
+	jobIdName       = "jobId"
+	jobPollInterval = 10 * time.Second
+	jobListLimit    = 100
+)
+
+var (
+	jobHandlers = map[string]jobHandler{
+		jobTypeProcessImages: processImagesJob,
+		jobTypeProcessImage:  processImageJob,
+	}
+	// jobNotify wakes up an idle worker after a job has been enqueued
+	jobNotify        = make(chan struct{}, 1)
+	runningJobs      = map[uint]context.CancelFunc{}
+	runningJobsMutex = sync.Mutex{}
+
+	errJobNotFound    = errors.New("job not found")
+	errJobNotActive   = errors.New("job already finished")
+	errUnknownJobType = errors.New("unknown job type")
+)
+
+func (job *Job) toDto() JobDto {
+	dto := JobDto{
+		ID:         job.ID,
+		Type:       job.Type,
+		Status:     job.Status,
+		Progress:   job.Progress,
+		Total:      job.Total,
+		Error:      job.Error,
+		CreatedBy:  job.CreatedBy,
+		CreatedAt:  job.CreatedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+	if job.Total > 0 {
+		dto.Percent = job.Progress * 100 / job.Total
+	}
+	if job.Status == JobCompleted {
+		dto.Percent = 100
+	}
+	if len(job.Result) > 0 {
+		dto.Result = json.RawMessage(job.Result)
+	}
+	return dto
+}
+
+func (job *Job) isActive() bool {
+	return job.Status == JobQueued || job.Status == JobRunning
+}
+
+// DecodePayload unmarshals the payload the job was enqueued with into target
+func (run *JobRun) DecodePayload(target any) error {
+	if len(run.job.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal([]byte(run.job.Payload), target)
+}
+
+// SetProgress stores how many of the total steps of the job are done
+func (run *JobRun) SetProgress(done, total int) {
+	run.job.Progress = done
+	run.job.Total = total
+	res := db.Model(&Job{}).Where("id = ?", run.job.ID).UpdateColumns(map[string]any{
+		"progress": done,
+		"total":    total,
+	})
+	if res.Error != nil {
+		logger.Warnf("Could not update progress of job %d: %v", run.job.ID, res.Error)
+	}
+}
+
+// setupJobs resets jobs that were interrupted by a shutdown and starts the worker pool
+func setupJobs() {
+	res := db.Model(&Job{}).Where("status = ?", JobRunning).Updates(map[string]any{
+		"status":     JobQueued,
+		"started_at": nil,
+		"progress":   0,
+	})
+	if res.Error != nil {
+		logger.Panicf("Error resetting interrupted jobs: %v", res.Error)
+	}
+	if res.RowsAffected > 0 {
+		logger.Infof("Requeued %d interrupted jobs", res.RowsAffected)
+	}
+
+	for i := 0; i < appConfig.JobWorkers; i++ {
+		go jobWorker()
+	}
+	logger.Infof("Started %d job workers", appConfig.JobWorkers)
+}
+
+func notifyJobWorkers() {
+	select {
+	case jobNotify <- struct{}{}:
+	default:
+	}
+}
+
+func enqueueJob(jobType string, payload any, createdBy string) (*Job, error) {
+	if _, found := jobHandlers[jobType]; !found {
+		return nil, fmt.Errorf("%w \"%s\"", errUnknownJobType, jobType)
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job := Job{
+		Type:      jobType,
+		Status:    JobQueued,
+		Payload:   string(payloadBytes),
+		CreatedBy: createdBy,
+	}
+	res := db.Create(&job)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	logger.Infof("Enqueued job %d of type \"%s\"", job.ID, job.Type)
+	notifyJobWorkers()
+	return &job, nil
+}
+
+func jobWorker() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			job, ctx, err := claimJob()
+			if err != nil {
+				logger.Errorf("Error claiming job: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			// There might be more queued jobs, so let another idle worker check as well
+			notifyJobWorkers()
+			runJob(ctx, job)
+		}
+
+		select {
+		case <-jobNotify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimJob marks the oldest queued job as running and registers the cancel func of the context it runs with. The
+// status is part of the update condition, so each job is only claimed by a single worker. runningJobsMutex is held
+// until the job is registered, so cancelJob never sees a running job it can't cancel.
+func claimJob() (*Job, context.Context, error) {
+	runningJobsMutex.Lock()
+	defer runningJobsMutex.Unlock()
+
+	for {
+		var job Job
+		res := db.Where("status = ?", JobQueued).Order("id ASC").Limit(1).Find(&job)
+		if res.Error != nil {
+			return nil, nil, res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil, nil, nil
+		}
+
+		now := time.Now()
+		res = db.Model(&Job{}).Where("id = ? AND status = ?", job.ID, JobQueued).Updates(map[string]any{
+			"status":     JobRunning,
+			"started_at": now,
+		})
+		if res.Error != nil {
+			return nil, nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			job.Status = JobRunning
+			job.StartedAt = &now
+			ctx, cancel := context.WithCancel(withAuditUser(context.Background(), job.CreatedBy))
+			runningJobs[job.ID] = cancel
+			return &job, ctx, nil
+		}
+	}
+}
+
+func runJob(ctx context.Context, job *Job) {
+	defer func() {
+		runningJobsMutex.Lock()
+		runningJobs[job.ID]()
+		delete(runningJobs, job.ID)
+		runningJobsMutex.Unlock()
+	}()
+
+	logger.Infof("Running job %d of type \"%s\"", job.ID, job.Type)
+
+	result, err := runJobHandler(ctx, &JobRun{job: job})
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = JobCompleted
+	job.Error = ""
+	if ctx.Err() != nil {
+		job.Status = JobCancelled
+		job.Error = "cancelled"
+	} else if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+
+	if result != nil {
+		resultBytes, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			logger.Errorf("Could not marshal result of job %d: %v", job.ID, marshalErr)
+		} else {
+			job.Result = string(resultBytes)
+		}
+	}
+
+	res := db.Model(job).Select("status", "error", "result", "progress", "total", "finished_at").Updates(job)
+	if res.Error != nil {
+		logger.Errorf("Could not store result of job %d: %v", job.ID, res.Error)
+	}
+
+	if job.Status == JobFailed {
+		logger.Errorf("Job %d failed: %s", job.ID, job.Error)
+	} else {
+		logger.Infof("Job %d %s", job.ID, job.Status)
+	}
+}
+
+// runJobHandler executes the handler of the job. Panics are turned into errors, so a single bad job can't take down
+// the worker pool.
+func runJobHandler(ctx context.Context, run *JobRun) (result any, err error) {
+	handler, found := jobHandlers[run.job.Type]
+	if !found {
+		return nil, fmt.Errorf("%w \"%s\"", errUnknownJobType, run.job.Type)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Job %d panicked: %v\n%s", run.job.ID, r, debug.Stack())
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return handler(ctx, run)
+}
+
+// cancelJob cancels a queued job right away, running jobs are asked to stop and finish as cancelled
+func cancelJob(id uint) error {
+	var job Job
+	res := db.First(&job, id)
+	if res.RowsAffected == 0 {
+		return errJobNotFound
+	}
+	if !job.isActive() {
+		return errJobNotActive
+	}
+
+	now := time.Now()
+	res = db.Model(&Job{}).Where("id = ? AND status = ?", id, JobQueued).Updates(map[string]any{
+		"status":      JobCancelled,
+		"error":       "cancelled",
+		"finished_at": now,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 1 {
+		logger.Infof("Cancelled queued job %d", id)
+		return nil
+	}
+
+	runningJobsMutex.Lock()
+	cancel, running := runningJobs[id]
+	runningJobsMutex.Unlock()
+	if !running {
+		return errJobNotActive
+	}
+
+	cancel()
+	logger.Infof("Requested cancellation of job %d", id)
+	return nil
+}
+
+func findJobs(status string) ([]Job, error) {
+	var jobs []Job
+	tx := db.Order("id DESC").Limit(jobListLimit)
+	if len(status) > 0 {
+		tx = tx.Where("status = ?", status)
+	}
+	res := tx.Find(&jobs)
+	return jobs, res.Error
+}
+
+func loadJob(c *gin.Context) (*Job, error) {
+	id, err := pathIdToInt(jobIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, err
+	}
+
+	var job Job
+	res := db.First(&job, id)
+	if res.RowsAffected == 0 {
+		c.String(http.StatusNotFound, "Job with id '%d' not found", id)
+		return nil, errJobNotFound
+	}
+
+	return &job, nil
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getJobsHtml(c *gin.Context) {
+	status := c.Query("status")
+	jobs, err := findJobs(status)
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error loading jobs: %v", err)
+		return
+	}
+
+	c.HTML(http.StatusOK, "jobs.gohtml", gin.H{
+		"jobs": Map(jobs, func(job Job) JobDto {
+			return job.toDto()
+		}),
+		"status":   status,
+		"statuses": []JobStatus{JobQueued, JobRunning, JobCompleted, JobFailed, JobCancelled},
+		"stats":    processingStats(),
+	})
+}
+
+func getJobHtml(c *gin.Context) {
+	job, err := loadJob(c)
+	if err != nil {
+		return
+	}
+
+	c.HTML(http.StatusOK, "job.gohtml", gin.H{
+		"job":    job.toDto(),
+		"active": job.isActive(),
+		"role":   currentRole(c),
+	})
+}
+
+func updateJobForm(c *gin.Context) {
+	job, err := loadJob(c)
+	if err != nil {
+		return
+	}
+
+	switch c.PostForm("action") {
+	case "cancel":
+		err = cancelJob(job.ID)
+		if err != nil && !errors.Is(err, errJobNotActive) {
+			c.Error(err)
+			c.String(http.StatusInternalServerError, "Error cancelling job: %v", err)
+			return
+		}
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/jobs/%d", job.ID))
+}
+
+func getJobs(c *gin.Context) {
+	jobs, err := findJobs(c.Query("status"))
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error loading jobs: %v", err)
+		return
+	}
+
+	jobsDto := Map(jobs, func(job Job) JobDto {
+		return job.toDto()
+	})
+	c.JSON(http.StatusOK, &jobsDto)
+}
+
+func getJob(c *gin.Context) {
+	job, err := loadJob(c)
+	if err != nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, job.toDto())
+}
+
+func cancelJobApi(c *gin.Context) {
+	job, err := loadJob(c)
+	if err != nil {
+		return
+	}
+
+	err = cancelJob(job.ID)
+	if errors.Is(err, errJobNotActive) {
+		c.String(http.StatusConflict, "Job with id '%d' already finished", job.ID)
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error cancelling job: %v", err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
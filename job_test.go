@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+)
+
+const jobTypeTest = "test"
+
+// setupTestJobs registers a job type that runs the given handler
+func setupTestJobs(t *testing.T, handler jobHandler) {
+	setupTestDatabase(t)
+	jobHandlers[jobTypeTest] = handler
+	t.Cleanup(func() {
+		delete(jobHandlers, jobTypeTest)
+	})
+}
+
+func loadTestJob(t *testing.T, id uint) Job {
+	t.Helper()
+	var job Job
+	if res := db.First(&job, id); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	return job
+}
+
+// releaseTestJob forgets a claimed job that isn't run
+func releaseTestJob(id uint) {
+	runningJobsMutex.Lock()
+	defer runningJobsMutex.Unlock()
+	runningJobs[id]()
+	delete(runningJobs, id)
+}
+
+func TestClaimJobConcurrently(t *testing.T) {
+	setupTestJobs(t, func(ctx context.Context, run *JobRun) (any, error) { return nil, nil })
+	for i := 0; i < 20; i++ {
+		if _, err := enqueueJob(jobTypeTest, i, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed := make([]uint, 0)
+	claimedMutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, ctx, err := claimJob()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if job == nil {
+					return
+				}
+				runJob(ctx, job)
+				claimedMutex.Lock()
+				claimed = append(claimed, job.ID)
+				claimedMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every job is run exactly once
+	slices.Sort(claimed)
+	if len(claimed) != 20 || len(slices.Compact(slices.Clone(claimed))) != 20 {
+		t.Errorf("claimed jobs %v", claimed)
+	}
+	completed, _ := findJobs(string(JobCompleted))
+	if len(completed) != 20 || len(runningJobs) > 0 {
+		t.Errorf("%d jobs completed, %d still registered as running", len(completed), len(runningJobs))
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	setupTestJobs(t, func(ctx context.Context, run *JobRun) (any, error) {
+		t.Error("cancelled job was run")
+		return nil, nil
+	})
+	job, err := enqueueJob(jobTypeTest, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cancelJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, _, err := claimJob(); claimed != nil || err != nil {
+		t.Errorf("claimed cancelled job %+v, %v", claimed, err)
+	}
+	if stored := loadTestJob(t, job.ID); stored.Status != JobCancelled || stored.FinishedAt == nil {
+		t.Errorf("cancelled job has status %s", stored.Status)
+	}
+
+	if err := cancelJob(job.ID); !errors.Is(err, errJobNotActive) {
+		t.Errorf("cancelling a finished job returned %v", err)
+	}
+	if err := cancelJob(job.ID + 1); !errors.Is(err, errJobNotFound) {
+		t.Errorf("cancelling an unknown job returned %v", err)
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	started := make(chan struct{})
+	setupTestJobs(t, func(ctx context.Context, run *JobRun) (any, error) {
+		run.SetProgress(1, 3)
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	job, err := enqueueJob(jobTypeTest, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, ctx, err := claimJob()
+	if err != nil || claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("claimed %+v, %v", claimed, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		runJob(ctx, claimed)
+		close(done)
+	}()
+	<-started
+
+	if err := cancelJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	stored := loadTestJob(t, job.ID)
+	if stored.Status != JobCancelled || stored.Progress != 1 || stored.Total != 3 {
+		t.Errorf("cancelled job has status %s and progress %d/%d", stored.Status, stored.Progress, stored.Total)
+	}
+	if err := cancelJob(job.ID); !errors.Is(err, errJobNotActive) {
+		t.Errorf("cancelling a cancelled job returned %v", err)
+	}
+}
+
+func TestRunJobFailures(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		name    string
+		handler jobHandler
+		error   string
+	}{
+		{"error", func(ctx context.Context, run *JobRun) (any, error) { return nil, failure }, "failure"},
+		{"panic", func(ctx context.Context, run *JobRun) (any, error) { panic("broken") }, "job panicked: broken"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestJobs(t, test.handler)
+			job, err := enqueueJob(jobTypeTest, nil, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			claimed, ctx, err := claimJob()
+			if err != nil || claimed == nil {
+				t.Fatalf("claimed %+v, %v", claimed, err)
+			}
+			runJob(ctx, claimed)
+
+			if stored := loadTestJob(t, job.ID); stored.Status != JobFailed || stored.Error != test.error {
+				t.Errorf("job has status %s and error %q", stored.Status, stored.Error)
+			}
+		})
+	}
+}
+
+func TestSetupJobsRequeuesInterruptedJobs(t *testing.T) {
+	setupTestJobs(t, func(ctx context.Context, run *JobRun) (any, error) { return nil, nil })
+	previousConfig := appConfig
+	t.Cleanup(func() {
+		appConfig = previousConfig
+	})
+	appConfig = &AppConfig{JobWorkers: 0}
+
+	job, err := enqueueJob(jobTypeTest, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, _, err := claimJob()
+	if err != nil || claimed == nil {
+		t.Fatalf("claimed %+v, %v", claimed, err)
+	}
+	releaseTestJob(claimed.ID)
+
+	// A restart finds the job running, but nothing runs it anymore
+	setupJobs()
+	if stored := loadTestJob(t, job.ID); stored.Status != JobQueued || stored.StartedAt != nil {
+		t.Errorf("interrupted job has status %s", stored.Status)
+	}
+	claimed, _, err = claimJob()
+	if err != nil || claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("requeued job wasn't claimed again: %+v, %v", claimed, err)
+	}
+	releaseTestJob(claimed.ID)
+}
+
+func TestEnqueueUnknownJobType(t *testing.T) {
+	setupTestDatabase(t)
+	if _, err := enqueueJob("unknown", nil, "alice"); !errors.Is(err, errUnknownJobType) {
+		t.Errorf("enqueueing an unknown job type returned %v", err)
+	}
+}
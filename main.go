@@ -1,48 +1,41 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"gallery-image-manager/util"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"html/template"
 	"os"
-	"path"
 	"slices"
 	"strconv"
 	"strings"
 )
 
 type (
-	AppConfig struct {
-		ExportDir    string
-		DataDir      string
-		ProcessedDir string
-		IconDir      string
-		OriginalDir  string
-		ImportDir    string
-		DbLocation   string
-		PasswordHash string
-		Port         uint16
-	}
-
-	Account struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
-
 	ListFilter struct {
-		Author   uint
-		Nsfw     *bool
-		Category uint
-		SortBy   string
-		SortMode string
+		// Query is a full-text search, the results are ordered by relevance if SortBy is "relevance"
+		Query      string
+		Authors    []uint
+		Nsfw       *bool
+		Categories []uint
+		// CategoryMode is "any" if images need one of the Categories, or "all" if they need every one of them
+		CategoryMode       string
+		ExcludedCategories []uint
+		// The date ranges are kept as given, either as date or RFC 3339 timestamp
+		CreatedAfter  string
+		CreatedBefore string
+		UpdatedAfter  string
+		UpdatedBefore string
+		// ImageExists is false for images that still need an upload
+		ImageExists *bool
+		HasVariants *bool
+		SortBy      string
+		SortMode    string
+		Page        Page
 	}
 )
 
@@ -55,15 +48,19 @@ const (
 )
 
 var (
-	appConfig     *AppConfig
-	accounts      gin.Accounts
-	sessionTokens = map[string]string{}
-	db            *gorm.DB
-	logger        *zap.SugaredLogger
-	sortModeMap   = map[string]int{
+	appConfig   *AppConfig
+	commandArgs []string
+	db          *gorm.DB
+	logger      *zap.SugaredLogger
+	sortModeMap = map[string]int{
 		"asc":  SORT_ASC,
 		"desc": SORT_DESC,
 	}
+	commands = map[string]func(args []string) error{
+		"check":  checkCommand,
+		"users":  usersCommand,
+		"verify": verifyCommand,
+	}
 )
 
 func Map[T, U any](ts []T, f func(T) U) []U {
@@ -74,44 +71,14 @@ func Map[T, U any](ts []T, f func(T) U) []U {
 	return us
 }
 
-func readAccounts() {
-	accountData, err := os.ReadFile("data/accounts.json")
-	if err != nil {
-		logger.Panicf("Error reading accounts file: %v", err)
-	}
-
-	var readAccounts []Account
-
-	err = json.Unmarshal(accountData, &readAccounts)
-	if err != nil {
-		logger.Panicf("Error unmarshaling accounts file: %v", err)
-	}
-
-	newAccounts := gin.Accounts{}
-	for _, account := range readAccounts {
-		newAccounts[account.Username] = account.Password
-	}
-
-	accounts = newAccounts
-}
-
-func hashPassword(pw []byte) string {
-	hash, err := bcrypt.GenerateFromPassword(pw, bcrypt.DefaultCost)
-	if err != nil {
-		logger.Errorf("Error hashing password: %v", err)
-	}
-	return string(hash)
-}
-
-func checkPassword(plainPw []byte) bool {
-	hashedPw := []byte(appConfig.PasswordHash)
-
-	err := bcrypt.CompareHashAndPassword(hashedPw, plainPw)
-	return err != nil
-}
-
 func setupLogging() {
 	logConfig := zap.NewDevelopmentConfig()
+	if appConfig != nil {
+		if appConfig.IsProduction() {
+			logConfig = zap.NewProductionConfig()
+		}
+		logConfig.Level = zap.NewAtomicLevelAt(appConfig.MinLogLevel())
+	}
 	baseLogger, _ := logConfig.Build()
 	defer baseLogger.Sync()
 	logger = baseLogger.Sugar()
@@ -126,22 +93,13 @@ func setupLogging() {
 	}
 }
 
-func createConfig() *AppConfig {
-	config := AppConfig{
-		ExportDir: "data/export",
-		DataDir:   "data/",
-		//ProcessedDir: "/mnt/m/Web/senex-gallery-content/managed/",
-		DbLocation: "/mnt/d/Sqlite/image-manager.db",
-		ImportDir:  "/mnt/m/Web/senex-gallery-content",
-		Port:       3000,
+func createConfig() (*AppConfig, error) {
+	config, args, err := loadConfig(os.Args[1:])
+	if config != nil {
+		appConfig = config
 	}
-
-	config.ProcessedDir = path.Join(config.DataDir, "images/processed")
-	config.OriginalDir = path.Join(config.DataDir, "images/originals")
-	config.IconDir = path.Join(config.DataDir, "icons")
-
-	appConfig = &config
-	return appConfig
+	commandArgs = args
+	return config, err
 }
 
 func pathIdToInt(idName string, c *gin.Context) (uint, error) {
@@ -160,10 +118,6 @@ func pathIdToInt(idName string, c *gin.Context) (uint, error) {
 	return uint(id), nil
 }
 
-func login(c *gin.Context) {
-
-}
-
 func apiPath(pathTemplate string, idNames ...any) string {
 	return apiPrefix + fmt.Sprintf(pathTemplate, idNames...)
 }
@@ -172,160 +126,54 @@ func createDirIfNotExists(dir string) error {
 	return os.MkdirAll(dir, os.ModeDir|os.ModePerm)
 }
 
-func setup() {
-	setupLogging()
-	createConfig()
-	createDirIfNotExists(appConfig.DataDir)
-	createDirIfNotExists(appConfig.OriginalDir)
-	createDirIfNotExists(appConfig.ProcessedDir)
-	createDirIfNotExists(appConfig.IconDir)
-}
-
-func exportData(c *gin.Context) {
-	tx := db.Session(&gorm.Session{})
-
-	err := os.RemoveAll(appConfig.ExportDir)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-
-	metaExportDir := path.Join(appConfig.ExportDir, "meta")
-	err = createDirIfNotExists(appConfig.ExportDir)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-
-	err = util.CopyDirectory(appConfig.ProcessedDir, appConfig.ExportDir)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-
-	iconsExportDir := path.Join(appConfig.ExportDir, "icons")
-	err = createDirIfNotExists(iconsExportDir)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-
-	err = util.CopyDirectory(appConfig.IconDir, iconsExportDir)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-
-	err = createDirIfNotExists(metaExportDir)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-
-	var jsonBytes []byte
-
-	iconCategory := Category{Name: iconCategoryName}
-	tx.First(&iconCategory)
-
-	var images []Image
-	tx.
-		Preload("Variants").
-		Preload("Categories").
-		Preload("Related").
-		Order("sort_index ASC").
-		Order("id ASC").
-		Find(&images)
-
-	imagesDto := make([]ImageDto, 0, len(images))
-	preloadUrlBuffer := bytes.Buffer{}
-
-	for _, image := range images {
-		dto := image.toDtoWithVariants()
-		if slices.Contains(dto.Categories, iconCategory.ID) {
-			logger.Infof("Skipping image in icon category")
-		} else {
-			imagesDto = append(imagesDto, dto)
-
-			for _, variant := range image.Variants {
-				preloadUrlBuffer.WriteString("/export/" + variant.FileName + "\n")
-			}
-		}
+// sqliteDsn adds a busy timeout to the database location. Background jobs write concurrently to the web handlers,
+// so writers have to wait for each other instead of failing with "database is locked".
+func sqliteDsn(location string) string {
+	if strings.Contains(location, "?") {
+		return location
 	}
+	return location + "?_busy_timeout=5000"
+}
 
-	jsonBytes, err = json.Marshal(&imagesDto)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-	err = os.WriteFile(path.Join(metaExportDir, "images.json"), jsonBytes, 0644)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-	err = os.WriteFile(path.Join(metaExportDir, "preload.txt"), preloadUrlBuffer.Bytes(), 0644)
+// migrateDatabase creates or updates the tables of all models
+func migrateDatabase() error {
+	err := setupJoinTables()
 	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
+		return fmt.Errorf("error setting up join tables: %w", err)
 	}
+	return db.AutoMigrate(&Image{}, &Category{}, &Author{}, &ImageVariant{}, &Icon{}, &Job{}, &ProcessingProfile{}, &ProcessingProfileRule{}, &ImageMetadata{}, &AuditEntry{}, &Revision{}, &OriginalVersion{}, &RevokedSession{})
+}
 
-	var categories []Category
-	tx.Find(&categories)
-
-	categoriesDto := Map(categories, func(c Category) CategoryDto {
-		return c.toDto()
-	})
-
-	jsonBytes, err = json.Marshal(&categoriesDto)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-	err = os.WriteFile(path.Join(metaExportDir, "categories.json"), jsonBytes, 0644)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
+func runCommand(args []string) {
+	command, found := commands[args[0]]
+	if !found {
+		logger.Fatalf("Unknown command \"%s\"", args[0])
 	}
 
-	var authors []Author
-	tx.Find(&authors)
-
-	authorsDto := Map(authors, func(a Author) AuthorDto {
-		return a.toDto()
-	})
-
-	jsonBytes, err = json.Marshal(&authorsDto)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
-	}
-	err = os.WriteFile(path.Join(metaExportDir, "authors.json"), jsonBytes, 0644)
+	err := command(args[1:])
 	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
+		logger.Fatalf("Error running command \"%s\": %v", args[0], err)
 	}
+}
 
-	var icons []Icon
-	tx.Find(&icons)
-
-	jsonBytes, err = json.Marshal(&icons)
-	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
+func setup() {
+	_, err := createConfig()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-	err = os.WriteFile(path.Join(iconsExportDir, "icons.json"), jsonBytes, 0644)
+	setupLogging()
 	if err != nil {
-		c.String(500, c.Error(err).Error())
-		return
+		logger.Fatalf("Invalid configuration: %v", err)
 	}
-
-	c.String(200, "Exported to %s", appConfig.ExportDir)
+	logger.Infof("Using environment profile \"%s\"", appConfig.Env)
+	setupStorage()
 }
 
 func main() {
 	setup()
 	var err error
 
-	tmpDb, err := gorm.Open(sqlite.Open(appConfig.DbLocation))
+	tmpDb, err := gorm.Open(sqlite.Open(sqliteDsn(appConfig.DbLocation)))
 
 	if err != nil {
 		logger.Panicf("Could not open sqlite database: %v", err)
@@ -333,23 +181,46 @@ func main() {
 
 	db = tmpDb
 
-	err = db.AutoMigrate(&Image{}, &Category{}, &Author{}, &ImageVariant{}, &Icon{})
+	err = migrateDatabase()
 	if err != nil {
 		logger.Panicf("Error migrating models: %v", err)
 	}
 
 	createReservedCategories()
+	createDefaultProcessingProfiles()
+	setupSearch()
+	setupProcessingLimiter()
+	detectFormats()
 
-	//importGalleryLibrary(appConfig.ImportDir)
+	if len(commandArgs) > 0 {
+		runCommand(commandArgs)
+		return
+	}
 
-	readAccounts()
+	setupAccounts()
+	setupSessions()
+	setupJobs()
+	setupTrash()
+	setupOriginalVersions()
+	setupBlobSweep()
 
-	gin.SetMode(gin.ReleaseMode)
+	gin.SetMode(appConfig.GinMode)
 
 	r := gin.Default()
 	//r.Use(ginzap.Ginzap(logger.Desugar(), time.RFC3339, false))
 	//r.Use(ginzap.RecoveryWithZap(logger.Desugar(), true))
 	r.SetTrustedProxies(nil)
+	setupRoutes(r)
+
+	logger.Infof("Server starting at http://localhost:%d", appConfig.Port)
+	err = r.Run(fmt.Sprintf(":%d", appConfig.Port))
+	if err != nil {
+		logger.Errorf("Error starting web server: %v", err)
+	}
+}
+
+// setupRoutes registers the templates and all routes with the permissions they require
+func setupRoutes(r *gin.Engine) {
 	r.SetFuncMap(template.FuncMap{
 		"joinStrings": strings.Join,
 		"joinUints": func(elems []uint, sep string) string {
@@ -365,6 +236,18 @@ func main() {
 		"isNullOrTrue": func(b *bool) bool {
 			return b == nil || *b
 		},
+		"inc": func(value int) int {
+			return value + 1
+		},
+		"auditValue": func(value any) string {
+			if value == nil {
+				return "-"
+			}
+			return fmt.Sprint(value)
+		},
+		"containsUint": func(elems []uint, value uint) bool {
+			return slices.Contains(elems, value)
+		},
 		"categorySelected": func(category CategoryDto, selectedCategories []uint) bool {
 			for _, categoryId := range selectedCategories {
 				if category.ID == categoryId {
@@ -376,63 +259,149 @@ func main() {
 		"derefBool": func(value *bool) bool {
 			return *value
 		},
+		"derefUint": func(value *uint) uint {
+			if value == nil {
+				return 0
+			}
+			return *value
+		},
+		"megabytes": func(value int64) int64 {
+			return value / megabyte
+		},
+		"kilobytes": func(value int64) int64 {
+			return value / 1024
+		},
+		"roleIncludes": func(role Role, required string) bool {
+			return role.Includes(Role(required))
+		},
 	})
 	r.LoadHTMLGlob("resources/ui/*")
 
-	authorized := r.Group("", gin.BasicAuth(accounts))
+	authorized := r.Group("", authRequired())
+	contributor := authorized.Group("", requireRole(RoleContributor))
+	maintainer := authorized.Group("", requireRole(RoleMaintainer))
+	admin := authorized.Group("", requireRole(RoleAdmin))
 
 	authorized.GET("/", func(c *gin.Context) {
-		c.HTML(200, "landing.gohtml", gin.H{})
+		c.HTML(200, "landing.gohtml", gin.H{
+			"role": currentRole(c),
+		})
 	})
 
 	authorized.GET("/images", getImagesHtml)
-	authorized.POST("/images/process", processImages)
-	authorized.POST("/images/process-icons", processFaviconApi)
+	authorized.GET("/images/duplicates", getDuplicatesHtml)
+	contributor.POST("/images/bulk", bulkEditImagesForm)
+	authorized.GET("/images/order", getImageOrderHtml)
+	contributor.POST("/images/order", reorderImagesForm)
+	maintainer.POST("/images/duplicates", mergeDuplicatesForm)
+	maintainer.POST("/images/process", processImagesForm)
+	maintainer.POST("/images/process-icons", processFaviconApi)
 	authorized.GET(fmt.Sprintf("/images/:%s", imageIdName), getImageHtml)
-	authorized.POST(fmt.Sprintf("/images/:%s", imageIdName), updateImageForm)
-	authorized.POST(fmt.Sprintf("/images/:%s/upload", imageIdName), uploadImageForm)
+	contributor.POST(fmt.Sprintf("/images/:%s", imageIdName), updateImageForm)
+	maintainer.POST(fmt.Sprintf("/images/:%s/upload", imageIdName), uploadImageForm)
+	maintainer.POST(fmt.Sprintf("/images/:%s/originals", imageIdName), updateOriginalVersionsForm)
+	authorized.GET(fmt.Sprintf("/images/:%s/revisions", imageIdName), getRevisionsHtml(auditEntityImage))
+	contributor.POST(fmt.Sprintf("/images/:%s/revisions", imageIdName), restoreRevisionForm(auditEntityImage))
 
 	authorized.GET("/authors", getAuthorsHtml)
 	authorized.GET(fmt.Sprintf("/authors/:%s", authorIdName), getAuthorHtml)
-	authorized.POST(fmt.Sprintf("/authors/:%s", authorIdName), updateAuthorForm)
+	maintainer.POST(fmt.Sprintf("/authors/:%s", authorIdName), updateAuthorForm)
+	authorized.GET(fmt.Sprintf("/authors/:%s/revisions", authorIdName), getRevisionsHtml(auditEntityAuthor))
+	maintainer.POST(fmt.Sprintf("/authors/:%s/revisions", authorIdName), restoreRevisionForm(auditEntityAuthor))
 
 	authorized.GET("/categories", getCategoriesHtml)
 	authorized.GET(fmt.Sprintf("/categories/:%s", categoryIdName), getCategoryHtml)
-	authorized.POST(fmt.Sprintf("/categories/:%s", categoryIdName), updateCategoryForm)
+	maintainer.POST(fmt.Sprintf("/categories/:%s", categoryIdName), updateCategoryForm)
+	authorized.GET(fmt.Sprintf("/categories/:%s/revisions", categoryIdName), getRevisionsHtml(auditEntityCategory))
+	maintainer.POST(fmt.Sprintf("/categories/:%s/revisions", categoryIdName), restoreRevisionForm(auditEntityCategory))
+
+	maintainer.POST("/export", exportData)
+	admin.POST("/import", importLibrary)
+
+	authorized.GET("/processing-profiles", getProcessingProfilesHtml)
+	authorized.GET(fmt.Sprintf("/processing-profiles/:%s", profileIdName), getProcessingProfileHtml)
+	maintainer.POST(fmt.Sprintf("/processing-profiles/:%s", profileIdName), updateProcessingProfileForm)
+
+	authorized.GET("/jobs", getJobsHtml)
+	authorized.GET(fmt.Sprintf("/jobs/:%s", jobIdName), getJobHtml)
+	maintainer.POST(fmt.Sprintf("/jobs/:%s", jobIdName), updateJobForm)
 
-	authorized.POST("/export", exportData)
+	maintainer.GET("/trash", getTrashHtml)
+	maintainer.POST("/trash", updateTrashForm)
 
-	r.Static("/files/originals", appConfig.OriginalDir)
-	r.Static("/files/processed", appConfig.ProcessedDir)
-	r.Static("/files/icons", appConfig.IconDir)
+	admin.GET("/users", getUsersHtml)
+	admin.POST("/users", updateUsersForm)
 
-	r.POST(apiPath("/auth/login"))
+	serveStorage(r, "/files/originals", originalStorage)
+	serveStorage(r, "/files/processed", processedStorage)
+	serveStorage(r, "/files/icons", iconStorage)
+
+	r.POST(apiPath("/auth/login"), login)
+	authorized.POST(apiPath("/auth/logout"), logout)
+	authorized.POST(apiPath("/auth/refresh"), refreshSession)
 
 	r.GET(apiPath("/categories"), getCategories)
-	authorized.PUT(apiPath("/categories"), addCategory)
+	maintainer.PUT(apiPath("/categories"), addCategory)
 	r.GET(apiPath("/categories/:%s", categoryIdName), getCategory)
 	r.GET(apiPath("/categories/:%s/images", categoryIdName), getImages)
-	authorized.PATCH(apiPath("/categories/:%s", categoryIdName), updateCategory)
-	authorized.DELETE(apiPath("/categories/:%s", categoryIdName), deleteCategory)
+	maintainer.PATCH(apiPath("/categories/:%s", categoryIdName), updateCategory)
+	admin.DELETE(apiPath("/categories/:%s", categoryIdName), deleteCategory)
+	authorized.GET(apiPath("/categories/:%s/revisions", categoryIdName), getRevisions(auditEntityCategory))
+	maintainer.POST(apiPath("/categories/:%s/revisions/:%s/restore", categoryIdName, revisionNumberName), restoreRevisionApi(auditEntityCategory))
 
 	r.GET(apiPath("/images"), getImages)
-	authorized.PUT(apiPath("/images"), addImage)
+	maintainer.PUT(apiPath("/images"), addImage)
+	contributor.POST(apiPath("/images/bulk"), bulkEditImagesApi)
+	contributor.POST(apiPath("/images/order"), reorderImagesApi)
+	authorized.GET(apiPath("/images/duplicates"), getDuplicates)
 	r.GET(apiPath("/images/:%s", imageIdName), getImage)
+	maintainer.POST(apiPath("/images/:%s/merge", imageIdName), mergeImageApi)
+	authorized.GET(apiPath("/images/:%s/metadata", imageIdName), getImageMetadata)
+	contributor.POST(apiPath("/images/:%s/metadata/apply", imageIdName), applyImageMetadataApi)
+	authorized.GET(apiPath("/images/:%s/originals", imageIdName), getOriginalVersions)
+	authorized.GET(apiPath("/images/:%s/originals/:%s/file", imageIdName, versionIdName), getOriginalVersionFile)
+	maintainer.POST(apiPath("/images/:%s/originals/:%s/activate", imageIdName, versionIdName), activateOriginalVersionApi)
+	maintainer.DELETE(apiPath("/images/:%s/originals/:%s", imageIdName, versionIdName), deleteOriginalVersionApi)
+	authorized.GET(apiPath("/images/:%s/revisions", imageIdName), getRevisions(auditEntityImage))
+	contributor.POST(apiPath("/images/:%s/revisions/:%s/restore", imageIdName, revisionNumberName), restoreRevisionApi(auditEntityImage))
 	r.GET(apiPath("/icons"), getIcons)
-	authorized.PATCH(apiPath("/images/:%s", imageIdName), updateImage)
-	authorized.DELETE(apiPath("/images/:%s", imageIdName), deleteImage)
-
-	authorized.POST(apiPath("/images/process"), processImages)
+	r.GET(apiPath("/formats"), getFormats)
+	r.GET(apiPath("/search"), search)
+	contributor.PATCH(apiPath("/images/:%s", imageIdName), updateImage)
+	maintainer.DELETE(apiPath("/images/:%s", imageIdName), deleteImage)
+
+	maintainer.GET(apiPath("/trash"), getTrash)
+	maintainer.POST(apiPath("/trash/:%s/:%s/restore", trashTypeName, trashIdName), restoreTrashApi)
+	admin.DELETE(apiPath("/trash/:%s/:%s", trashTypeName, trashIdName), purgeTrashItemApi)
+	admin.DELETE(apiPath("/trash"), emptyTrashApi)
+
+	maintainer.GET(apiPath("/audit"), getAuditLog)
+
+	maintainer.POST(apiPath("/images/process"), processImages)
+	admin.POST(apiPath("/import"), importLibrary)
+
+	authorized.GET(apiPath("/processing-profiles"), getProcessingProfiles)
+	maintainer.PUT(apiPath("/processing-profiles"), addProcessingProfile)
+	authorized.GET(apiPath("/processing-profiles/:%s", profileIdName), getProcessingProfile)
+	maintainer.PATCH(apiPath("/processing-profiles/:%s", profileIdName), updateProcessingProfile)
+	admin.DELETE(apiPath("/processing-profiles/:%s", profileIdName), deleteProcessingProfileApi)
+
+	authorized.GET(apiPath("/processing-rules"), getProcessingRules)
+	maintainer.PUT(apiPath("/processing-rules"), addProcessingRule)
+	authorized.GET(apiPath("/processing-rules/:%s", ruleIdName), getProcessingRule)
+	maintainer.PATCH(apiPath("/processing-rules/:%s", ruleIdName), updateProcessingRule)
+	maintainer.DELETE(apiPath("/processing-rules/:%s", ruleIdName), deleteProcessingRule)
+
+	authorized.GET(apiPath("/jobs"), getJobs)
+	authorized.GET(apiPath("/jobs/:%s", jobIdName), getJob)
+	maintainer.POST(apiPath("/jobs/:%s/cancel", jobIdName), cancelJobApi)
+	authorized.GET(apiPath("/processing/stats"), getProcessingStats)
 
 	r.GET(apiPath("/authors"), getAuthors)
-	authorized.PUT(apiPath("/authors"), addAuthor)
+	maintainer.PUT(apiPath("/authors"), addAuthor)
 	r.GET(apiPath("/authors/:%s", authorIdName), getAuthor)
-	authorized.PATCH(apiPath("/authors/:%s", authorIdName), updateAuthor)
-	authorized.DELETE(apiPath("/authors/:%s", authorIdName), deleteAuthor)
-
-	logger.Infof("Server starting at http://localhost:%d", appConfig.Port)
-	err = r.Run(fmt.Sprintf(":%d", appConfig.Port))
-	if err != nil {
-		logger.Errorf("Error starting web server: %v", err)
-	}
+	maintainer.PATCH(apiPath("/authors/:%s", authorIdName), updateAuthor)
+	admin.DELETE(apiPath("/authors/:%s", authorIdName), deleteAuthor)
+	authorized.GET(apiPath("/authors/:%s/revisions", authorIdName), getRevisions(auditEntityAuthor))
+	maintainer.POST(apiPath("/authors/:%s/revisions/:%s/restore", authorIdName, revisionNumberName), restoreRevisionApi(auditEntityAuthor))
 }
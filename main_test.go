@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutePermissions(t *testing.T) {
+	setupTestSessions(t)
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	setupRoutes(r)
+
+	tokens := map[Role]string{}
+	for _, role := range roles {
+		username := string(role)
+		accounts[username] = Account{Username: username, Role: role}
+		token, err := issueSessionToken(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[role] = token.Token
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		// required is the role the route requires, an empty role allows anonymous requests
+		required Role
+		// allowed is the status of requests with the required role
+		allowed int
+	}{
+		{http.MethodGet, "/v1/images", "", "", http.StatusOK},
+		{http.MethodGet, "/v1/jobs", "", RoleViewer, http.StatusOK},
+		{http.MethodGet, "/images", "", RoleViewer, http.StatusOK},
+		{http.MethodPost, "/v1/images/order", "{}", RoleContributor, http.StatusBadRequest},
+		{http.MethodPut, "/v1/images", `{"name": "new"}`, RoleMaintainer, http.StatusOK},
+		{http.MethodGet, "/v1/trash", "", RoleMaintainer, http.StatusOK},
+		{http.MethodGet, "/v1/audit", "", RoleMaintainer, http.StatusOK},
+		{http.MethodGet, "/users", "", RoleAdmin, http.StatusOK},
+		{http.MethodDelete, "/v1/trash", "", RoleAdmin, http.StatusOK},
+	}
+	for _, test := range tests {
+		for _, role := range append([]Role{""}, roles...) {
+			t.Run(fmt.Sprintf("%s %s as %s", test.method, test.path, role), func(t *testing.T) {
+				request := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+				request.Header.Set("Content-Type", "application/json")
+				if len(role) > 0 {
+					request.Header.Set("Authorization", "Bearer "+tokens[role])
+				}
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, request)
+
+				expected := test.allowed
+				if len(role) == 0 && len(test.required) > 0 {
+					expected = http.StatusUnauthorized
+				} else if len(role) > 0 && !role.Includes(test.required) {
+					expected = http.StatusForbidden
+				}
+				if recorder.Code != expected {
+					t.Errorf("got status %d, expected %d", recorder.Code, expected)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/bimg"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type (
+	// ImageMetadata is the metadata embedded in the original of an image. It's kept for reference only, the processed
+	// variants don't carry it unless a processing rule explicitly keeps it.
+	ImageMetadata struct {
+		gorm.Model
+		ImageID      uint `gorm:"uniqueIndex"`
+		Width        int
+		Height       int
+		ColorSpace   string `gorm:"size:20"`
+		ColorProfile bool
+		Orientation  int
+		CameraMake   string `gorm:"size:100"`
+		CameraModel  string `gorm:"size:100"`
+		Software     string `gorm:"size:100"`
+		CapturedAt   *time.Time
+		// HasGps only records that the original contains a location, the coordinates themselves are never stored
+		HasGps      bool
+		Title       string
+		Description string
+		Creator     string
+		Copyright   string
+		// Keywords are stored comma separated
+		Keywords string
+	}
+
+	ImageMetadataDto struct {
+		ImageID      uint       `json:"imageId" yaml:"imageId"`
+		Width        int        `json:"width" yaml:"width"`
+		Height       int        `json:"height" yaml:"height"`
+		ColorSpace   string     `json:"colorSpace" yaml:"colorSpace"`
+		ColorProfile bool       `json:"colorProfile" yaml:"colorProfile"`
+		Orientation  int        `json:"orientation" yaml:"orientation"`
+		CameraMake   string     `json:"cameraMake,omitempty" yaml:"cameraMake,omitempty"`
+		CameraModel  string     `json:"cameraModel,omitempty" yaml:"cameraModel,omitempty"`
+		Software     string     `json:"software,omitempty" yaml:"software,omitempty"`
+		CapturedAt   *time.Time `json:"capturedAt,omitempty" yaml:"capturedAt,omitempty"`
+		HasGps       bool       `json:"hasGps" yaml:"hasGps"`
+		Title        string     `json:"title,omitempty" yaml:"title,omitempty"`
+		Description  string     `json:"description,omitempty" yaml:"description,omitempty"`
+		Creator      string     `json:"creator,omitempty" yaml:"creator,omitempty"`
+		Copyright    string     `json:"copyright,omitempty" yaml:"copyright,omitempty"`
+		Keywords     []string   `json:"keywords,omitempty" yaml:"keywords,omitempty"`
+	}
+
+	ApplyMetadataDto struct {
+		// Overwrite replaces fields that are already set, otherwise only empty fields are filled
+		Overwrite bool `json:"overwrite" form:"overwrite"`
+	}
+
+	// embeddedText holds the descriptive fields of IPTC or XMP metadata
+	embeddedText struct {
+		Title       string
+		Description string
+		Creator     string
+		Copyright   string
+		Keywords    []string
+	}
+)
+
+const (
+	exifDateLayout = "2006:01:02 15:04:05"
+
+	jpegMarkerApp13 = 0xED
+	jpegMarkerSos   = 0xDA
+	jpegMarkerEoi   = 0xD9
+
+	iptcTagMarker     = 0x1C
+	iptcRecordApp     = 2
+	iptcObjectName    = 5
+	iptcKeywords      = 25
+	iptcByline        = 80
+	iptcCopyright     = 116
+	iptcCaption       = 120
+	photoshopIptcId   = 0x0404
+	dublinCoreNs      = "http://purl.org/dc/elements/1.1/"
+	rdfNs             = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	keywordsSeparator = ", "
+)
+
+var (
+	photoshopHeader = []byte("Photoshop 3.0\x00")
+	resourceHeader  = []byte("8BIM")
+	xmpStart        = []byte("<x:xmpmeta")
+	xmpEnd          = []byte("</x:xmpmeta>")
+
+	errNoMetadata = errors.New("image has no metadata")
+)
+
+func (m *ImageMetadata) toDto() ImageMetadataDto {
+	dto := ImageMetadataDto{
+		ImageID:      m.ImageID,
+		Width:        m.Width,
+		Height:       m.Height,
+		ColorSpace:   m.ColorSpace,
+		ColorProfile: m.ColorProfile,
+		Orientation:  m.Orientation,
+		CameraMake:   m.CameraMake,
+		CameraModel:  m.CameraModel,
+		Software:     m.Software,
+		CapturedAt:   m.CapturedAt,
+		HasGps:       m.HasGps,
+		Title:        m.Title,
+		Description:  m.Description,
+		Creator:      m.Creator,
+		Copyright:    m.Copyright,
+	}
+	if len(m.Keywords) > 0 {
+		dto.Keywords = strings.Split(m.Keywords, keywordsSeparator)
+	}
+	return dto
+}
+
+// extractMetadata reads the technical metadata with libvips and the descriptive IPTC and XMP fields with the
+// parsers below. XMP wins over IPTC, as editors keep it more up to date.
+func extractMetadata(imageId uint, data []byte) (*ImageMetadata, error) {
+	vipsMetadata, err := bimg.Metadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	exif := vipsMetadata.EXIF
+	metadata := ImageMetadata{
+		ImageID:      imageId,
+		Width:        vipsMetadata.Size.Width,
+		Height:       vipsMetadata.Size.Height,
+		ColorSpace:   vipsMetadata.Space,
+		ColorProfile: vipsMetadata.Profile,
+		Orientation:  vipsMetadata.Orientation,
+		CameraMake:   strings.TrimSpace(exif.Make),
+		CameraModel:  strings.TrimSpace(exif.Model),
+		Software:     strings.TrimSpace(exif.Software),
+		HasGps:       len(exif.GPSLatitude) > 0 || len(exif.GPSLongitude) > 0,
+	}
+
+	for _, rawDate := range []string{exif.DateTimeOriginal, exif.Datetime} {
+		if capturedAt, err := time.Parse(exifDateLayout, strings.TrimSpace(rawDate)); err == nil {
+			metadata.CapturedAt = &capturedAt
+			break
+		}
+	}
+
+	text := parseIptc(data)
+	xmpText := parseXmp(data)
+	text.mergeFrom(xmpText)
+
+	metadata.Title = text.Title
+	metadata.Description = text.Description
+	metadata.Creator = text.Creator
+	metadata.Copyright = text.Copyright
+	metadata.Keywords = strings.Join(text.Keywords, keywordsSeparator)
+
+	return &metadata, nil
+}
+
+// mergeFrom overrides the fields that are set in the other text
+func (t *embeddedText) mergeFrom(other embeddedText) {
+	if len(other.Title) > 0 {
+		t.Title = other.Title
+	}
+	if len(other.Description) > 0 {
+		t.Description = other.Description
+	}
+	if len(other.Creator) > 0 {
+		t.Creator = other.Creator
+	}
+	if len(other.Copyright) > 0 {
+		t.Copyright = other.Copyright
+	}
+	if len(other.Keywords) > 0 {
+		t.Keywords = other.Keywords
+	}
+}
+
+// decodeLegacyText decodes IPTC values, which are either UTF-8 or, in older files, Latin-1
+func decodeLegacyText(value []byte) string {
+	if utf8.Valid(value) {
+		return strings.TrimSpace(string(value))
+	}
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		runes[i] = rune(b)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// jpegSegments returns the payload of all JPEG segments with the given marker before the image data starts
+func jpegSegments(data []byte, marker byte) [][]byte {
+	segments := make([][]byte, 0)
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return segments
+	}
+
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		segmentMarker := data[pos+1]
+		if segmentMarker == jpegMarkerSos || segmentMarker == jpegMarkerEoi {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		if segmentMarker == marker {
+			segments = append(segments, data[pos+4:end])
+		}
+		pos = end
+	}
+	return segments
+}
+
+// parseIptc reads the IPTC-IIM record stored in the Photoshop resources of a JPEG file
+func parseIptc(data []byte) embeddedText {
+	text := embeddedText{}
+
+	for _, segment := range jpegSegments(data, jpegMarkerApp13) {
+		if !bytes.HasPrefix(segment, photoshopHeader) {
+			continue
+		}
+		resources := segment[len(photoshopHeader):]
+
+		for len(resources) >= 12 && bytes.HasPrefix(resources, resourceHeader) {
+			resourceId := binary.BigEndian.Uint16(resources[4:])
+			// The resource name is a pascal string padded to an even length
+			nameLength := int(resources[6]) + 1
+			nameLength += nameLength % 2
+			sizePos := 6 + nameLength
+			if sizePos+4 > len(resources) {
+				break
+			}
+			size := int(binary.BigEndian.Uint32(resources[sizePos:]))
+			dataPos := sizePos + 4
+			if size < 0 || dataPos+size > len(resources) {
+				break
+			}
+
+			if resourceId == photoshopIptcId {
+				parseIptcRecords(resources[dataPos:dataPos+size], &text)
+			}
+
+			next := dataPos + size + size%2
+			if next > len(resources) {
+				break
+			}
+			resources = resources[next:]
+		}
+	}
+
+	return text
+}
+
+func parseIptcRecords(records []byte, text *embeddedText) {
+	for len(records) >= 5 && records[0] == iptcTagMarker {
+		record, dataset := records[1], records[2]
+		length := int(binary.BigEndian.Uint16(records[3:]))
+		// Extended datasets longer than 32767 bytes don't carry any of the text fields we're interested in
+		if length&0x8000 != 0 || 5+length > len(records) {
+			return
+		}
+		value := decodeLegacyText(records[5 : 5+length])
+		records = records[5+length:]
+
+		if record != iptcRecordApp || len(value) == 0 {
+			continue
+		}
+		switch dataset {
+		case iptcObjectName:
+			text.Title = value
+		case iptcCaption:
+			text.Description = value
+		case iptcByline:
+			text.Creator = value
+		case iptcCopyright:
+			text.Copyright = value
+		case iptcKeywords:
+			text.Keywords = append(text.Keywords, value)
+		}
+	}
+}
+
+// parseXmp reads the Dublin Core fields of an XMP packet. The packet is stored as plain XML in JPEG, PNG and WebP
+// files, so it's searched for in the raw data instead of parsing each container format.
+func parseXmp(data []byte) embeddedText {
+	text := embeddedText{}
+
+	start := bytes.Index(data, xmpStart)
+	if start < 0 {
+		return text
+	}
+	end := bytes.Index(data[start:], xmpEnd)
+	if end < 0 {
+		return text
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data[start : start+end+len(xmpEnd)]))
+	decoder.Strict = false
+
+	var field string
+	var inItem bool
+	var itemText strings.Builder
+	values := map[string][]string{}
+
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) || err != nil {
+			break
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if element.Name.Space == dublinCoreNs {
+				field = element.Name.Local
+			} else if len(field) > 0 && element.Name.Space == rdfNs && element.Name.Local == "li" {
+				inItem = true
+				itemText.Reset()
+			}
+		case xml.CharData:
+			if inItem {
+				itemText.Write(element)
+			}
+		case xml.EndElement:
+			if element.Name.Space == dublinCoreNs && element.Name.Local == field {
+				field = ""
+			} else if inItem && element.Name.Space == rdfNs && element.Name.Local == "li" {
+				inItem = false
+				if value := strings.TrimSpace(itemText.String()); len(value) > 0 {
+					values[field] = append(values[field], value)
+				}
+			}
+		}
+	}
+
+	first := func(name string) string {
+		if len(values[name]) == 0 {
+			return ""
+		}
+		return values[name][0]
+	}
+
+	text.Title = first("title")
+	text.Description = first("description")
+	text.Creator = strings.Join(values["creator"], keywordsSeparator)
+	text.Copyright = first("rights")
+	text.Keywords = values["subject"]
+	return text
+}
+
+// saveImageMetadata replaces the stored metadata of the image
+func saveImageMetadata(tx *gorm.DB, metadata *ImageMetadata) error {
+	res := tx.Unscoped().Where("image_id = ?", metadata.ImageID).Delete(&ImageMetadata{})
+	if res.Error != nil {
+		return res.Error
+	}
+	metadata.ID = 0
+	return tx.Create(metadata).Error
+}
+
+// applyMetadata fills the title, description and author of the image from its metadata. Authors are only matched
+// against existing authors by name. It returns whether the author changed.
+func applyMetadata(image *Image, metadata *ImageMetadata, overwrite bool) bool {
+	if len(metadata.Title) > 0 && (overwrite || len(image.Title) == 0) {
+		image.Title = metadata.Title
+	}
+	if len(metadata.Description) > 0 && (overwrite || len(image.Description) == 0) {
+		image.Description = strings.ReplaceAll(metadata.Description, "\r\n", "\n")
+	}
+
+	if len(metadata.Creator) == 0 || (!overwrite && image.AuthorID > 0) {
+		return false
+	}
+
+	var author Author
+	res := db.Where("LOWER(name) = LOWER(?)", metadata.Creator).Limit(1).Find(&author)
+	if res.RowsAffected == 0 || author.ID == image.AuthorID {
+		return false
+	}
+
+	image.AuthorID = author.ID
+	image.Author = &author
+	return true
+}
+
+func loadImageMetadata(imageId uint) (*ImageMetadata, error) {
+	var metadata ImageMetadata
+	res := db.Where("image_id = ?", imageId).Limit(1).Find(&metadata)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, errNoMetadata
+	}
+	return &metadata, nil
+}
+
+// applyImageMetadata applies the stored metadata to the image and saves it. Variants named after the old author are
+// removed and the image is processed again.
+func applyImageMetadata(c *gin.Context, image *Image, overwrite bool) error {
+	metadata, err := loadImageMetadata(image.ID)
+	if err != nil {
+		return err
+	}
+
+	authorChanged := applyMetadata(image, metadata, overwrite)
+	err = db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Omit("Categories", "Related", "Variants", "ProcessingProfile").Save(image)
+		if res.Error != nil {
+			return res.Error
+		}
+		if authorChanged {
+			return removeVariants(image.ID, tx, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if authorChanged {
+		processImageForm(c, image)
+	}
+	return nil
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getImageMetadata(c *gin.Context) {
+	id, err := pathIdToInt(imageIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metadata, err := loadImageMetadata(id)
+	if errors.Is(err, errNoMetadata) {
+		c.String(http.StatusNotFound, "No metadata for image with id '%d'", id)
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading metadata: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, metadata.toDto())
+}
+
+func applyImageMetadataApi(c *gin.Context) {
+	id, err := pathIdToInt(imageIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	applyDto := ApplyMetadataDto{}
+	if err := c.ShouldBind(&applyDto); err != nil && !errors.Is(err, io.EOF) {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	image, err := loadImageById(id)
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+
+	err = applyImageMetadata(c, image, applyDto.Overwrite)
+	if errors.Is(err, errNoMetadata) {
+		c.String(http.StatusNotFound, "No metadata for image with id '%d'", id)
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error applying metadata: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, image.toDto())
+}
+
+// imageMetadataView returns the stored metadata of the image, nil if there is none
+func imageMetadataView(imageId uint) *ImageMetadataDto {
+	metadata, err := loadImageMetadata(imageId)
+	if err != nil {
+		return nil
+	}
+	dto := metadata.toDto()
+	return &dto
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func iptcDataset(record, dataset byte, value string) []byte {
+	data := []byte{iptcTagMarker, record, dataset}
+	data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+	return append(data, value...)
+}
+
+// photoshopResource encodes an image resource block with a pascal string name padded to an even length
+func photoshopResource(id uint16, name string, data []byte) []byte {
+	resource := append([]byte{}, resourceHeader...)
+	resource = binary.BigEndian.AppendUint16(resource, id)
+	resource = append(resource, byte(len(name)))
+	resource = append(resource, name...)
+	if (len(name)+1)%2 != 0 {
+		resource = append(resource, 0)
+	}
+	resource = binary.BigEndian.AppendUint32(resource, uint32(len(data)))
+	resource = append(resource, data...)
+	if len(data)%2 != 0 {
+		resource = append(resource, 0)
+	}
+	return resource
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func jpegWith(segments ...[]byte) []byte {
+	data := []byte{0xFF, 0xD8}
+	for _, segment := range segments {
+		data = append(data, segment...)
+	}
+	return append(data, 0xFF, jpegMarkerSos, 0x00, 0x02, 0xFF, jpegMarkerEoi)
+}
+
+func iptcJpeg(resources ...[]byte) []byte {
+	return jpegWith(jpegSegment(jpegMarkerApp13, append(append([]byte{}, photoshopHeader...), bytes.Join(resources, nil)...)))
+}
+
+func TestParseIptc(t *testing.T) {
+	records := bytes.Join([][]byte{
+		iptcDataset(1, 90, "\x1b%G"),
+		iptcDataset(iptcRecordApp, iptcObjectName, "Sunset"),
+		iptcDataset(iptcRecordApp, iptcCaption, " Over the sea "),
+		iptcDataset(iptcRecordApp, iptcByline, "Jane Doe"),
+		iptcDataset(iptcRecordApp, iptcCopyright, "© Jane Doe"),
+		iptcDataset(iptcRecordApp, iptcKeywords, "sea"),
+		iptcDataset(iptcRecordApp, iptcKeywords, ""),
+		iptcDataset(iptcRecordApp, iptcKeywords, "sun"),
+	}, nil)
+	full := embeddedText{
+		Title:       "Sunset",
+		Description: "Over the sea",
+		Creator:     "Jane Doe",
+		Copyright:   "© Jane Doe",
+		Keywords:    []string{"sea", "sun"},
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		text embeddedText
+	}{
+		{"iptc resource", iptcJpeg(photoshopResource(photoshopIptcId, "", records)), full},
+		{"after other resources", iptcJpeg(
+			photoshopResource(0x03ED, "resolution", []byte{1, 2, 3}),
+			photoshopResource(photoshopIptcId, "ab", records),
+		), full},
+		{"other segments first", jpegWith(
+			jpegSegment(0xE0, []byte("JFIF\x00")),
+			jpegSegment(jpegMarkerApp13, append(append([]byte{}, photoshopHeader...), photoshopResource(photoshopIptcId, "", records)...)),
+		), full},
+		{"latin-1", iptcJpeg(photoshopResource(photoshopIptcId, "", iptcDataset(iptcRecordApp, iptcByline, "J\xfcrgen"))),
+			embeddedText{Creator: "Jürgen"}},
+		{"truncated dataset", iptcJpeg(photoshopResource(photoshopIptcId, "",
+			append(iptcDataset(iptcRecordApp, iptcObjectName, "Kept"), iptcDataset(iptcRecordApp, iptcCaption, "Lost")[:8]...))),
+			embeddedText{Title: "Kept"}},
+		{"truncated resource", iptcJpeg(photoshopResource(photoshopIptcId, "", records)[:20]), embeddedText{}},
+		{"no photoshop header", jpegWith(jpegSegment(jpegMarkerApp13, photoshopResource(photoshopIptcId, "", records))), embeddedText{}},
+		{"after image data", append(jpegWith(), iptcJpeg(photoshopResource(photoshopIptcId, "", records))...), embeddedText{}},
+		{"not a jpeg", append([]byte("\x89PNG"), records...), embeddedText{}},
+		{"empty", nil, embeddedText{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if text := parseIptc(test.data); !reflect.DeepEqual(text, test.text) {
+				t.Errorf("got %+v, expected %+v", text, test.text)
+			}
+		})
+	}
+}
+
+func TestParseXmp(t *testing.T) {
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Sunset</rdf:li><rdf:li xml:lang="de">Sonnenuntergang</rdf:li></rdf:Alt></dc:title>
+<dc:description><rdf:Alt><rdf:li xml:lang="x-default"> Over the sea </rdf:li></rdf:Alt></dc:description>
+<dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li><rdf:li>John Doe</rdf:li></rdf:Seq></dc:creator>
+<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">CC BY 4.0 &amp; more</rdf:li></rdf:Alt></dc:rights>
+<dc:subject><rdf:Bag><rdf:li>sea</rdf:li><rdf:li> </rdf:li><rdf:li>sun</rdf:li></rdf:Bag></dc:subject>
+</rdf:Description></rdf:RDF></x:xmpmeta>`
+	full := embeddedText{
+		Title:       "Sunset",
+		Description: "Over the sea",
+		Creator:     "Jane Doe, John Doe",
+		Copyright:   "CC BY 4.0 & more",
+		Keywords:    []string{"sea", "sun"},
+	}
+	otherNamespace := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"><photoshop:Headline><rdf:Alt><rdf:li>Ignored</rdf:li></rdf:Alt></photoshop:Headline>
+</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+	tests := []struct {
+		name string
+		data string
+		text embeddedText
+	}{
+		{"packet", packet, full},
+		{"embedded in binary data", "\x89PNG\r\n\x1a\n\x00iTXtXML:com.adobe.xmp\x00" + packet + "\x00IEND", full},
+		{"other namespace", otherNamespace, embeddedText{}},
+		{"unterminated", packet[:len(packet)-len(xmpEnd)], embeddedText{}},
+		{"malformed", `<x:xmpmeta><dc:title xmlns:dc="http://purl.org/dc/elements/1.1/"><rdf:li>Broken</x:xmpmeta>`, embeddedText{}},
+		{"no packet", "plain image data", embeddedText{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if text := parseXmp([]byte(test.data)); !reflect.DeepEqual(text, test.text) {
+				t.Errorf("got %+v, expected %+v", text, test.text)
+			}
+		})
+	}
+}
+
+func TestDecodeLegacyText(t *testing.T) {
+	tests := []struct {
+		value    []byte
+		expected string
+	}{
+		{[]byte("plain"), "plain"},
+		{[]byte(" Jürgen "), "Jürgen"},
+		{[]byte("J\xfcrgen"), "Jürgen"},
+		{[]byte("\xa9 2024"), "© 2024"},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if decoded := decodeLegacyText(test.value); decoded != test.expected {
+			t.Errorf("decodeLegacyText(%q) = %q, expected %q", test.value, decoded, test.expected)
+		}
+	}
+}
+
+func TestEmbeddedTextMergeFrom(t *testing.T) {
+	text := embeddedText{Title: "IPTC title", Creator: "IPTC creator", Keywords: []string{"iptc"}}
+	text.mergeFrom(embeddedText{Title: "XMP title", Copyright: "XMP rights"})
+
+	expected := embeddedText{Title: "XMP title", Creator: "IPTC creator", Copyright: "XMP rights", Keywords: []string{"iptc"}}
+	if !reflect.DeepEqual(text, expected) {
+		t.Errorf("got %+v, expected %+v", text, expected)
+	}
+}
+
+func TestApplyMetadata(t *testing.T) {
+	setupTestDatabase(t)
+	jane, john := Author{Name: "Jane Doe"}, Author{Name: "John Doe"}
+	db.Create(&jane)
+	db.Create(&john)
+	metadata := ImageMetadata{Title: "Sunset", Description: "Over\r\nthe sea", Creator: "jane doe"}
+
+	tests := []struct {
+		name      string
+		image     Image
+		metadata  ImageMetadata
+		overwrite bool
+		expected  Image
+		changed   bool
+	}{
+		{"fills empty fields", Image{}, metadata, false,
+			Image{Title: "Sunset", Description: "Over\nthe sea", AuthorID: jane.ID}, true},
+		{"keeps existing fields", Image{Title: "Mine", Description: "Kept", AuthorID: john.ID}, metadata, false,
+			Image{Title: "Mine", Description: "Kept", AuthorID: john.ID}, false},
+		{"overwrites existing fields", Image{Title: "Mine", Description: "Kept", AuthorID: john.ID}, metadata, true,
+			Image{Title: "Sunset", Description: "Over\nthe sea", AuthorID: jane.ID}, true},
+		{"empty metadata doesn't clear fields", Image{Title: "Mine", AuthorID: john.ID}, ImageMetadata{}, true,
+			Image{Title: "Mine", AuthorID: john.ID}, false},
+		{"unknown creator", Image{AuthorID: john.ID}, ImageMetadata{Creator: "Someone Else"}, true,
+			Image{AuthorID: john.ID}, false},
+		{"same author", Image{AuthorID: jane.ID}, metadata, true,
+			Image{Title: "Sunset", Description: "Over\nthe sea", AuthorID: jane.ID}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image := test.image
+			changed := applyMetadata(&image, &test.metadata, test.overwrite)
+			if changed != test.changed {
+				t.Errorf("author changed is %v, expected %v", changed, test.changed)
+			}
+			if image.Title != test.expected.Title || image.Description != test.expected.Description ||
+				image.AuthorID != test.expected.AuthorID {
+				t.Errorf("got %q, %q by %d, expected %q, %q by %d", image.Title, image.Description, image.AuthorID,
+					test.expected.Title, test.expected.Description, test.expected.AuthorID)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+type (
+	// ImageCategory is the join table between images and categories. SortIndex orders the images within the
+	// category, images with a SortIndex of 0 haven't been ordered in the category and follow the ordered ones.
+	ImageCategory struct {
+		ImageID    uint `gorm:"primaryKey"`
+		CategoryID uint `gorm:"primaryKey"`
+		SortIndex  int  `gorm:"not null;default:0"`
+	}
+
+	// ReorderImagesDto moves the images into the given order. The images keep the positions they occupied
+	// together, so a part of the list (e.g. a single page) can be reordered without moving the other images.
+	ReorderImagesDto struct {
+		ImageIDs []uint `json:"imageIds" yaml:"imageIds" form:"imageIds" binding:"required"`
+		// CategoryID orders the images within the category instead of the global order
+		CategoryID uint `json:"categoryId,omitempty" yaml:"categoryId,omitempty" form:"categoryId"`
+	}
+
+	ReorderResultDto struct {
+		// Renumbered is the number of images whose sort index changed
+		Renumbered int `json:"renumbered" yaml:"renumbered"`
+	}
+)
+
+// sortIndexStep is the gap between the sort indices of neighbouring images
+const sortIndexStep = 10
+
+var errReorderInvalid = errors.New("invalid order")
+
+func (ImageCategory) TableName() string {
+	return "images_categories"
+}
+
+// setupJoinTables has to run before the models are migrated, so the join table gets the sort index column. Rows that
+// were added before the column was NOT NULL are backfilled first, otherwise the migration couldn't copy them.
+func setupJoinTables() error {
+	if db.Migrator().HasColumn(&ImageCategory{}, "sort_index") {
+		res := db.Exec("UPDATE images_categories SET sort_index = 0 WHERE sort_index IS NULL")
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	err := db.SetupJoinTable(&Image{}, "Categories", &ImageCategory{})
+	if err != nil {
+		return err
+	}
+	return db.SetupJoinTable(&Category{}, "Images", &ImageCategory{})
+}
+
+// categoryOrder orders the images by their sort index within the category, followed by the unordered images
+func categoryOrder(categoryId uint, sortMode string) string {
+	sortIndex := fmt.Sprintf("(SELECT COALESCE(ic.sort_index, 0) FROM images_categories ic WHERE ic.image_id = images.id AND ic.category_id = %d)", categoryId)
+	return sortIndex + " = 0, " + sortIndex + " " + sortMode + ", images.sort_index " + sortMode
+}
+
+// orderedImageIds returns the IDs of all images in their current global order, or their order within the category
+func orderedImageIds(tx *gorm.DB, categoryId uint) ([]uint, error) {
+	var ids []uint
+	query := tx.Model(&Image{})
+	if categoryId > 0 {
+		query = query.Where("images.id IN (SELECT image_id FROM images_categories WHERE category_id = ?)", categoryId).
+			Order(categoryOrder(categoryId, "asc"))
+	} else {
+		query = query.Order("images.sort_index asc")
+	}
+	res := query.Order("images.id asc").Pluck("images.id", &ids)
+	return ids, res.Error
+}
+
+// reorderImages moves the images into the given order and renumbers the sort indices of the whole list with gaps of
+// sortIndexStep in a single transaction
+func reorderImages(ctx context.Context, reorder *ReorderImagesDto) (*ReorderResultDto, error) {
+	if len(reorder.ImageIDs) == 0 {
+		return nil, fmt.Errorf("%w: no images given", errReorderInvalid)
+	}
+	result := ReorderResultDto{}
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if reorder.CategoryID > 0 {
+			err := requireExisting(tx, &Category{}, "categories", []uint{reorder.CategoryID})
+			if err != nil {
+				return fmt.Errorf("%w: %w", errReorderInvalid, err)
+			}
+		}
+
+		current, err := orderedImageIds(tx, reorder.CategoryID)
+		if err != nil {
+			return err
+		}
+
+		positions := make([]int, 0, len(reorder.ImageIDs))
+		for _, id := range reorder.ImageIDs {
+			position := slices.Index(current, id)
+			if position < 0 {
+				return fmt.Errorf("%w: image %d isn't part of the list", errReorderInvalid, id)
+			}
+			if slices.Contains(positions, position) {
+				return fmt.Errorf("%w: image %d is listed more than once", errReorderInvalid, id)
+			}
+			positions = append(positions, position)
+		}
+
+		// The given images take the positions they occupied together, in the new order
+		slices.Sort(positions)
+		ordered := slices.Clone(current)
+		for i, position := range positions {
+			ordered[position] = reorder.ImageIDs[i]
+		}
+
+		var sortIndices map[uint]int
+		if reorder.CategoryID > 0 {
+			sortIndices, err = categorySortIndices(tx, reorder.CategoryID)
+		} else {
+			sortIndices, err = globalSortIndices(tx)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only the global order is a column of the images, the order within a category isn't audited
+		audited := make([]uint, 0)
+		if reorder.CategoryID == 0 {
+			audited = ordered
+		}
+		tx, audit, err := beginAudit(tx, auditEntityImage, audited...)
+		if err != nil {
+			return err
+		}
+
+		for i, id := range ordered {
+			sortIndex := (i + 1) * sortIndexStep
+			if sortIndices[id] == sortIndex {
+				continue
+			}
+			var res *gorm.DB
+			if reorder.CategoryID > 0 {
+				res = tx.Model(&ImageCategory{}).Where("image_id = ? AND category_id = ?", id, reorder.CategoryID).
+					UpdateColumn("sort_index", sortIndex)
+			} else {
+				res = tx.Model(&Image{}).Where("id = ?", id).UpdateColumn("sort_index", sortIndex)
+			}
+			if res.Error != nil {
+				return res.Error
+			}
+			result.Renumbered++
+		}
+		return audit.commit(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func globalSortIndices(tx *gorm.DB) (map[uint]int, error) {
+	var rows []struct {
+		ID        uint
+		SortIndex int
+	}
+	res := tx.Model(&Image{}).Select("id, sort_index").Scan(&rows)
+	sortIndices := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		sortIndices[row.ID] = row.SortIndex
+	}
+	return sortIndices, res.Error
+}
+
+func categorySortIndices(tx *gorm.DB, categoryId uint) (map[uint]int, error) {
+	var rows []ImageCategory
+	res := tx.Where("category_id = ?", categoryId).Find(&rows)
+	sortIndices := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		sortIndices[row.ImageID] = row.SortIndex
+	}
+	return sortIndices, res.Error
+}
+
+func reorderErrorStatus(err error) int {
+	if errors.Is(err, errReorderInvalid) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getImageOrderHtml(c *gin.Context) {
+	var categoryId uint
+	rawCategory := c.Query("category")
+	if len(rawCategory) > 0 {
+		id, err := strconv.ParseUint(rawCategory, 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		categoryId = uint(id)
+	}
+
+	ids, err := orderedImageIds(db, categoryId)
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	var images []Image
+	db.Preload("Author").Preload("Categories").Where("id IN ?", ids).Find(&images)
+	positions := make(map[uint]int, len(ids))
+	for i, id := range ids {
+		positions[id] = i
+	}
+	slices.SortFunc(images, func(a, b Image) int {
+		return positions[a.ID] - positions[b.ID]
+	})
+
+	c.HTML(http.StatusOK, "image-order.gohtml", gin.H{
+		"images": Map(images, func(image Image) ImageView {
+			return image.toView()
+		}),
+		"category":   categoryId,
+		"categories": getAllCategories(),
+		"role":       currentRole(c),
+		"renumbered": c.Query("renumbered"),
+	})
+}
+
+func reorderImagesForm(c *gin.Context) {
+	reorder := ReorderImagesDto{}
+	if err := c.ShouldBind(&reorder); err != nil {
+		c.String(http.StatusBadRequest, "Invalid order: %v", err)
+		return
+	}
+
+	result, err := reorderImages(c, &reorder)
+	if err != nil {
+		c.Error(err)
+		c.String(reorderErrorStatus(err), "Error reordering images: %v", err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/images/order?category=%d&renumbered=%d", reorder.CategoryID, result.Renumbered))
+}
+
+func reorderImagesApi(c *gin.Context) {
+	reorder := ReorderImagesDto{}
+	if err := c.ShouldBind(&reorder); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	result, err := reorderImages(c, &reorder)
+	if err != nil {
+		c.Error(err)
+		c.String(reorderErrorStatus(err), "Error reordering images: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormLogger "gorm.io/gorm/logger"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// setupTestDatabase replaces the database with a new one in a temporary directory
+func setupTestDatabase(t *testing.T) {
+	previousDb := db
+	t.Cleanup(func() {
+		db = previousDb
+	})
+
+	logger = zap.NewNop().Sugar()
+	testDb, err := gorm.Open(sqlite.Open(sqliteDsn(filepath.Join(t.TempDir(), "test.db"))), &gorm.Config{
+		Logger: gormLogger.Default.LogMode(gormLogger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = testDb
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestImages creates count images, which are ordered by their IDs
+func createTestImages(t *testing.T, count int) {
+	for i := 1; i <= count; i++ {
+		image := Image{Name: fmt.Sprintf("image-%d", i)}
+		if res := db.Create(&image); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+}
+
+func TestReorderImages(t *testing.T) {
+	tests := []struct {
+		name       string
+		imageIds   []uint
+		order      []uint
+		renumbered int
+	}{
+		{"swap", []uint{3, 1}, []uint{3, 2, 1, 4, 5}, 2},
+		{"reverse", []uint{5, 4, 3, 2, 1}, []uint{5, 4, 3, 2, 1}, 4},
+		{"keeps the positions of the others", []uint{4, 2}, []uint{1, 4, 3, 2, 5}, 2},
+		{"move to the front", []uint{5, 1, 2, 3, 4}, []uint{5, 1, 2, 3, 4}, 5},
+		{"unchanged", []uint{2, 3}, []uint{1, 2, 3, 4, 5}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTestDatabase(t)
+			createTestImages(t, 5)
+
+			result, err := reorderImages(context.Background(), &ReorderImagesDto{ImageIDs: test.imageIds})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Renumbered != test.renumbered {
+				t.Errorf("renumbered %d images, expected %d", result.Renumbered, test.renumbered)
+			}
+			order, err := orderedImageIds(db, 0)
+			if err != nil || !slices.Equal(order, test.order) {
+				t.Errorf("got order %v, %v, expected %v", order, err, test.order)
+			}
+
+			sortIndices, err := globalSortIndices(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, id := range test.order {
+				if sortIndices[id] != (i+1)*sortIndexStep {
+					t.Errorf("image %d has sort index %d at position %d", id, sortIndices[id], i)
+				}
+			}
+		})
+	}
+}
+
+func TestReorderImagesAfterDelete(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	createTestImages(t, 5)
+	image := Image{}
+	db.First(&image, 2)
+	if err := trashImage(context.Background(), &image); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted image leaves a gap, the remaining images are renumbered without it
+	result, err := reorderImages(context.Background(), &ReorderImagesDto{ImageIDs: []uint{5, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, _ := orderedImageIds(db, 0)
+	if expected := []uint{5, 3, 4, 1}; !slices.Equal(order, expected) || result.Renumbered != 4 {
+		t.Errorf("got order %v with %d renumbered, expected %v", order, result.Renumbered, expected)
+	}
+	sortIndices, _ := globalSortIndices(db)
+	for i, id := range order {
+		if sortIndices[id] != (i+1)*sortIndexStep {
+			t.Errorf("image %d has sort index %d at position %d", id, sortIndices[id], i)
+		}
+	}
+
+	if _, err := reorderImages(context.Background(), &ReorderImagesDto{ImageIDs: []uint{2, 1}}); !errors.Is(err, errReorderInvalid) {
+		t.Errorf("reordering a deleted image returned %v", err)
+	}
+}
+
+func TestReorderImagesInCategory(t *testing.T) {
+	setupTestDatabase(t)
+	createTestImages(t, 5)
+	category := Category{Name: "landscapes"}
+	if res := db.Create(&category); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	// Image 4 is ordered in the category, the others follow in their global order
+	for _, row := range []ImageCategory{{ImageID: 2}, {ImageID: 4, SortIndex: 5}, {ImageID: 5}} {
+		row.CategoryID = category.ID
+		db.Create(&row)
+	}
+
+	order, _ := orderedImageIds(db, category.ID)
+	if expected := []uint{4, 2, 5}; !slices.Equal(order, expected) {
+		t.Fatalf("got initial order %v, expected %v", order, expected)
+	}
+
+	result, err := reorderImages(context.Background(), &ReorderImagesDto{ImageIDs: []uint{5, 4}, CategoryID: category.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, _ = orderedImageIds(db, category.ID)
+	if expected := []uint{5, 2, 4}; !slices.Equal(order, expected) || result.Renumbered != 3 {
+		t.Errorf("got order %v with %d renumbered, expected %v", order, result.Renumbered, expected)
+	}
+	sortIndices, _ := categorySortIndices(db, category.ID)
+	if sortIndices[5] != 10 || sortIndices[2] != 20 || sortIndices[4] != 30 {
+		t.Errorf("got category sort indices %v", sortIndices)
+	}
+
+	global, _ := orderedImageIds(db, 0)
+	if expected := []uint{1, 2, 3, 4, 5}; !slices.Equal(global, expected) {
+		t.Errorf("reordering the category changed the global order to %v", global)
+	}
+}
+
+func TestReorderImagesInvalid(t *testing.T) {
+	setupTestDatabase(t)
+	createTestImages(t, 3)
+
+	tests := []struct {
+		name    string
+		reorder ReorderImagesDto
+	}{
+		{"no images", ReorderImagesDto{}},
+		{"unknown image", ReorderImagesDto{ImageIDs: []uint{1, 9}}},
+		{"duplicate image", ReorderImagesDto{ImageIDs: []uint{2, 1, 2}}},
+		{"unknown category", ReorderImagesDto{ImageIDs: []uint{1}, CategoryID: 99}},
+		{"image outside the category", ReorderImagesDto{ImageIDs: []uint{1}, CategoryID: 1}},
+	}
+	db.Create(&Category{Name: "empty"})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := reorderImages(context.Background(), &test.reorder)
+			if !errors.Is(err, errReorderInvalid) {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+
+	order, _ := orderedImageIds(db, 0)
+	if expected := []uint{1, 2, 3}; !slices.Equal(order, expected) {
+		t.Errorf("rejected reorders changed the order to %v", order)
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+type (
+	// OriginalVersion is an uploaded original of an image. The current original is kept in the original storage, the
+	// previous ones are kept in the version storage until they are pruned.
+	OriginalVersion struct {
+		ID        uint `gorm:"primaryKey"`
+		CreatedAt time.Time
+		ImageID   uint `gorm:"index"`
+		// Username is empty for originals that were uploaded before versions were kept
+		Username string `gorm:"size:100"`
+		// FileName is the name of the uploaded file
+		FileName       string
+		Format         string `gorm:"size:5"`
+		Width          int
+		Height         int
+		FileSize       int64
+		MimeType       string `gorm:"size:50"`
+		Checksum       string `gorm:"size:64"`
+		PerceptualHash string `gorm:"size:16"`
+	}
+
+	OriginalVersionDto struct {
+		ID        uint      `json:"id" yaml:"id"`
+		CreatedAt time.Time `json:"createdAt" yaml:"createdAt"`
+		Username  string    `json:"username" yaml:"username"`
+		FileName  string    `json:"fileName" yaml:"fileName"`
+		Format    string    `json:"format" yaml:"format"`
+		Width     int       `json:"width" yaml:"width"`
+		Height    int       `json:"height" yaml:"height"`
+		FileSize  int64     `json:"fileSize" yaml:"fileSize"`
+		MimeType  string    `json:"mimeType" yaml:"mimeType"`
+		Checksum  string    `json:"sha256" yaml:"sha256"`
+		// Active is set for the version that is the current original of the image
+		Active bool `json:"active" yaml:"active"`
+	}
+)
+
+const (
+	versionIdName = "versionId"
+
+	versionSweepInterval = time.Hour
+)
+
+var (
+	errVersionNotFound = errors.New("original version not found")
+	errVersionActive   = errors.New("original version is the current original")
+	errVersionMissing  = errors.New("file of the original version is missing")
+)
+
+// storedFileName is the key of the file in the version storage, while the version isn't the current original
+func (v *OriginalVersion) storedFileName() string {
+	return fmt.Sprintf("%d-%d.%s", v.ImageID, v.ID, v.Format)
+}
+
+func (v *OriginalVersion) setOriginalFileInfo(info OriginalFileInfo) {
+	v.Width = info.Width
+	v.Height = info.Height
+	v.FileSize = info.FileSize
+	v.MimeType = info.MimeType
+	v.Checksum = info.Checksum
+}
+
+// makeOriginalOf copies the description of the version to the image, the file has to be moved by the caller
+func (v *OriginalVersion) makeOriginalOf(image *Image) {
+	image.Format = v.Format
+	image.ImageExists = true
+	image.PerceptualHash = v.PerceptualHash
+	image.OriginalVersionID = v.ID
+	image.setOriginalFileInfo(OriginalFileInfo{
+		Width:    v.Width,
+		Height:   v.Height,
+		FileSize: v.FileSize,
+		MimeType: v.MimeType,
+		Checksum: v.Checksum,
+	})
+}
+
+func (v *OriginalVersion) toDto(image *Image) OriginalVersionDto {
+	return OriginalVersionDto{
+		ID:        v.ID,
+		CreatedAt: v.CreatedAt,
+		Username:  v.Username,
+		FileName:  v.FileName,
+		Format:    v.Format,
+		Width:     v.Width,
+		Height:    v.Height,
+		FileSize:  v.FileSize,
+		MimeType:  v.MimeType,
+		Checksum:  v.Checksum,
+		Active:    image.ImageExists && image.OriginalVersionID == v.ID,
+	}
+}
+
+// fileLocation returns where the version is currently stored, which is the original of the image if it's active
+func (v *OriginalVersion) fileLocation(image *Image) (Storage, string) {
+	if image.ImageExists && image.OriginalVersionID == v.ID {
+		return originalStorage, image.OriginalFileName()
+	}
+	return versionStorage, v.storedFileName()
+}
+
+func readUploadedFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// originalFiles collects the file changes made while a transaction replaces, trashes or restores an original. Files are
+// only added, overwritten or moved during the transaction, overwritten content is kept and moved files are moved back
+// if the transaction fails. Files that aren't needed anymore are deleted after the transaction has been committed.
+type originalFiles struct {
+	undo     []func(ctx context.Context) error
+	obsolete []func(ctx context.Context) error
+}
+
+// put writes the file, remembering how to restore the previous state
+func (f *originalFiles) put(ctx context.Context, storage Storage, key string, data []byte) error {
+	previous, err := storage.Get(ctx, key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = storage.Put(ctx, key, data)
+	if err != nil {
+		return err
+	}
+	f.undo = append(f.undo, func(ctx context.Context) error {
+		if exists {
+			return storage.Put(ctx, key, previous)
+		}
+		return storage.Delete(ctx, key)
+	})
+	return nil
+}
+
+// move moves the file to the other storage, and back again if the transaction fails
+func (f *originalFiles) move(ctx context.Context, source Storage, sourceKey string, destination Storage, destinationKey string) error {
+	err := moveObject(ctx, source, sourceKey, destination, destinationKey)
+	if err != nil {
+		return err
+	}
+	f.undo = append(f.undo, func(ctx context.Context) error {
+		return moveObject(ctx, destination, destinationKey, source, sourceKey)
+	})
+	return nil
+}
+
+// deleteAfterCommit deletes the file once the transaction has been committed
+func (f *originalFiles) deleteAfterCommit(storage Storage, key string) {
+	f.obsolete = append(f.obsolete, func(ctx context.Context) error {
+		return storage.Delete(ctx, key)
+	})
+}
+
+// finish deletes the obsolete files if the transaction succeeded, or restores the previous files if it failed
+func (f *originalFiles) finish(ctx context.Context, err error) {
+	ctx = context.WithoutCancel(ctx)
+	if err == nil {
+		for _, remove := range f.obsolete {
+			if removeErr := remove(ctx); removeErr != nil {
+				logger.Warnf("Could not delete replaced file: %v", removeErr)
+			}
+		}
+		return
+	}
+	for i := len(f.undo) - 1; i >= 0; i-- {
+		if undoErr := f.undo[i](ctx); undoErr != nil {
+			logger.Errorf("Could not restore file after failed transaction: %v", undoErr)
+		}
+	}
+}
+
+// archiveOriginal copies the current original of the image into the version storage. Originals that were uploaded
+// before versions were kept get a version first.
+func archiveOriginal(tx *gorm.DB, files *originalFiles, image *Image) error {
+	if !image.ImageExists {
+		return nil
+	}
+	ctx := tx.Statement.Context
+	data, err := originalStorage.Get(ctx, image.OriginalFileName())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	version := OriginalVersion{}
+	if image.OriginalVersionID > 0 {
+		res := tx.Where("image_id = ?", image.ID).Limit(1).Find(&version, image.OriginalVersionID)
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+	if version.ID == 0 {
+		version = OriginalVersion{
+			ImageID:        image.ID,
+			FileName:       image.OriginalFileName(),
+			Format:         image.Format,
+			Width:          image.Width,
+			Height:         image.Height,
+			FileSize:       image.FileSize,
+			MimeType:       image.MimeType,
+			Checksum:       image.Checksum,
+			PerceptualHash: image.PerceptualHash,
+		}
+		res := tx.Create(&version)
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	err = files.put(ctx, versionStorage, version.storedFileName(), data)
+	if err != nil {
+		return fmt.Errorf("could not keep previous original: %w", err)
+	}
+	image.OriginalVersionID = 0
+	return nil
+}
+
+// replaceOriginal keeps the current original as a version and writes the data as original of the image, described by
+// the version, which is created if it's new. The previous original is deleted after the commit if the new one has
+// another format. The image has to be saved afterwards, within the same transaction.
+func replaceOriginal(tx *gorm.DB, files *originalFiles, image *Image, version *OriginalVersion, data []byte) error {
+	previousKey := image.OriginalFileName()
+	hadOriginal := image.ImageExists
+	err := archiveOriginal(tx, files, image)
+	if err != nil {
+		return err
+	}
+
+	if version.ID == 0 {
+		version.ImageID = image.ID
+		res := tx.Create(version)
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	version.makeOriginalOf(image)
+	err = files.put(tx.Statement.Context, originalStorage, image.OriginalFileName(), data)
+	if err != nil {
+		return err
+	}
+	if hadOriginal && previousKey != image.OriginalFileName() {
+		files.deleteAfterCommit(originalStorage, previousKey)
+	}
+	return nil
+}
+
+// activateOriginalVersion makes a previous original the current original of the image again. The image has to be
+// processed afterwards.
+func activateOriginalVersion(ctx context.Context, image *Image, versionId uint) error {
+	version := OriginalVersion{}
+	res := db.Where("image_id = ?", image.ID).Limit(1).Find(&version, versionId)
+	if res.Error != nil {
+		return res.Error
+	}
+	if version.ID == 0 {
+		return fmt.Errorf("%w: %d", errVersionNotFound, versionId)
+	}
+	if image.ImageExists && image.OriginalVersionID == version.ID {
+		return nil
+	}
+	data, err := versionStorage.Get(ctx, version.storedFileName())
+	if err != nil {
+		return fmt.Errorf("%w: %w", errVersionMissing, err)
+	}
+
+	// The metadata belongs to the original, it's extracted again like after an upload
+	metadata, err := extractMetadata(image.ID, data)
+	if err != nil {
+		logger.Warnf("Could not extract metadata of image %d: %v", image.ID, err)
+		metadata = nil
+	}
+
+	files := originalFiles{}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := replaceOriginal(tx, &files, image, &version, data)
+		if err != nil {
+			return err
+		}
+		files.deleteAfterCommit(versionStorage, version.storedFileName())
+		if metadata != nil {
+			err = saveImageMetadata(tx, metadata)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Save(image).Error
+	})
+	files.finish(ctx, err)
+	return err
+}
+
+func deleteOriginalVersion(tx *gorm.DB, image *Image, versionId uint) error {
+	version := OriginalVersion{}
+	res := tx.Where("image_id = ?", image.ID).Limit(1).Find(&version, versionId)
+	if res.Error != nil {
+		return res.Error
+	}
+	if version.ID == 0 {
+		return fmt.Errorf("%w: %d", errVersionNotFound, versionId)
+	}
+	if image.ImageExists && image.OriginalVersionID == version.ID {
+		return errVersionActive
+	}
+	return removeVersions(tx, []OriginalVersion{version})
+}
+
+func removeVersions(tx *gorm.DB, versions []OriginalVersion) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	for _, version := range versions {
+		err := versionStorage.Delete(tx.Statement.Context, version.storedFileName())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Delete(&versions).Error
+}
+
+// pruneOriginalVersions deletes the previous originals of the image that exceed the configured number of versions
+// or are older than the retention period. The current original is never deleted.
+func pruneOriginalVersions(tx *gorm.DB, imageId uint) (int, error) {
+	keep := appConfig.OriginalVersions
+	retention := appConfig.OriginalVersionRetentionPeriod()
+	if keep == 0 && retention == 0 {
+		return 0, nil
+	}
+
+	var versions []OriginalVersion
+	res := tx.Where("image_id = ? AND id NOT IN (SELECT original_version_id FROM images WHERE id = ?)", imageId, imageId).
+		Order("created_at desc").Order("id desc").Find(&versions)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+
+	pruned := make([]OriginalVersion, 0)
+	for i, version := range versions {
+		if keep > 0 && i >= keep || retention > 0 && time.Since(version.CreatedAt) > retention {
+			pruned = append(pruned, version)
+		}
+	}
+	return len(pruned), removeVersions(tx, pruned)
+}
+
+// removeImageVersions deletes the previous originals of a purged image
+func removeImageVersions(tx *gorm.DB, imageId uint) error {
+	var versions []OriginalVersion
+	res := tx.Where("image_id = ?", imageId).Find(&versions)
+	if res.Error != nil {
+		return res.Error
+	}
+	return removeVersions(tx, versions)
+}
+
+// repairOrphanedVersions deletes the versions of purged images, together with their files
+func repairOrphanedVersions(tx *gorm.DB) (int64, error) {
+	var versions []OriginalVersion
+	res := tx.Where("image_id NOT IN (SELECT id FROM images)").Find(&versions)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	return int64(len(versions)), removeVersions(tx, versions)
+}
+
+func setupOriginalVersions() {
+	if appConfig.OriginalVersions == 0 && appConfig.OriginalVersionRetentionPeriod() == 0 {
+		logger.Info("Previous originals are kept forever")
+		return
+	}
+	go sweepOriginalVersions()
+}
+
+// sweepOriginalVersions prunes the versions of all images, so the retention period applies to images that don't get
+// new uploads and a lowered number of versions applies to all images
+func sweepOriginalVersions() {
+	ticker := time.NewTicker(versionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		var imageIds []uint
+		res := db.Model(&OriginalVersion{}).Distinct("image_id").Pluck("image_id", &imageIds)
+		if res.Error != nil {
+			logger.Errorf("Error loading original versions: %v", res.Error)
+		}
+
+		pruned := 0
+		for _, imageId := range imageIds {
+			count, err := pruneOriginalVersions(db, imageId)
+			if err != nil {
+				logger.Errorf("Error pruning original versions of image %d: %v", imageId, err)
+			}
+			pruned += count
+		}
+		if pruned > 0 {
+			logger.Infof("Deleted %d previous originals", pruned)
+		}
+		<-ticker.C
+	}
+}
+
+// originalVersionViews returns the versions of the image, newest first
+func originalVersionViews(image *Image) []OriginalVersionDto {
+	if image.ID == 0 {
+		return nil
+	}
+	var versions []OriginalVersion
+	res := db.Where("image_id = ?", image.ID).Order("created_at desc").Order("id desc").Find(&versions)
+	if res.Error != nil {
+		logger.Errorf("Could not load original versions of image %d: %v", image.ID, res.Error)
+	}
+	return Map(versions, func(version OriginalVersion) OriginalVersionDto {
+		return version.toDto(image)
+	})
+}
+
+func versionErrorStatus(err error) int {
+	if errors.Is(err, errVersionNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errVersionActive) || errors.Is(err, errVersionMissing) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// versionParams loads the image and parses the version ID of API requests
+func versionParams(c *gin.Context) (*Image, uint, error) {
+	imageId, err := pathIdToInt(imageIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, 0, err
+	}
+	versionId, err := pathIdToInt(versionIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, 0, err
+	}
+
+	image := Image{}
+	res := db.Preload(clause.Associations).Limit(1).Find(&image, imageId)
+	if res.Error != nil || res.RowsAffected == 0 {
+		c.String(http.StatusNotFound, "Image with id '%d' not found", imageId)
+		return nil, 0, errors.New("image not found")
+	}
+	return &image, versionId, nil
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func updateOriginalVersionsForm(c *gin.Context) {
+	image, err := loadImage(c)
+	if err != nil {
+		return
+	}
+	versionId, err := strconv.ParseUint(c.PostForm("version"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid version: %v", err)
+		return
+	}
+
+	switch c.PostForm("action") {
+	case "activate":
+		err = activateOriginalVersion(c, image, uint(versionId))
+		if err == nil {
+			processImageForm(c, image)
+		}
+	case "delete":
+		err = deleteOriginalVersion(db.WithContext(c), image, uint(versionId))
+	default:
+		c.String(http.StatusBadRequest, "Unknown action \"%s\"", c.PostForm("action"))
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.String(versionErrorStatus(err), "Error updating original version %d: %v", versionId, err)
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/images/%d", image.ID))
+}
+
+func getOriginalVersions(c *gin.Context) {
+	id, err := pathIdToInt(imageIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	image := Image{}
+	res := db.Limit(1).Find(&image, id)
+	if res.RowsAffected == 0 {
+		c.String(http.StatusNotFound, "Image with id '%d' not found", id)
+		return
+	}
+
+	versionsDto := originalVersionViews(&image)
+	c.JSON(http.StatusOK, &versionsDto)
+}
+
+func getOriginalVersionFile(c *gin.Context) {
+	image, versionId, err := versionParams(c)
+	if err != nil {
+		return
+	}
+
+	version := OriginalVersion{}
+	res := db.Where("image_id = ?", image.ID).Limit(1).Find(&version, versionId)
+	if res.RowsAffected == 0 {
+		c.String(http.StatusNotFound, "Original version with id '%d' not found", versionId)
+		return
+	}
+
+	storage, key := version.fileLocation(image)
+	data, err := storage.Get(c, key)
+	if errors.Is(err, os.ErrNotExist) {
+		c.String(http.StatusNotFound, "File of original version '%d' is missing", versionId)
+		return
+	} else if err != nil {
+		c.String(http.StatusInternalServerError, c.Error(err).Error())
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": version.FileName}))
+	c.Data(http.StatusOK, storageContentType(version.FileName), data)
+}
+
+func activateOriginalVersionApi(c *gin.Context) {
+	image, versionId, err := versionParams(c)
+	if err != nil {
+		return
+	}
+
+	err = activateOriginalVersion(c, image, versionId)
+	if err != nil {
+		c.Error(err)
+		c.String(versionErrorStatus(err), "Error activating original version %d: %v", versionId, err)
+		return
+	}
+	processImageForm(c, image)
+
+	c.JSON(http.StatusOK, image.toDto())
+}
+
+func deleteOriginalVersionApi(c *gin.Context) {
+	image, versionId, err := versionParams(c)
+	if err != nil {
+		return
+	}
+
+	err = deleteOriginalVersion(db.WithContext(c), image, versionId)
+	if err != nil {
+		c.Error(err)
+		c.String(versionErrorStatus(err), "Error deleting original version %d: %v", versionId, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// createTestOriginal creates an image whose original predates the kept versions
+func createTestOriginal(t *testing.T, data string) *Image {
+	image := Image{Name: "sunset", Format: "jpg", ImageExists: true}
+	if res := db.Create(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if err := originalStorage.Put(context.Background(), image.OriginalFileName(), []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return &image
+}
+
+// uploadTestOriginal replaces the original like an upload, the transaction fails with the given error
+func uploadTestOriginal(image *Image, format string, data string, failure error) error {
+	files := originalFiles{}
+	version := OriginalVersion{FileName: "upload." + format, Format: format}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := replaceOriginal(tx, &files, image, &version, []byte(data))
+		if err != nil {
+			return err
+		}
+		err = tx.Save(image).Error
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	files.finish(context.Background(), err)
+	return err
+}
+
+func expectStoredFile(t *testing.T, storage Storage, key string, expected string) {
+	t.Helper()
+	data, err := storage.Get(context.Background(), key)
+	if len(expected) == 0 {
+		if err == nil {
+			t.Errorf("%s still exists", key)
+		}
+	} else if err != nil || string(data) != expected {
+		t.Errorf("%s contains %q, %v, expected %q", key, data, err, expected)
+	}
+}
+
+func TestReplaceAndActivateOriginal(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	image := createTestOriginal(t, "first")
+
+	if err := uploadTestOriginal(image, "png", "second", nil); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredFile(t, originalStorage, "1.png", "second")
+	expectStoredFile(t, originalStorage, "1.jpg", "")
+	expectStoredFile(t, versionStorage, "1-1.jpg", "first")
+
+	var versions []OriginalVersion
+	db.Order("id").Find(&versions)
+	if len(versions) != 2 || image.OriginalVersionID != versions[1].ID || versions[0].Format != "jpg" {
+		t.Fatalf("got versions %+v with active version %d", versions, image.OriginalVersionID)
+	}
+
+	// Making the first original the current one again keeps the second as version
+	if err := activateOriginalVersion(context.Background(), image, versions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredFile(t, originalStorage, "1.jpg", "first")
+	expectStoredFile(t, originalStorage, "1.png", "")
+	expectStoredFile(t, versionStorage, "1-2.png", "second")
+	if image.Format != "jpg" || image.OriginalVersionID != versions[0].ID {
+		t.Errorf("image has format %s and active version %d", image.Format, image.OriginalVersionID)
+	}
+}
+
+func TestReplaceOriginalUndo(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	image := createTestOriginal(t, "first")
+	failure := errors.New("failure after the original was replaced")
+
+	if err := uploadTestOriginal(image, "png", "second", failure); !errors.Is(err, failure) {
+		t.Fatalf("got error %v", err)
+	}
+	expectStoredFile(t, originalStorage, "1.jpg", "first")
+	expectStoredFile(t, originalStorage, "1.png", "")
+	expectStoredFile(t, versionStorage, "1-1.jpg", "")
+
+	var count int64
+	db.Model(&OriginalVersion{}).Count(&count)
+	stored := Image{}
+	db.First(&stored, image.ID)
+	if count != 0 || stored.Format != "jpg" || stored.OriginalVersionID != 0 {
+		t.Errorf("failed upload left %d versions and format %s", count, stored.Format)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/h2non/bimg"
+	"net/http"
+)
+
+type (
+	// OriginalFileInfo describes the uploaded or imported original of an image
+	OriginalFileInfo struct {
+		Width    int
+		Height   int
+		FileSize int64
+		MimeType string
+		// Checksum is the hex encoded SHA-256 of the file
+		Checksum string
+	}
+
+	ImageOriginalDto struct {
+		Width    int    `json:"width" yaml:"width"`
+		Height   int    `json:"height" yaml:"height"`
+		FileSize int64  `json:"fileSize" yaml:"fileSize"`
+		MimeType string `json:"mimeType" yaml:"mimeType"`
+		Checksum string `json:"sha256" yaml:"sha256"`
+		// VersionID is the uploaded version the original belongs to
+		VersionID uint `json:"versionId,omitempty" yaml:"versionId,omitempty"`
+	}
+)
+
+const verifyUsage = "usage: verify [--accept]"
+
+func originalChecksum(data []byte) string {
+	checksum := sha256.Sum256(data)
+	return hex.EncodeToString(checksum[:])
+}
+
+func originalFileInfo(data []byte) (OriginalFileInfo, error) {
+	size, err := imageSizeFromBytes(&data)
+	if err != nil {
+		return OriginalFileInfo{}, err
+	}
+
+	mimeType, found := mimeTypes[bimg.DetermineImageType(data)]
+	if !found {
+		mimeType = http.DetectContentType(data)
+	}
+
+	return OriginalFileInfo{
+		Width:    size.Width,
+		Height:   size.Height,
+		FileSize: int64(len(data)),
+		MimeType: mimeType,
+		Checksum: originalChecksum(data),
+	}, nil
+}
+
+func (i *Image) setOriginalFileInfo(info OriginalFileInfo) {
+	i.Width = info.Width
+	i.Height = info.Height
+	i.FileSize = info.FileSize
+	i.MimeType = info.MimeType
+	i.Checksum = info.Checksum
+}
+
+// originalSize returns the stored dimensions of the original, if they belong to the file with the given checksum
+func (i *Image) originalSize(checksum string) (bimg.ImageSize, bool) {
+	if i.Checksum != checksum || i.Width == 0 || i.Height == 0 {
+		return bimg.ImageSize{}, false
+	}
+	return bimg.ImageSize{Width: i.Width, Height: i.Height}, true
+}
+
+func (i *Image) originalDto() *ImageOriginalDto {
+	if len(i.Checksum) == 0 {
+		return nil
+	}
+	return &ImageOriginalDto{
+		Width:     i.Width,
+		Height:    i.Height,
+		FileSize:  i.FileSize,
+		MimeType:  i.MimeType,
+		Checksum:  i.Checksum,
+		VersionID: i.OriginalVersionID,
+	}
+}
+
+// updateOriginalFileInfo reads the original of the image and stores its dimensions, size and checksum
+func updateOriginalFileInfo(ctx context.Context, image *Image) error {
+	data, err := originalStorage.Get(ctx, image.OriginalFileName())
+	if err != nil {
+		return err
+	}
+	info, err := originalFileInfo(data)
+	if err != nil {
+		return err
+	}
+	image.setOriginalFileInfo(info)
+	return nil
+}
+
+func saveOriginalFileInfo(imageId uint, info OriginalFileInfo) error {
+	return db.Model(&Image{}).Where("id = ?", imageId).Updates(map[string]any{
+		"width":     info.Width,
+		"height":    info.Height,
+		"file_size": info.FileSize,
+		"mime_type": info.MimeType,
+		"checksum":  info.Checksum,
+	}).Error
+}
+
+// verifyCommand recomputes the checksums of all originals. Originals without a recorded checksum get one, changed
+// originals are reported and only recorded again with --accept.
+func verifyCommand(args []string) error {
+	accept := false
+	for _, arg := range args {
+		if arg != "--accept" {
+			return errors.New(verifyUsage)
+		}
+		accept = true
+	}
+
+	var images []Image
+	res := db.Where("image_exists = ?", true).Order("id ASC").Find(&images)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	var verified, recorded, missing, changed int
+	for _, image := range images {
+		data, err := originalStorage.Get(context.Background(), image.OriginalFileName())
+		if err != nil {
+			fmt.Printf("missing\t%d\t%s\t%v\n", image.ID, image.Name, err)
+			missing++
+			continue
+		}
+
+		checksum := originalChecksum(data)
+		if checksum == image.Checksum {
+			verified++
+			continue
+		}
+
+		hadChecksum := len(image.Checksum) > 0
+		if hadChecksum {
+			fmt.Printf("changed\t%d\t%s\texpected %s, found %s\n", image.ID, image.Name, image.Checksum, checksum)
+			changed++
+			if !accept {
+				continue
+			}
+		}
+
+		info, err := originalFileInfo(data)
+		if err != nil {
+			fmt.Printf("unreadable\t%d\t%s\t%v\n", image.ID, image.Name, err)
+			changed++
+			continue
+		}
+		err = saveOriginalFileInfo(image.ID, info)
+		if err != nil {
+			return err
+		}
+		if !hadChecksum {
+			recorded++
+		}
+	}
+
+	fmt.Printf("%d verified, %d recorded, %d missing, %d changed\n", verified, recorded, missing, changed)
+
+	if missing > 0 || (changed > 0 && !accept) {
+		return fmt.Errorf("%d originals are missing or don't match their checksum", missing+changed)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCommand(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	ctx := context.Background()
+	png := []byte("\x89PNG\r\n\x1a\nsunset")
+	images := []Image{
+		{Name: "unrecorded", Format: "png", ImageExists: true},
+		{Name: "verified", Format: "png", ImageExists: true, Checksum: originalChecksum(png)},
+		{Name: "changed", Format: "png", ImageExists: true, Checksum: originalChecksum([]byte("previous"))},
+		{Name: "missing", Format: "png", ImageExists: true, Checksum: originalChecksum(png)},
+		// Images without an original aren't verified
+		{Name: "not uploaded", Format: "png"},
+	}
+	for i := range images {
+		if res := db.Create(&images[i]); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		if i < 3 {
+			if err := originalStorage.Put(ctx, images[i].OriginalFileName(), png); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checksums := func() []string {
+		var checksums []string
+		db.Model(&Image{}).Order("id").Pluck("checksum", &checksums)
+		return checksums
+	}
+
+	var err error
+	report := captureStdout(t, func() {
+		err = verifyCommand(nil)
+	})
+	if err == nil || err.Error() != "2 originals are missing or don't match their checksum" {
+		t.Errorf("verify returned %v", err)
+	}
+	for _, line := range []string{
+		"changed\t3\tchanged\texpected " + images[2].Checksum + ", found " + originalChecksum(png) + "\n",
+		"missing\t4\tmissing\t",
+		"1 verified, 1 recorded, 1 missing, 1 changed\n",
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("report doesn't contain %q:\n%s", line, report)
+		}
+	}
+	// The missing checksum is recorded, the changed one is kept without --accept
+	recorded := Image{}
+	db.First(&recorded, 1)
+	if recorded.Checksum != originalChecksum(png) || recorded.FileSize != int64(len(png)) || recorded.MimeType != "image/png" {
+		t.Errorf("verify recorded %s, %d bytes and %s", recorded.Checksum, recorded.FileSize, recorded.MimeType)
+	}
+	if checksums()[2] != images[2].Checksum {
+		t.Error("verify without --accept recorded the changed checksum")
+	}
+
+	report = captureStdout(t, func() {
+		err = verifyCommand([]string{"--accept"})
+	})
+	if err == nil || !strings.HasSuffix(report, "2 verified, 0 recorded, 1 missing, 1 changed\n") {
+		t.Errorf("verify --accept returned %v:\n%s", err, report)
+	}
+	if checksums()[2] != originalChecksum(png) {
+		t.Error("verify --accept didn't record the changed checksum")
+	}
+
+	db.Delete(&images[3])
+	report = captureStdout(t, func() {
+		err = verifyCommand(nil)
+	})
+	if err != nil || report != "3 verified, 0 recorded, 0 missing, 0 changed\n" {
+		t.Errorf("verify after accepting the changes returned %v:\n%s", err, report)
+	}
+
+	if err := verifyCommand([]string{"--fix"}); err == nil || err.Error() != verifyUsage {
+		t.Errorf("unknown argument returned %v", err)
+	}
+}
+
+func TestOriginalSize(t *testing.T) {
+	image := Image{Width: 1200, Height: 800, Checksum: "abc"}
+	if size, found := image.originalSize("abc"); !found || size.Width != 1200 || size.Height != 800 {
+		t.Errorf("got size %+v, %v", size, found)
+	}
+	// The dimensions of a replaced original aren't used
+	if _, found := image.originalSize("def"); found {
+		t.Error("got the size of a different original")
+	}
+	unknown := Image{Checksum: "abc"}
+	if _, found := unknown.originalSize("abc"); found {
+		t.Error("got the size of an original without dimensions")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/url"
+	"strconv"
+)
+
+type (
+	// Page is the part of a list that is returned. It starts either at Offset or after the element the Cursor
+	// points to, a Limit of 0 returns all remaining elements.
+	Page struct {
+		Limit  int
+		Offset int
+		Cursor string
+		// NextCursor continues the list after the last returned element, it is empty on the last page
+		NextCursor string
+		// Count is the number of returned elements
+		Count int
+		// Total is the number of elements matching the filter, regardless of the page
+		Total int64
+	}
+
+	// pageCursor is encoded into an opaque string. It stores the sort value and ID of the last element of a page,
+	// lists sorted by search relevance store the offset instead, as the rank can't be compared reliably.
+	pageCursor struct {
+		SortBy   string `json:"s"`
+		SortMode string `json:"m"`
+		Value    any    `json:"v,omitempty"`
+		ID       uint   `json:"i,omitempty"`
+		Offset   int    `json:"o,omitempty"`
+	}
+)
+
+const (
+	defaultHtmlPageSize = 50
+	maxPageSize         = 500
+
+	headerTotalCount = "X-Total-Count"
+	headerNextCursor = "X-Next-Cursor"
+)
+
+var errCursorMismatch = errors.New("cursor doesn't match the sort order of the request")
+
+func encodeCursor(cursor pageCursor) string {
+	raw, _ := json.Marshal(&cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(encoded string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	var cursor pageCursor
+	err = json.Unmarshal(raw, &cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return &cursor, nil
+}
+
+// parsePage reads limit, offset and cursor from the query. defaultLimit is used if no limit is given.
+func parsePage(c *gin.Context, defaultLimit int) (Page, error) {
+	page := Page{Limit: defaultLimit}
+
+	rawLimit := c.Query("limit")
+	if len(rawLimit) > 0 {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit < 0 {
+			return page, fmt.Errorf("invalid limit '%s'", rawLimit)
+		}
+		page.Limit = limit
+	}
+	if page.Limit > maxPageSize {
+		page.Limit = maxPageSize
+	}
+
+	rawOffset := c.Query("offset")
+	if len(rawOffset) > 0 {
+		offset, err := strconv.Atoi(rawOffset)
+		if err != nil || offset < 0 {
+			return page, fmt.Errorf("invalid offset '%s'", rawOffset)
+		}
+		page.Offset = offset
+	}
+
+	page.Cursor = c.Query("cursor")
+	if len(page.Cursor) > 0 && page.Offset > 0 {
+		return page, errors.New("offset and cursor can't be used together")
+	}
+	// A cursor without a limit would return everything after it, so it always uses pages
+	if len(page.Cursor) > 0 && page.Limit == 0 {
+		page.Limit = maxPageSize
+	}
+
+	return page, nil
+}
+
+// paged returns whether only a part of the list is requested
+func (p *Page) paged() bool {
+	return p.Limit > 0 || p.Offset > 0 || len(p.Cursor) > 0
+}
+
+// Start is the 1-based position of the first element of the page, only known for offset based pages
+func (p *Page) Start() int {
+	return p.Offset + 1
+}
+
+// End is the 1-based position of the last element of the page, only known for offset based pages
+func (p *Page) End() int {
+	return p.Offset + p.Count
+}
+
+func (p *Page) HasPrevious() bool {
+	return p.Offset > 0
+}
+
+func (p *Page) HasNext() bool {
+	return len(p.NextCursor) > 0
+}
+
+// pageUrl returns the current URL with all filter and sort parameters, but starting at the given offset
+func pageUrl(u *url.URL, offset int) string {
+	query := u.Query()
+	query.Del("cursor")
+	if offset > 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	} else {
+		query.Del("offset")
+	}
+	pageUrl := *u
+	pageUrl.RawQuery = query.Encode()
+	return pageUrl.RequestURI()
+}
+
+// applyImageCursor continues the image list after the element the cursor points to
+func applyImageCursor(tx *gorm.DB, page *Page, filter *ListFilter) (*gorm.DB, error) {
+	if len(page.Cursor) == 0 {
+		return tx.Offset(page.Offset), nil
+	}
+
+	cursor, err := decodeCursor(page.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if cursor.SortBy != filter.SortBy || cursor.SortMode != filter.SortMode {
+		return nil, errCursorMismatch
+	}
+
+	column := imageSortColumn(filter.SortBy)
+	if len(column) == 0 {
+		return tx.Offset(cursor.Offset), nil
+	}
+
+	operator := ">"
+	if filter.SortMode == "desc" {
+		operator = "<"
+	}
+	if column == "images.id" {
+		return tx.Where("images.id "+operator+" ?", cursor.ID), nil
+	}
+	return tx.Where("("+column+" "+operator+" ?) OR ("+column+" = ? AND images.id "+operator+" ?)",
+		cursor.Value, cursor.Value, cursor.ID), nil
+}
+
+// nextImageCursor points to the last image of the page. offset is the offset of the page when the list can't be
+// continued by the sort value.
+func nextImageCursor(last *Image, filter *ListFilter, offset int) string {
+	cursor := pageCursor{
+		SortBy:   filter.SortBy,
+		SortMode: filter.SortMode,
+		ID:       last.ID,
+	}
+	switch filter.SortBy {
+	case "sortIndex":
+		cursor.Value = last.SortIndex
+	case "name":
+		cursor.Value = last.Name
+	case "title":
+		cursor.Value = last.Title
+	case "id":
+	default:
+		cursor.ID = 0
+		cursor.Offset = offset
+	}
+	return encodeCursor(cursor)
+}
+
+// cursorOffset returns the offset stored in a relevance cursor
+func cursorOffset(page *Page) int {
+	if len(page.Cursor) == 0 {
+		return page.Offset
+	}
+	cursor, err := decodeCursor(page.Cursor)
+	if err != nil {
+		return 0
+	}
+	return cursor.Offset
+}
+
+// setPageHeaders adds the total count and the cursor of the next page to the response
+func setPageHeaders(c *gin.Context, page *Page) {
+	c.Header(headerTotalCount, strconv.FormatInt(page.Total, 10))
+	if page.HasNext() {
+		c.Header(headerNextCursor, page.NextCursor)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		cursor  pageCursor
+	}{
+		{"id", encodeCursor(pageCursor{SortBy: "id", SortMode: "asc", ID: 7}), pageCursor{SortBy: "id", SortMode: "asc", ID: 7}},
+		{"sort value", encodeCursor(pageCursor{SortBy: "name", SortMode: "desc", Value: "b", ID: 3}),
+			pageCursor{SortBy: "name", SortMode: "desc", Value: "b", ID: 3}},
+		// Numbers are decoded as float64, which SQLite compares with integer columns just fine
+		{"numeric value", encodeCursor(pageCursor{SortBy: "sortIndex", SortMode: "asc", Value: 12, ID: 3}),
+			pageCursor{SortBy: "sortIndex", SortMode: "asc", Value: float64(12), ID: 3}},
+		{"offset", encodeCursor(pageCursor{SortBy: "relevance", SortMode: "desc", Offset: 50}),
+			pageCursor{SortBy: "relevance", SortMode: "desc", Offset: 50}},
+		{"empty object", "e30", pageCursor{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor, err := decodeCursor(test.encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *cursor != test.cursor {
+				t.Errorf("got %+v, expected %+v", *cursor, test.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, encoded := range []string{"not base64!", "e30=", "bm90IGpzb24", "W10"} {
+		if cursor, err := decodeCursor(encoded); err == nil {
+			t.Errorf("decodeCursor(%q) returned %+v", encoded, cursor)
+		}
+	}
+}
+
+// fetchTestPage lists the image names of the page requested by the query
+func fetchTestPage(t *testing.T, query string) ([]string, Page) {
+	t.Helper()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/v1/images?"+query, nil)
+	images, filter, err := fetchImages(c, 0)
+	if err != nil {
+		t.Fatalf("fetchImages(%s) failed: %v", query, err)
+	}
+	return Map(images, func(image *Image) string { return image.Name }), filter.Page
+}
+
+func TestImageCursorStableAcrossChanges(t *testing.T) {
+	tests := []struct {
+		sortMode string
+		first    []string
+		// inserted images sort before and after the first page
+		inserted []string
+		deleted  string
+		rest     []string
+	}{
+		{"asc", []string{"b", "c"}, []string{"a", "cc"}, "d", []string{"cc", "e", "f"}},
+		{"desc", []string{"f", "e"}, []string{"g", "dd"}, "d", []string{"dd", "c", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.sortMode, func(t *testing.T) {
+			setupTestDatabase(t)
+			for _, name := range []string{"d", "b", "f", "c", "e"} {
+				if res := db.Create(&Image{Name: name}); res.Error != nil {
+					t.Fatal(res.Error)
+				}
+			}
+
+			query := "sortBy=name&sortMode=" + test.sortMode + "&limit=2"
+			names, page := fetchTestPage(t, query)
+			if !slices.Equal(names, test.first) || !page.HasNext() {
+				t.Fatalf("first page is %v, next cursor %q", names, page.NextCursor)
+			}
+
+			// Images added or deleted while paging don't make the next pages repeat or skip images
+			for _, name := range test.inserted {
+				if res := db.Create(&Image{Name: name}); res.Error != nil {
+					t.Fatal(res.Error)
+				}
+			}
+			if res := db.Where("name = ?", test.deleted).Delete(&Image{}); res.Error != nil {
+				t.Fatal(res.Error)
+			}
+
+			rest := make([]string, 0)
+			for page.HasNext() {
+				names, page = fetchTestPage(t, query+"&cursor="+page.NextCursor)
+				rest = append(rest, names...)
+			}
+			if !slices.Equal(rest, test.rest) {
+				t.Errorf("following pages are %v, expected %v", rest, test.rest)
+			}
+		})
+	}
+}
+
+func TestImageCursorMismatch(t *testing.T) {
+	setupTestDatabase(t)
+	createTestImages(t, 3)
+	_, page := fetchTestPage(t, "sortBy=name&limit=1")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/v1/images?sortBy=id&limit=1&cursor="+page.NextCursor, nil)
+	if _, _, err := fetchImages(c, 0); !errors.Is(err, errCursorMismatch) {
+		t.Errorf("cursor of another order returned %v", err)
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		query   string
+		page    Page
+		invalid bool
+	}{
+		{"", Page{Limit: 50}, false},
+		{"limit=0", Page{}, false},
+		{"limit=10&offset=20", Page{Limit: 10, Offset: 20}, false},
+		{"limit=100000", Page{Limit: maxPageSize}, false},
+		{"limit=0&cursor=e30", Page{Limit: maxPageSize, Cursor: "e30"}, false},
+		{"limit=-1", Page{}, true},
+		{"offset=x", Page{}, true},
+		{"offset=5&cursor=e30", Page{}, true},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/images?"+test.query, nil)
+
+		page, err := parsePage(c, 50)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parsePage(%s) accepted %+v", test.query, page)
+			}
+			continue
+		}
+		if err != nil || page != test.page {
+			t.Errorf("parsePage(%s) = %+v, %v, expected %+v", test.query, page, err, test.page)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/bimg"
+	"net/http"
+	"sync"
+)
+
+type (
+	// ProcessingLimiter bounds the number of libvips pipelines running at the same time as well as their estimated
+	// memory usage. All image processing, no matter whether it's started by a job or a request, goes through it.
+	ProcessingLimiter struct {
+		mutex       sync.Mutex
+		changed     chan struct{}
+		slots       int
+		memoryLimit int64
+		active      int
+		waiting     int
+		memoryInUse int64
+		peakMemory  int64
+		completed   uint64
+		throttled   uint64
+	}
+
+	ProcessingStatsDto struct {
+		Workers     int    `json:"workers" yaml:"workers"`
+		Active      int    `json:"active" yaml:"active"`
+		Waiting     int    `json:"waiting" yaml:"waiting"`
+		MemoryLimit int64  `json:"memoryLimit" yaml:"memoryLimit"`
+		MemoryInUse int64  `json:"memoryInUse" yaml:"memoryInUse"`
+		PeakMemory  int64  `json:"peakMemory" yaml:"peakMemory"`
+		Completed   uint64 `json:"completed" yaml:"completed"`
+		Throttled   uint64 `json:"throttled" yaml:"throttled"`
+		VipsMemory  int64  `json:"vipsMemory" yaml:"vipsMemory"`
+		QueuedJobs  int64  `json:"queuedJobs" yaml:"queuedJobs"`
+		RunningJobs int64  `json:"runningJobs" yaml:"runningJobs"`
+	}
+)
+
+const (
+	// Decoded images are held as 8-bit RGBA in the worst case
+	decodedBytesPerPixel = 4
+	megabyte             = 1 << 20
+)
+
+var (
+	processingLimiter *ProcessingLimiter
+)
+
+func setupProcessingLimiter() {
+	processingLimiter = NewProcessingLimiter(appConfig.ProcessingWorkers, int64(appConfig.ProcessingMemoryMB)*megabyte)
+}
+
+// NewProcessingLimiter creates a limiter with the given number of slots. A memory limit of 0 disables memory based
+// throttling.
+func NewProcessingLimiter(slots int, memoryLimit int64) *ProcessingLimiter {
+	return &ProcessingLimiter{
+		changed:     make(chan struct{}),
+		slots:       max(slots, 1),
+		memoryLimit: memoryLimit,
+	}
+}
+
+// estimateProcessingMemory estimates the memory a single pipeline needs for the encoded source and the decoded image
+func estimateProcessingMemory(size bimg.ImageSize, encodedBytes int) int64 {
+	return int64(encodedBytes) + int64(size.Width)*int64(size.Height)*decodedBytesPerPixel
+}
+
+func (l *ProcessingLimiter) fits(memory int64) bool {
+	if l.active >= l.slots {
+		return false
+	}
+	// A pipeline that exceeds the limit on its own still runs, but only while nothing else is running
+	return l.memoryLimit <= 0 || l.active == 0 || l.memoryInUse+memory <= l.memoryLimit
+}
+
+// Acquire blocks until a slot and the estimated memory are available. The returned function has to be called once the
+// pipeline is done.
+func (l *ProcessingLimiter) Acquire(ctx context.Context, memory int64) (func(), error) {
+	l.mutex.Lock()
+	counted := false
+	for !l.fits(memory) {
+		if !counted {
+			counted = true
+			l.waiting++
+			if l.active < l.slots {
+				l.throttled++
+				logger.Debugf("Throttling image processing, %d MB in use, %d MB requested", l.memoryInUse/megabyte, memory/megabyte)
+			}
+		}
+		changed := l.changed
+		l.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			l.mutex.Lock()
+			l.waiting--
+			l.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+		l.mutex.Lock()
+	}
+
+	if counted {
+		l.waiting--
+	}
+	l.active++
+	l.memoryInUse += memory
+	l.peakMemory = max(l.peakMemory, l.memoryInUse)
+	l.mutex.Unlock()
+
+	released := sync.Once{}
+	return func() {
+		released.Do(func() {
+			l.release(memory)
+		})
+	}, nil
+}
+
+func (l *ProcessingLimiter) release(memory int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.active--
+	l.memoryInUse -= memory
+	l.completed++
+
+	// Wake up everyone waiting, they check again whether they fit now
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Slots returns the number of pipelines allowed to run at the same time
+func (l *ProcessingLimiter) Slots() int {
+	return l.slots
+}
+
+func (l *ProcessingLimiter) Stats() ProcessingStatsDto {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return ProcessingStatsDto{
+		Workers:     l.slots,
+		Active:      l.active,
+		Waiting:     l.waiting,
+		MemoryLimit: l.memoryLimit,
+		MemoryInUse: l.memoryInUse,
+		PeakMemory:  l.peakMemory,
+		Completed:   l.completed,
+		Throttled:   l.throttled,
+	}
+}
+
+func processingStats() ProcessingStatsDto {
+	stats := processingLimiter.Stats()
+	stats.VipsMemory = bimg.VipsMemory().Memory
+	db.Model(&Job{}).Where("status = ?", JobQueued).Count(&stats.QueuedJobs)
+	db.Model(&Job{}).Where("status = ?", JobRunning).Count(&stats.RunningJobs)
+	return stats
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getProcessingStats(c *gin.Context) {
+	c.JSON(http.StatusOK, processingStats())
+}
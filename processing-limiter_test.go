@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acquireAsync acquires the limiter in the background, the release func is sent once it was acquired
+func acquireAsync(ctx context.Context, limiter *ProcessingLimiter, memory int64) (<-chan func(), <-chan error) {
+	acquired := make(chan func(), 1)
+	failed := make(chan error, 1)
+	go func() {
+		release, err := limiter.Acquire(ctx, memory)
+		if err != nil {
+			failed <- err
+			return
+		}
+		acquired <- release
+	}()
+	return acquired, failed
+}
+
+// waitForWaiting waits until the given number of pipelines wait for the limiter
+func waitForWaiting(t *testing.T, limiter *ProcessingLimiter, waiting int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for limiter.Stats().Waiting != waiting {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pipelines are waiting, expected %d", limiter.Stats().Waiting, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectAcquired(t *testing.T, acquired <-chan func()) func() {
+	t.Helper()
+	select {
+	case release := <-acquired:
+		return release
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline didn't start")
+		return nil
+	}
+}
+
+func TestProcessingLimiterSlots(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	limiter := NewProcessingLimiter(2, 0)
+	ctx := context.Background()
+	first, _ := limiter.Acquire(ctx, 0)
+	second, _ := limiter.Acquire(ctx, 0)
+
+	acquired, _ := acquireAsync(ctx, limiter, 0)
+	waitForWaiting(t, limiter, 1)
+	first()
+	// Releasing twice doesn't free a second slot
+	first()
+	third := expectAcquired(t, acquired)
+
+	stats := limiter.Stats()
+	if stats.Active != 2 || stats.Waiting != 0 || stats.Completed != 1 || stats.Throttled != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+	second()
+	third()
+	if stats := limiter.Stats(); stats.Active != 0 || stats.Completed != 3 {
+		t.Errorf("got stats %+v after all pipelines finished", stats)
+	}
+}
+
+func TestProcessingLimiterMemory(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	limiter := NewProcessingLimiter(4, 100)
+	ctx := context.Background()
+	large, _ := limiter.Acquire(ctx, 60)
+
+	// A pipeline that doesn't fit next to the running one waits, smaller ones overtake it
+	waitingAcquired, _ := acquireAsync(ctx, limiter, 50)
+	waitForWaiting(t, limiter, 1)
+	small, err := limiter.Acquire(ctx, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := limiter.Stats(); stats.MemoryInUse != 100 || stats.Throttled != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	large()
+	waiting := expectAcquired(t, waitingAcquired)
+	if stats := limiter.Stats(); stats.MemoryInUse != 90 || stats.PeakMemory != 100 {
+		t.Errorf("got stats %+v", stats)
+	}
+	small()
+	waiting()
+
+	// A pipeline larger than the limit runs once nothing else is running
+	oversized, err := limiter.Acquire(ctx, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, _ := acquireAsync(ctx, limiter, 1)
+	waitForWaiting(t, limiter, 1)
+	oversized()
+	expectAcquired(t, blocked)()
+}
+
+func TestProcessingLimiterCancel(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	limiter := NewProcessingLimiter(1, 100)
+	running, _ := limiter.Acquire(context.Background(), 80)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, failed := acquireAsync(ctx, limiter, 50)
+	waitForWaiting(t, limiter, 1)
+	cancel()
+	select {
+	case err := <-failed:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled pipeline returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled pipeline is still waiting")
+	}
+
+	// The cancelled pipeline neither waits nor holds memory
+	if stats := limiter.Stats(); stats.Waiting != 0 || stats.Active != 1 || stats.MemoryInUse != 80 {
+		t.Errorf("got stats %+v", stats)
+	}
+	running()
+	release, err := limiter.Acquire(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestProcessingLimiterConcurrency(t *testing.T) {
+	logger = zap.NewNop().Sugar()
+	limiter := NewProcessingLimiter(3, 250)
+	ctx := context.Background()
+
+	mutex := sync.Mutex{}
+	active, memory, maxActive, maxMemory := 0, int64(0), 0, int64(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+			release, err := limiter.Acquire(ctx, size)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			active++
+			memory += size
+			maxActive, maxMemory = max(maxActive, active), max(maxMemory, memory)
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			active--
+			memory -= size
+			mutex.Unlock()
+			release()
+		}(int64(50 + i%3*50))
+	}
+	wg.Wait()
+
+	if maxActive > 3 || maxMemory > 250 {
+		t.Errorf("%d pipelines with %d bytes ran at the same time", maxActive, maxMemory)
+	}
+	if stats := limiter.Stats(); stats.Completed != 30 || stats.Active != 0 || stats.MemoryInUse != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
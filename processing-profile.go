@@ -0,0 +1,770 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/bimg"
+	"gorm.io/gorm"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type (
+	// ProcessingProfile is a named set of processing rules. Profiles can be attached to categories and images, every
+	// other image is processed with the default profile.
+	ProcessingProfile struct {
+		gorm.Model
+		Name        string `gorm:"uniqueIndex;size:50"`
+		Description string
+		Rules       []ProcessingProfileRule
+	}
+
+	ProcessingProfileRule struct {
+		gorm.Model
+		ProcessingProfileID uint
+		SortIndex           int
+		Quality             int
+		MaxDim              int
+		Height              int
+		Width               int
+		Suffix              string `gorm:"size:50"`
+		NoSizeSuffix        bool
+		Name                string `gorm:"size:50"`
+		Enlarge             bool
+		// Background is a hex color like "#4376c6", empty for none
+		Background string `gorm:"size:7"`
+		Format     string `gorm:"size:5"`
+		// Original marks the rule used for the processed copy of the original
+		Original bool
+		// KeepMetadata copies EXIF, IPTC and XMP metadata into the variant, by default it's stripped
+		KeepMetadata bool
+	}
+
+	ProcessingProfileDto struct {
+		ID          uint                `binding:"-" json:"id" yaml:"id"`
+		Name        string              `json:"name" yaml:"name"`
+		Description string              `json:"description" yaml:"description"`
+		Rules       []ProcessingRuleDto `binding:"-" json:"rules,omitempty" yaml:"rules,omitempty"`
+		UsageCount  uint                `json:"-" yaml:"-"`
+	}
+
+	ProcessingRuleDto struct {
+		ID           uint    `binding:"-" json:"id" yaml:"id"`
+		ProfileID    uint    `json:"profileId" yaml:"profileId"`
+		SortIndex    *int    `json:"sortIndex" yaml:"sortIndex"`
+		Quality      *int    `json:"quality" yaml:"quality"`
+		MaxDim       *int    `json:"maxDim" yaml:"maxDim"`
+		Height       *int    `json:"height" yaml:"height"`
+		Width        *int    `json:"width" yaml:"width"`
+		Suffix       *string `json:"suffix" yaml:"suffix"`
+		NoSizeSuffix *bool   `json:"noSizeSuffix" yaml:"noSizeSuffix"`
+		Name         *string `json:"name" yaml:"name"`
+		Enlarge      *bool   `json:"enlarge" yaml:"enlarge"`
+		Background   *string `json:"background" yaml:"background"`
+		Format       string  `json:"format" yaml:"format"`
+		Original     *bool   `json:"original" yaml:"original"`
+		KeepMetadata *bool   `json:"keepMetadata" yaml:"keepMetadata"`
+	}
+)
+
+const (
+	profileIdName          = "profileId"
+	ruleIdName             = "ruleId"
+	defaultProfileName     = "default"
+	iconProfileName        = "icon"
+	processingRuleSortStep = 10
+)
+
+var (
+	reservedProfiles = []string{defaultProfileName, iconProfileName}
+
+	errProfileInUse    = errors.New("processing profile is still in use")
+	errProfileReserved = errors.New("reserved processing profiles can't be deleted")
+)
+
+func parseHexColor(value string) (*bimg.Color, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	var color bimg.Color
+	_, err := fmt.Sscanf(strings.ToLower(value), "#%02x%02x%02x", &color.R, &color.G, &color.B)
+	if err != nil || len(value) != 7 {
+		return nil, fmt.Errorf("invalid color \"%s\", expected the format #rrggbb", value)
+	}
+	return &color, nil
+}
+
+func formatHexColor(color *bimg.Color) string {
+	if color == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", color.R, color.G, color.B)
+}
+
+func (r *ProcessingProfileRule) toProcessingRule() ProcessingRule {
+	rule := ProcessingRule{
+		Quality:      r.Quality,
+		MaxDim:       r.MaxDim,
+		Height:       r.Height,
+		Width:        r.Width,
+		Suffix:       r.Suffix,
+		NoSizeSuffix: r.NoSizeSuffix,
+		Name:         r.Name,
+		Enlarge:      r.Enlarge,
+		KeepMetadata: r.KeepMetadata,
+	}
+
+	// Both are validated when the rule is stored
+	rule.Format, _ = parseImageFormat(r.Format)
+	rule.Background, _ = parseHexColor(r.Background)
+
+	return rule
+}
+
+func processingRuleToModel(rule ProcessingRule, original bool, sortIndex int) ProcessingProfileRule {
+	return ProcessingProfileRule{
+		SortIndex:    sortIndex,
+		Quality:      rule.Quality,
+		MaxDim:       rule.MaxDim,
+		Height:       rule.Height,
+		Width:        rule.Width,
+		Suffix:       rule.Suffix,
+		NoSizeSuffix: rule.NoSizeSuffix,
+		Name:         rule.Name,
+		Enlarge:      rule.Enlarge,
+		Background:   formatHexColor(rule.Background),
+		Format:       bimg.ImageTypeName(rule.Format),
+		Original:     original,
+		KeepMetadata: rule.KeepMetadata,
+	}
+}
+
+func (r *ProcessingProfileRule) toDto() ProcessingRuleDto {
+	return ProcessingRuleDto{
+		ID:           r.ID,
+		ProfileID:    r.ProcessingProfileID,
+		SortIndex:    &r.SortIndex,
+		Quality:      &r.Quality,
+		MaxDim:       &r.MaxDim,
+		Height:       &r.Height,
+		Width:        &r.Width,
+		Suffix:       &r.Suffix,
+		NoSizeSuffix: &r.NoSizeSuffix,
+		Name:         &r.Name,
+		Enlarge:      &r.Enlarge,
+		Background:   &r.Background,
+		Format:       r.Format,
+		Original:     &r.Original,
+		KeepMetadata: &r.KeepMetadata,
+	}
+}
+
+func (r *ProcessingProfileRule) updateWithDto(dto ProcessingRuleDto) {
+	if dto.ProfileID > 0 {
+		r.ProcessingProfileID = dto.ProfileID
+	}
+	if dto.SortIndex != nil {
+		r.SortIndex = *dto.SortIndex
+	}
+	if dto.Quality != nil {
+		r.Quality = *dto.Quality
+	}
+	if dto.MaxDim != nil {
+		r.MaxDim = *dto.MaxDim
+	}
+	if dto.Height != nil {
+		r.Height = *dto.Height
+	}
+	if dto.Width != nil {
+		r.Width = *dto.Width
+	}
+	if dto.Suffix != nil {
+		r.Suffix = strings.TrimSpace(*dto.Suffix)
+	}
+	if dto.NoSizeSuffix != nil {
+		r.NoSizeSuffix = *dto.NoSizeSuffix
+	}
+	if dto.Name != nil {
+		r.Name = strings.TrimSpace(*dto.Name)
+	}
+	if dto.Enlarge != nil {
+		r.Enlarge = *dto.Enlarge
+	}
+	if dto.Background != nil {
+		r.Background = strings.ToLower(strings.TrimSpace(*dto.Background))
+	}
+	if len(dto.Format) > 0 {
+		r.Format = strings.ToLower(strings.TrimSpace(dto.Format))
+	}
+	if dto.Original != nil {
+		r.Original = *dto.Original
+	}
+	if dto.KeepMetadata != nil {
+		r.KeepMetadata = *dto.KeepMetadata
+	}
+}
+
+func (r *ProcessingProfileRule) validate() error {
+	format, err := parseImageFormat(r.Format)
+	if err != nil {
+		return err
+	}
+	r.Format = bimg.ImageTypeName(format)
+	if !isFormatAvailable(format) {
+		return fmt.Errorf("the installed libvips can't write %s images", r.Format)
+	}
+
+	if _, err := parseHexColor(r.Background); err != nil {
+		return err
+	}
+	if r.Quality < 1 || r.Quality > 100 {
+		return fmt.Errorf("quality has to be between 1 and 100, got %d", r.Quality)
+	}
+	if r.Width < 0 || r.Height < 0 || r.MaxDim < 0 {
+		return errors.New("dimensions must not be negative")
+	}
+	if r.MaxDim == 0 && (r.Width == 0 || r.Height == 0) {
+		return errors.New("either a maximum dimension or both width and height are required")
+	}
+	if r.ProcessingProfileID == 0 {
+		return errors.New("no processing profile specified")
+	}
+	return nil
+}
+
+func (p *ProcessingProfile) toDto() ProcessingProfileDto {
+	return ProcessingProfileDto{
+		ID:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+	}
+}
+
+func (p *ProcessingProfile) toDtoWithRules() ProcessingProfileDto {
+	dto := p.toDto()
+	dto.Rules = Map(p.Rules, func(rule ProcessingProfileRule) ProcessingRuleDto {
+		return rule.toDto()
+	})
+	return dto
+}
+
+func (p *ProcessingProfile) toDtoWithUsageCount() ProcessingProfileDto {
+	dto := p.toDto()
+	dto.UsageCount = p.usageCount()
+	return dto
+}
+
+func (p *ProcessingProfile) usageCount() uint {
+	var images, categories int64
+	db.Model(&Image{}).Where("processing_profile_id = ?", p.ID).Count(&images)
+	db.Model(&Category{}).Where("processing_profile_id = ?", p.ID).Count(&categories)
+	return uint(images + categories)
+}
+
+// updateWithDto updates the profile. Reserved profiles are looked up by their name, so they can't be renamed.
+func (p *ProcessingProfile) updateWithDto(dto ProcessingProfileDto) {
+	if len(dto.Name) > 0 && !slices.Contains(reservedProfiles, p.Name) {
+		p.Name = strings.TrimSpace(dto.Name)
+	}
+	if len(dto.Description) > 0 {
+		p.Description = strings.ReplaceAll(dto.Description, "\r\n", "\n")
+	}
+}
+
+// processingRules splits the rules of the profile into the variant rules and the rule for the original
+func (p *ProcessingProfile) processingRules() ([]ProcessingRule, *ProcessingRule) {
+	rules := make([]ProcessingRule, 0, len(p.Rules))
+	var original *ProcessingRule
+	for _, profileRule := range p.Rules {
+		rule := profileRule.toProcessingRule()
+		if profileRule.Original {
+			original = &rule
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, original
+}
+
+func preloadProfileRules(tx *gorm.DB) *gorm.DB {
+	return tx.Order("sort_index ASC").Order("id ASC")
+}
+
+func findProcessingProfile(tx *gorm.DB, query any, args ...any) (*ProcessingProfile, error) {
+	var profile ProcessingProfile
+	res := tx.Preload("Rules", preloadProfileRules).Where(query, args...).Limit(1).Find(&profile)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &profile, nil
+}
+
+// createDefaultProcessingProfiles stores the built-in processing rules as profiles, so they can be edited
+func createDefaultProcessingProfiles() {
+	builtInOriginal := originalProcessingRule()
+	defaults := []struct {
+		name        string
+		description string
+		rules       []ProcessingRule
+		original    *ProcessingRule
+	}{
+		{defaultProfileName, "Used for every image without a profile of its own or of one of its categories", defaultProcessingRules(), &builtInOriginal},
+		{iconProfileName, "Used to process the favicons from the image in the icon category", IconProcessingRules(), nil},
+	}
+
+	db.Transaction(func(tx *gorm.DB) error {
+		for _, profileDefaults := range defaults {
+			res := tx.Where("name = ?", profileDefaults.name).Find(&ProcessingProfile{})
+			if res.RowsAffected > 0 {
+				continue
+			}
+
+			profile := ProcessingProfile{
+				Name:        profileDefaults.name,
+				Description: profileDefaults.description,
+			}
+			for i, rule := range profileDefaults.rules {
+				profile.Rules = append(profile.Rules, processingRuleToModel(rule, false, (i+1)*processingRuleSortStep))
+			}
+			if profileDefaults.original != nil {
+				sortIndex := (len(profileDefaults.rules) + 1) * processingRuleSortStep
+				profile.Rules = append(profile.Rules, processingRuleToModel(*profileDefaults.original, true, sortIndex))
+			}
+
+			res = tx.Create(&profile)
+			if res.Error != nil {
+				return res.Error
+			}
+			logger.Infof("Created processing profile \"%s\"", profile.Name)
+		}
+		return nil
+	})
+}
+
+// processingRulesForImage resolves the rules an image is processed with. The profile of the image wins over the
+// profile of its categories, which wins over the default profile. If no profile provides rules, the built-in
+// rules are used.
+func processingRulesForImage(image *Image) ([]ProcessingRule, ProcessingRule) {
+	profileId := image.ProcessingProfileID
+	if profileId == nil {
+		categories := slices.Clone(image.Categories)
+		slices.SortFunc(categories, func(a, b *Category) int {
+			return int(a.ID) - int(b.ID)
+		})
+		for _, category := range categories {
+			if category.ProcessingProfileID != nil {
+				profileId = category.ProcessingProfileID
+				break
+			}
+		}
+	}
+
+	var profile *ProcessingProfile
+	var err error
+	if profileId != nil {
+		profile, err = findProcessingProfile(db, "id = ?", *profileId)
+	}
+	if profile == nil {
+		profile, err = findProcessingProfile(db, "name = ?", defaultProfileName)
+	}
+	if err != nil {
+		logger.Warnf("Could not load processing profile for image %d, using built-in rules: %v", image.ID, err)
+		return defaultProcessingRules(), originalProcessingRule()
+	}
+
+	rules, original := profile.processingRules()
+	if len(rules) == 0 {
+		rules = defaultProcessingRules()
+	}
+	if original == nil {
+		builtInOriginal := originalProcessingRule()
+		original = &builtInOriginal
+	}
+	return rules, *original
+}
+
+func iconProcessingRules() []ProcessingRule {
+	profile, err := findProcessingProfile(db, "name = ?", iconProfileName)
+	if err != nil {
+		logger.Warnf("Could not load icon processing profile, using built-in rules: %v", err)
+		return IconProcessingRules()
+	}
+
+	rules, _ := profile.processingRules()
+	if len(rules) == 0 {
+		return IconProcessingRules()
+	}
+	return rules
+}
+
+func getAllProcessingProfiles() []ProcessingProfileDto {
+	var profiles []ProcessingProfile
+	db.Order("name ASC").Find(&profiles)
+	return Map(profiles, func(p ProcessingProfile) ProcessingProfileDto {
+		return p.toDto()
+	})
+}
+
+func deleteProcessingProfile(profile *ProcessingProfile) error {
+	if slices.Contains(reservedProfiles, profile.Name) {
+		return errProfileReserved
+	}
+	if profile.usageCount() > 0 {
+		return errProfileInUse
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Unscoped().Delete(&ProcessingProfileRule{}, "processing_profile_id = ?", profile.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+		return tx.Unscoped().Delete(profile).Error
+	})
+}
+
+// parseProfileId reads an optional profile reference from a form, an empty value means no profile
+func parseProfileId(rawProfileId string) *uint {
+	profileId, err := strconv.ParseUint(rawProfileId, 10, 64)
+	id := uint(profileId)
+	if err != nil {
+		id = 0
+	}
+	return &id
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func loadProcessingProfile(c *gin.Context) (*ProcessingProfile, error) {
+	id, err := pathIdToInt(profileIdName, c)
+	if err != nil {
+		if c.Param(profileIdName) == entityNew {
+			return &ProcessingProfile{}, nil
+		}
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, err
+	}
+
+	profile, err := findProcessingProfile(db, "id = ?", id)
+	if err != nil {
+		c.String(http.StatusNotFound, "Processing profile with id '%d' not found", id)
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+func getProcessingProfilesHtml(c *gin.Context) {
+	var profiles []ProcessingProfile
+	db.Order("name ASC").Find(&profiles)
+
+	c.HTML(http.StatusOK, "processing-profiles.gohtml", gin.H{
+		"profiles": Map(profiles, func(p ProcessingProfile) ProcessingProfileDto {
+			return p.toDtoWithUsageCount()
+		}),
+	})
+}
+
+func getProcessingProfileHtml(c *gin.Context) {
+	profile, err := loadProcessingProfile(c)
+	if err == nil {
+		renderProcessingProfileHtml(c, http.StatusOK, profile, "")
+	}
+}
+
+func renderProcessingProfileHtml(c *gin.Context, status int, profile *ProcessingProfile, errorMessage string) {
+	dto := profile.toDtoWithRules()
+	dto.UsageCount = profile.usageCount()
+	c.HTML(status, "processing-profile.gohtml", gin.H{
+		"profile":  dto,
+		"formats":  Map(availableOutputFormats(), bimg.ImageTypeName),
+		"reserved": slices.Contains(reservedProfiles, profile.Name),
+		"error":    errorMessage,
+	})
+}
+
+func processingRuleFromForm(c *gin.Context) ProcessingRuleDto {
+	intValue := func(name string) *int {
+		value, err := strconv.Atoi(c.PostForm(name))
+		if err != nil {
+			value = 0
+		}
+		return &value
+	}
+	stringValue := func(name string) *string {
+		value := c.PostForm(name)
+		return &value
+	}
+	boolValue := func(name string) *bool {
+		_, checked := c.GetPostForm(name)
+		return &checked
+	}
+
+	return ProcessingRuleDto{
+		SortIndex:    intValue("sortIndex"),
+		Quality:      intValue("quality"),
+		MaxDim:       intValue("maxDim"),
+		Height:       intValue("height"),
+		Width:        intValue("width"),
+		Suffix:       stringValue("suffix"),
+		NoSizeSuffix: boolValue("noSizeSuffix"),
+		Name:         stringValue("name"),
+		Enlarge:      boolValue("enlarge"),
+		Background:   stringValue("background"),
+		Format:       c.PostForm("format"),
+		Original:     boolValue("original"),
+		KeepMetadata: boolValue("keepMetadata"),
+	}
+}
+
+func updateProcessingProfileForm(c *gin.Context) {
+	profile, err := loadProcessingProfile(c)
+	if err != nil {
+		return
+	}
+
+	switch c.PostForm("action") {
+	case "save":
+		isNewProfile := profile.ID == 0
+		profile.updateWithDto(ProcessingProfileDto{
+			Name:        c.PostForm("name"),
+			Description: c.PostForm("description"),
+		})
+		if len(profile.Name) == 0 {
+			renderProcessingProfileHtml(c, http.StatusBadRequest, profile, "Name must not be empty")
+			return
+		}
+
+		res := db.Omit("Rules").Save(profile)
+		if res.Error != nil {
+			renderProcessingProfileHtml(c, http.StatusBadRequest, profile, res.Error.Error())
+			return
+		}
+		if isNewProfile {
+			c.Redirect(http.StatusFound, fmt.Sprintf("/processing-profiles/%d", profile.ID))
+			return
+		}
+	case "delete":
+		if !hasRole(c, RoleAdmin) {
+			return
+		}
+		err = deleteProcessingProfile(profile)
+		if err != nil {
+			renderProcessingProfileHtml(c, http.StatusConflict, profile, err.Error())
+			return
+		}
+		c.Redirect(http.StatusFound, "/processing-profiles")
+		return
+	case "add-rule", "save-rule":
+		rule := ProcessingProfileRule{ProcessingProfileID: profile.ID}
+		if c.PostForm("action") == "save-rule" {
+			ruleId, _ := strconv.Atoi(c.PostForm("ruleId"))
+			res := db.Where("processing_profile_id = ?", profile.ID).First(&rule, ruleId)
+			if res.RowsAffected == 0 {
+				renderProcessingProfileHtml(c, http.StatusNotFound, profile, "Rule not found")
+				return
+			}
+		}
+
+		rule.updateWithDto(processingRuleFromForm(c))
+		if err = rule.validate(); err != nil {
+			renderProcessingProfileHtml(c, http.StatusBadRequest, profile, err.Error())
+			return
+		}
+		db.Save(&rule)
+	case "delete-rule":
+		ruleId, _ := strconv.Atoi(c.PostForm("ruleId"))
+		db.Unscoped().Where("processing_profile_id = ?", profile.ID).Delete(&ProcessingProfileRule{}, ruleId)
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/processing-profiles/%d", profile.ID))
+}
+
+func getProcessingProfiles(c *gin.Context) {
+	var profiles []ProcessingProfile
+	db.Preload("Rules", preloadProfileRules).Order("name ASC").Find(&profiles)
+
+	profilesDto := Map(profiles, func(p ProcessingProfile) ProcessingProfileDto {
+		return p.toDtoWithRules()
+	})
+	c.JSON(http.StatusOK, &profilesDto)
+}
+
+func getProcessingProfile(c *gin.Context) {
+	profile, err := loadProcessingProfile(c)
+	if err == nil {
+		c.JSON(http.StatusOK, profile.toDtoWithRules())
+	}
+}
+
+func addProcessingProfile(c *gin.Context) {
+	profileDto := ProcessingProfileDto{}
+	if err := c.ShouldBind(&profileDto); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	profile := ProcessingProfile{}
+	profile.updateWithDto(profileDto)
+	if len(profile.Name) == 0 {
+		c.String(http.StatusBadRequest, "Name must not be empty")
+		return
+	}
+
+	res := db.Create(&profile)
+	if res.Error != nil {
+		c.String(http.StatusInternalServerError, "Error inserting processing profile: %v", res.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, profile.toDto())
+}
+
+func updateProcessingProfile(c *gin.Context) {
+	profile, err := loadProcessingProfile(c)
+	if err != nil {
+		return
+	}
+
+	profileDto := ProcessingProfileDto{}
+	if err := c.ShouldBind(&profileDto); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	profile.updateWithDto(profileDto)
+	res := db.Omit("Rules").Save(profile)
+	if res.Error != nil {
+		c.String(http.StatusInternalServerError, "Error updating processing profile with ID '%d': %v", profile.ID, res.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, profile.toDtoWithRules())
+}
+
+func deleteProcessingProfileApi(c *gin.Context) {
+	profile, err := loadProcessingProfile(c)
+	if err != nil {
+		return
+	}
+
+	err = deleteProcessingProfile(profile)
+	if errors.Is(err, errProfileInUse) || errors.Is(err, errProfileReserved) {
+		c.String(http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error deleting processing profile with ID '%d': %v", profile.ID, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func loadProcessingRule(c *gin.Context) (*ProcessingProfileRule, error) {
+	id, err := pathIdToInt(ruleIdName, c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, err
+	}
+
+	var rule ProcessingProfileRule
+	res := db.First(&rule, id)
+	if res.RowsAffected == 0 {
+		c.String(http.StatusNotFound, "Processing rule with id '%d' not found", id)
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return &rule, nil
+}
+
+func getProcessingRules(c *gin.Context) {
+	var rules []ProcessingProfileRule
+	tx := preloadProfileRules(db.Order("processing_profile_id ASC"))
+	if profileId, err := strconv.ParseUint(c.Query("profile"), 10, 64); err == nil {
+		tx = tx.Where("processing_profile_id = ?", profileId)
+	}
+	tx.Find(&rules)
+
+	rulesDto := Map(rules, func(rule ProcessingProfileRule) ProcessingRuleDto {
+		return rule.toDto()
+	})
+	c.JSON(http.StatusOK, &rulesDto)
+}
+
+func getProcessingRule(c *gin.Context) {
+	rule, err := loadProcessingRule(c)
+	if err == nil {
+		c.JSON(http.StatusOK, rule.toDto())
+	}
+}
+
+func addProcessingRule(c *gin.Context) {
+	ruleDto := ProcessingRuleDto{}
+	if err := c.ShouldBind(&ruleDto); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	rule := ProcessingProfileRule{}
+	rule.updateWithDto(ruleDto)
+	saveProcessingRule(c, &rule)
+}
+
+func updateProcessingRule(c *gin.Context) {
+	rule, err := loadProcessingRule(c)
+	if err != nil {
+		return
+	}
+
+	ruleDto := ProcessingRuleDto{}
+	if err := c.ShouldBind(&ruleDto); err != nil {
+		c.String(http.StatusBadRequest, "Could not bind body to DTO: %v", err)
+		return
+	}
+
+	rule.updateWithDto(ruleDto)
+	saveProcessingRule(c, rule)
+}
+
+func saveProcessingRule(c *gin.Context, rule *ProcessingProfileRule) {
+	if err := rule.validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res := db.Where("id = ?", rule.ProcessingProfileID).Find(&ProcessingProfile{})
+	if res.RowsAffected == 0 {
+		c.String(http.StatusBadRequest, "Processing profile with ID '%d' not found", rule.ProcessingProfileID)
+		return
+	}
+
+	res = db.Save(rule)
+	if res.Error != nil {
+		c.String(http.StatusInternalServerError, "Error saving processing rule: %v", res.Error)
+		return
+	}
+
+	c.JSON(http.StatusOK, rule.toDto())
+}
+
+func deleteProcessingRule(c *gin.Context) {
+	rule, err := loadProcessingRule(c)
+	if err != nil {
+		return
+	}
+
+	res := db.Unscoped().Delete(rule)
+	if res.Error != nil {
+		c.String(http.StatusInternalServerError, "Error deleting processing rule with ID '%d': %v", rule.ID, res.Error)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
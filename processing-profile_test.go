@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"github.com/h2non/bimg"
+	"slices"
+	"testing"
+)
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		value string
+		color *bimg.Color
+		valid bool
+		// formatted is the value the color is stored as
+		formatted string
+	}{
+		{"", nil, true, ""},
+		{"#4376c6", &bimg.Color{R: 67, G: 118, B: 198}, true, "#4376c6"},
+		{"#FFFFFF", &bimg.Color{R: 255, G: 255, B: 255}, true, "#ffffff"},
+		{"4376c6", nil, false, ""},
+		{"#4376c", nil, false, ""},
+		{"#4376c6ff", nil, false, ""},
+		{"#43zzc6", nil, false, ""},
+	}
+	for _, test := range tests {
+		color, err := parseHexColor(test.value)
+		if (err == nil) != test.valid || (color == nil) != (test.color == nil) || color != nil && *color != *test.color {
+			t.Errorf("parseHexColor(%q) = %v, %v", test.value, color, err)
+		}
+		if formatted := formatHexColor(color); formatted != test.formatted {
+			t.Errorf("color %q is formatted as %q", test.value, formatted)
+		}
+	}
+}
+
+func TestProcessingRuleValidate(t *testing.T) {
+	previous := supportedFormats
+	t.Cleanup(func() {
+		supportedFormats = previous
+	})
+	supportedFormats = map[bimg.ImageType]FormatDto{
+		bimg.WEBP: {Save: true},
+		bimg.JPEG: {Save: true},
+		bimg.AVIF: {Save: false},
+	}
+
+	valid := ProcessingProfileRule{ProcessingProfileID: 1, Format: " JPG", Quality: 80, MaxDim: 900}
+	if err := valid.validate(); err != nil || valid.Format != "jpeg" {
+		t.Errorf("valid rule returned %v with format %s", err, valid.Format)
+	}
+
+	tests := []struct {
+		name string
+		edit func(rule *ProcessingProfileRule)
+	}{
+		{"unknown format", func(rule *ProcessingProfileRule) { rule.Format = "bmp" }},
+		{"format libvips can't write", func(rule *ProcessingProfileRule) { rule.Format = "avif" }},
+		{"jpeg xl", func(rule *ProcessingProfileRule) { rule.Format = "jxl" }},
+		{"invalid background", func(rule *ProcessingProfileRule) { rule.Background = "blue" }},
+		{"quality too low", func(rule *ProcessingProfileRule) { rule.Quality = 0 }},
+		{"quality too high", func(rule *ProcessingProfileRule) { rule.Quality = 101 }},
+		{"negative dimension", func(rule *ProcessingProfileRule) { rule.Width = -1 }},
+		{"width without height", func(rule *ProcessingProfileRule) { rule.MaxDim, rule.Width = 0, 300 }},
+		{"no profile", func(rule *ProcessingProfileRule) { rule.ProcessingProfileID = 0 }},
+	}
+	for _, test := range tests {
+		rule := ProcessingProfileRule{ProcessingProfileID: 1, Format: "webp", Quality: 80, MaxDim: 900}
+		test.edit(&rule)
+		if err := rule.validate(); err == nil {
+			t.Errorf("rule with %s is valid", test.name)
+		}
+	}
+}
+
+func TestProcessingRulesForImage(t *testing.T) {
+	setupTestDatabase(t)
+	createDefaultProcessingProfiles()
+	profiles := []ProcessingProfile{
+		{Name: "small", Rules: []ProcessingProfileRule{{Format: "webp", Quality: 60, MaxDim: 300}}},
+		{Name: "large", Rules: []ProcessingProfileRule{{Format: "webp", Quality: 90, MaxDim: 2000},
+			{Format: "png", Quality: 100, MaxDim: 4000, Original: true}}},
+		{Name: "empty"},
+	}
+	for i := range profiles {
+		if res := db.Create(&profiles[i]); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	small, large, empty := profiles[0].ID, profiles[1].ID, profiles[2].ID
+	plain, withSmall, withLarge := &Category{}, &Category{ProcessingProfileID: &small}, &Category{ProcessingProfileID: &large}
+	plain.ID, withSmall.ID, withLarge.ID = 1, 2, 3
+	maxDim := func(rule ProcessingRule) int { return rule.MaxDim }
+
+	builtInOriginal := originalProcessingRule()
+	tests := []struct {
+		name     string
+		image    Image
+		maxDims  []int
+		original ProcessingRule
+	}{
+		{"default profile", Image{}, Map(defaultProcessingRules(), maxDim), builtInOriginal},
+		{"image profile wins", Image{ProcessingProfileID: &small, Categories: []*Category{withLarge}}, []int{300}, builtInOriginal},
+		// The category with the lowest ID wins
+		{"category profile", Image{Categories: []*Category{withLarge, plain, withSmall}}, []int{300}, builtInOriginal},
+		{"original rule of the profile", Image{Categories: []*Category{withLarge}}, []int{2000}, ProcessingRule{
+			Quality: 100, MaxDim: 4000, Format: bimg.PNG}},
+		{"profile without rules", Image{ProcessingProfileID: &empty}, Map(defaultProcessingRules(), maxDim), builtInOriginal},
+		{"missing profile", Image{ProcessingProfileID: new(uint)}, Map(defaultProcessingRules(), maxDim), builtInOriginal},
+	}
+	for _, test := range tests {
+		rules, original := processingRulesForImage(&test.image)
+		maxDims := Map(rules, maxDim)
+		if !slices.Equal(maxDims, test.maxDims) || original.MaxDim != test.original.MaxDim ||
+			original.Format != test.original.Format || original.Quality != test.original.Quality {
+			t.Errorf("%s: got rules with the sizes %v and original %+v", test.name, maxDims, original)
+		}
+	}
+}
+
+func TestDeleteProcessingProfile(t *testing.T) {
+	setupTestDatabase(t)
+	createDefaultProcessingProfiles()
+	used := ProcessingProfile{Name: "used", Rules: []ProcessingProfileRule{{Format: "webp", Quality: 60, MaxDim: 300}}}
+	db.Create(&used)
+	db.Create(&Category{Name: "landscapes", ProcessingProfileID: &used.ID})
+
+	defaultProfile, err := findProcessingProfile(db, "name = ?", defaultProfileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteProcessingProfile(defaultProfile); !errors.Is(err, errProfileReserved) {
+		t.Errorf("deleting the default profile returned %v", err)
+	}
+	if err := deleteProcessingProfile(&used); !errors.Is(err, errProfileInUse) {
+		t.Errorf("deleting a profile in use returned %v", err)
+	}
+
+	db.Model(&Category{}).Where("name = ?", "landscapes").Update("processing_profile_id", nil)
+	if err := deleteProcessingProfile(&used); err != nil {
+		t.Fatal(err)
+	}
+	var rules int64
+	db.Unscoped().Model(&ProcessingProfileRule{}).Where("processing_profile_id = ?", used.ID).Count(&rules)
+	if rules != 0 {
+		t.Errorf("%d rules of the deleted profile are left", rules)
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type (
+	// Revision is the complete state of an image, author or category after a save, so it can be restored later
+	Revision struct {
+		ID         uint `gorm:"primaryKey"`
+		CreatedAt  time.Time
+		EntityType string `gorm:"size:20;uniqueIndex:idx_revision_number"`
+		EntityID   uint   `gorm:"uniqueIndex:idx_revision_number"`
+		// Number counts the revisions of the entity, starting at 1
+		Number int `gorm:"uniqueIndex:idx_revision_number"`
+		// Username is empty for the state before the first recorded save
+		Username string `gorm:"size:100"`
+		// Data is a JSON object of the audited columns, with the category and related image IDs of images
+		Data string
+	}
+
+	RevisionDto struct {
+		ID         uint           `json:"id" yaml:"id"`
+		Number     int            `json:"number" yaml:"number"`
+		CreatedAt  time.Time      `json:"createdAt" yaml:"createdAt"`
+		Username   string         `json:"username" yaml:"username"`
+		EntityType string         `json:"entityType" yaml:"entityType"`
+		EntityID   uint           `json:"entityId" yaml:"entityId"`
+		Data       map[string]any `json:"data" yaml:"data"`
+	}
+
+	// revisionEntity describes where the revisions of an entity type are served
+	revisionEntity struct {
+		// Path is the path of the entities in the UI and the API
+		Path   string
+		IdName string
+		// Columns are restored from a revision, the others describe the original file or are managed by the app
+		Columns []string
+	}
+)
+
+const (
+	revisionNumberName = "revision"
+)
+
+var (
+	revisionEntities = map[string]revisionEntity{
+		auditEntityImage: {
+			Path:   "images",
+			IdName: imageIdName,
+			Columns: []string{"name", "title", "description", "nsfw", "sort_index", "no_resize",
+				"ignore_author_name", "author_id", "processing_profile_id"},
+		},
+		auditEntityAuthor: {
+			Path:    "authors",
+			IdName:  authorIdName,
+			Columns: []string{"name", "url"},
+		},
+		auditEntityCategory: {
+			Path:    "categories",
+			IdName:  categoryIdName,
+			Columns: []string{"name", "display_name", "description", "show", "nsfw", "processing_profile_id"},
+		},
+	}
+
+	errRevisionNotFound = errors.New("not found")
+	errRevisionConflict = errors.New("can't be restored")
+)
+
+func (Revision) TableName() string {
+	return "revisions"
+}
+
+func (r *Revision) toDto() RevisionDto {
+	dto := RevisionDto{
+		ID:         r.ID,
+		Number:     r.Number,
+		CreatedAt:  r.CreatedAt,
+		Username:   r.Username,
+		EntityType: r.EntityType,
+		EntityID:   r.EntityID,
+	}
+	data, err := r.snapshot()
+	if err != nil {
+		logger.Warnf("Could not decode data of revision %d: %v", r.ID, err)
+	}
+	dto.Data = data
+	return dto
+}
+
+func (r *Revision) snapshot() (auditSnapshot, error) {
+	var snapshot auditSnapshot
+	// Numbers are kept as written, like the changes of the audit log
+	decoder := json.NewDecoder(bytes.NewReader([]byte(r.Data)))
+	decoder.UseNumber()
+	err := decoder.Decode(&snapshot)
+	return snapshot, err
+}
+
+func hasRevisions(entityType string) bool {
+	_, found := revisionEntities[entityType]
+	return found
+}
+
+// recordRevision is called by recordAudit for every save that changed the entity
+func recordRevision(tx *gorm.DB, entityType string, id uint, before, after auditSnapshot) error {
+	username := auditUser(tx)
+	tx = tx.Session(&gorm.Session{NewDB: true})
+
+	var last int
+	res := tx.Model(&Revision{}).Where("entity_type = ? AND entity_id = ?", entityType, id).
+		Select("COALESCE(MAX(number), 0)").Scan(&last)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if last == 0 && before != nil {
+		// Entities that existed before revisions were recorded keep their previous state as well, it's the one an
+		// accidental change needs to be reverted to
+		last++
+		err := createRevision(tx, entityType, id, last, "", before)
+		if err != nil {
+			return err
+		}
+	}
+	return createRevision(tx, entityType, id, last+1, username, after)
+}
+
+func createRevision(tx *gorm.DB, entityType string, id uint, number int, username string, snapshot auditSnapshot) error {
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	revision := Revision{
+		EntityType: entityType,
+		EntityID:   id,
+		Number:     number,
+		Username:   username,
+		Data:       string(raw),
+	}
+	return tx.Create(&revision).Error
+}
+
+// entityRevisions returns the revisions of the entity, newest first. It fails if the entity doesn't exist, or is in
+// the trash.
+func entityRevisions(tx *gorm.DB, entityType string, id uint) ([]Revision, error) {
+	model, err := auditModel(entityType)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	res := tx.Model(model).Where("id = ?", id).Count(&count)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("%s %d %w", entityType, id, errRevisionNotFound)
+	}
+
+	var revisions []Revision
+	res = tx.Where("entity_type = ? AND entity_id = ?", entityType, id).Order("number desc").Find(&revisions)
+	return revisions, res.Error
+}
+
+// revisionValue converts the numbers of a decoded revision back to integers, all restored numeric columns are IDs,
+// flags or indices
+func revisionValue(value any) any {
+	if number, ok := value.(json.Number); ok {
+		if integer, err := number.Int64(); err == nil {
+			return integer
+		}
+		return number.String()
+	}
+	return value
+}
+
+func revisionIds(value any) []uint {
+	values, _ := value.([]any)
+	ids := make([]uint, 0, len(values))
+	for _, value := range values {
+		if id, ok := revisionValue(value).(int64); ok && id > 0 {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
+
+// restoreRevision reapplies the revision to the entity, including the categories and related images of images. The
+// restore is saved as a new revision, so it can be reverted as well. Categories and related images that don't exist
+// anymore are skipped, a missing author or processing profile fails the restore. It returns whether the author of an
+// image changed, so its variants have to be processed again.
+func restoreRevision(ctx context.Context, entityType string, id uint, number int) (bool, error) {
+	entity, found := revisionEntities[entityType]
+	if !found {
+		return false, fmt.Errorf("%w \"%s\"", errUnknownAuditEntity, entityType)
+	}
+	model, _ := auditModel(entityType)
+
+	authorChanged := false
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		revisions, err := entityRevisions(tx, entityType, id)
+		if err != nil {
+			return err
+		}
+		var revision *Revision
+		for i := range revisions {
+			if revisions[i].Number == number {
+				revision = &revisions[i]
+			}
+		}
+		if revision == nil {
+			return fmt.Errorf("revision %d of %s %d %w", number, entityType, id, errRevisionNotFound)
+		}
+		snapshot, err := revision.snapshot()
+		if err != nil {
+			return err
+		}
+
+		tx, audit, err := beginAudit(tx, entityType, id)
+		if err != nil {
+			return err
+		}
+		current := audit.before[id]
+
+		columns := map[string]any{"updated_at": time.Now()}
+		for _, column := range entity.Columns {
+			if value, found := snapshot[column]; found {
+				columns[column] = revisionValue(value)
+			}
+		}
+
+		for column, reference := range map[string]struct {
+			model any
+			name  string
+		}{
+			"author_id":             {&Author{}, "author"},
+			"processing_profile_id": {&ProcessingProfile{}, "processing profile"},
+		} {
+			referenced, ok := columns[column].(int64)
+			if !ok || referenced == 0 {
+				continue
+			}
+			err = requireExisting(tx, reference.model, reference.name, []uint{uint(referenced)})
+			if err != nil {
+				return fmt.Errorf("%w: %w", errRevisionConflict, err)
+			}
+		}
+
+		res := tx.Model(model).Where("id = ?", id).UpdateColumns(columns)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		switch entityType {
+		case auditEntityImage:
+			err = restoreImageAssociations(tx, id, revisionIds(snapshot["categories"]), revisionIds(snapshot["related"]))
+			if err != nil {
+				return err
+			}
+			if author, ok := columns["author_id"].(int64); ok && uint(author) != current["author_id"] {
+				authorChanged = true
+				err = removeVariants(id, tx, nil)
+				if err != nil {
+					return err
+				}
+			}
+			err = indexImages(tx, id)
+		case auditEntityAuthor:
+			err = indexImagesWhere(tx, "author_id = ?", id)
+		case auditEntityCategory:
+			err = indexImagesWhere(tx, "id IN (SELECT image_id FROM images_categories WHERE category_id = ?)", id)
+		}
+		if err != nil {
+			return err
+		}
+
+		return audit.commit(tx)
+	})
+	return authorChanged, err
+}
+
+// restoreImageAssociations replaces the categories and related images of the image. Categories it keeps stay at
+// their position within the category.
+func restoreImageAssociations(tx *gorm.DB, imageId uint, categoryIds, relatedIds []uint) error {
+	var categories []uint
+	res := tx.Model(&Category{}).Where("id IN ?", append(categoryIds, 0)).Pluck("id", &categories)
+	if res.Error != nil {
+		return res.Error
+	}
+	res = tx.Exec("DELETE FROM images_categories WHERE image_id = ? AND category_id NOT IN ?", imageId,
+		append(categories, 0))
+	if res.Error != nil {
+		return res.Error
+	}
+	for _, categoryId := range categories {
+		res = tx.Exec("INSERT INTO images_categories (image_id, category_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+			imageId, categoryId)
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	var related []uint
+	res = tx.Model(&Image{}).Where("id IN ? AND id <> ?", append(relatedIds, 0), imageId).Pluck("id", &related)
+	if res.Error != nil {
+		return res.Error
+	}
+	res = tx.Exec("DELETE FROM images_relations WHERE image_id = ? OR related_id = ?", imageId, imageId)
+	if res.Error != nil {
+		return res.Error
+	}
+	for _, relatedId := range related {
+		res = tx.Exec("INSERT INTO images_relations (image_id, related_id) VALUES (?, ?), (?, ?)",
+			imageId, relatedId, relatedId, imageId)
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
+
+func revisionErrorStatus(err error) int {
+	if errors.Is(err, errRevisionNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errRevisionConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// revisionComparison selects the revisions to compare in the UI, by default the latest revision and the one before
+func revisionComparison(c *gin.Context, revisions []Revision) (from, to *Revision) {
+	if len(revisions) == 0 {
+		return nil, nil
+	}
+	find := func(raw string, fallback int) *Revision {
+		number, err := strconv.Atoi(raw)
+		if err != nil {
+			number = fallback
+		}
+		for i := range revisions {
+			if revisions[i].Number == number {
+				return &revisions[i]
+			}
+		}
+		return nil
+	}
+
+	to = find(c.Query("to"), revisions[0].Number)
+	if to == nil {
+		to = &revisions[0]
+	}
+	from = find(c.Query("from"), to.Number-1)
+	if from == nil {
+		from = to
+	}
+	return from, to
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getRevisionsHtml(entityType string) gin.HandlerFunc {
+	entity := revisionEntities[entityType]
+	return func(c *gin.Context) {
+		id, err := pathIdToInt(entity.IdName, c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		revisions, err := entityRevisions(db, entityType, id)
+		if err != nil {
+			c.Error(err)
+			c.String(revisionErrorStatus(err), "Error loading revisions: %v", err)
+			return
+		}
+
+		data := gin.H{
+			"entityType": entityType,
+			"entityPath": fmt.Sprintf("/%s/%d", entity.Path, id),
+			"revisions": Map(revisions, func(revision Revision) RevisionDto {
+				return revision.toDto()
+			}),
+			"role":        currentRole(c),
+			"restoreRole": string(revisionRestoreRole(entityType)),
+		}
+		from, to := revisionComparison(c, revisions)
+		if from != nil {
+			fromDto, toDto := from.toDto(), to.toDto()
+			data["from"] = fromDto
+			data["to"] = toDto
+			data["changes"] = auditSnapshot(fromDto.Data).diff(toDto.Data)
+		}
+		c.HTML(http.StatusOK, "revisions.gohtml", data)
+	}
+}
+
+// revisionRestoreRole is the role needed to edit the entity, which is needed to restore its revisions as well
+func revisionRestoreRole(entityType string) Role {
+	if entityType == auditEntityImage {
+		return RoleContributor
+	}
+	return RoleMaintainer
+}
+
+func restoreRevisionForm(entityType string) gin.HandlerFunc {
+	entity := revisionEntities[entityType]
+	return func(c *gin.Context) {
+		id, err := pathIdToInt(entity.IdName, c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		number, err := strconv.Atoi(c.PostForm(revisionNumberName))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid revision: %v", err)
+			return
+		}
+
+		authorChanged, err := restoreRevision(c, entityType, id, number)
+		if err != nil {
+			c.Error(err)
+			c.String(revisionErrorStatus(err), "Error restoring revision %d: %v", number, err)
+			return
+		}
+		if authorChanged {
+			processRestoredImage(c, id)
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/%s/%d", entity.Path, id))
+	}
+}
+
+// processRestoredImage processes the variants of an image again, after the restored revision changed its author
+func processRestoredImage(c *gin.Context, imageId uint) {
+	image := Image{}
+	res := db.Limit(1).Find(&image, imageId)
+	if res.Error != nil {
+		c.Error(res.Error)
+		return
+	}
+	processImageForm(c, &image)
+}
+
+func getRevisions(entityType string) gin.HandlerFunc {
+	entity := revisionEntities[entityType]
+	return func(c *gin.Context) {
+		id, err := pathIdToInt(entity.IdName, c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		revisions, err := entityRevisions(db, entityType, id)
+		if err != nil {
+			c.Error(err)
+			c.String(revisionErrorStatus(err), err.Error())
+			return
+		}
+
+		revisionsDto := Map(revisions, func(revision Revision) RevisionDto {
+			return revision.toDto()
+		})
+		c.JSON(http.StatusOK, &revisionsDto)
+	}
+}
+
+func restoreRevisionApi(entityType string) gin.HandlerFunc {
+	entity := revisionEntities[entityType]
+	return func(c *gin.Context) {
+		id, err := pathIdToInt(entity.IdName, c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		number, err := strconv.Atoi(c.Param(revisionNumberName))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid revision: %v", err)
+			return
+		}
+
+		authorChanged, err := restoreRevision(c, entityType, id, number)
+		if err != nil {
+			c.Error(err)
+			c.String(revisionErrorStatus(err), "Error restoring revision %d of %s %d: %v", number, entityType, id, err)
+			return
+		}
+		if authorChanged {
+			processRestoredImage(c, id)
+		}
+
+		revisions, err := entityRevisions(db, entityType, id)
+		if err != nil || len(revisions) == 0 {
+			c.Status(http.StatusOK)
+			return
+		}
+		c.JSON(http.StatusOK, revisions[0].toDto())
+	}
+}
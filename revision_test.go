@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"slices"
+	"testing"
+)
+
+// editTestImage changes the image the way the image form does, with the categories and related images replaced in
+// the same audited change
+func editTestImage(t *testing.T, username string, id uint, title string, authorId uint, categories, related []uint) {
+	t.Helper()
+	err := db.WithContext(withAuditUser(context.Background(), username)).Transaction(func(tx *gorm.DB) error {
+		tx, audit, err := beginAudit(tx, auditEntityImage, id)
+		if err != nil {
+			return err
+		}
+		res := tx.Model(&Image{}).Where("id = ?", id).UpdateColumns(map[string]any{"title": title, "author_id": authorId})
+		if res.Error != nil {
+			return res.Error
+		}
+		err = restoreImageAssociations(tx, id, categories, related)
+		if err != nil {
+			return err
+		}
+		return audit.commit(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func revisionTestNumbers(t *testing.T, entityType string, id uint) []int {
+	t.Helper()
+	revisions, err := entityRevisions(db, entityType, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Map(revisions, func(revision Revision) int { return revision.Number })
+}
+
+func TestRestoreImageRevision(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	jane, john := Author{Name: "Jane"}, Author{Name: "John"}
+	db.Create(&jane)
+	db.Create(&john)
+	landscapes, coast, removed := Category{Name: "landscapes"}, Category{Name: "coast"}, Category{Name: "removed"}
+	db.Create(&landscapes)
+	db.Create(&coast)
+	db.Create(&removed)
+	createTestImages(t, 3)
+	db.Create(&ImageVariant{ImageID: 1, Format: "webp", FileName: "image-1-small.webp"})
+
+	editTestImage(t, "alice", 1, "Sunset", jane.ID, []uint{landscapes.ID, removed.ID}, []uint{2})
+	editTestImage(t, "bob", 1, "Evening", john.ID, []uint{coast.ID}, []uint{3})
+	if res := db.Delete(&removed); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if numbers := revisionTestNumbers(t, auditEntityImage, 1); !slices.Equal(numbers, []int{3, 2, 1}) {
+		t.Fatalf("image has the revisions %v", numbers)
+	}
+
+	authorChanged, err := restoreRevision(withAuditUser(context.Background(), "carol"), auditEntityImage, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !authorChanged {
+		t.Error("restoring a different author wasn't reported")
+	}
+
+	image := Image{}
+	db.Preload("Categories").Preload("Related").First(&image, 1)
+	categories, related := image.categoryIds(), image.relatedImageIds()
+	slices.Sort(categories)
+	// The deleted category is skipped
+	if image.Title != "Sunset" || image.AuthorID != jane.ID || !slices.Equal(categories, []uint{landscapes.ID}) ||
+		!slices.Equal(related, []uint{2}) {
+		t.Errorf("restored image has title %s, author %d, categories %v and related images %v", image.Title,
+			image.AuthorID, categories, related)
+	}
+	for _, relation := range []struct {
+		id      uint
+		related []uint
+	}{{2, []uint{1}}, {3, []uint{}}} {
+		var ids []uint
+		db.Table("images_relations").Where("image_id = ?", relation.id).Pluck("related_id", &ids)
+		if !slices.Equal(ids, relation.related) {
+			t.Errorf("image %d is related to %v, expected %v", relation.id, ids, relation.related)
+		}
+	}
+	var variants int64
+	db.Model(&ImageVariant{}).Where("image_id = 1").Count(&variants)
+	if variants != 0 {
+		t.Errorf("variants of the previous author are kept")
+	}
+
+	// The restore is a revision and an audit entry of its own
+	if numbers := revisionTestNumbers(t, auditEntityImage, 1); !slices.Equal(numbers, []int{4, 3, 2, 1}) {
+		t.Errorf("image has the revisions %v after the restore", numbers)
+	}
+	history := imageHistory(1)
+	if len(history) == 0 || history[0].Username != "carol" || history[0].Action != auditActionUpdate {
+		t.Fatalf("restore recorded %+v", history)
+	}
+	if change := history[0].Changes["title"]; change.Old != "Evening" || change.New != "Sunset" {
+		t.Errorf("restore recorded the title change %+v", change)
+	}
+
+	// Restoring the current state changes nothing
+	authorChanged, err = restoreRevision(context.Background(), auditEntityImage, 1, 4)
+	if err != nil || authorChanged {
+		t.Errorf("restoring the current revision returned %v, %v", authorChanged, err)
+	}
+	if numbers := revisionTestNumbers(t, auditEntityImage, 1); len(numbers) != 4 {
+		t.Errorf("restoring the current revision added a revision: %v", numbers)
+	}
+}
+
+func TestRestoreRevisionErrors(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	jane, john := Author{Name: "Jane"}, Author{Name: "John"}
+	db.Create(&jane)
+	db.Create(&john)
+	createTestImages(t, 2)
+	editTestImage(t, "alice", 1, "Sunset", jane.ID, nil, nil)
+	editTestImage(t, "alice", 1, "Evening", john.ID, nil, nil)
+	if res := db.Delete(&jane); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res := db.Delete(&Image{}, 2); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	tests := []struct {
+		name       string
+		entityType string
+		id         uint
+		number     int
+		err        error
+		status     int
+	}{
+		{"unknown revision", auditEntityImage, 1, 9, errRevisionNotFound, 404},
+		{"unknown image", auditEntityImage, 9, 1, errRevisionNotFound, 404},
+		{"image in the trash", auditEntityImage, 2, 1, errRevisionNotFound, 404},
+		{"deleted author", auditEntityImage, 1, 2, errRevisionConflict, 409},
+		{"entity without revisions", auditEntityVariant, 1, 1, errUnknownAuditEntity, 500},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := restoreRevision(context.Background(), test.entityType, test.id, test.number)
+			if !errors.Is(err, test.err) || revisionErrorStatus(err) != test.status {
+				t.Errorf("got error %v with status %d", err, revisionErrorStatus(err))
+			}
+		})
+	}
+
+	// The failed restores changed nothing
+	image := Image{}
+	db.First(&image, 1)
+	if image.Title != "Evening" || image.AuthorID != john.ID {
+		t.Errorf("image has title %s and author %d", image.Title, image.AuthorID)
+	}
+	if numbers := revisionTestNumbers(t, auditEntityImage, 1); !slices.Equal(numbers, []int{3, 2, 1}) {
+		t.Errorf("image has the revisions %v", numbers)
+	}
+}
+
+func TestRestoreAuthorRevision(t *testing.T) {
+	setupTestDatabase(t)
+	author := Author{Name: "Jane", Url: "https://jane.example"}
+	db.Create(&author)
+	author.Name, author.Url = "Mary", ""
+	if res := db.WithContext(withAuditUser(context.Background(), "alice")).Save(&author); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	if _, err := restoreRevision(context.Background(), auditEntityAuthor, author.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	restored := Author{}
+	db.First(&restored, author.ID)
+	if restored.Name != "Jane" || restored.Url != "https://jane.example" {
+		t.Errorf("restored author is %+v", restored)
+	}
+	if numbers := revisionTestNumbers(t, auditEntityAuthor, author.ID); !slices.Equal(numbers, []int{3, 2, 1}) {
+		t.Errorf("author has the revisions %v", numbers)
+	}
+}
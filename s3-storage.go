@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// S3Config configures an S3 compatible object storage, e.g. AWS S3 or MinIO. Objects are addressed path-style,
+	// which every S3 compatible storage supports.
+	S3Config struct {
+		Endpoint  string `yaml:"endpoint" toml:"endpoint"`
+		Region    string `yaml:"region" toml:"region"`
+		Bucket    string `yaml:"bucket" toml:"bucket"`
+		AccessKey string `yaml:"accessKey" toml:"accessKey"`
+		SecretKey string `yaml:"secretKey" toml:"secretKey"`
+		// PublicUrl is the public location of the bucket, files are redirected to it instead of being proxied
+		PublicUrl string `yaml:"publicUrl" toml:"publicUrl"`
+	}
+
+	// S3Storage keeps the files as objects below a prefix of the bucket. Requests are signed with AWS signature
+	// version 4.
+	S3Storage struct {
+		config *S3Config
+		prefix string
+		client *http.Client
+	}
+
+	s3ListResult struct {
+		Contents []struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+)
+
+const (
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+	s3DefaultRegion = "us-east-1"
+	s3Timeout       = time.Minute
+)
+
+func newS3Storage(config *S3Config, prefix string) *S3Storage {
+	return &S3Storage{
+		config: config,
+		prefix: prefix,
+		client: &http.Client{Timeout: s3Timeout},
+	}
+}
+
+func (config *S3Config) validate() error {
+	missing := make([]string, 0)
+	for name, value := range map[string]string{
+		"endpoint":  config.Endpoint,
+		"bucket":    config.Bucket,
+		"accessKey": config.AccessKey,
+		"secretKey": config.SecretKey,
+	} {
+		if len(value) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Errorf("the s3 storage needs %s", strings.Join(missing, ", "))
+	}
+	if _, err := url.Parse(config.Endpoint); err != nil {
+		return fmt.Errorf("invalid s3 endpoint \"%s\": %w", config.Endpoint, err)
+	}
+	if len(config.Region) == 0 {
+		config.Region = s3DefaultRegion
+	}
+	return nil
+}
+
+// s3Escape encodes everything except the unreserved characters, as required for the canonical request
+func s3Escape(value string, keepSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			builder.WriteByte(b)
+		case b == '/' && keepSlash:
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := slices.Clone(query[key])
+		slices.Sort(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request adds the authorization header to the request. All headers set on the request, and the host, are
+// signed. The payload hash has to be set as X-Amz-Content-Sha256 header.
+func signS3Request(request *http.Request, config *S3Config, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	date := now.UTC().Format(s3DateFormat)
+	request.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalPath := request.URL.EscapedPath()
+	if unescaped, err := url.PathUnescape(canonicalPath); err == nil {
+		canonicalPath = s3Escape(unescaped, true)
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalPath,
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		request.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := strings.Join([]string{date, config.Region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+config.SecretKey), date)
+	for _, part := range []string{config.Region, s3Service, "aws4_request"} {
+		signingKey = hmacSha256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, config.AccessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3Storage) objectUrl(key string) string {
+	endpoint := strings.TrimSuffix(s.config.Endpoint, "/")
+	if len(key) == 0 {
+		return fmt.Sprintf("%s/%s", endpoint, s3Escape(s.config.Bucket, false))
+	}
+	return fmt.Sprintf("%s/%s/%s", endpoint, s3Escape(s.config.Bucket, false), s3Escape(s.prefix+key, true))
+}
+
+// do sends a signed request for the object with the key, or for the bucket if the key is empty
+func (s *S3Storage) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	location := s.objectUrl(key)
+	if len(query) > 0 {
+		location += "?" + s3CanonicalQuery(query)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, location, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256.Sum256(body)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if body != nil {
+		request.ContentLength = int64(len(body))
+		request.Header.Set("Content-Type", storageContentType(key))
+	}
+	signS3Request(request, s.config, time.Now())
+	return s.client.Do(request)
+}
+
+// s3Error turns an unexpected response into an error, missing objects wrap fs.ErrNotExist
+func s3Error(response *http.Response, method, key string) error {
+	message := ""
+	if method != http.MethodHead {
+		message = readAllLimited(response.Body)
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", method, key, fs.ErrNotExist)
+	}
+	return fmt.Errorf("%s %s failed with status %d: %s", method, key, response.StatusCode, message)
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	response, err := s.do(ctx, http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return s3Error(response, http.MethodPut, key)
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	response, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, s3Error(response, http.MethodGet, key)
+	}
+	return io.ReadAll(response.Body)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	response, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK &&
+		response.StatusCode != http.StatusNotFound {
+		return s3Error(response, http.MethodDelete, key)
+	}
+	return nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]StorageObject, error) {
+	objects := make([]StorageObject, 0)
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.prefix + prefix},
+	}
+	for {
+		response, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			err = s3Error(response, http.MethodGet, s.prefix+prefix)
+			response.Body.Close()
+			return nil, err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read object list: %w", err)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, StorageObject{
+				Key:      strings.TrimPrefix(content.Key, s.prefix),
+				Size:     content.Size,
+				Modified: content.LastModified,
+			})
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (StorageObject, error) {
+	response, err := s.do(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return StorageObject{}, s3Error(response, http.MethodHead, key)
+	}
+
+	object := StorageObject{Key: key}
+	object.Size, _ = strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64)
+	object.Modified, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+	return object, nil
+}
+
+// PublicURL returns the location of the object below the configured public URL of the bucket
+func (s *S3Storage) PublicURL(key string) (string, bool) {
+	if len(s.config.PublicUrl) == 0 {
+		return "", false
+	}
+	return strings.TrimSuffix(s.config.PublicUrl, "/") + "/" + s3Escape(s.prefix+key, true), true
+}
+
+// readAllLimited reads the start of a response body for error messages
+func readAllLimited(reader io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(reader, 4096))
+	return strings.TrimSpace(string(data))
+}
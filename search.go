@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"html"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type (
+	SearchResultDto struct {
+		Image ImageDto `json:"image" yaml:"image"`
+		// Rank is the bm25 score of the match, lower is better
+		Rank       float64            `json:"rank" yaml:"rank"`
+		Highlights SearchHighlightDto `json:"highlights" yaml:"highlights"`
+	}
+
+	// SearchHighlightDto contains the HTML escaped fields of a match, matching terms are wrapped in <mark> tags
+	SearchHighlightDto struct {
+		Name        string `json:"name" yaml:"name"`
+		Title       string `json:"title" yaml:"title"`
+		Description string `json:"description" yaml:"description"`
+		Author      string `json:"author" yaml:"author"`
+		Categories  string `json:"categories" yaml:"categories"`
+	}
+
+	searchMatch struct {
+		ImageID     uint
+		Score       float64
+		Name        string
+		Title       string
+		Description string
+		Author      string
+		Categories  string
+	}
+)
+
+const (
+	searchTable        = "image_search"
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+	// The markers are replaced by <mark> tags after the highlighted text has been escaped
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+var (
+	// searchAvailable is false if the sqlite library was built without FTS5
+	searchAvailable bool
+
+	errSearchUnavailable = errors.New("full-text search is not available, the binary has to be built with the sqlite_fts5 tag")
+	errEmptySearch       = errors.New("search query is empty")
+)
+
+// setupSearch creates the FTS5 index and fills it if it doesn't match the images. The index is kept up to date by
+// the hooks of images, authors and categories.
+func setupSearch() {
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS " + searchTable + " USING fts5(" +
+		"name, title, description, author, categories, " +
+		"tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3')").Error
+	if err != nil {
+		logger.Warnf("Full-text search is disabled: %v", err)
+		return
+	}
+	searchAvailable = true
+
+	var indexed, images int64
+	db.Raw("SELECT COUNT(*) FROM " + searchTable).Scan(&indexed)
+	db.Model(&Image{}).Count(&images)
+	if indexed == images {
+		return
+	}
+
+	var ids []uint
+	db.Model(&Image{}).Pluck("id", &ids)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec("DELETE FROM " + searchTable)
+		if res.Error != nil {
+			return res.Error
+		}
+		return indexImages(tx, ids...)
+	})
+	if err != nil {
+		logger.Errorf("Error building search index: %v", err)
+		return
+	}
+	logger.Infof("Indexed %d images for full-text search", len(ids))
+}
+
+// indexImages replaces the index entries of the images with their current names, author and categories
+func indexImages(tx *gorm.DB, ids ...uint) error {
+	if !searchAvailable || len(ids) == 0 {
+		return nil
+	}
+
+	res := tx.Exec("DELETE FROM "+searchTable+" WHERE rowid IN ?", ids)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	return tx.Exec("INSERT INTO "+searchTable+" (rowid, name, title, description, author, categories) "+
+		"SELECT images.id, images.name, images.title, images.description, COALESCE(authors.name, ''), "+
+		"COALESCE((SELECT group_concat(categories.display_name, ' ') FROM images_categories "+
+		"INNER JOIN categories ON categories.id = images_categories.category_id AND categories.deleted_at IS NULL "+
+		"WHERE images_categories.image_id = images.id), '') "+
+		"FROM images LEFT JOIN authors ON authors.id = images.author_id AND authors.deleted_at IS NULL "+
+		"WHERE images.id IN ? AND images.deleted_at IS NULL", ids).Error
+}
+
+func unindexImage(tx *gorm.DB, id uint) error {
+	if !searchAvailable {
+		return nil
+	}
+	return tx.Exec("DELETE FROM "+searchTable+" WHERE rowid = ?", id).Error
+}
+
+// indexImagesWhere reindexes all images matching the condition, e.g. all images of an author
+func indexImagesWhere(tx *gorm.DB, query string, args ...any) error {
+	if !searchAvailable {
+		return nil
+	}
+	var ids []uint
+	res := tx.Model(&Image{}).Where(query, args...).Pluck("images.id", &ids)
+	if res.Error != nil {
+		return res.Error
+	}
+	return indexImages(tx, ids...)
+}
+
+// searchQuery turns user input into an FTS5 query. Every word is quoted, so operators in the input are matched
+// literally, and matched as a prefix. All words have to match.
+func searchQuery(input string) (string, error) {
+	words := strings.FieldsFunc(input, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return "", errEmptySearch
+	}
+	terms := Map(words, func(word string) string {
+		return "\"" + word + "\"*"
+	})
+	return strings.Join(terms, " "), nil
+}
+
+// searchRank weights matches in the name and title higher than matches in the description
+func searchRank() string {
+	return "bm25(" + searchTable + ", 10.0, 8.0, 1.0, 4.0, 2.0)"
+}
+
+func searchImages(input string, limit int) ([]searchMatch, error) {
+	if !searchAvailable {
+		return nil, errSearchUnavailable
+	}
+	query, err := searchQuery(input)
+	if err != nil {
+		return nil, err
+	}
+
+	highlight := func(column int) string {
+		return "highlight(" + searchTable + ", " + strconv.Itoa(column) + ", '" + highlightStart + "', '" + highlightEnd + "')"
+	}
+
+	var matches []searchMatch
+	res := db.Raw("SELECT rowid AS image_id, "+searchRank()+" AS score, "+
+		highlight(0)+" AS name, "+highlight(1)+" AS title, "+
+		"snippet("+searchTable+", 2, '"+highlightStart+"', '"+highlightEnd+"', '…', 24) AS description, "+
+		highlight(3)+" AS author, "+highlight(4)+" AS categories "+
+		"FROM "+searchTable+" WHERE "+searchTable+" MATCH ? ORDER BY score LIMIT ?", query, limit).Scan(&matches)
+	return matches, res.Error
+}
+
+// highlightHtml escapes the text and replaces the highlight markers with <mark> tags
+func highlightHtml(text string) string {
+	escaped := html.EscapeString(text)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightEnd, "</mark>")
+}
+
+func (m *searchMatch) highlights() SearchHighlightDto {
+	return SearchHighlightDto{
+		Name:        highlightHtml(m.Name),
+		Title:       highlightHtml(m.Title),
+		Description: highlightHtml(m.Description),
+		Author:      highlightHtml(m.Author),
+		Categories:  highlightHtml(m.Categories),
+	}
+}
+
+// searchHighlights returns the highlighted titles of the matching images for the image list
+func searchHighlights(input string) map[uint]template.HTML {
+	highlights := map[uint]template.HTML{}
+	matches, err := searchImages(input, maxSearchLimit)
+	if err != nil {
+		return highlights
+	}
+	for _, match := range matches {
+		title := match.Title
+		if !strings.Contains(title, highlightStart) && strings.Contains(match.Name, highlightStart) {
+			title = match.Name
+		}
+		highlights[match.ImageID] = template.HTML(highlightHtml(title))
+	}
+	return highlights
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func search(c *gin.Context) {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+
+	matches, err := searchImages(c.Query("q"), limit)
+	if errors.Is(err, errSearchUnavailable) {
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid search: %v", err)
+		return
+	}
+
+	ids := Map(matches, func(match searchMatch) uint {
+		return match.ImageID
+	})
+	var images []Image
+	db.Preload("Author").Preload("Categories").Where("id IN ?", ids).Find(&images)
+	imagesById := make(map[uint]*Image, len(images))
+	for i := range images {
+		imagesById[images[i].ID] = &images[i]
+	}
+
+	results := make([]SearchResultDto, 0, len(matches))
+	for _, match := range matches {
+		image, found := imagesById[match.ImageID]
+		if !found {
+			continue
+		}
+		results = append(results, SearchResultDto{
+			Image:      image.toDto(),
+			Rank:       match.Score,
+			Highlights: match.highlights(),
+		})
+	}
+
+	c.JSON(http.StatusOK, &results)
+}
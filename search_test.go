@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// setupTestSearch creates the search index of a new database
+func setupTestSearch(t *testing.T) {
+	setupTestDatabase(t)
+	previous := searchAvailable
+	t.Cleanup(func() {
+		searchAvailable = previous
+	})
+	setupSearch()
+	if !searchAvailable {
+		t.Skip("sqlite was built without FTS5")
+	}
+}
+
+func searchTestIds(t *testing.T, input string) []uint {
+	t.Helper()
+	matches, err := searchImages(input, defaultSearchLimit)
+	if err != nil {
+		t.Fatalf("search for %q failed: %v", input, err)
+	}
+	return Map(matches, func(match searchMatch) uint { return match.ImageID })
+}
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		query string
+	}{
+		{"sunset", `"sunset"*`},
+		{"  Sunset  over the\tsea ", `"Sunset"* "over"* "the"* "sea"*`},
+		{`sun "sea`, `"sun"* "sea"*`},
+		{"sun AND NOT sea", `"sun"* "AND"* "NOT"* "sea"*`},
+		{"title:sun -sea NEAR(a b)", `"title"* "sun"* "sea"* "NEAR"* "a"* "b"*`},
+		{"jürgen's 2024", `"jürgen"* "s"* "2024"*`},
+	}
+	for _, test := range tests {
+		query, err := searchQuery(test.input)
+		if err != nil || query != test.query {
+			t.Errorf("searchQuery(%q) = %s, %v, expected %s", test.input, query, err, test.query)
+		}
+	}
+
+	for _, input := range []string{"", "   ", `"*^-:()`} {
+		if query, err := searchQuery(input); !errors.Is(err, errEmptySearch) {
+			t.Errorf("searchQuery(%q) = %s, %v", input, query, err)
+		}
+	}
+}
+
+func TestSearchImages(t *testing.T) {
+	setupTestSearch(t)
+	jane := Author{Name: "Jürgen Doe"}
+	db.Create(&jane)
+	coast := Category{Name: "coast", DisplayName: "Rocky Coast"}
+	db.Create(&coast)
+	images := []Image{
+		{Name: "sunset", Title: "Sunset over the sea", AuthorID: jane.ID},
+		{Name: "harbour", Title: "Harbour", Description: "Boats at sunset"},
+		{Name: "cliffs", Title: "Cliffs <b>and</b> waves"},
+		{Name: "forest", Title: "Forest"},
+	}
+	for i := range images {
+		if res := db.Create(&images[i]); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+	}
+	db.Model(&images[2]).Association("Categories").Append(&coast)
+	if err := indexImages(db, images[2].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input string
+		ids   []uint
+	}{
+		// Matches in the title rank higher than matches in the description
+		{"sunset", []uint{1, 2}},
+		{"sun", []uint{1, 2}},
+		{"sunset sea", []uint{1}},
+		{"jurgen", []uint{1}},
+		{"rocky", []uint{3}},
+		{"harbour boats", []uint{2}},
+		// Operators are matched as words instead of changing the query
+		{"sunset OR forest", []uint{}},
+		{`sunset" OR "forest`, []uint{}},
+		{"NEAR(sunset sea)", []uint{}},
+		{"title:forest", []uint{}},
+		{"mountains", []uint{}},
+	}
+	for _, test := range tests {
+		if ids := searchTestIds(t, test.input); !slices.Equal(ids, test.ids) {
+			t.Errorf("search for %q found %v, expected %v", test.input, ids, test.ids)
+		}
+	}
+
+	matches, err := searchImages("cliffs", defaultSearchLimit)
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("got matches %+v, %v", matches, err)
+	}
+	if title := matches[0].highlights().Title; title != "<mark>Cliffs</mark> &lt;b&gt;and&lt;/b&gt; waves" {
+		t.Errorf("got highlighted title %s", title)
+	}
+}
+
+func TestSearchIndexFollowsChanges(t *testing.T) {
+	setupTestSearch(t)
+	author := Author{Name: "Jane"}
+	db.Create(&author)
+	image := Image{Name: "sunset", AuthorID: author.ID}
+	db.Create(&image)
+
+	author.Name = "Mary"
+	if res := db.Save(&author); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if ids := searchTestIds(t, "jane"); len(ids) > 0 {
+		t.Errorf("search found the previous author name in %v", ids)
+	}
+	if ids := searchTestIds(t, "mary"); !slices.Equal(ids, []uint{image.ID}) {
+		t.Errorf("search for the new author name found %v", ids)
+	}
+
+	image.Title = "Evening"
+	if res := db.Save(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if ids := searchTestIds(t, "evening"); !slices.Equal(ids, []uint{image.ID}) {
+		t.Errorf("search for the new title found %v", ids)
+	}
+
+	if res := db.Delete(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if ids := searchTestIds(t, "sunset"); len(ids) > 0 {
+		t.Errorf("search found the deleted image in %v", ids)
+	}
+}
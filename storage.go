@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// Storage keeps the files of one kind, e.g. the originals or the processed variants, by their key. Keys are
+	// relative paths using "/" as separator, chosen by the callers from the names the files are published under
+	// (e.g. "<id>.<format>" for originals), so the URLs below /files stay the same for every storage.
+	Storage interface {
+		Put(ctx context.Context, key string, data []byte) error
+		// Get fails with an error wrapping fs.ErrNotExist if the file doesn't exist
+		Get(ctx context.Context, key string) ([]byte, error)
+		// Delete doesn't fail if the file doesn't exist
+		Delete(ctx context.Context, key string) error
+		// List returns the files whose keys start with the prefix, an empty prefix lists all files
+		List(ctx context.Context, prefix string) ([]StorageObject, error)
+		// Stat fails with an error wrapping fs.ErrNotExist if the file doesn't exist
+		Stat(ctx context.Context, key string) (StorageObject, error)
+	}
+
+	StorageObject struct {
+		Key      string
+		Size     int64
+		Modified time.Time
+	}
+
+	// LocalStorage keeps the files in a directory of the local file system
+	LocalStorage struct {
+		Dir string
+	}
+
+	// storageRedirector is implemented by storages whose files can be downloaded from a public URL
+	storageRedirector interface {
+		PublicURL(key string) (string, bool)
+	}
+)
+
+const (
+	storageLocal = "local"
+	storageS3    = "s3"
+
+	storageKeyName = "storageKey"
+)
+
+var (
+	originalStorage  Storage
+	processedStorage Storage
+	iconStorage      Storage
+	trashStorage     Storage
+	versionStorage   Storage
+
+	errInvalidStorageKey = errors.New("invalid storage key")
+)
+
+func newLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Dir: dir}
+}
+
+// path returns the location of the file, keys can't point outside of the directory
+func (s *LocalStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" {
+		return "", fmt.Errorf("%w \"%s\"", errInvalidStorageKey, key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(cleaned)), nil
+}
+
+func (s *LocalStorage) Put(_ context.Context, key string, data []byte) error {
+	location, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = createDirIfNotExists(filepath.Dir(location))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(location, data, 0644)
+}
+
+func (s *LocalStorage) Get(_ context.Context, key string) ([]byte, error) {
+	location, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(location)
+}
+
+func (s *LocalStorage) Delete(_ context.Context, key string) error {
+	location, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(location)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) List(_ context.Context, prefix string) ([]StorageObject, error) {
+	objects := make([]StorageObject, 0)
+	err := filepath.WalkDir(s.Dir, func(location string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && location == s.Dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		relative, err := filepath.Rel(s.Dir, location)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, StorageObject{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (s *LocalStorage) Stat(_ context.Context, key string) (StorageObject, error) {
+	location, err := s.path(key)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	info, err := os.Stat(location)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	if info.IsDir() {
+		return StorageObject{}, fmt.Errorf("%s is a directory: %w", key, fs.ErrNotExist)
+	}
+	return StorageObject{Key: key, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+// setupStorage creates the storages of originals, variants, icons, the trash and previous originals. The content of
+// all files is kept in a shared content addressed storage, the storages only keep references to it. The local storage
+// uses the configured directories, the object storage uses a prefix per kind in a single bucket.
+func setupStorage() {
+	var refs [5]Storage
+	var blobs Storage
+	if appConfig.Storage == storageS3 {
+		refs = [5]Storage{
+			newS3Storage(&appConfig.S3, "originals/"),
+			newS3Storage(&appConfig.S3, "processed/"),
+			newS3Storage(&appConfig.S3, "icons/"),
+			newS3Storage(&appConfig.S3, "trash/"),
+			newS3Storage(&appConfig.S3, "versions/"),
+		}
+		blobs = newS3Storage(&appConfig.S3, "objects/")
+		logger.Infof("Storing files in bucket \"%s\" at %s", appConfig.S3.Bucket, appConfig.S3.Endpoint)
+	} else {
+		refs = [5]Storage{
+			newLocalStorage(appConfig.OriginalDir),
+			newLocalStorage(appConfig.ProcessedDir),
+			newLocalStorage(appConfig.IconDir),
+			newLocalStorage(appConfig.TrashDir),
+			newLocalStorage(appConfig.VersionDir),
+		}
+		blobs = newLocalStorage(appConfig.ObjectDir)
+	}
+
+	contentStorages = Map(refs[:], func(refs Storage) *ContentStorage {
+		return newContentStorage(refs, blobs)
+	})
+	originalStorage = contentStorages[0]
+	processedStorage = contentStorages[1]
+	iconStorage = contentStorages[2]
+	trashStorage = contentStorages[3]
+	versionStorage = contentStorages[4]
+
+	err := migrateContentStorages(context.Background())
+	if err != nil {
+		logger.Panicf("Error moving stored files into the content addressed storage: %v", err)
+	}
+}
+
+// moveObject moves a file between storages. Only the reference is moved if both storages keep their content in the
+// same blobs, and files are renamed if both are on the local file system.
+func moveObject(ctx context.Context, source Storage, sourceKey string, destination Storage, destinationKey string) error {
+	contentSource, sourceIsContent := source.(*ContentStorage)
+	contentDestination, destinationIsContent := destination.(*ContentStorage)
+	if sourceIsContent && destinationIsContent {
+		moved, err := contentSource.moveRef(ctx, sourceKey, contentDestination, destinationKey)
+		if moved || err != nil {
+			return err
+		}
+	}
+
+	localSource, sourceIsLocal := source.(*LocalStorage)
+	localDestination, destinationIsLocal := destination.(*LocalStorage)
+	if sourceIsLocal && destinationIsLocal {
+		sourcePath, err := localSource.path(sourceKey)
+		if err != nil {
+			return err
+		}
+		destinationPath, err := localDestination.path(destinationKey)
+		if err != nil {
+			return err
+		}
+		return moveFile(sourcePath, destinationPath)
+	}
+
+	data, err := source.Get(ctx, sourceKey)
+	if err != nil {
+		return err
+	}
+	err = destination.Put(ctx, destinationKey, data)
+	if err != nil {
+		return err
+	}
+	return source.Delete(ctx, sourceKey)
+}
+
+// objectExists returns whether the file exists, errors other than a missing file are logged and count as missing
+func objectExists(ctx context.Context, storage Storage, key string) bool {
+	_, err := storage.Stat(ctx, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warnf("Could not check whether %s exists: %v", key, err)
+	}
+	return err == nil
+}
+
+// clearStorage deletes all files of the storage
+func clearStorage(ctx context.Context, storage Storage) error {
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		err = storage.Delete(ctx, object.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func storageContentType(key string) string {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if len(contentType) == 0 {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// serveStorage serves the files of the storage below the path. Local files are served directly, files of an object
+// storage are redirected to their public URL if one is configured and proxied otherwise.
+func serveStorage(r gin.IRoutes, relativePath string, storage Storage) {
+	if local, isLocal := storage.(*LocalStorage); isLocal {
+		r.Static(relativePath, local.Dir)
+		return
+	}
+
+	handler := func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param(storageKeyName), "/")
+		if redirector, ok := storage.(storageRedirector); ok {
+			if url, public := redirector.PublicURL(key); public {
+				c.Redirect(http.StatusFound, url)
+				return
+			}
+		}
+		// The content type is taken from the extension of the key, blobs keep the extension of the file
+		if content, ok := storage.(*ContentStorage); ok {
+			if location, local := content.localPath(c, key); local {
+				c.File(location)
+				return
+			}
+		}
+
+		data, err := storage.Get(c, key)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errInvalidStorageKey) {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.Error(err)
+			c.String(http.StatusBadGateway, "Error loading file: %v", err)
+			return
+		}
+		c.Data(http.StatusOK, storageContentType(key), data)
+	}
+	r.GET(relativePath+"/*"+storageKeyName, handler)
+	r.HEAD(relativePath+"/*"+storageKeyName, handler)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLocalStorageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	storage := newLocalStorage(dir)
+	ctx := context.Background()
+
+	for _, key := range []string{"1.png", "nested/2.png"} {
+		if err := storage.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	data, err := storage.Get(ctx, "nested/2.png")
+	if err != nil || string(data) != "nested/2.png" {
+		t.Errorf("Get returned %q, %v", data, err)
+	}
+	object, err := storage.Stat(ctx, "1.png")
+	if err != nil || object.Size != int64(len("1.png")) {
+		t.Errorf("Stat returned %+v, %v", object, err)
+	}
+	if _, err := storage.Stat(ctx, "nested"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a directory returned %v", err)
+	}
+
+	objects, err := storage.List(ctx, "nested/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := Map(objects, func(o StorageObject) string { return o.Key })
+	if !slices.Equal(keys, []string{"nested/2.png"}) {
+		t.Errorf("List returned %v", keys)
+	}
+
+	if err := storage.Delete(ctx, "1.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(ctx, "1.png"); err != nil {
+		t.Errorf("deleting a missing file failed: %v", err)
+	}
+	if _, err := storage.Get(ctx, "1.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get of a deleted file returned %v", err)
+	}
+}
+
+func TestLocalStorageListMissingDir(t *testing.T) {
+	storage := newLocalStorage(filepath.Join(t.TempDir(), "missing"))
+	objects, err := storage.List(context.Background(), "")
+	if err != nil || len(objects) != 0 {
+		t.Errorf("List returned %v, %v", objects, err)
+	}
+}
+
+func TestLocalStorageKeysStayInsideDir(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "files")
+	storage := newLocalStorage(dir)
+
+	err := storage.Put(context.Background(), "../outside.png", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "outside.png")); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("file was written outside of the storage directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside.png")); err != nil {
+		t.Errorf("file wasn't written inside the storage directory: %v", err)
+	}
+
+	for _, key := range []string{"", "/", ".."} {
+		if _, err := storage.Get(context.Background(), key); !errors.Is(err, errInvalidStorageKey) {
+			t.Errorf("Get(%q) returned %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gallery-image-manager/util"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type (
+	// TrashItemDto is a deleted image, author or category that can still be restored
+	TrashItemDto struct {
+		Type      string    `json:"type" yaml:"type"`
+		ID        uint      `json:"id" yaml:"id"`
+		Name      string    `json:"name" yaml:"name"`
+		DeletedAt time.Time `json:"deletedAt" yaml:"deletedAt"`
+		// PurgeAt is when the item gets deleted permanently, it is not set if the trash is never emptied automatically
+		PurgeAt *time.Time `json:"purgeAt,omitempty" yaml:"purgeAt,omitempty"`
+	}
+
+	trashedEntity struct {
+		ID        uint
+		Name      string
+		DeletedAt time.Time
+	}
+)
+
+const (
+	trashTypeImage    = "image"
+	trashTypeAuthor   = "author"
+	trashTypeCategory = "category"
+
+	trashTypeName = "trashType"
+	trashIdName   = "trashId"
+
+	trashSweepInterval = time.Hour
+)
+
+var (
+	trashTypes = []string{trashTypeImage, trashTypeAuthor, trashTypeCategory}
+
+	errUnknownTrashType = errors.New("unknown trash type")
+	errNotInTrash       = errors.New("not in trash")
+)
+
+// moveFile renames the file, or copies and removes it if it has to be moved to another file system
+func moveFile(source, destination string) error {
+	err := os.Rename(source, destination)
+	if err == nil {
+		return nil
+	}
+	err = util.Copy(source, destination)
+	if err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+// trashImage deletes the image and moves its original into the trash storage. The variants are removed, they
+// are generated again when the restored image is processed.
+func trashImage(ctx context.Context, image *Image) error {
+	files := originalFiles{}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return trashImageTx(tx, &files, image)
+	})
+	files.finish(ctx, err)
+	return err
+}
+
+// trashImageTx deletes the image in the transaction. The original is moved back and the files of the variants are
+// kept unless files.finish is called without an error.
+func trashImageTx(tx *gorm.DB, files *originalFiles, image *Image) error {
+	var variants []ImageVariant
+	res := tx.Where("image_id = ?", image.ID).Find(&variants)
+	if res.Error != nil {
+		return res.Error
+	}
+	for _, variant := range variants {
+		res = tx.Unscoped().Delete(&variant)
+		if res.Error != nil {
+			return res.Error
+		}
+		files.deleteAfterCommit(processedStorage, variant.FileName)
+	}
+	res = tx.Model(image).UpdateColumn("processing_fingerprint", "")
+	if res.Error != nil {
+		return res.Error
+	}
+	res = tx.Delete(image)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	err := files.move(tx.Statement.Context, originalStorage, image.OriginalFileName(), trashStorage, image.OriginalFileName())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not move original to trash: %w", err)
+	}
+	return nil
+}
+
+// trashAuthor deletes the author after its images have been handled according to the delete strategy
+func trashAuthor(ctx context.Context, author *Author, options DeleteOptions) error {
+	err := options.validate(author.ID)
+	if err != nil {
+		return err
+	}
+	files := originalFiles{}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := releaseAuthor(tx, &files, author.ID, options)
+		if err != nil {
+			return err
+		}
+		return tx.Delete(author).Error
+	})
+	files.finish(ctx, err)
+	return err
+}
+
+// trashCategory deletes the category after its images have been handled according to the delete strategy. Reserved
+// categories can't be deleted.
+func trashCategory(ctx context.Context, category *Category, options DeleteOptions) error {
+	if isReservedCategory(category) {
+		return fmt.Errorf("%w \"%s\" can't be deleted", errReservedCategory, category.Name)
+	}
+	err := options.validate(category.ID)
+	if err != nil {
+		return err
+	}
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := releaseCategory(tx, category.ID, options)
+		if err != nil {
+			return err
+		}
+		return tx.Delete(category).Error
+	})
+}
+
+func trashModel(trashType string) (any, error) {
+	switch trashType {
+	case trashTypeImage:
+		return &Image{}, nil
+	case trashTypeAuthor:
+		return &Author{}, nil
+	case trashTypeCategory:
+		return &Category{}, nil
+	}
+	return nil, fmt.Errorf("%w \"%s\"", errUnknownTrashType, trashType)
+}
+
+// trashedItems lists the deleted entities of all types, most recently deleted first
+func trashedItems() ([]TrashItemDto, error) {
+	items := make([]TrashItemDto, 0)
+	for _, trashType := range trashTypes {
+		model, _ := trashModel(trashType)
+		var entities []trashedEntity
+		res := db.Unscoped().Model(model).Select("id, name, deleted_at").Where("deleted_at IS NOT NULL").Scan(&entities)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		for _, entity := range entities {
+			item := TrashItemDto{
+				Type:      trashType,
+				ID:        entity.ID,
+				Name:      entity.Name,
+				DeletedAt: entity.DeletedAt,
+			}
+			if appConfig.TrashRetentionPeriod() > 0 {
+				purgeAt := entity.DeletedAt.Add(appConfig.TrashRetentionPeriod())
+				item.PurgeAt = &purgeAt
+			}
+			items = append(items, item)
+		}
+	}
+	slices.SortFunc(items, func(a, b TrashItemDto) int {
+		return b.DeletedAt.Compare(a.DeletedAt)
+	})
+	return items, nil
+}
+
+func findTrashed(tx *gorm.DB, model any, id uint) error {
+	res := tx.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).Limit(1).Find(model)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%w: %d", errNotInTrash, id)
+	}
+	return nil
+}
+
+// restoreFromTrash undeletes the entity and moves the original of an image back
+func restoreFromTrash(ctx context.Context, trashType string, id uint) error {
+	model, err := trashModel(trashType)
+	if err != nil {
+		return err
+	}
+
+	files := originalFiles{}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := findTrashed(tx, model, id)
+		if err != nil {
+			return err
+		}
+		res := tx.Unscoped().Model(model).Where("id = ?", id).UpdateColumn("deleted_at", nil)
+		if res.Error != nil {
+			return res.Error
+		}
+		// The trash types are audited under the same entity types
+		err = recordAudit(tx, trashType, id, auditActionRestore, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		// Restoring doesn't run the update hooks, so the search index is updated here
+		switch trashType {
+		case trashTypeImage:
+			image := model.(*Image)
+			err = indexImages(tx, id)
+			if err != nil {
+				return err
+			}
+			err = files.move(tx.Statement.Context, trashStorage, image.OriginalFileName(), originalStorage, image.OriginalFileName())
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("could not restore original: %w", err)
+			}
+			return nil
+		case trashTypeAuthor:
+			return indexImagesWhere(tx, "author_id = ?", id)
+		default:
+			return indexImagesWhere(tx, "id IN (SELECT image_id FROM images_categories WHERE category_id = ?)", id)
+		}
+	})
+	files.finish(ctx, err)
+	return err
+}
+
+// purgeFromTrash permanently deletes the entity together with its associations and the original of an image
+func purgeFromTrash(ctx context.Context, trashType string, id uint) error {
+	model, err := trashModel(trashType)
+	if err != nil {
+		return err
+	}
+
+	files := originalFiles{}
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := findTrashed(tx, model, id)
+		if err != nil {
+			return err
+		}
+
+		cleanup := make([]*gorm.DB, 0)
+		switch trashType {
+		case trashTypeImage:
+			err = removeImageVersions(tx, id)
+			if err != nil {
+				return err
+			}
+			cleanup = append(cleanup,
+				tx.Exec("DELETE FROM images_categories WHERE image_id = ?", id),
+				tx.Exec("DELETE FROM images_relations WHERE image_id = ? OR related_id = ?", id, id),
+				tx.Unscoped().Where("image_id = ?", id).Delete(&ImageMetadata{}),
+				tx.Unscoped().Where("image_id = ?", id).Delete(&ImageVariant{}),
+			)
+		case trashTypeAuthor:
+			// Images in the trash may still reference the author
+			cleanup = append(cleanup, tx.Unscoped().Model(&Image{}).Where("author_id = ?", id).UpdateColumn("author_id", 0))
+		case trashTypeCategory:
+			cleanup = append(cleanup, tx.Exec("DELETE FROM images_categories WHERE category_id = ?", id))
+		}
+		// The audit log is kept, but there's nothing left to restore the revisions to
+		cleanup = append(cleanup, tx.Where("entity_type = ? AND entity_id = ?", trashType, id).Delete(&Revision{}))
+		for _, res := range cleanup {
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+
+		res := tx.Unscoped().Delete(model)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if image, isImage := model.(*Image); isImage {
+			files.deleteAfterCommit(trashStorage, image.OriginalFileName())
+		}
+		return nil
+	})
+	files.finish(ctx, err)
+	return err
+}
+
+// purgeTrash permanently deletes all entities that were deleted before the given time
+func purgeTrash(ctx context.Context, deletedBefore time.Time) (int, error) {
+	items, err := trashedItems()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	errs := make([]error, 0)
+	for _, item := range items {
+		if !item.DeletedAt.Before(deletedBefore) {
+			continue
+		}
+		err = purgeFromTrash(ctx, item.Type, item.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %d: %w", item.Type, item.ID, err))
+			continue
+		}
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+func setupTrash() {
+	if appConfig.TrashRetentionPeriod() <= 0 {
+		logger.Info("Trash retention is disabled, deleted items are kept until the trash is emptied")
+		return
+	}
+	go sweepTrash()
+}
+
+// sweepTrash permanently deletes items that have been in the trash for longer than the retention period
+func sweepTrash() {
+	ticker := time.NewTicker(trashSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := purgeTrash(context.Background(), time.Now().Add(-appConfig.TrashRetentionPeriod()))
+		if err != nil {
+			logger.Errorf("Error emptying trash: %v", err)
+		}
+		if purged > 0 {
+			logger.Infof("Permanently deleted %d items from the trash", purged)
+		}
+		<-ticker.C
+	}
+}
+
+func trashParams(c *gin.Context) (string, uint, error) {
+	trashType := c.Param(trashTypeName)
+	if _, err := trashModel(trashType); err != nil {
+		return "", 0, err
+	}
+	id, err := strconv.ParseUint(c.Param(trashIdName), 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return trashType, uint(id), nil
+}
+
+func trashErrorStatus(err error) int {
+	if errors.Is(err, errNotInTrash) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errUnknownTrashType) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// ------------- WEBSERVER HANDLER -------------
+
+func getTrashHtml(c *gin.Context) {
+	renderTrashHtml(c, http.StatusOK, gin.H{})
+}
+
+func renderTrashHtml(c *gin.Context, status int, data gin.H) {
+	items, err := trashedItems()
+	if err != nil {
+		c.Error(err)
+		data["error"] = err.Error()
+	}
+	data["items"] = items
+	data["retention"] = appConfig.TrashRetentionPeriod()
+	data["role"] = currentRole(c)
+	c.HTML(status, "trash.gohtml", data)
+}
+
+func updateTrashForm(c *gin.Context) {
+	trashType := c.PostForm("type")
+	id, _ := strconv.ParseUint(c.PostForm("id"), 10, 64)
+
+	var err error
+	var message string
+	switch c.PostForm("action") {
+	case "restore":
+		err = restoreFromTrash(c, trashType, uint(id))
+		message = fmt.Sprintf("Restored %s %d", trashType, id)
+	case "purge":
+		if !hasRole(c, RoleAdmin) {
+			return
+		}
+		err = purgeFromTrash(c, trashType, uint(id))
+		message = fmt.Sprintf("Permanently deleted %s %d", trashType, id)
+	case "empty":
+		if !hasRole(c, RoleAdmin) {
+			return
+		}
+		var purged int
+		purged, err = purgeTrash(c, time.Now())
+		message = fmt.Sprintf("Permanently deleted %d items", purged)
+	default:
+		err = errors.New("unknown action")
+	}
+
+	if err != nil {
+		c.Error(err)
+		renderTrashHtml(c, trashErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	renderTrashHtml(c, http.StatusOK, gin.H{"message": message})
+}
+
+func getTrash(c *gin.Context) {
+	items, err := trashedItems()
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &items)
+}
+
+func restoreTrashApi(c *gin.Context) {
+	trashType, id, err := trashParams(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = restoreFromTrash(c, trashType, id)
+	if err != nil {
+		c.Error(err)
+		c.String(trashErrorStatus(err), "Error restoring %s %d: %v", trashType, id, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func purgeTrashItemApi(c *gin.Context) {
+	trashType, id, err := trashParams(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = purgeFromTrash(c, trashType, id)
+	if err != nil {
+		c.Error(err)
+		c.String(trashErrorStatus(err), "Error deleting %s %d: %v", trashType, id, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func emptyTrashApi(c *gin.Context) {
+	purged, err := purgeTrash(c, time.Now())
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusInternalServerError, "Error emptying trash: %v", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
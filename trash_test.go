@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// setupTestStorage replaces the storages with local storages in temporary directories, and creates an empty
+// configuration unless another setup did
+func setupTestStorage(t *testing.T) {
+	previousConfig := appConfig
+	previous := []Storage{originalStorage, processedStorage, iconStorage, trashStorage, versionStorage}
+	t.Cleanup(func() {
+		appConfig = previousConfig
+		originalStorage, processedStorage, iconStorage, trashStorage, versionStorage = previous[0], previous[1], previous[2], previous[3], previous[4]
+	})
+
+	if appConfig == nil {
+		appConfig = &AppConfig{}
+	}
+	originalStorage = newLocalStorage(t.TempDir())
+	processedStorage = newLocalStorage(t.TempDir())
+	iconStorage = newLocalStorage(t.TempDir())
+	trashStorage = newLocalStorage(t.TempDir())
+	versionStorage = newLocalStorage(t.TempDir())
+}
+
+// createTestImageFiles creates an image with an original and a processed variant
+func createTestImageFiles(t *testing.T) *Image {
+	ctx := context.Background()
+	image := Image{Name: "sunset", Format: "jpg"}
+	if res := db.Create(&image); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	variant := ImageVariant{ImageID: image.ID, Format: "webp", FileName: "sunset-small.webp"}
+	if res := db.Create(&variant); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if err := originalStorage.Put(ctx, image.OriginalFileName(), []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	if err := processedStorage.Put(ctx, variant.FileName, []byte("variant")); err != nil {
+		t.Fatal(err)
+	}
+	return &image
+}
+
+func countImages(t *testing.T, tx *gorm.DB) int64 {
+	var count int64
+	if res := tx.Model(&Image{}).Count(&count); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	return count
+}
+
+func TestTrashRestoreAndPurgeImage(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	ctx := context.Background()
+	image := createTestImageFiles(t)
+
+	if err := trashImage(ctx, image); err != nil {
+		t.Fatal(err)
+	}
+	if objectExists(ctx, originalStorage, image.OriginalFileName()) || !objectExists(ctx, trashStorage, image.OriginalFileName()) {
+		t.Error("original wasn't moved to the trash")
+	}
+	if objectExists(ctx, processedStorage, "sunset-small.webp") {
+		t.Error("variant wasn't deleted")
+	}
+	items, err := trashedItems()
+	if err != nil || len(items) != 1 || items[0].Type != trashTypeImage || items[0].ID != image.ID {
+		t.Fatalf("got trash %+v, %v", items, err)
+	}
+
+	if err := restoreFromTrash(ctx, trashTypeImage, image.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !objectExists(ctx, originalStorage, image.OriginalFileName()) || objectExists(ctx, trashStorage, image.OriginalFileName()) {
+		t.Error("original wasn't restored")
+	}
+	if countImages(t, db) != 1 {
+		t.Error("image wasn't restored")
+	}
+	if err := restoreFromTrash(ctx, trashTypeImage, image.ID); !errors.Is(err, errNotInTrash) {
+		t.Errorf("restoring an image that isn't in the trash returned %v", err)
+	}
+
+	if err := trashImage(ctx, image); err != nil {
+		t.Fatal(err)
+	}
+	// Only items deleted before the given time are purged, like the sweeper does after the retention period
+	if purged, err := purgeTrash(ctx, time.Now().Add(-time.Hour)); purged != 0 || err != nil {
+		t.Errorf("purged %d items deleted within the retention period, %v", purged, err)
+	}
+	if purged, err := purgeTrash(ctx, time.Now().Add(time.Second)); purged != 1 || err != nil {
+		t.Fatalf("purged %d items, %v", purged, err)
+	}
+	if countImages(t, db.Unscoped()) != 0 || objectExists(ctx, trashStorage, image.OriginalFileName()) {
+		t.Error("purged image is still stored")
+	}
+}
+
+func TestTrashImageRollback(t *testing.T) {
+	setupTestDatabase(t)
+	setupTestStorage(t)
+	ctx := context.Background()
+	image := createTestImageFiles(t)
+	failure := errors.New("failure after the image was trashed")
+
+	files := originalFiles{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := trashImageTx(tx, &files, image)
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	files.finish(ctx, err)
+
+	if !errors.Is(err, failure) {
+		t.Fatalf("got error %v", err)
+	}
+	if countImages(t, db) != 1 {
+		t.Error("image was deleted")
+	}
+	if !objectExists(ctx, originalStorage, image.OriginalFileName()) || objectExists(ctx, trashStorage, image.OriginalFileName()) {
+		t.Error("original wasn't moved back from the trash")
+	}
+	if !objectExists(ctx, processedStorage, "sunset-small.webp") {
+		t.Error("variant of the kept image was deleted")
+	}
+}